@@ -0,0 +1,221 @@
+package loader
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// batchTicket tracks the records buffered by one file until they are flushed
+type batchTicket struct {
+	count    int
+	done     chan struct{}
+	inserted int64
+	err      error
+}
+
+// recordBatch holds the buffered records of one collection (and field order)
+// and the tickets of the files they come from, in record order
+type recordBatch struct {
+	col        *mongo.Collection
+	fieldOrder []string
+	records    []SensorRecord
+	tickets    []*batchTicket
+}
+
+// recordBatcher buffers CSV records across concurrent files and inserts them together
+// Records are flushed after FLUSH_INTERVAL_MS, once FLUSH_MAX_RECORDS are buffered, or on Shutdown.
+// Each file waits for the flush of its records (see wait), so it is only reported, archived or
+// marked processed once its records are written
+type recordBatcher struct {
+	sync.Mutex
+	batches  map[string]*recordBatch
+	buffered int
+	timer    *time.Timer
+}
+
+// globalBatcher is the micro-batching accumulator shared by all events of the instance
+var globalBatcher = &recordBatcher{batches: make(map[string]*recordBatch)}
+
+// batchingEnabled checks if records are buffered across files (FLUSH_INTERVAL_MS or FLUSH_MAX_RECORDS set)
+func batchingEnabled() bool {
+	return GlobalConfig != nil && (GlobalConfig.FlushIntervalMS > 0 || GlobalConfig.FlushMaxRecords > 0)
+}
+
+// add buffers records for a collection, flushing when FLUSH_MAX_RECORDS is reached
+// The first buffered record arms the FLUSH_INTERVAL_MS timer
+// Returns the ticket to wait for the records to be written
+func (b *recordBatcher) add(ctx context.Context, col *mongo.Collection, records []SensorRecord, fieldOrder []string) *batchTicket {
+	ticket := &batchTicket{count: len(records), done: make(chan struct{})}
+	if len(records) < 1 {
+		close(ticket.done)
+		return ticket
+	}
+
+	b.Lock()
+	key := col.Database().Name() + "." + col.Name() + "|" + strings.Join(fieldOrder, ",")
+	batch, exists := b.batches[key]
+	if !exists {
+		batch = &recordBatch{col: col, fieldOrder: fieldOrder}
+		b.batches[key] = batch
+	}
+	batch.records = append(batch.records, records...)
+	batch.tickets = append(batch.tickets, ticket)
+	b.buffered += len(records)
+
+	if GlobalConfig.FlushMaxRecords > 0 && b.buffered >= GlobalConfig.FlushMaxRecords {
+		batches := b.takeLocked()
+		b.Unlock()
+		flushDetached(ctx, batches)
+		return ticket
+	}
+	if b.timer == nil && GlobalConfig.FlushIntervalMS > 0 {
+		b.timer = time.AfterFunc(time.Duration(GlobalConfig.FlushIntervalMS)*time.Millisecond, func() {
+			b.Flush(context.Background())
+		})
+	}
+	b.Unlock()
+	return ticket
+}
+
+// wait blocks until the records of a ticket are flushed and returns the number written and the insert error
+// Without FLUSH_INTERVAL_MS nothing would flush a partial batch: it is flushed right away
+// Only the wait itself is bounded by ctx: the flush also writes the records of other files
+func (b *recordBatcher) wait(ctx context.Context, ticket *batchTicket) (int64, error) {
+	if GlobalConfig.FlushIntervalMS <= 0 {
+		b.Lock()
+		batches := b.takeLocked()
+		b.Unlock()
+		flushDetached(ctx, batches)
+	}
+	select {
+	case <-ticket.done:
+		return ticket.inserted, ticket.err
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// takeLocked removes and returns the buffered batches; the lock must be held
+func (b *recordBatcher) takeLocked() []*recordBatch {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	batches := make([]*recordBatch, 0, len(b.batches))
+	for _, batch := range b.batches {
+		batches = append(batches, batch)
+	}
+	b.batches = make(map[string]*recordBatch)
+	b.buffered = 0
+	return batches
+}
+
+// Flush inserts all buffered records
+func (b *recordBatcher) Flush(ctx context.Context) {
+	b.Lock()
+	batches := b.takeLocked()
+	b.Unlock()
+	flushBatches(ctx, batches)
+}
+
+// flushTimeout bounds a flush triggered by an event, which no longer follows the event's deadline
+const flushTimeout = 60 * time.Second
+
+// flushDetached flushes batches triggered by an event without its cancellation or deadline, so the
+// records of other files buffered in the same batches don't fail with the event's context error
+func flushDetached(ctx context.Context, batches []*recordBatch) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), flushTimeout)
+	defer cancel()
+	flushBatches(ctx, batches)
+}
+
+// flushBatches inserts buffered batches and releases the files waiting for them
+func flushBatches(ctx context.Context, batches []*recordBatch) {
+	for _, batch := range batches {
+		flushBatch(ctx, batch)
+	}
+}
+
+// flushBatch inserts the records of a batch in BATCH_SIZE chunks, ignoring duplicates, and reports to
+// each ticket the number of its records written and the first insert error among them
+func flushBatch(ctx context.Context, batch *recordBatch) {
+	written := make([]bool, len(batch.records))
+	recordErrs := make([]error, len(batch.records))
+
+	for start := 0; start < len(batch.records); start += BATCH_SIZE {
+		end := min(start+BATCH_SIZE, len(batch.records))
+		docs := make([]interface{}, 0, end-start)
+		for _, record := range batch.records[start:end] {
+			docs = append(docs, orderedDocument(record, batch.fieldOrder))
+		}
+
+		_, err := batch.col.InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+		var bulkErr mongo.BulkWriteException
+		switch {
+		case err == nil:
+			for i := start; i < end; i++ {
+				written[i] = true
+			}
+		case errors.As(err, &bulkErr):
+			// Unordered insert: only the documents of the write errors were not written
+			for i := start; i < end; i++ {
+				written[i] = true
+			}
+			for _, writeErr := range bulkErr.WriteErrors {
+				written[start+writeErr.Index] = false
+				if writeErr.Code != 11000 {
+					recordErrs[start+writeErr.Index] = err
+				}
+			}
+			if bulkErr.WriteConcernError != nil {
+				for i := start; i < end; i++ {
+					recordErrs[i] = err
+				}
+			}
+		case strings.Contains(err.Error(), "E11000 duplicate key error"):
+			// Nothing written, nothing to report
+		default:
+			for i := start; i < end; i++ {
+				recordErrs[i] = err
+			}
+		}
+	}
+
+	var inserted int64
+	offset := 0
+	for _, ticket := range batch.tickets {
+		for i := offset; i < offset+ticket.count; i++ {
+			if written[i] {
+				ticket.inserted++
+			}
+			if recordErrs[i] != nil && ticket.err == nil {
+				ticket.err = recordErrs[i]
+			}
+		}
+		offset += ticket.count
+		inserted += ticket.inserted
+		close(ticket.done)
+	}
+
+	if failed := countErrors(recordErrs); failed > 0 {
+		GlobalLogger.Errorf("batch flush: %d of %d buffered records failed to insert into %s", failed, len(batch.records), batch.col.Name())
+	}
+	GlobalLogger.Infof("batch flush: inserted %d of %d buffered records from %d file(s) into %s", inserted, len(batch.records), len(batch.tickets), batch.col.Name())
+}
+
+// countErrors returns the number of non-nil errors
+func countErrors(errs []error) int {
+	n := 0
+	for _, err := range errs {
+		if err != nil {
+			n++
+		}
+	}
+	return n
+}
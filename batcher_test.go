@@ -0,0 +1,152 @@
+package loader
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// newTestBatcher returns an empty batcher and stops its timer at the end of the test
+func newTestBatcher(t testing.TB) *recordBatcher {
+	b := &recordBatcher{batches: make(map[string]*recordBatch)}
+	t.Cleanup(func() {
+		b.Lock()
+		b.takeLocked()
+		b.Unlock()
+	})
+	return b
+}
+
+func TestRecordBatcher(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	fields := []string{"WA"}
+
+	mt.Run("max records flushes files together", func(mt *mtest.T) {
+		withConfig(mt.T, func(c *Config) { c.FlushMaxRecords = 3 })
+		b := newTestBatcher(mt)
+		col := mt.Coll
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 3}))
+
+		first := b.add(context.Background(), col, []SensorRecord{{"_id": int64(1), "WA": 1.0}, {"_id": int64(2), "WA": 2.0}}, fields)
+		select {
+		case <-first.done:
+			t.Fatal("first file flushed before FLUSH_MAX_RECORDS")
+		default:
+		}
+		second := b.add(context.Background(), col, []SensorRecord{{"_id": int64(3), "WA": 3.0}}, fields)
+
+		for i, ticket := range []*batchTicket{first, second} {
+			inserted, err := b.wait(context.Background(), ticket)
+			if err != nil || inserted != int64(ticket.count) {
+				t.Errorf("file %d: wait() = %d, %v, want %d, nil", i, inserted, err, ticket.count)
+			}
+		}
+		if inserts := countCommands(mt, "insert"); inserts != 1 {
+			t.Errorf("%d insert commands, want 1", inserts)
+		}
+		if docs := insertedDocuments(mt); len(docs) != 3 {
+			t.Errorf("%d documents inserted, want 3", len(docs))
+		}
+	})
+
+	mt.Run("interval flush", func(mt *mtest.T) {
+		withConfig(mt.T, func(c *Config) { c.FlushIntervalMS = 10 })
+		b := newTestBatcher(mt)
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 2}))
+
+		first := b.add(context.Background(), mt.Coll, []SensorRecord{{"_id": int64(1), "WA": 1.0}}, fields)
+		second := b.add(context.Background(), mt.Coll, []SensorRecord{{"_id": int64(2), "WA": 2.0}}, fields)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		for i, ticket := range []*batchTicket{first, second} {
+			if inserted, err := b.wait(ctx, ticket); err != nil || inserted != 1 {
+				t.Errorf("file %d: wait() = %d, %v, want 1, nil", i, inserted, err)
+			}
+		}
+		if inserts := countCommands(mt, "insert"); inserts != 1 {
+			t.Errorf("%d insert commands, want 1", inserts)
+		}
+	})
+
+	mt.Run("flush on shutdown", func(mt *mtest.T) {
+		withConfig(mt.T, func(c *Config) { c.FlushIntervalMS = int(time.Hour / time.Millisecond) })
+		b := newTestBatcher(mt)
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}))
+
+		ticket := b.add(context.Background(), mt.Coll, []SensorRecord{{"_id": int64(1), "WA": 1.0}}, fields)
+		b.Flush(context.Background())
+		select {
+		case <-ticket.done:
+		default:
+			t.Fatal("ticket not released by Flush")
+		}
+		if ticket.inserted != 1 || ticket.err != nil {
+			t.Errorf("ticket = %d, %v, want 1, nil", ticket.inserted, ticket.err)
+		}
+	})
+
+	mt.Run("duplicates are not errors", func(mt *mtest.T) {
+		withConfig(mt.T, func(c *Config) { c.FlushMaxRecords = 3 })
+		b := newTestBatcher(mt)
+		mt.AddMockResponses(mtest.CreateWriteErrorsResponse(mtest.WriteError{Index: 1, Code: 11000, Message: "E11000 duplicate key error"}))
+
+		first := b.add(context.Background(), mt.Coll, []SensorRecord{{"_id": int64(1), "WA": 1.0}, {"_id": int64(2), "WA": 2.0}}, fields)
+		second := b.add(context.Background(), mt.Coll, []SensorRecord{{"_id": int64(3), "WA": 3.0}}, fields)
+
+		if inserted, err := b.wait(context.Background(), first); err != nil || inserted != 1 {
+			t.Errorf("first file: wait() = %d, %v, want 1, nil", inserted, err)
+		}
+		if inserted, err := b.wait(context.Background(), second); err != nil || inserted != 1 {
+			t.Errorf("second file: wait() = %d, %v, want 1, nil", inserted, err)
+		}
+	})
+
+	mt.Run("cancelled trigger does not fail other files", func(mt *mtest.T) {
+		withConfig(mt.T, func(c *Config) { c.FlushMaxRecords = 2 })
+		b := newTestBatcher(mt)
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 2}))
+
+		first := b.add(context.Background(), mt.Coll, []SensorRecord{{"_id": int64(1), "WA": 1.0}}, fields)
+		cancelled, cancel := context.WithCancel(context.Background())
+		cancel()
+		second := b.add(cancelled, mt.Coll, []SensorRecord{{"_id": int64(2), "WA": 2.0}}, fields)
+
+		if inserted, err := b.wait(context.Background(), first); err != nil || inserted != 1 {
+			t.Errorf("first file: wait() = %d, %v, want 1, nil", inserted, err)
+		}
+		if inserted, err := b.wait(context.Background(), second); err != nil || inserted != 1 {
+			t.Errorf("second file: wait() = %d, %v, want 1, nil", inserted, err)
+		}
+	})
+
+	mt.Run("insert error is reported to its file", func(mt *mtest.T) {
+		withConfig(mt.T, func(c *Config) { c.FlushMaxRecords = 2 })
+		b := newTestBatcher(mt)
+		mt.AddMockResponses(mtest.CreateWriteErrorsResponse(mtest.WriteError{Index: 1, Code: 121, Message: "Document failed validation"}))
+
+		first := b.add(context.Background(), mt.Coll, []SensorRecord{{"_id": int64(1), "WA": 1.0}}, fields)
+		second := b.add(context.Background(), mt.Coll, []SensorRecord{{"_id": int64(2), "WA": 2.0}}, fields)
+
+		if inserted, err := b.wait(context.Background(), first); err != nil || inserted != 1 {
+			t.Errorf("first file: wait() = %d, %v, want 1, nil", inserted, err)
+		}
+		if inserted, err := b.wait(context.Background(), second); err == nil || inserted != 0 {
+			t.Errorf("second file: wait() = %d, %v, want 0 and an error", inserted, err)
+		}
+	})
+}
+
+// countCommands returns the number of started commands with the given name
+func countCommands(mt *mtest.T, name string) int {
+	n := 0
+	for _, event := range mt.GetAllStartedEvents() {
+		if event.CommandName == name {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,171 @@
+package loader
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"strconv"
+	"time"
+)
+
+// DefaultCollectionPrefix is the prefix of the sensor data collections
+const DefaultCollectionPrefix = "sensor_data_"
+
+// bucketConfigEntry is the JSON form of the settings of one bucket
+type bucketConfigEntry struct {
+	AllowPatterns    string `json:"allow_patterns"`
+	IgnorePatterns   string `json:"ignore_patterns"`
+	TimezoneOffset   *int   `json:"timezone_offset"`
+	CollectionPrefix string `json:"collection_prefix"`
+}
+
+// BucketSettings holds the settings overridden for one bucket
+// Unset fields fall back to the global configuration
+type BucketSettings struct {
+	Bucket string
+	// Patterns - allow/ignore patterns of the bucket (nil = global ALLOW_PATTERNS/IGNORE_PATTERNS)
+	Patterns *FilePattern
+	// TimezoneLocation - timezone of the bucket's timestamps (nil = TIMEZONE_OFFSET)
+	TimezoneLocation *time.Location
+	// CollectionPrefix - sensor data collection prefix ("" = "sensor_data_")
+	CollectionPrefix string
+}
+
+// BucketConfig maps a bucket name to its settings
+type BucketConfig map[string]*BucketSettings
+
+// GlobalBucketConfig holds the per-bucket settings loaded from BUCKET_CONFIG / BUCKET_CONFIG_FILE
+var GlobalBucketConfig BucketConfig
+
+// InitBucketConfig loads the per-bucket settings from environment variables
+// Environment variables:
+//
+//	BUCKET_CONFIG - JSON object keyed by bucket name
+//	BUCKET_CONFIG_FILE - path to a JSON file holding the object (used when BUCKET_CONFIG is not set)
+//
+// Example: {"station-uploads": {"allow_patterns": "\\.dat$", "timezone_offset": 8, "collection_prefix": "st_"}}
+func InitBucketConfig() {
+	raw := os.Getenv("BUCKET_CONFIG")
+	source := "BUCKET_CONFIG"
+	if raw == "" {
+		path := os.Getenv("BUCKET_CONFIG_FILE")
+		if path == "" {
+			return
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			GlobalLogger.Fatalf("failed to read BUCKET_CONFIG_FILE %s: %v", path, err)
+		}
+		raw = string(data)
+		source = path
+	}
+
+	var entries map[string]bucketConfigEntry
+	if err := json.Unmarshal([]byte(raw), &entries); err != nil {
+		GlobalLogger.Fatalf("invalid bucket config in %s: %v", source, err)
+	}
+
+	config := make(BucketConfig, len(entries))
+	for bucket, entry := range entries {
+		settings := &BucketSettings{Bucket: bucket, CollectionPrefix: entry.CollectionPrefix}
+
+		if entry.AllowPatterns != "" || entry.IgnorePatterns != "" {
+			allow, err := compilePatterns(entry.AllowPatterns)
+			if err != nil {
+				GlobalLogger.Fatalf("invalid allow_patterns for bucket %s: %v", bucket, err)
+			}
+			ignore, err := compilePatterns(entry.IgnorePatterns)
+			if err != nil {
+				GlobalLogger.Fatalf("invalid ignore_patterns for bucket %s: %v", bucket, err)
+			}
+			settings.Patterns = &FilePattern{AllowPatterns: allow, IgnorePatterns: ignore}
+		}
+
+		if entry.TimezoneOffset != nil {
+			offset := *entry.TimezoneOffset
+			name := "GMT" + strconv.Itoa(offset)
+			if offset >= 0 {
+				name = "GMT+" + strconv.Itoa(offset)
+			}
+			settings.TimezoneLocation = time.FixedZone(name, offset*3600)
+		}
+
+		config[bucket] = settings
+		GlobalLogger.Infof("Bucket config for %s: patterns=%v, timezone=%v, collection_prefix=%q", bucket, settings.Patterns != nil, settings.TimezoneLocation, settings.CollectionPrefix)
+	}
+	GlobalBucketConfig = config
+}
+
+// BucketSettingsFor returns the settings of a bucket, or nil if the bucket has none
+func BucketSettingsFor(bucket string) *BucketSettings {
+	return GlobalBucketConfig[bucket]
+}
+
+// FilePattern returns the effective file patterns of the bucket
+func (b *BucketSettings) FilePattern() *FilePattern {
+	if b == nil || b.Patterns == nil {
+		return GlobalFilePattern
+	}
+	return b.Patterns
+}
+
+// bucketSettingsKey is the context key of the per-bucket settings
+type bucketSettingsKey struct{}
+
+// withBucketSettings returns a context carrying the bucket settings (unchanged if nil)
+func withBucketSettings(ctx context.Context, settings *BucketSettings) context.Context {
+	if settings == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, bucketSettingsKey{}, settings)
+}
+
+// bucketSettingsFrom returns the bucket settings carried by the context, or nil
+func bucketSettingsFrom(ctx context.Context) *BucketSettings {
+	settings, _ := ctx.Value(bucketSettingsKey{}).(*BucketSettings)
+	return settings
+}
+
+// timezoneFor returns the effective timezone for the event being processed
+func timezoneFor(ctx context.Context) *time.Location {
+	if settings := bucketSettingsFrom(ctx); settings != nil && settings.TimezoneLocation != nil {
+		return settings.TimezoneLocation
+	}
+	return configTimezone()
+}
+
+// collectionPrefixFor returns the effective sensor data collection prefix for the event being processed
+func collectionPrefixFor(ctx context.Context) string {
+	if settings := bucketSettingsFrom(ctx); settings != nil && settings.CollectionPrefix != "" {
+		return settings.CollectionPrefix
+	}
+	return DefaultCollectionPrefix
+}
+
+// reinterpretTimestamp converts a Unix timestamp parsed from a wall-clock time in one timezone
+// to the Unix timestamp of the same wall-clock time in another timezone
+func reinterpretTimestamp(ts int64, from *time.Location, to *time.Location) int64 {
+	if from == nil || to == nil || from == to {
+		return ts
+	}
+	t := time.Unix(ts, 0).In(from)
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, to).Unix()
+}
+
+// reinterpretRecords re-bases the timestamps (_id and ts) of parsed records from one timezone to another
+func reinterpretRecords(records []SensorRecord, from *time.Location, to *time.Location) {
+	if from == nil || to == nil || from == to {
+		return
+	}
+	for _, record := range records {
+		ts, err := GetInt64FromInterface(record["_id"])
+		if err != nil {
+			continue
+		}
+		ts = reinterpretTimestamp(ts, from, to)
+		record["_id"] = ts
+		if _, exists := record["ts"]; exists {
+			applyBSONDate(record, ts)
+		}
+	}
+}
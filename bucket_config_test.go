@@ -0,0 +1,117 @@
+package loader
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withBucketConfig runs InitBucketConfig with the given BUCKET_CONFIG for the duration of the test
+func withBucketConfig(t *testing.T, raw string) {
+	t.Helper()
+	previous := GlobalBucketConfig
+	t.Cleanup(func() { GlobalBucketConfig = previous })
+	t.Setenv("BUCKET_CONFIG", raw)
+	InitBucketConfig()
+}
+
+func TestInitBucketConfig(t *testing.T) {
+	withBucketConfig(t, `{
+		"station-uploads": {"allow_patterns": "\\.dat$", "timezone_offset": 8, "collection_prefix": "st_"},
+		"lake-uploads": {"timezone_offset": -3}
+	}`)
+
+	stations := BucketSettingsFor("station-uploads")
+	if stations == nil || stations.Patterns == nil || stations.CollectionPrefix != "st_" {
+		t.Fatalf("station-uploads settings = %+v", stations)
+	}
+	if _, offset := time.Unix(0, 0).In(stations.TimezoneLocation).Zone(); offset != 8*3600 {
+		t.Errorf("station-uploads timezone offset = %d, want 8h", offset)
+	}
+	lake := BucketSettingsFor("lake-uploads")
+	if lake == nil || lake.Patterns != nil || lake.TimezoneLocation.String() != "GMT-3" {
+		t.Errorf("lake-uploads settings = %+v", lake)
+	}
+
+	// Unconfigured buckets and fields fall back to the global settings
+	withFilePatterns(t, &FilePattern{})
+	if BucketSettingsFor("other") != nil || BucketSettingsFor("other").FilePattern() != GlobalFilePattern || lake.FilePattern() != GlobalFilePattern {
+		t.Errorf("unset patterns do not fall back to GlobalFilePattern")
+	}
+
+	tests := []struct {
+		bucket     string
+		wantPrefix string
+		wantZone   string
+	}{
+		{"station-uploads", "st_", "GMT+8"},
+		{"lake-uploads", DefaultCollectionPrefix, "GMT-3"},
+		{"other", DefaultCollectionPrefix, GlobalConfig.TimezoneLocation.String()},
+	}
+	for _, tt := range tests {
+		ctx := withBucketSettings(context.Background(), BucketSettingsFor(tt.bucket))
+		if got := sensorCollectionName(ctx, "RIENVHK4"); got != tt.wantPrefix+"RIENVHK4" {
+			t.Errorf("%s: collection = %s, want prefix %s", tt.bucket, got, tt.wantPrefix)
+		}
+		if got := timezoneFor(ctx).String(); got != tt.wantZone {
+			t.Errorf("%s: timezone = %s, want %s", tt.bucket, got, tt.wantZone)
+		}
+	}
+}
+
+func TestInitBucketConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "buckets.json")
+	if err := os.WriteFile(path, []byte(`{"b": {"collection_prefix": "b_"}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("BUCKET_CONFIG_FILE", path)
+	withBucketConfig(t, "")
+	if settings := BucketSettingsFor("b"); settings == nil || settings.CollectionPrefix != "b_" {
+		t.Errorf("BUCKET_CONFIG_FILE settings = %+v", settings)
+	}
+}
+
+func TestHelloGCSBucketPatterns(t *testing.T) {
+	now := time.Date(2025, time.January, 2, 12, 0, 0, 0, time.UTC)
+	withNow(t, now)
+	withFilePatterns(t, &FilePattern{})
+	withBucketConfig(t, `{"csv-uploads": {"allow_patterns": "\\.csv$"}, "dat-uploads": {"allow_patterns": "\\.dat$"}}`)
+
+	logs := captureLogs(t)
+	if err := helloGCS(context.Background(), newStorageEvent(t, StorageObjectData{Name: "CR300_19531_Table1.dat", Bucket: "csv-uploads"}, now)); err != nil {
+		t.Fatalf("helloGCS() error = %v", err)
+	}
+	if !strings.Contains(logs.String(), "does not match any ALLOW_PATTERN") {
+		t.Errorf("csv-uploads: .dat file not skipped by the bucket patterns:\n%s", logs)
+	}
+
+	// Without bucket settings, the global (empty) ALLOW_PATTERNS skip every file
+	logs.Reset()
+	if err := helloGCS(context.Background(), newStorageEvent(t, StorageObjectData{Name: "CR300_19531_Table1.csv", Bucket: "other"}, now)); err != nil {
+		t.Fatalf("helloGCS() error = %v", err)
+	}
+	if strings.Contains(logs.String(), "does not match any ALLOW_PATTERN") {
+		t.Errorf("other: bucket patterns applied to an unconfigured bucket:\n%s", logs)
+	}
+}
+
+func TestReinterpretTimestamp(t *testing.T) {
+	gmt7, gmt8 := time.FixedZone("GMT+7", 7*3600), time.FixedZone("GMT+8", 8*3600)
+	ts := time.Date(2025, time.January, 2, 3, 4, 5, 0, gmt7).Unix()
+
+	if got := reinterpretTimestamp(ts, gmt7, gmt8); got != ts-3600 {
+		t.Errorf("reinterpretTimestamp(GMT+7 -> GMT+8) = %d, want %d", got, ts-3600)
+	}
+	if got := reinterpretTimestamp(ts, gmt7, nil); got != ts {
+		t.Errorf("reinterpretTimestamp(nil timezone) = %d, want unchanged", got)
+	}
+
+	records := []SensorRecord{{"_id": ts}, {"_id": "invalid"}}
+	reinterpretRecords(records, gmt7, gmt8)
+	if records[0]["_id"] != ts-3600 || records[1]["_id"] != "invalid" {
+		t.Errorf("reinterpretRecords() = %v", records)
+	}
+}
@@ -0,0 +1,70 @@
+package loader
+
+import (
+	"math"
+	"strings"
+)
+
+// compositeIndexes locates the COMPOSITE_FIELDS source columns in a CSV columns line
+type compositeIndexes struct {
+	// fieldAt - composite field produced at the index of its integer column
+	fieldAt map[int]CompositeField
+	// fracIndex - index of the fractional column, by integer column index
+	fracIndex map[int]int
+	// sources - indexes of all source columns (never stored as is)
+	sources map[int]bool
+}
+
+// compositeFieldIndexes locates the composite fields whose source columns are both present
+func compositeFieldIndexes(columns []string) compositeIndexes {
+	indexes := compositeIndexes{
+		fieldAt:   make(map[int]CompositeField),
+		fracIndex: make(map[int]int),
+		sources:   make(map[int]bool),
+	}
+	if GlobalConfig == nil || len(GlobalConfig.CompositeFields) == 0 {
+		return indexes
+	}
+
+	for _, composite := range GlobalConfig.CompositeFields {
+		intIndex, fracIndex := -1, -1
+		for i, column := range columns {
+			switch column {
+			case composite.IntColumn:
+				intIndex = i
+			case composite.FracColumn:
+				fracIndex = i
+			}
+		}
+		if start := valueColumnStart(); intIndex < start || fracIndex < start {
+			continue
+		}
+		indexes.fieldAt[intIndex] = composite
+		indexes.fracIndex[intIndex] = fracIndex
+		indexes.sources[intIndex] = true
+		indexes.sources[fracIndex] = true
+	}
+	return indexes
+}
+
+// combine returns int + frac/Divisor from the source columns of a row
+// The fractional part takes the sign of the integer part: "-3" and "250" give -3.25 with the default divisor 1000
+func (c CompositeField) combine(row []string, intIndex int, fracIndex int) (float64, bool) {
+	if intIndex >= len(row) || fracIndex >= len(row) {
+		return 0, false
+	}
+	intPart, err := parseNumber(row[intIndex])
+	if err != nil {
+		return 0, false
+	}
+	fracPart, err := parseNumber(row[fracIndex])
+	if err != nil {
+		return 0, false
+	}
+
+	frac := math.Abs(fracPart) / c.Divisor
+	if intPart < 0 || strings.HasPrefix(strings.TrimSpace(row[intIndex]), "-") {
+		return intPart - frac, true
+	}
+	return intPart + frac, true
+}
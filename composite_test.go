@@ -0,0 +1,40 @@
+package loader
+
+import "testing"
+
+func TestExtractDataCompositeFields(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.CompositeFields = []CompositeField{
+			{Field: "WA", IntColumn: "WA_int", FracColumn: "WA_frac", Divisor: 1000},
+			{Field: "TE", IntColumn: "TE_i", FracColumn: "TE_f", Divisor: 100},
+			// Source columns absent from the file: ignored
+			{Field: "HU", IntColumn: "HU_i", FracColumn: "HU_f", Divisor: 1000},
+		}
+	})
+	records := extractRecords(t, toa5CSV(`"TIMESTAMP","RECORD","WA_int","WA_frac","TE_i","TE_f"`,
+		`"2025-01-02 03:04:05",1,12,250,21,5`,
+		`"2025-01-02 03:05:05",2,-3,250,-0,50`,
+		`"2025-01-02 03:06:05",3,12,"",21,5`,
+	))
+
+	tests := []struct {
+		wa, te interface{}
+	}{
+		{12.25, 21.05},
+		// The fractional part takes the sign of the integer part
+		{-3.25, -0.5},
+		// A missing source value: the field is not stored
+		{nil, 21.05},
+	}
+	for i, tt := range tests {
+		record := records[i]
+		if record["WA"] != tt.wa || record["TE"] != tt.te {
+			t.Errorf("record %d: WA=%v TE=%v, want %v %v", i, record["WA"], record["TE"], tt.wa, tt.te)
+		}
+		for _, source := range []string{"WA_int", "WA_frac", "TE_i", "TE_f"} {
+			if _, exists := record[source]; exists {
+				t.Errorf("record %d: source column %s stored", i, source)
+			}
+		}
+	}
+}
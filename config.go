@@ -1,7 +1,10 @@
 package loader
 
 import (
+	"encoding/json"
+	"fmt"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -15,16 +18,294 @@ type Config struct {
 	TimezoneOffset int
 	// TimezoneLocation - parsed timezone location
 	TimezoneLocation *time.Location
+	// SkipMetadataUpdates - whether to ignore events for metadata-only object updates (metageneration > 1)
+	SkipMetadataUpdates bool
+	// QualityColumn - name of the CSV column holding the record quality/status flag (stored as "q")
+	QualityColumn string
+	// KVTimestampFallback - behavior when a KV filename timestamp can't be parsed ("fail", "now", "content")
+	KVTimestampFallback string
+	// BitFlagFields - bit flag decoding per field code: field -> bit flags expanded into boolean fields
+	BitFlagFields map[string][]BitFlag
+	// HashCollections - number of shared sensor data collections (0 = one collection per box)
+	HashCollections int
+	// MissingMetricPolicy - value stored for KV metrics missing from the file ("zero", "skip", "null")
+	MissingMetricPolicy string
+	// GCSBillingProject - project billed for GCS requests on requester-pays buckets
+	GCSBillingProject string
+	// OrderedFields - whether to insert documents with a deterministic field order (CSV column order)
+	OrderedFields bool
+	// StoreBSONDate - whether to add a "ts" BSON datetime field alongside the Unix timestamp _id
+	StoreBSONDate bool
+	// CSVComment - comment character for CSV files; lines starting with it are ignored (0 = none)
+	CSVComment rune
+	// CSVLazyQuotes - whether to tolerate non-standard quotes in CSV fields
+	CSVLazyQuotes bool
+	// MinValidTimestamp - rows with a timestamp before this Unix time are dropped (0 = no check)
+	MinValidTimestamp int64
+	// DeviceIDColumn - CSV column whose first data value is used as the device ID instead of the meta line
+	DeviceIDColumn string
+	// DecimalComma - whether numeric values use a comma as decimal separator (e.g. "12,34")
+	DecimalComma bool
+	// CSVTimeLayout - Go time layout of the CSV timestamp column, tried before the default layout
+	CSVTimeLayout string
+	// MaxCollections - maximum number of new sensor data collections this instance may create (0 = unlimited)
+	MaxCollections int
+	// WriteGCSManifest - whether to write a JSON result manifest to GCS after each processed file
+	WriteGCSManifest bool
+	// GCSManifestPrefix - object name prefix of the result manifests
+	GCSManifestPrefix string
+	// DetectorPrecedence - order in which file type detectors are consulted
+	DetectorPrecedence []string
+	// StoreGeneration - whether to add the GCS object generation of the source file as a "gen" field
+	StoreGeneration bool
+	// FailedCopyRetries - number of retries of the copy of a failed file to load_failed/
+	FailedCopyRetries int
+	// PrefixNewestPerDevice - whether ProcessPrefix only processes the newest file of each device
+	PrefixNewestPerDevice bool
+	// FieldConversions - per field code unit conversion applied to CSV values before storage
+	FieldConversions map[string]FieldConversion
+	// ColumnBlacklist - CSV columns (codes or aliases) never stored
+	ColumnBlacklist map[string]bool
+	// SummaryLogFormat - format of the per-file summary line ("" = disabled, "csv" or "json")
+	SummaryLogFormat string
+	// QuarantineThreshold - number of failures after which a file is quarantined (0 = disabled)
+	QuarantineThreshold int
+	// AutoDetectDataStart - whether to locate the columns and first data line instead of assuming the TOA5 layout
+	AutoDetectDataStart bool
+	// AllowedContentTypes - GCS content types of the files to process (empty = any)
+	AllowedContentTypes []string
+	// CompositeFields - fields combined from an integer and a fractional CSV column
+	CompositeFields []CompositeField
+	// FlushIntervalMS - maximum time CSV records are buffered across files before insert (0 = no time limit)
+	FlushIntervalMS int
+	// FlushMaxRecords - number of buffered CSV records triggering an insert (0 = no size limit)
+	FlushMaxRecords int
+	// IngestTimeUnit - unit of the Unix "c" (ingest time) field of KV documents: "s" or "ms"
+	IngestTimeUnit string
+	// LatestNumericID - whether the latest-record lookup ignores documents with a non-numeric _id
+	LatestNumericID bool
+	// MinRecords - minimum number of records (KV values) a file must produce (0 = no check)
+	MinRecords int
+	// MinRecordsMode - "warn" or "fail" when a file produces fewer than MinRecords
+	MinRecordsMode string
+	// CopyFailed - whether failed files are copied to load_failed/
+	CopyFailed bool
+	// AmChuaFanOut - whether AmChua metrics are stored in per-metric collections
+	AmChuaFanOut bool
+	// LogFailedContent - whether to log the content of files that fail to parse
+	LogFailedContent bool
+	// LogFailedContentMaxBytes - maximum number of content bytes logged per failed file
+	LogFailedContentMaxBytes int
+	// ProcessHours - clock hours during which events are processed (nil = always)
+	ProcessHours *HourWindow
+	// ProcessHoursMode - "defer" (retryable error) or "skip" for events outside ProcessHours
+	ProcessHoursMode string
+	// UpdateLastSeen - whether to set the box last_seen field to the newest ingested record timestamp
+	UpdateLastSeen bool
+	// NColumnIndex - index of the record number (n) column: 1, or -1 for files without one
+	NColumnIndex int
+	// SignedURLFallback - whether objects are fetched from a signed URL when direct reads are denied
+	SignedURLFallback bool
+	// SignedURLAccessID - service account email signing the fallback URLs ("" = detected from credentials)
+	SignedURLAccessID string
+	// SignedURLPrivateKeyFile - PEM private key signing the fallback URLs ("" = IAM signBlob API)
+	SignedURLPrivateKeyFile string
+	// SignedURLExpirySeconds - validity of the fallback signed URLs
+	SignedURLExpirySeconds int
+	// StoreFileType - whether to add the source file type (csv/amchua/baria) as an "ft" field
+	StoreFileType bool
+	// KVMinValidLines - minimum number of valid key-value lines for a KV file to be stored (0 = no minimum)
+	KVMinValidLines int
+	// KVMinMetrics - minimum number of box metrics found in a KV file for it to be stored, above the built-in 1 (0 = no higher minimum)
+	KVMinMetrics int
+	// YearlyCollections - whether records go to one sensor_data_<box ID>_<YYYY> collection per year
+	YearlyCollections bool
+	// StoreOriginalNames - whether CSV documents keep the original header of renamed columns in a "_cols" map
+	StoreOriginalNames bool
+	// MissingValueSentinels - numeric values meaning "no reading" (e.g. -9999, NaN)
+	MissingValueSentinels []float64
+	// MissingValueMode - "drop" (omit) or "null" (store null) for sentinel values
+	MissingValueMode string
+	// ArchiveProcessed - whether successfully processed files are moved to ArchivePrefix
+	ArchiveProcessed bool
+	// ArchivePrefix - object name prefix of archived files
+	ArchivePrefix string
+	// MaxLineBytes - maximum line length of CSV and NDJSON files, longer lines fail the file (0 = no limit)
+	MaxLineBytes int
+	// StationColumn - CSV column whose values route rows to boxes through StationToBox
+	StationColumn string
+	// StationToBox - box _id of each station of consolidated multi-station files
+	StationToBox map[string]string
+	// UnknownDevicePolicy - "skip" (warn), "fail" (error) or "autocreate" (BoxTemplate) for devices and stations without a box
+	UnknownDevicePolicy string
+	// LogSampleRecords - number of parsed records logged per file at info level (0 = none)
+	LogSampleRecords int
+	// MaxParseTimeMS - maximum time spent parsing the rows of a CSV file, in milliseconds (0 = no limit)
+	MaxParseTimeMS int
+	// BoxEnrichFields - box document fields copied into each CSV record (e.g. lat, lon, name)
+	BoxEnrichFields []string
+	// FlexibleTime - whether second-less CSV timestamps ("2006-01-02 15:04") are accepted when CSVTimeLayout is unset
+	FlexibleTime bool
+	// SkipProcessedFiles - whether file generations recorded in processed_files are skipped
+	SkipProcessedFiles bool
+	// DetectInt - whether reading values without a fractional part are stored as integers
+	DetectInt bool
+	// AgeSource - timestamp compared with MAX_EVENT_AGE_SECONDS: "event", "object-updated" or "object-created"
+	AgeSource string
+	// BoxTemplate - default fields of the box documents created by UNKNOWN_DEVICE_POLICY=autocreate
+	BoxTemplate map[string]interface{}
+	// KVTruncate - resolution of KV file timestamps: "minute", "second" or "none"
+	KVTruncate string
+	// KVDuplicatePolicy - "skip", "upsert" or "error" for KV documents whose timestamp is already stored
+	KVDuplicatePolicy string
+	// ProgressEvery - number of inserted records between progress logs of a file (0 = no progress logs)
+	ProgressEvery int
+	// DeviceIDAliases - canonical device ID of each raw derived device ID, applied before the box lookup
+	DeviceIDAliases map[string]string
+	// RetryOnMongoError - whether MongoDB/GCS processing failures are returned to the platform for a retry
+	RetryOnMongoError bool
+	// LogBatchResults - whether the inserted/duplicate/error counts of each insert batch are logged
+	LogBatchResults bool
+}
+
+// BitFlag describes one boolean field packed into a bit of a numeric field
+type BitFlag struct {
+	// Bit - bit position (0 = least significant bit)
+	Bit uint
+	// Name - name of the boolean field stored in the record
+	Name string
+}
+
+// HourWindow is an inclusive range of clock hours, e.g. 6-22; Start > End wraps past midnight (22-5)
+type HourWindow struct {
+	Start int
+	End   int
+}
+
+// Contains checks if a clock hour (0-23) is within the window
+func (w *HourWindow) Contains(hour int) bool {
+	if w.Start <= w.End {
+		return hour >= w.Start && hour <= w.End
+	}
+	return hour >= w.Start || hour <= w.End
+}
+
+// String returns the window as "start-end"
+func (w *HourWindow) String() string {
+	return fmt.Sprintf("%d-%d", w.Start, w.End)
+}
+
+// CompositeField combines two CSV columns into one field as IntColumn + FracColumn/Divisor
+type CompositeField struct {
+	Field      string
+	IntColumn  string
+	FracColumn string
+	Divisor    float64
+}
+
+// FieldConversion converts a value as value*Scale + Offset
+type FieldConversion struct {
+	Scale  float64
+	Offset float64
+}
+
+// Apply returns the converted value
+func (c FieldConversion) Apply(v float64) float64 {
+	return v*c.Scale + c.Offset
 }
 
 // GlobalConfig is the global configuration instance
 var GlobalConfig *Config
 
+// configTimezone returns the TIMEZONE_OFFSET location, GMT+7 (the default offset) before InitConfig
+func configTimezone() *time.Location {
+	if GlobalConfig == nil || GlobalConfig.TimezoneLocation == nil {
+		return time.FixedZone("GMT+7", 7*3600)
+	}
+	return GlobalConfig.TimezoneLocation
+}
+
 // InitConfig initializes the global configuration from environment variables
 // Environment variables:
 //
-//	DEBUG - "true"/"false" - whether to print records before MongoDB insert (default: false)
+//	DEBUG - "true"/"false" - whether to print records before MongoDB insert and output debug level log messages,
+//	  which were always output before DEBUG gated them (default: false)
 //	TIMEZONE_OFFSET - integer offset in hours from UTC (default: 7 for GMT+7)
+//	SKIP_METADATA_UPDATES - "true"/"false" - skip events whose metageneration is not 1 (default: false)
+//	QUALITY_COLUMN - CSV column whose raw value is stored under the "q" field (default: none)
+//	KV_TIMESTAMP_FALLBACK - "fail"/"now"/"content" - KV file timestamp source when the filename can't be parsed (default: fail)
+//	BITFLAG_FIELDS - "field:bit:name" entries separated by ";" e.g. "TI:0:tilt_x;TI:1:tilt_y" (default: none)
+//	HASH_COLLECTIONS - integer N - route boxes into N shared collections by hashing the box ID (default: 0, disabled)
+//	MISSING_METRIC_POLICY - "zero"/"skip"/"null" - KV metrics missing from a file are stored as 0, omitted or null (default: zero)
+//	GCS_BILLING_PROJECT - project ID billed for requester-pays bucket access (default: none)
+//	ORDERED_FIELDS - "true"/"false" - insert documents as ordered BSON in CSV column order (default: false)
+//	STORE_BSON_DATE - "true"/"false" - add a "ts" BSON datetime field derived from the record timestamp (default: false)
+//	CSV_COMMENT - single character starting comment lines in CSV files, e.g. "#" (default: none)
+//	CSV_LAZY_QUOTES - "true"/"false" - tolerate bare and non-doubled quotes in CSV fields (default: false)
+//	MIN_VALID_TIMESTAMP - Unix seconds or "YYYY-MM-DD"; earlier CSV rows are dropped, 0 disables (default: 2000-01-01)
+//	DEVICE_ID_FROM_COLUMN - CSV column whose first data value is the device ID, overriding the meta line (default: none)
+//	DECIMAL_COMMA - "true"/"false" - parse "12,34" as 12.34; commas are never treated as thousands separators (default: false)
+//	CSV_TIME_LAYOUT - Go time layout of CSV timestamps, e.g. "2006/01/02 15:04:05" or "2006-01-02T15:04:05Z07:00" (default: "2006-01-02 15:04:05")
+//	MAX_COLLECTIONS - integer - maximum number of new collections created per instance (default: 0, unlimited)
+//	WRITE_GCS_MANIFEST - "true"/"false" - write a JSON result manifest to the bucket after each processed file (default: false)
+//	GCS_MANIFEST_PREFIX - object name prefix of the result manifests (default: "processed/")
+//	DETECTOR_PRECEDENCE - comma-separated file type detectors, first match wins; unlisted ones follow in default order (default: "dat,amchua,baria,kv")
+//	STORE_GENERATION - "true"/"false" - add the GCS object generation of the source file as a "gen" field (default: false)
+//	COPY_FAILED - "true"/"false" - copy failed files to load_failed/; disable when lifecycle rules or QUARANTINE_THRESHOLD track failures (default: true)
+//	FAILED_COPY_RETRIES - integer - retries with exponential backoff of the copy of a failed file to load_failed/ (default: 0)
+//	PREFIX_NEWEST_PER_DEVICE - "true"/"false" - ProcessPrefix only processes the most recently updated file of each device (default: false)
+//	FIELD_CONVERSIONS - "field:op" entries separated by ";", op "*scale" or "+offset", applied in order, e.g. "WA:*0.1;TE:+273.15" (default: none)
+//	COLUMN_BLACKLIST - codes or aliases separated by ";" or ","; matching CSV columns are never stored (default: none)
+//	SUMMARY_LOG_FORMAT - "csv"/"json" - emit one machine-parseable summary line per processed file (default: none)
+//	QUARANTINE_THRESHOLD - integer - failures after which a file is quarantined and no longer reprocessed (default: 0, disabled)
+//	AUTO_DETECT_DATA_START - "true"/"false" - data starts at the first line beginning with a timestamp instead of line 4 (default: false)
+//	ALLOWED_CONTENT_TYPES - GCS content types separated by ";", e.g. "text/csv;text/plain;application/zip"; other files are skipped (default: any)
+//	COMPOSITE_FIELDS - "field:int_column,frac_column[/divisor]" entries separated by ";", stored as int + frac/divisor, e.g. "WA:WA_int,WA_frac" (default divisor: 1000)
+//	FLUSH_INTERVAL_MS - integer - buffer CSV records across concurrent files for up to this many milliseconds before insert, each file waits for the flush (default: 0, no batching)
+//	FLUSH_MAX_RECORDS - integer - insert buffered CSV records once this many are buffered (default: 0, no batching)
+//	INGEST_TIME_UNIT - "s"/"ms" - unit of the Unix epoch "c" (ingest time) field of KV documents (default: s)
+//	LATEST_NUMERIC_ID - "true"/"false" - ignore documents with a non-numeric _id when looking up the latest stored record (default: false)
+//	MIN_RECORDS - integer - minimum number of records (values for KV files) a file must produce (default: 0, no check)
+//	MIN_RECORDS_MODE - "warn"/"fail" - log a warning or fail files below MIN_RECORDS (default: warn)
+//	AMCHUA_FANOUT_METRICS - "true"/"false" - store each AmChua metric in sensor_data_<box ID>_<code> instead of one document per box (default: false)
+//	LOG_FAILED_CONTENT - "true"/"false" - log the content of files that fail to parse, as text or hex dump (default: false)
+//	LOG_FAILED_CONTENT_MAX_BYTES - integer - maximum number of content bytes logged per failed file (default: 1024)
+//	PROCESS_HOURS - "start-end" inclusive clock hours in TIMEZONE_OFFSET when events are processed, e.g. "6-22" or "22-5" (default: always)
+//	PROCESS_HOURS_MODE - "defer"/"skip" - return a retryable error or skip events outside PROCESS_HOURS (default: defer)
+//	UPDATE_LAST_SEEN - "true"/"false" - set the box document last_seen field to the newest CSV record timestamp (default: false)
+//	N_COLUMN_INDEX - "1" or "-1" - index of the record number (n) column, -1 for files without one (default: 1)
+//	SIGNED_URL_FALLBACK - "true"/"false" - fetch objects from a signed URL when direct reads are denied (default: false)
+//	SIGNED_URL_ACCESS_ID - service account email signing the fallback URLs (default: detected from credentials)
+//	SIGNED_URL_PRIVATE_KEY_FILE - PEM private key signing the fallback URLs (default: IAM signBlob API)
+//	SIGNED_URL_EXPIRY_SECONDS - validity of the fallback signed URLs (default: 300)
+//	STORE_FILE_TYPE - "true"/"false" - add the source file type (csv/amchua/baria) as an "ft" field (default: false)
+//	KV_MIN_VALID_LINES - minimum number of valid key-value lines, KV files with fewer fail (default: 0, no minimum)
+//	KV_MIN_METRICS - minimum number of configured box metrics present in a KV file, files with fewer fail instead of storing zero/missing readings, e.g. 3; files without any box metric always fail (default: 0, no higher minimum)
+//	YEARLY_COLLECTIONS - "true"/"false" - store records in sensor_data_<box ID>_<YYYY> collections by record year, in TIMEZONE_OFFSET (default: false)
+//	STORE_ORIGINAL_NAMES - "true"/"false" - add a "_cols" map of stored code to original CSV header (e.g. {"WA": "water"}) (default: false)
+//	MISSING_VALUE_SENTINELS - ";"-separated numeric values meaning "no reading", e.g. "-9999;-99;NAN" (default: none)
+//	MISSING_VALUE_MODE - "drop" or "null" - omit sentinel values from CSV records or store them as null (default: drop)
+//	ARCHIVE_PROCESSED - "true"/"false" - move successfully processed files to ARCHIVE_PREFIX (default: false)
+//	ARCHIVE_PREFIX - object name prefix of archived files, skipped by the loader (default: "archive/")
+//	MAX_LINE_BYTES - maximum line length of CSV and NDJSON files in bytes, files with a longer line fail (default: 0, no limit)
+//	STATION_COLUMN - CSV column whose values route the rows of consolidated files to boxes via STATION_TO_BOX (default: none)
+//	STATION_TO_BOX - ";"-separated station=box _id pairs, e.g. "TramA=65a1...;TramB=65a2..." (default: none)
+//	UNKNOWN_DEVICE_POLICY - "skip", "fail" or "autocreate" - skip the records of devices and stations without a box, fail the file, or create the device box from BOX_TEMPLATE (default: skip)
+//	LOG_SAMPLE_RECORDS - number of parsed records (KV documents) logged per file at info level, for parsing sanity checks (default: 0)
+//	MAX_PARSE_TIME_MS - maximum time spent parsing the rows of a CSV file, slower files fail with a parse timeout (default: 0, no limit)
+//	BOX_ENRICH_FIELDS - ";"-separated box document fields copied into each CSV record, e.g. "lat;lon;name" (default: none)
+//	FLEXIBLE_TIME - "true"/"false" - also accept second-less CSV timestamps ("2006-01-02 15:04") when CSV_TIME_LAYOUT is unset (default: false)
+//	SKIP_PROCESSED_FILES - "true"/"false" - record processed file generations in processed_files and skip them on redelivery (default: false)
+//	DETECT_INT - "true"/"false" - store reading values without a fractional part as int64 (_id and n are unchanged) (default: false)
+//	AGE_SOURCE - "event", "object-updated" or "object-created" - timestamp driving the MAX_EVENT_AGE_SECONDS check (default: event)
+//	BOX_TEMPLATE - JSON object of default fields of auto-created box documents, e.g. {"name": "new device", "timezone": "7"} (default: {})
+//	STRICT_MAPPINGS - "true"/"false" - fail on field mapping collisions instead of logging them, read by SetFieldMappings (default: false)
+//	KV_TRUNCATE - "minute", "second" or "none" - truncation of KV file timestamps, "second"/"none" keep the seconds of the filename (default: minute)
+//	KV_DUPLICATE_POLICY - "skip", "upsert" or "error" - keep the stored KV document, replace it, or keep it and fail the file (default: skip)
+//	PROGRESS_EVERY - log the running inserted record count of a file every N records, for long ingestions (default: 0, off)
+//	DEVICE_ID_ALIASES - ";"-separated raw=canonical device ID pairs, e.g. "CR300_19531b=CR300_19531" for a device reporting a changed serial (default: none)
+//	RETRY_ON_MONGO_ERROR - "true"/"false" - return MongoDB and GCS failures from helloGCS so the platform retries the event; parse errors are still dropped (default: false)
+//	LOG_BATCH_RESULTS - "true"/"false" - log the index, size and inserted/duplicate/error counts of each insert batch (default: false)
 func InitConfig() {
 	tzOffset := parseIntEnv("TIMEZONE_OFFSET", 7)
 
@@ -38,12 +319,309 @@ func InitConfig() {
 	tzLocation := time.FixedZone(tzName, tzOffset*3600)
 
 	GlobalConfig = &Config{
-		Debug:            parseBoolEnv("DEBUG", false),
-		TimezoneOffset:   tzOffset,
-		TimezoneLocation: tzLocation,
+		Debug:               parseBoolEnv("DEBUG", false),
+		TimezoneOffset:      tzOffset,
+		TimezoneLocation:    tzLocation,
+		SkipMetadataUpdates: parseBoolEnv("SKIP_METADATA_UPDATES", false),
+		QualityColumn:       strings.TrimSpace(os.Getenv("QUALITY_COLUMN")),
+		KVTimestampFallback: parseEnumEnv("KV_TIMESTAMP_FALLBACK", KVTimestampFallbackFail, KVTimestampFallbackNow, KVTimestampFallbackContent),
+
+		BitFlagFields:   parseBitFlagFields(os.Getenv("BITFLAG_FIELDS")),
+		HashCollections: parseIntEnv("HASH_COLLECTIONS", 0),
+
+		MissingMetricPolicy: parseEnumEnv("MISSING_METRIC_POLICY", MissingMetricZero, MissingMetricSkip, MissingMetricNull),
+		GCSBillingProject:   strings.TrimSpace(os.Getenv("GCS_BILLING_PROJECT")),
+		OrderedFields:       parseBoolEnv("ORDERED_FIELDS", false),
+		StoreBSONDate:       parseBoolEnv("STORE_BSON_DATE", false),
+		DetectInt:           parseBoolEnv("DETECT_INT", false),
+		LogBatchResults:     parseBoolEnv("LOG_BATCH_RESULTS", false),
+		KVDuplicatePolicy:   parseEnumEnv("KV_DUPLICATE_POLICY", KVDuplicateSkip, KVDuplicateUpsert, KVDuplicateError),
+		ProgressEvery:       parseIntEnv("PROGRESS_EVERY", 0),
+		RetryOnMongoError:   parseBoolEnv("RETRY_ON_MONGO_ERROR", false),
+		KVTruncate:          parseEnumEnv("KV_TRUNCATE", KVTruncateMinute, KVTruncateSecond, KVTruncateNone),
+		AgeSource:           parseEnumEnv("AGE_SOURCE", AgeSourceEvent, AgeSourceObjectUpdated, AgeSourceObjectCreated),
+		CSVComment:          parseRuneEnv("CSV_COMMENT"),
+		CSVLazyQuotes:       parseBoolEnv("CSV_LAZY_QUOTES", false),
+		MinValidTimestamp:   parseMinValidTimestamp(tzLocation),
+		DeviceIDColumn:      strings.TrimSpace(os.Getenv("DEVICE_ID_FROM_COLUMN")),
+		DecimalComma:        parseBoolEnv("DECIMAL_COMMA", false),
+		CSVTimeLayout:       parseTimeLayoutEnv("CSV_TIME_LAYOUT"),
+		FlexibleTime:        parseBoolEnv("FLEXIBLE_TIME", false),
+		MaxCollections:      parseIntEnv("MAX_COLLECTIONS", 0),
+
+		WriteGCSManifest:  parseBoolEnv("WRITE_GCS_MANIFEST", false),
+		GCSManifestPrefix: parseStringEnv("GCS_MANIFEST_PREFIX", "processed/"),
+		ArchiveProcessed:  parseBoolEnv("ARCHIVE_PROCESSED", false),
+		ArchivePrefix:     parseStringEnv("ARCHIVE_PREFIX", "archive/"),
+
+		DetectorPrecedence: parseDetectorPrecedence(os.Getenv("DETECTOR_PRECEDENCE")),
+		StoreGeneration:    parseBoolEnv("STORE_GENERATION", false),
+		StoreFileType:      parseBoolEnv("STORE_FILE_TYPE", false),
+		StoreOriginalNames: parseBoolEnv("STORE_ORIGINAL_NAMES", false),
+		CopyFailed:         parseBoolEnv("COPY_FAILED", true),
+		AmChuaFanOut:       parseBoolEnv("AMCHUA_FANOUT_METRICS", false),
+		FailedCopyRetries:  parseIntEnv("FAILED_COPY_RETRIES", 0),
+
+		LogFailedContent:         parseBoolEnv("LOG_FAILED_CONTENT", false),
+		LogFailedContentMaxBytes: parseIntEnv("LOG_FAILED_CONTENT_MAX_BYTES", 1024),
+		LogSampleRecords:         parseIntEnv("LOG_SAMPLE_RECORDS", 0),
+		ProcessHours:             parseHourWindow(os.Getenv("PROCESS_HOURS")),
+		UpdateLastSeen:           parseBoolEnv("UPDATE_LAST_SEEN", false),
+		ProcessHoursMode:         parseEnumEnv("PROCESS_HOURS_MODE", ProcessHoursModeDefer, ProcessHoursModeSkip),
+		NColumnIndex:             parseNColumnIndex(os.Getenv("N_COLUMN_INDEX")),
+
+		SignedURLFallback:       parseBoolEnv("SIGNED_URL_FALLBACK", false),
+		SignedURLAccessID:       os.Getenv("SIGNED_URL_ACCESS_ID"),
+		SignedURLPrivateKeyFile: os.Getenv("SIGNED_URL_PRIVATE_KEY_FILE"),
+		SignedURLExpirySeconds:  parseIntEnv("SIGNED_URL_EXPIRY_SECONDS", 300),
+
+		PrefixNewestPerDevice: parseBoolEnv("PREFIX_NEWEST_PER_DEVICE", false),
+		FieldConversions:      parseFieldConversions(os.Getenv("FIELD_CONVERSIONS")),
+		ColumnBlacklist:       parseColumnBlacklist(os.Getenv("COLUMN_BLACKLIST")),
+		QuarantineThreshold:   parseIntEnv("QUARANTINE_THRESHOLD", 0),
+		SkipProcessedFiles:    parseBoolEnv("SKIP_PROCESSED_FILES", false),
+		AutoDetectDataStart:   parseBoolEnv("AUTO_DETECT_DATA_START", false),
+		AllowedContentTypes:   parseListEnv("ALLOWED_CONTENT_TYPES"),
+		CompositeFields:       parseCompositeFields(os.Getenv("COMPOSITE_FIELDS")),
+		FlushIntervalMS:       parseIntEnv("FLUSH_INTERVAL_MS", 0),
+		FlushMaxRecords:       parseIntEnv("FLUSH_MAX_RECORDS", 0),
+		LatestNumericID:       parseBoolEnv("LATEST_NUMERIC_ID", false),
+		MinRecords:            parseIntEnv("MIN_RECORDS", 0),
+		KVMinValidLines:       parseIntEnv("KV_MIN_VALID_LINES", 0),
+		KVMinMetrics:          parseIntEnv("KV_MIN_METRICS", 0),
+		YearlyCollections:     parseBoolEnv("YEARLY_COLLECTIONS", false),
+		MaxLineBytes:          parseIntEnv("MAX_LINE_BYTES", 0),
+		MaxParseTimeMS:        parseIntEnv("MAX_PARSE_TIME_MS", 0),
+		BoxEnrichFields:       parseNameListEnv("BOX_ENRICH_FIELDS"),
+		StationColumn:         strings.TrimSpace(os.Getenv("STATION_COLUMN")),
+		StationToBox:          parseStationToBox(os.Getenv("STATION_TO_BOX")),
+		BoxTemplate:           parseBoxTemplate(os.Getenv("BOX_TEMPLATE")),
+		DeviceIDAliases:       parseDeviceIDAliases(os.Getenv("DEVICE_ID_ALIASES")),
+		UnknownDevicePolicy:   parseEnumEnv("UNKNOWN_DEVICE_POLICY", UnknownDeviceSkip, UnknownDeviceFail, UnknownDeviceAutoCreate),
+		MissingValueSentinels: parseMissingValueSentinels(os.Getenv("MISSING_VALUE_SENTINELS")),
+		MissingValueMode:      parseEnumEnv("MISSING_VALUE_MODE", MissingValueDrop, MissingValueNull),
+		MinRecordsMode:        parseEnumEnv("MIN_RECORDS_MODE", MinRecordsModeWarn, MinRecordsModeFail),
+		IngestTimeUnit:        parseEnumEnv("INGEST_TIME_UNIT", IngestTimeUnitSeconds, IngestTimeUnitMilliseconds),
+		SummaryLogFormat:      parseEnumEnv("SUMMARY_LOG_FORMAT", "", SummaryLogFormatCSV, SummaryLogFormatJSON),
+	}
+
+	GlobalLogger.Infof("Config initialized: Debug=%v, TimezoneOffset=%d hours (%s), SkipMetadataUpdates=%v, OrderedFields=%v, StoreBSONDate=%v", GlobalConfig.Debug, GlobalConfig.TimezoneOffset, tzName, GlobalConfig.SkipMetadataUpdates, GlobalConfig.OrderedFields, GlobalConfig.StoreBSONDate)
+	if GlobalConfig.CSVTimeLayout != "" {
+		GlobalLogger.Infof("CSV time layout: %s (default layout %s used as fallback)", GlobalConfig.CSVTimeLayout, DefaultCSVTimeLayout)
+	} else if GlobalConfig.FlexibleTime {
+		GlobalLogger.Infof("Flexible CSV time: %s also accepted", MinuteCSVTimeLayout)
+	}
+	if len(GlobalConfig.AllowedContentTypes) > 0 {
+		GlobalLogger.Infof("Allowed content types: %v", GlobalConfig.AllowedContentTypes)
+	}
+	if GlobalConfig.AutoDetectDataStart {
+		GlobalLogger.Info("Auto-detecting the CSV data start line")
+	}
+	if GlobalConfig.DecimalComma {
+		GlobalLogger.Info("Decimal comma enabled: \"12,34\" is parsed as 12.34")
+	}
+	if GlobalConfig.UnknownDevicePolicy == UnknownDeviceAutoCreate {
+		GlobalLogger.Infof("Boxes of unknown devices are created from BOX_TEMPLATE (%d template field(s))", len(GlobalConfig.BoxTemplate))
+	}
+	if GlobalConfig.StationColumn != "" && len(GlobalConfig.StationToBox) > 0 {
+		GlobalLogger.Infof("Rows are routed by station column %s to %d box(es), unknown devices: %s", GlobalConfig.StationColumn, len(GlobalConfig.StationToBox), GlobalConfig.UnknownDevicePolicy)
+	}
+	if GlobalConfig.DeviceIDColumn != "" {
+		GlobalLogger.Infof("Device ID column: %s", GlobalConfig.DeviceIDColumn)
+	}
+	if GlobalConfig.QualityColumn != "" {
+		GlobalLogger.Infof("Quality column: %s (stored as \"q\")", GlobalConfig.QualityColumn)
+	}
+	GlobalLogger.Infof("KV timestamp fallback: %s, missing metric policy: %s, ingest time unit: %s", GlobalConfig.KVTimestampFallback, GlobalConfig.MissingMetricPolicy, GlobalConfig.IngestTimeUnit)
+	if len(GlobalConfig.BitFlagFields) > 0 {
+		GlobalLogger.Infof("Bit flag fields: %v", GlobalConfig.BitFlagFields)
+	}
+	if len(GlobalConfig.ColumnBlacklist) > 0 {
+		GlobalLogger.Infof("Column blacklist: %v", GlobalConfig.ColumnBlacklist)
+	}
+	if len(GlobalConfig.CompositeFields) > 0 {
+		GlobalLogger.Infof("Composite fields: %v", GlobalConfig.CompositeFields)
+	}
+	if len(GlobalConfig.FieldConversions) > 0 {
+		GlobalLogger.Infof("Field conversions: %v", GlobalConfig.FieldConversions)
+	}
+	if GlobalConfig.HashCollections > 0 {
+		GlobalLogger.Infof("Hash collections enabled: %d shared sensor data collections", GlobalConfig.HashCollections)
+	}
+	if GlobalConfig.YearlyCollections {
+		GlobalLogger.Info("Yearly collections enabled: sensor data collections are suffixed with _<YYYY>")
+	}
+	if GlobalConfig.CSVComment != 0 || GlobalConfig.CSVLazyQuotes {
+		GlobalLogger.Infof("CSV options: comment=%q, lazyQuotes=%v", GlobalConfig.CSVComment, GlobalConfig.CSVLazyQuotes)
+	}
+	if GlobalConfig.MinValidTimestamp > 0 {
+		GlobalLogger.Infof("Minimum valid record timestamp: %d (%s)", GlobalConfig.MinValidTimestamp, time.Unix(GlobalConfig.MinValidTimestamp, 0).In(tzLocation).Format("2006-01-02 15:04:05"))
+	}
+	if GlobalConfig.MaxCollections > 0 {
+		GlobalLogger.Infof("Maximum new collections per instance: %d", GlobalConfig.MaxCollections)
+	}
+	if os.Getenv("DETECTOR_PRECEDENCE") != "" {
+		GlobalLogger.Infof("File type detector precedence: %v", GlobalConfig.DetectorPrecedence)
+	}
+	if GlobalConfig.NColumnIndex == NoNColumn {
+		GlobalLogger.Info("Files have no record number (n) column (N_COLUMN_INDEX=-1)")
+	}
+	if GlobalConfig.SignedURLFallback {
+		GlobalLogger.Infof("Signed URL fallback enabled for denied reads (expiry: %ds)", GlobalConfig.SignedURLExpirySeconds)
+	}
+	if GlobalConfig.ProcessHours != nil {
+		GlobalLogger.Infof("Process hours: %s (%s outside)", GlobalConfig.ProcessHours, GlobalConfig.ProcessHoursMode)
+	}
+	if !GlobalConfig.CopyFailed {
+		GlobalLogger.Info("Failed files are not copied to load_failed/ (COPY_FAILED=false)")
+	}
+	if GlobalConfig.MinRecords > 0 {
+		GlobalLogger.Infof("Minimum records per file: %d (%s)", GlobalConfig.MinRecords, GlobalConfig.MinRecordsMode)
+	}
+	if len(GlobalConfig.MissingValueSentinels) > 0 {
+		GlobalLogger.Infof("Missing value sentinels: %v (%s)", GlobalConfig.MissingValueSentinels, GlobalConfig.MissingValueMode)
+	}
+	if GlobalConfig.LogSampleRecords > 0 {
+		GlobalLogger.Infof("Logging the first %d parsed records of each file", GlobalConfig.LogSampleRecords)
+	}
+	if len(GlobalConfig.BoxEnrichFields) > 0 {
+		GlobalLogger.Infof("Records are enriched with box fields: %v", GlobalConfig.BoxEnrichFields)
+	}
+	if GlobalConfig.MaxParseTimeMS > 0 {
+		GlobalLogger.Infof("Maximum CSV parse time: %d ms", GlobalConfig.MaxParseTimeMS)
+	}
+	if GlobalConfig.MaxLineBytes > 0 {
+		GlobalLogger.Infof("Maximum CSV line length: %d bytes", GlobalConfig.MaxLineBytes)
+	}
+	if GlobalConfig.KVMinValidLines > 0 {
+		GlobalLogger.Infof("Minimum valid lines per KV file: %d", GlobalConfig.KVMinValidLines)
+	}
+	if GlobalConfig.LatestNumericID {
+		GlobalLogger.Info("Latest-record lookups ignore documents with a non-numeric _id")
+	}
+	if GlobalConfig.KVMinMetrics > 0 {
+		GlobalLogger.Infof("Minimum box metrics per KV file: %d", GlobalConfig.KVMinMetrics)
+	}
+	if GlobalConfig.FlushIntervalMS > 0 || GlobalConfig.FlushMaxRecords > 0 {
+		GlobalLogger.Infof("Micro-batching enabled: flush after %d ms or %d records (0 = no limit)", GlobalConfig.FlushIntervalMS, GlobalConfig.FlushMaxRecords)
+	}
+	if GlobalConfig.SkipProcessedFiles {
+		GlobalLogger.Info("Processed file generations are recorded in processed_files and skipped")
+	}
+	if GlobalConfig.QuarantineThreshold > 0 {
+		GlobalLogger.Infof("Quarantine enabled: files are no longer reprocessed after %d failures", GlobalConfig.QuarantineThreshold)
+	}
+	if GlobalConfig.SummaryLogFormat != "" {
+		GlobalLogger.Infof("Per-file summary lines enabled (%s): %s", GlobalConfig.SummaryLogFormat, strings.Join(summaryColumns, ","))
+	}
+	if GlobalConfig.StoreGeneration {
+		GlobalLogger.Info("Storing the GCS object generation as \"gen\"")
+	}
+	if GlobalConfig.AgeSource != AgeSourceEvent {
+		GlobalLogger.Infof("Event age is checked against the object %s time (AGE_SOURCE=%s)", strings.TrimPrefix(GlobalConfig.AgeSource, "object-"), GlobalConfig.AgeSource)
+	}
+	if GlobalConfig.DetectInt {
+		GlobalLogger.Info("Integral reading values are stored as integers (DETECT_INT)")
+	}
+	if GlobalConfig.KVDuplicatePolicy != KVDuplicateSkip {
+		GlobalLogger.Infof("KV duplicate policy: %s", GlobalConfig.KVDuplicatePolicy)
+	}
+	if GlobalConfig.KVTruncate != KVTruncateMinute {
+		GlobalLogger.Infof("KV timestamps are truncated to: %s", GlobalConfig.KVTruncate)
+	}
+	if GlobalConfig.ProgressEvery > 0 {
+		GlobalLogger.Infof("Logging progress every %d inserted records", GlobalConfig.ProgressEvery)
+	}
+	if len(GlobalConfig.DeviceIDAliases) > 0 {
+		GlobalLogger.Infof("Device ID aliases: %v", GlobalConfig.DeviceIDAliases)
+	}
+	if GlobalConfig.RetryOnMongoError {
+		GlobalLogger.Info("MongoDB and GCS processing failures are retried by the platform")
+	}
+	if GlobalConfig.LogBatchResults {
+		GlobalLogger.Info("Logging the result of each insert batch")
+	}
+	if GlobalConfig.StoreFileType {
+		GlobalLogger.Info("Storing the source file type as \"ft\"")
+	}
+	if GlobalConfig.ArchiveProcessed {
+		GlobalLogger.Infof("Processed files are moved to %s<filename>", GlobalConfig.ArchivePrefix)
+	}
+	if GlobalConfig.StoreOriginalNames {
+		GlobalLogger.Info("Storing the original header of renamed columns as \"_cols\"")
+	}
+	if GlobalConfig.WriteGCSManifest {
+		GlobalLogger.Infof("GCS result manifests enabled: %s<filename>.json", GlobalConfig.GCSManifestPrefix)
+	}
+	if GlobalConfig.GCSBillingProject != "" {
+		GlobalLogger.Infof("GCS requests billed to project: %s", GlobalConfig.GCSBillingProject)
+	}
+}
+
+// DefaultCSVTimeLayout is the layout of the timestamp column of TOA5 CSV files
+const DefaultCSVTimeLayout = "2006-01-02 15:04:05"
+
+// parseTimeLayoutEnv parses a Go time layout environment variable
+// The layout is validated by formatting and parsing back a reference time; invalid layouts are ignored
+func parseTimeLayoutEnv(key string) string {
+	layout := os.Getenv(key)
+	if layout == "" {
+		return ""
 	}
 
-	GlobalLogger.Infof("Config initialized: Debug=%v, TimezoneOffset=%d hours (%s)", GlobalConfig.Debug, GlobalConfig.TimezoneOffset, tzName)
+	reference := time.Date(2025, time.December, 31, 23, 58, 0, 0, time.UTC)
+	parsed, err := time.Parse(layout, reference.Format(layout))
+	if err != nil || !parsed.Equal(reference) {
+		GlobalLogger.Warnf("Invalid time layout for %s: %q (reference time does not round-trip), ignoring", key, layout)
+		return ""
+	}
+	return layout
+}
+
+// defaultMinValidTimestamp is 2000-01-01 00:00:00 UTC
+const defaultMinValidTimestamp int64 = 946684800
+
+// parseMinValidTimestamp parses MIN_VALID_TIMESTAMP as Unix seconds or a "YYYY-MM-DD" date
+func parseMinValidTimestamp(loc *time.Location) int64 {
+	val := strings.TrimSpace(os.Getenv("MIN_VALID_TIMESTAMP"))
+	if val == "" {
+		return defaultMinValidTimestamp
+	}
+	if ts, err := strconv.ParseInt(val, 10, 64); err == nil {
+		return ts
+	}
+	if t, err := time.ParseInLocation("2006-01-02", val, loc); err == nil {
+		return t.Unix()
+	}
+	GlobalLogger.Warnf("Invalid value for MIN_VALID_TIMESTAMP: %s, using default: %d", val, defaultMinValidTimestamp)
+	return defaultMinValidTimestamp
+}
+
+// parseBitFlagFields parses BITFLAG_FIELDS entries ("field:bit:name" separated by ";")
+// Invalid entries are logged and skipped
+func parseBitFlagFields(val string) map[string][]BitFlag {
+	fields := make(map[string][]BitFlag)
+	for _, entry := range strings.Split(val, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.Split(entry, ":")
+		if len(parts) != 3 {
+			GlobalLogger.Warnf("Invalid BITFLAG_FIELDS entry: %s (expected field:bit:name)", entry)
+			continue
+		}
+		field := strings.TrimSpace(parts[0])
+		name := strings.TrimSpace(parts[2])
+		bit, err := strconv.ParseUint(strings.TrimSpace(parts[1]), 10, 6)
+		if err != nil || field == "" || name == "" {
+			GlobalLogger.Warnf("Invalid BITFLAG_FIELDS entry: %s (expected field:bit:name, bit 0-63)", entry)
+			continue
+		}
+		fields[field] = append(fields[field], BitFlag{Bit: uint(bit), Name: name})
+	}
+	return fields
 }
 
 // parseBoolEnv parses a boolean environment variable with a default value
@@ -55,6 +633,280 @@ func parseBoolEnv(key string, defaultValue bool) bool {
 	return strings.ToLower(val) == "true"
 }
 
+// parseEnumEnv parses a string environment variable restricted to a set of values
+// The first value is the default, used for empty or unknown values (case-insensitive)
+func parseEnumEnv(key string, defaultValue string, others ...string) string {
+	val := strings.ToLower(strings.TrimSpace(os.Getenv(key)))
+	if val == "" || val == defaultValue {
+		return defaultValue
+	}
+	for _, allowed := range others {
+		if val == allowed {
+			return val
+		}
+	}
+	GlobalLogger.Warnf("Invalid value for %s: %s, using default: %s", key, val, defaultValue)
+	return defaultValue
+}
+
+// parseRuneEnv parses a single-character environment variable (0 if unset or invalid)
+func parseRuneEnv(key string) rune {
+	val := os.Getenv(key)
+	if val == "" {
+		return 0
+	}
+	runes := []rune(val)
+	if len(runes) != 1 {
+		GlobalLogger.Warnf("Invalid value for %s: %q (expected a single character), ignoring", key, val)
+		return 0
+	}
+	return runes[0]
+}
+
+// parseColumnBlacklist parses column codes or aliases separated by ";" or ","
+// Aliases are kept as listed: they are resolved when a column is checked (see isBlacklistedColumn)
+func parseColumnBlacklist(val string) map[string]bool {
+	blacklist := make(map[string]bool)
+	for _, name := range strings.FieldsFunc(val, func(r rune) bool { return r == ';' || r == ',' }) {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		blacklist[name] = true
+	}
+	return blacklist
+}
+
+// parseMissingValueSentinels parses ";"-separated numeric sentinel values ("NAN" matches NaN readings)
+// Invalid values are logged and ignored
+func parseMissingValueSentinels(val string) []float64 {
+	var sentinels []float64
+	for _, item := range strings.Split(val, ";") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		v, err := strconv.ParseFloat(item, 64)
+		if err != nil {
+			GlobalLogger.Warnf("Invalid MISSING_VALUE_SENTINELS value: %s, ignoring", item)
+			continue
+		}
+		sentinels = append(sentinels, v)
+	}
+	return sentinels
+}
+
+// parseStationToBox parses ";"-separated station=box _id pairs; invalid entries are logged and ignored
+func parseStationToBox(val string) map[string]string {
+	stationToBox := make(map[string]string)
+	for _, entry := range strings.Split(val, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		station, boxID, found := strings.Cut(entry, "=")
+		station, boxID = strings.TrimSpace(station), strings.TrimSpace(boxID)
+		if !found || station == "" || boxID == "" {
+			GlobalLogger.Warnf("Invalid STATION_TO_BOX entry: %s (expected station=box_id)", entry)
+			continue
+		}
+		stationToBox[station] = boxID
+	}
+	return stationToBox
+}
+
+// parseDeviceIDAliases parses ";"-separated raw=canonical device ID pairs; invalid entries are logged and ignored
+func parseDeviceIDAliases(val string) map[string]string {
+	aliases := make(map[string]string)
+	for _, entry := range strings.Split(val, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		raw, canonical, found := strings.Cut(entry, "=")
+		raw, canonical = strings.TrimSpace(raw), strings.TrimSpace(canonical)
+		if !found || raw == "" || canonical == "" {
+			GlobalLogger.Warnf("Invalid DEVICE_ID_ALIASES entry: %s (expected raw=canonical)", entry)
+			continue
+		}
+		aliases[raw] = canonical
+	}
+	return aliases
+}
+
+// parseBoxTemplate parses the BOX_TEMPLATE JSON object; invalid values are fatal
+func parseBoxTemplate(val string) map[string]interface{} {
+	template := make(map[string]interface{})
+	if strings.TrimSpace(val) == "" {
+		return template
+	}
+	if err := json.Unmarshal([]byte(val), &template); err != nil {
+		GlobalLogger.Fatalf("Invalid BOX_TEMPLATE: %v (expected a JSON object)", err)
+	}
+	return template
+}
+
+// parseHourWindow parses a "start-end" clock hour window (hours 0-23); invalid values are fatal
+func parseHourWindow(val string) *HourWindow {
+	val = strings.TrimSpace(val)
+	if val == "" {
+		return nil
+	}
+	start, end, found := strings.Cut(val, "-")
+	startHour, errStart := strconv.Atoi(strings.TrimSpace(start))
+	endHour, errEnd := strconv.Atoi(strings.TrimSpace(end))
+	if !found || errStart != nil || errEnd != nil || startHour < 0 || startHour > 23 || endHour < 0 || endHour > 23 {
+		GlobalLogger.Fatalf("invalid PROCESS_HOURS %q (expected start-end, hours 0-23)", val)
+	}
+	return &HourWindow{Start: startHour, End: endHour}
+}
+
+// parseCompositeFields parses "field:int_column,frac_column[/divisor]" entries separated by ";"
+func parseCompositeFields(val string) []CompositeField {
+	var composites []CompositeField
+	for _, entry := range strings.Split(val, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		field, sources, found := strings.Cut(entry, ":")
+		intColumn, fracColumn, hasFrac := strings.Cut(sources, ",")
+		composite := CompositeField{
+			Field:      strings.TrimSpace(field),
+			IntColumn:  strings.TrimSpace(intColumn),
+			FracColumn: strings.TrimSpace(fracColumn),
+			Divisor:    1000,
+		}
+		if frac, divisor, hasDivisor := strings.Cut(composite.FracColumn, "/"); hasDivisor {
+			d, err := strconv.ParseFloat(strings.TrimSpace(divisor), 64)
+			if err != nil || d <= 0 {
+				GlobalLogger.Warnf("Invalid COMPOSITE_FIELDS entry: %s (divisor must be a positive number)", entry)
+				continue
+			}
+			composite.FracColumn = strings.TrimSpace(frac)
+			composite.Divisor = d
+		}
+		if !found || !hasFrac || composite.Field == "" || composite.IntColumn == "" || composite.FracColumn == "" {
+			GlobalLogger.Warnf("Invalid COMPOSITE_FIELDS entry: %s (expected field:int_column,frac_column[/divisor])", entry)
+			continue
+		}
+		composites = append(composites, composite)
+	}
+	return composites
+}
+
+// parseFieldConversions parses "field:op" entries separated by ";" where op is "*scale" or "+offset"
+// Several entries for the same field are composed in order, e.g. "WA:*0.1;WA:+2" converts v to v*0.1 + 2
+func parseFieldConversions(val string) map[string]FieldConversion {
+	conversions := make(map[string]FieldConversion)
+	for _, entry := range strings.Split(val, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		field, op, found := strings.Cut(entry, ":")
+		field = strings.TrimSpace(field)
+		op = strings.TrimSpace(op)
+		if !found || field == "" || len(op) < 2 {
+			GlobalLogger.Warnf("Invalid FIELD_CONVERSIONS entry: %s (expected field:*scale or field:+offset)", entry)
+			continue
+		}
+		operand, err := strconv.ParseFloat(strings.TrimSpace(op[1:]), 64)
+		if err != nil {
+			GlobalLogger.Warnf("Invalid FIELD_CONVERSIONS entry: %s (invalid number)", entry)
+			continue
+		}
+
+		conversion, exists := conversions[field]
+		if !exists {
+			conversion = FieldConversion{Scale: 1}
+		}
+		switch op[0] {
+		case '*':
+			conversion.Scale *= operand
+			conversion.Offset *= operand
+		case '+':
+			conversion.Offset += operand
+		default:
+			GlobalLogger.Warnf("Invalid FIELD_CONVERSIONS entry: %s (operation must be * or +)", entry)
+			continue
+		}
+		conversions[field] = conversion
+	}
+	return conversions
+}
+
+// parseDetectorPrecedence parses a comma-separated list of file type detector names
+// Unknown names are fatal; detectors not listed are appended in the default order
+func parseDetectorPrecedence(val string) []string {
+	var order []string
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(val, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || seen[name] {
+			continue
+		}
+		if !slices.Contains(DefaultDetectorPrecedence, name) {
+			GlobalLogger.Fatalf("invalid DETECTOR_PRECEDENCE entry %q, allowed: %v", name, DefaultDetectorPrecedence)
+		}
+		seen[name] = true
+		order = append(order, name)
+	}
+	for _, name := range DefaultDetectorPrecedence {
+		if !seen[name] {
+			order = append(order, name)
+		}
+	}
+	return order
+}
+
+// parseListEnv parses a ";"-separated list environment variable into lowercase, trimmed, non-empty entries
+func parseListEnv(key string) []string {
+	var values []string
+	for _, val := range strings.Split(os.Getenv(key), ";") {
+		val = strings.ToLower(strings.TrimSpace(val))
+		if val != "" {
+			values = append(values, val)
+		}
+	}
+	return values
+}
+
+// parseNameListEnv parses a ";"-separated list of names (trimmed, case preserved)
+func parseNameListEnv(key string) []string {
+	var names []string
+	for _, name := range strings.Split(os.Getenv(key), ";") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// parseStringEnv parses a string environment variable (trimmed), falling back to the default if unset or blank
+func parseStringEnv(key string, defaultValue string) string {
+	val := strings.TrimSpace(os.Getenv(key))
+	if val == "" {
+		return defaultValue
+	}
+	return val
+}
+
+// parseNColumnIndex parses N_COLUMN_INDEX: only 1 (default) and -1 (no n column) are supported
+func parseNColumnIndex(val string) int {
+	if val == "" {
+		return 1
+	}
+	index, err := strconv.Atoi(strings.TrimSpace(val))
+	if err != nil || (index != 1 && index != NoNColumn) {
+		GlobalLogger.Warnf("Invalid N_COLUMN_INDEX value: %s (supported: 1, -1), using default: 1", val)
+		return 1
+	}
+	return index
+}
+
 // parseIntEnv parses an integer environment variable with a default value
 func parseIntEnv(key string, defaultValue int) int {
 	val := os.Getenv(key)
@@ -0,0 +1,288 @@
+package loader
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+// withConfig replaces GlobalConfig by an updated copy for the duration of the test
+func withConfig(t *testing.T, update func(c *Config)) {
+	t.Helper()
+	previous := GlobalConfig
+	config := *previous
+	update(&config)
+	GlobalConfig = &config
+	t.Cleanup(func() { GlobalConfig = previous })
+}
+
+// initTestConfig runs InitConfig with the given environment and returns the resulting config
+// GlobalConfig is restored when the test ends
+func initTestConfig(t *testing.T, env map[string]string) *Config {
+	t.Helper()
+	previous := GlobalConfig
+	t.Cleanup(func() { GlobalConfig = previous })
+	for key, value := range env {
+		t.Setenv(key, value)
+	}
+	InitConfig()
+	return GlobalConfig
+}
+
+func TestSkipMetadataUpdatesConfig(t *testing.T) {
+	tests := []struct {
+		value string
+		want  bool
+	}{
+		{"", false},
+		{"true", true},
+		{"TRUE", true},
+		{"false", false},
+		{"yes", false},
+	}
+	for _, tt := range tests {
+		config := initTestConfig(t, map[string]string{"SKIP_METADATA_UPDATES": tt.value})
+		if config.SkipMetadataUpdates != tt.want {
+			t.Errorf("SKIP_METADATA_UPDATES=%q: got %v, want %v", tt.value, config.SkipMetadataUpdates, tt.want)
+		}
+	}
+}
+
+func TestKVTimestampFallbackConfig(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"", KVTimestampFallbackFail},
+		{"now", KVTimestampFallbackNow},
+		{" Content ", KVTimestampFallbackContent},
+		{"later", KVTimestampFallbackFail},
+	}
+	for _, tt := range tests {
+		config := initTestConfig(t, map[string]string{"KV_TIMESTAMP_FALLBACK": tt.value})
+		if config.KVTimestampFallback != tt.want {
+			t.Errorf("KV_TIMESTAMP_FALLBACK=%q: got %s, want %s", tt.value, config.KVTimestampFallback, tt.want)
+		}
+	}
+}
+
+func TestParseBitFlagFields(t *testing.T) {
+	got := parseBitFlagFields("TI:0:tilt_x; TI:1:tilt_y;bad;AL:64:overflow;AL:3:alarm;:1:x")
+	want := map[string][]BitFlag{
+		"TI": {{Bit: 0, Name: "tilt_x"}, {Bit: 1, Name: "tilt_y"}},
+		"AL": {{Bit: 3, Name: "alarm"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseBitFlagFields() = %v, want %v", got, want)
+	}
+}
+
+func TestParseRuneEnv(t *testing.T) {
+	tests := []struct {
+		val  string
+		want rune
+	}{
+		{"", 0},
+		{"#", '#'},
+		{";", ';'},
+		{"//", 0},
+	}
+	for _, tt := range tests {
+		t.Setenv("CSV_COMMENT", tt.val)
+		if got := parseRuneEnv("CSV_COMMENT"); got != tt.want {
+			t.Errorf("parseRuneEnv(%q) = %q, want %q", tt.val, got, tt.want)
+		}
+	}
+}
+
+func TestMinValidTimestampConfig(t *testing.T) {
+	tests := []struct {
+		val  string
+		want int64
+	}{
+		{"", defaultMinValidTimestamp},
+		{"0", 0},
+		{"1577836800", 1577836800},
+		{"2020-01-01", 1577836800 - 7*3600},
+		{"yesterday", defaultMinValidTimestamp},
+	}
+	for _, tt := range tests {
+		config := initTestConfig(t, map[string]string{"TIMEZONE_OFFSET": "7", "MIN_VALID_TIMESTAMP": tt.val})
+		if config.MinValidTimestamp != tt.want {
+			t.Errorf("MIN_VALID_TIMESTAMP=%q: got %d, want %d", tt.val, config.MinValidTimestamp, tt.want)
+		}
+	}
+}
+
+func TestParseTimeLayoutEnv(t *testing.T) {
+	tests := []struct {
+		layout string
+		want   string
+	}{
+		{"", ""},
+		{"2006/01/02 15:04:05", "2006/01/02 15:04:05"},
+		{"2006-01-02T15:04:05Z07:00", "2006-01-02T15:04:05Z07:00"},
+		// No date, no year or no minutes: the reference time does not round-trip
+		{"15:04:05", ""},
+		{"01/02 15:04", ""},
+		{"2006-01-02 15", ""},
+	}
+	for _, tt := range tests {
+		t.Setenv("CSV_TIME_LAYOUT", tt.layout)
+		if got := parseTimeLayoutEnv("CSV_TIME_LAYOUT"); got != tt.want {
+			t.Errorf("parseTimeLayoutEnv(%q) = %q, want %q", tt.layout, got, tt.want)
+		}
+	}
+}
+
+func TestParseFieldConversions(t *testing.T) {
+	got := parseFieldConversions("WA:*0.5; TE:+273.15;HU:+1;HU:*2;bad;XX:/2;YY:*abc;:*2")
+	want := map[string]FieldConversion{
+		"WA": {Scale: 0.5},
+		"TE": {Scale: 1, Offset: 273.15},
+		// Operations apply in order: (v + 1) * 2
+		"HU": {Scale: 2, Offset: 2},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseFieldConversions() = %v, want %v", got, want)
+	}
+}
+
+func TestSummaryLogFormatConfig(t *testing.T) {
+	for val, want := range map[string]string{"": "", "CSV": SummaryLogFormatCSV, " json ": SummaryLogFormatJSON, "xml": ""} {
+		if got := initTestConfig(t, map[string]string{"SUMMARY_LOG_FORMAT": val}).SummaryLogFormat; got != want {
+			t.Errorf("SUMMARY_LOG_FORMAT=%q: got %q, want %q", val, got, want)
+		}
+	}
+}
+
+func TestParseCompositeFields(t *testing.T) {
+	got := parseCompositeFields("WA:WA_int,WA_frac; TE: TE_i , TE_f/100;bad;XX:a;YY:a,b/0;:a,b")
+	want := []CompositeField{
+		{Field: "WA", IntColumn: "WA_int", FracColumn: "WA_frac", Divisor: 1000},
+		{Field: "TE", IntColumn: "TE_i", FracColumn: "TE_f", Divisor: 100},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseCompositeFields() = %+v, want %+v", got, want)
+	}
+}
+
+func TestIngestTimeUnitConfig(t *testing.T) {
+	for val, want := range map[string]string{"": IngestTimeUnitSeconds, "s": IngestTimeUnitSeconds, "MS": IngestTimeUnitMilliseconds, "us": IngestTimeUnitSeconds} {
+		if got := initTestConfig(t, map[string]string{"INGEST_TIME_UNIT": val}).IngestTimeUnit; got != want {
+			t.Errorf("INGEST_TIME_UNIT=%q: got %q, want %q", val, got, want)
+		}
+	}
+}
+
+func TestMinRecordsConfig(t *testing.T) {
+	c := initTestConfig(t, nil)
+	if c.MinRecords != 0 || c.MinRecordsMode != MinRecordsModeWarn {
+		t.Errorf("defaults: MIN_RECORDS=%d MIN_RECORDS_MODE=%q, want 0 and %q", c.MinRecords, c.MinRecordsMode, MinRecordsModeWarn)
+	}
+	c = initTestConfig(t, map[string]string{"MIN_RECORDS": "5", "MIN_RECORDS_MODE": "FAIL"})
+	if c.MinRecords != 5 || c.MinRecordsMode != MinRecordsModeFail {
+		t.Errorf("MIN_RECORDS=%d MIN_RECORDS_MODE=%q, want 5 and %q", c.MinRecords, c.MinRecordsMode, MinRecordsModeFail)
+	}
+}
+
+func TestCopyFailedConfig(t *testing.T) {
+	for val, want := range map[string]bool{"": true, "true": true, "false": false} {
+		if got := initTestConfig(t, map[string]string{"COPY_FAILED": val}).CopyFailed; got != want {
+			t.Errorf("COPY_FAILED=%q: got %v, want %v", val, got, want)
+		}
+	}
+}
+
+func TestFailedCopyRetriesConfig(t *testing.T) {
+	for val, want := range map[string]int{"": 0, "3": 3} {
+		if got := initTestConfig(t, map[string]string{"FAILED_COPY_RETRIES": val}).FailedCopyRetries; got != want {
+			t.Errorf("FAILED_COPY_RETRIES=%q: got %d, want %d", val, got, want)
+		}
+	}
+}
+
+func TestLogFailedContentConfig(t *testing.T) {
+	c := initTestConfig(t, nil)
+	if c.LogFailedContent || c.LogFailedContentMaxBytes != 1024 {
+		t.Errorf("defaults: LOG_FAILED_CONTENT=%v LOG_FAILED_CONTENT_MAX_BYTES=%d, want false and 1024", c.LogFailedContent, c.LogFailedContentMaxBytes)
+	}
+	c = initTestConfig(t, map[string]string{"LOG_FAILED_CONTENT": "true", "LOG_FAILED_CONTENT_MAX_BYTES": "64"})
+	if !c.LogFailedContent || c.LogFailedContentMaxBytes != 64 {
+		t.Errorf("LOG_FAILED_CONTENT=%v LOG_FAILED_CONTENT_MAX_BYTES=%d, want true and 64", c.LogFailedContent, c.LogFailedContentMaxBytes)
+	}
+}
+
+func TestHourWindow(t *testing.T) {
+	tests := []struct {
+		window string
+		in     []int
+		out    []int
+	}{
+		{"0-23", []int{0, 12, 23}, nil},
+		{" 6 - 22 ", []int{6, 12, 22}, []int{0, 5, 23}},
+		// Wraps past midnight
+		{"22-5", []int{22, 23, 0, 5}, []int{6, 12, 21}},
+	}
+	for _, tt := range tests {
+		w := parseHourWindow(tt.window)
+		for _, hour := range tt.in {
+			if !w.Contains(hour) {
+				t.Errorf("%s.Contains(%d) = false, want true", w, hour)
+			}
+		}
+		for _, hour := range tt.out {
+			if w.Contains(hour) {
+				t.Errorf("%s.Contains(%d) = true, want false", w, hour)
+			}
+		}
+	}
+	if w := parseHourWindow(""); w != nil {
+		t.Errorf("parseHourWindow(\"\") = %v, want nil (always)", w)
+	}
+}
+
+func TestParseNColumnIndex(t *testing.T) {
+	for val, want := range map[string]int{"": 1, "1": 1, " -1 ": NoNColumn, "2": 1, "n": 1} {
+		if got := parseNColumnIndex(val); got != want {
+			t.Errorf("parseNColumnIndex(%q) = %d, want %d", val, got, want)
+		}
+	}
+}
+
+func TestParseMissingValueSentinels(t *testing.T) {
+	got := parseMissingValueSentinels(" -9999; -99 ;;bad;NAN")
+	if len(got) != 3 || got[0] != -9999 || got[1] != -99 || !math.IsNaN(got[2]) {
+		t.Errorf("parseMissingValueSentinels() = %v, want [-9999 -99 NaN]", got)
+	}
+	if got := parseMissingValueSentinels(""); len(got) != 0 {
+		t.Errorf("parseMissingValueSentinels(\"\") = %v, want none", got)
+	}
+}
+
+func TestParseStationToBox(t *testing.T) {
+	got := parseStationToBox(" STA_A = BOXAAAAA ;STA_B=BOXBBBBB;;bad;=BOXC;STA_D=")
+	want := map[string]string{"STA_A": "BOXAAAAA", "STA_B": "BOXBBBBB"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseStationToBox() = %v, want %v", got, want)
+	}
+}
+
+func TestParseBoxTemplate(t *testing.T) {
+	if got := parseBoxTemplate("  "); len(got) != 0 {
+		t.Errorf("parseBoxTemplate(empty) = %v, want an empty template", got)
+	}
+	got := parseBoxTemplate(`{"name": "unnamed", "public": false, "tags": ["auto"]}`)
+	want := map[string]interface{}{"name": "unnamed", "public": false, "tags": []interface{}{"auto"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseBoxTemplate() = %v, want %v", got, want)
+	}
+}
+
+func TestParseDeviceIDAliases(t *testing.T) {
+	got := parseDeviceIDAliases(" CR300_19531 = CR300_00001 ;CR1000_7=CR1000X_7;;bad;=CR300_2;CR300_3=")
+	want := map[string]string{"CR300_19531": "CR300_00001", "CR1000_7": "CR1000X_7"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseDeviceIDAliases() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,75 @@
+package loader
+
+import (
+	"errors"
+
+	"cloud.google.com/go/storage"
+	"go.mongodb.org/mongo-driver/mongo"
+	"google.golang.org/api/googleapi"
+)
+
+// Failure classes of processing errors, stored in the failure tracking documents
+const (
+	// ErrorTypeParse - the file content can't be parsed (retrying won't help until the file is fixed)
+	ErrorTypeParse = "parse"
+	// ErrorTypeStorage - reading or writing GCS failed
+	ErrorTypeStorage = "storage"
+	// ErrorTypeMongo - a MongoDB operation failed
+	ErrorTypeMongo = "mongo"
+	// ErrorTypeOther - any other error
+	ErrorTypeOther = "other"
+)
+
+// ParseError marks errors caused by the content of a file
+type ParseError struct {
+	Err error
+}
+
+func (e *ParseError) Error() string { return e.Err.Error() }
+
+func (e *ParseError) Unwrap() error { return e.Err }
+
+// classifyError returns the failure class of a processing error
+// MongoDB and GCS errors are checked first: a storage failure while parsing is not a content problem
+func classifyError(err error) string {
+	var (
+		serverErr mongo.ServerError
+		apiErr    *googleapi.Error
+		parseErr  *ParseError
+	)
+	switch {
+	case errors.As(err, &serverErr), mongo.IsNetworkError(err), mongo.IsTimeout(err),
+		errors.Is(err, mongo.ErrClientDisconnected), errors.Is(err, ErrMongoNotConnected):
+		return ErrorTypeMongo
+	case errors.As(err, &apiErr), errors.Is(err, storage.ErrObjectNotExist), errors.Is(err, storage.ErrBucketNotExist):
+		return ErrorTypeStorage
+	case errors.As(err, &parseErr), errors.Is(err, ErrParseTimeout):
+		return ErrorTypeParse
+	}
+	return ErrorTypeOther
+}
+
+// isRetryableError checks if a processing error should be returned to the platform for a retry
+// (RETRY_ON_MONGO_ERROR): MongoDB and GCS failures may be transient, parse errors never are
+func isRetryableError(err error) bool {
+	if GlobalConfig == nil || !GlobalConfig.RetryOnMongoError {
+		return false
+	}
+	switch classifyError(err) {
+	case ErrorTypeMongo, ErrorTypeStorage:
+		return true
+	}
+	return false
+}
+
+// errorChain returns the messages of an error and of the errors it wraps, outermost first
+// Markers such as ParseError don't add a message of their own and are not repeated
+func errorChain(err error) []string {
+	var chain []string
+	for ; err != nil; err = errors.Unwrap(err) {
+		if msg := err.Error(); len(chain) == 0 || chain[len(chain)-1] != msg {
+			chain = append(chain, msg)
+		}
+	}
+	return chain
+}
@@ -0,0 +1,69 @@
+package loader
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"go.mongodb.org/mongo-driver/mongo"
+	"google.golang.org/api/googleapi"
+)
+
+func TestClassifyError(t *testing.T) {
+	parseErr := &ParseError{Err: errors.New("invalid meta line")}
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"parse", fmt.Errorf("file a.csv: %w", parseErr), ErrorTypeParse},
+		{"parse timeout", fmt.Errorf("file a.csv: %w", ErrParseTimeout), ErrorTypeParse},
+		{"gcs api", fmt.Errorf("failed to read: %w", &googleapi.Error{Code: 503}), ErrorTypeStorage},
+		{"gcs not found", fmt.Errorf("failed to read: %w", storage.ErrObjectNotExist), ErrorTypeStorage},
+		{"mongo server", fmt.Errorf("failed to insert: %w", mongo.CommandError{Code: 11600, Message: "interrupted"}), ErrorTypeMongo},
+		{"mongo not connected", ErrMongoNotConnected, ErrorTypeMongo},
+		// A storage failure while parsing is not a content problem
+		{"mongo inside parse", &ParseError{Err: mongo.ErrClientDisconnected}, ErrorTypeMongo},
+		{"other", errors.New("boom"), ErrorTypeOther},
+	}
+	for _, tt := range tests {
+		if got := classifyError(tt.err); got != tt.want {
+			t.Errorf("%s: classifyError() = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestErrorChain(t *testing.T) {
+	err := fmt.Errorf("file a.csv: %w", &ParseError{Err: fmt.Errorf("line 3: %w", errors.New("invalid timestamp"))})
+	want := []string{"file a.csv: line 3: invalid timestamp", "line 3: invalid timestamp", "invalid timestamp"}
+	if got := errorChain(err); !slices.Equal(got, want) {
+		t.Errorf("errorChain() = %q, want %q", got, want)
+	}
+	if got := errorChain(nil); got != nil {
+		t.Errorf("errorChain(nil) = %q, want nil", got)
+	}
+}
+
+func TestIsRetryableError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{fmt.Errorf("failed to insert: %w", ErrMongoNotConnected), true},
+		{fmt.Errorf("failed to read: %w", storage.ErrObjectNotExist), true},
+		{&ParseError{Err: errors.New("invalid meta line")}, false},
+		{errors.New("boom"), false},
+	}
+	for _, tt := range tests {
+		withConfig(t, func(c *Config) { c.RetryOnMongoError = true })
+		if got := isRetryableError(tt.err); got != tt.want {
+			t.Errorf("isRetryableError(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+		withConfig(t, func(c *Config) { c.RetryOnMongoError = false })
+		if isRetryableError(tt.err) {
+			t.Errorf("isRetryableError(%v) = true with RETRY_ON_MONGO_ERROR=false", tt.err)
+		}
+	}
+}
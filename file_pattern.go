@@ -1,9 +1,12 @@
 package loader
 
 import (
+	"context"
+	"fmt"
 	"os"
 	"regexp"
 	"strings"
+	"sync"
 )
 
 // FilePattern contains the regex patterns for file matching
@@ -16,19 +19,31 @@ type FilePattern struct {
 	// Multiple patterns can be separated by semicolons (;)
 	// If any pattern matches, the file is ignored
 	IgnorePatterns []*regexp.Regexp
+	// AgeCheckExemptPatterns are regex patterns for files that bypass the event age check (e.g. backfills)
+	// Multiple patterns can be separated by semicolons (;)
+	AgeCheckExemptPatterns []*regexp.Regexp
+	// ManifestPatterns are regex patterns for manifest objects listing the data files to process
+	// Multiple patterns can be separated by semicolons (;)
+	ManifestPatterns []*regexp.Regexp
 }
 
 // GlobalFilePattern holds the compiled patterns for file matching
 var GlobalFilePattern *FilePattern
 
+// noAllowPatternsOnce limits the "no ALLOW_PATTERNS" info message to once per instance
+var noAllowPatternsOnce sync.Once
+
 // InitFilePatterns initializes the global file patterns from environment variables
 // Should be called once at startup
-// Supports regex patterns: \.csv$, upload/.*\.csv, sensor_data_.*\.csv, etc.
+// Supports regex patterns: \.csv$, \.(csv|dat)$, upload/.*\.csv, sensor_data_.*\.csv, etc.
 // Multiple patterns can be separated by semicolons (;)
 func InitFilePatterns() {
 	GlobalFilePattern = &FilePattern{
 		AllowPatterns:  loadAllowPatterns(),
 		IgnorePatterns: loadIgnorePatterns(),
+
+		AgeCheckExemptPatterns: loadAgeCheckExemptPatterns(),
+		ManifestPatterns:       loadManifestPatterns(),
 	}
 }
 
@@ -98,6 +113,46 @@ func loadIgnorePatterns() []*regexp.Regexp {
 	return patterns
 }
 
+// loadAgeCheckExemptPatterns loads the regex patterns from AGE_CHECK_EXEMPT_PATTERNS env variable
+// Files matching any pattern are processed regardless of MAX_EVENT_AGE_SECONDS
+// Examples: "backfill/.*", "archive/2023/.*\.csv;history_.*\.csv"
+func loadAgeCheckExemptPatterns() []*regexp.Regexp {
+	patternStrs := parsePatternString(os.Getenv("AGE_CHECK_EXEMPT_PATTERNS"))
+	if len(patternStrs) == 0 {
+		return []*regexp.Regexp{}
+	}
+
+	// Compile and validate patterns
+	var patterns []*regexp.Regexp
+	for _, patternStr := range patternStrs {
+		compiled, err := regexp.Compile(patternStr)
+		if err != nil {
+			GlobalLogger.Fatalf("invalid AGE_CHECK_EXEMPT_PATTERNS regex: %q - %v", patternStr, err)
+		}
+		patterns = append(patterns, compiled)
+	}
+	GlobalLogger.Infof("Loaded %d AGE_CHECK_EXEMPT_PATTERN(s): %v", len(patterns), patternStrs)
+	return patterns
+}
+
+// loadManifestPatterns loads the regex patterns from MANIFEST_PATTERN env variable
+// Files matching any pattern are manifests: lists of data files processed in order (see ProcessManifest)
+// Examples: "manifests/.*\.txt$", "_MANIFEST$;\.manifest$"
+func loadManifestPatterns() []*regexp.Regexp {
+	patternStr := os.Getenv("MANIFEST_PATTERN")
+	patternStrs := parsePatternString(patternStr)
+	if len(patternStrs) == 0 {
+		return []*regexp.Regexp{}
+	}
+
+	patterns, err := compilePatterns(patternStr)
+	if err != nil {
+		GlobalLogger.Fatalf("invalid MANIFEST_PATTERN: %v", err)
+	}
+	GlobalLogger.Infof("Loaded %d MANIFEST_PATTERN(s): %v", len(patterns), patternStrs)
+	return patterns
+}
+
 // parsePatternString splits pattern string by semicolons and trims whitespace
 // Returns non-empty patterns
 func parsePatternString(patternStr string) []string {
@@ -125,30 +180,59 @@ func parsePatternString(patternStr string) []string {
 //   - Check IGNORE_PATTERNS first (if any pattern matches, skip immediately)
 //   - Check ALLOW_PATTERNS (if set, file must match at least one)
 func ShouldProcessFile(filename string) bool {
-	if GlobalFilePattern == nil || len(GlobalFilePattern.AllowPatterns) < 1 {
-		GlobalLogger.Infof("file %s: no ALLOW_PATTERNS, skipping", filename)
+	return GlobalFilePattern.ShouldProcess(filename)
+}
+
+// ShouldProcess checks if a file should be processed according to these patterns
+// See ShouldProcessFile for the rules
+func (fp *FilePattern) ShouldProcess(filename string) bool {
+	return fp.shouldProcess(context.Background(), filename)
+}
+
+// shouldProcess is ShouldProcess logging the skipped files with the logger of ctx
+func (fp *FilePattern) shouldProcess(ctx context.Context, filename string) bool {
+	logger := LoggerFrom(ctx)
+	if fp == nil || len(fp.AllowPatterns) < 1 {
+		// Intentionally disabled instances would flood the logs: log once, then per file at debug level
+		noAllowPatternsOnce.Do(func() {
+			GlobalLogger.Info("no ALLOW_PATTERNS, skipping all files (per-file messages are logged at debug level)")
+		})
+		logger.Debugf("file %s: no ALLOW_PATTERNS, skipping", filename)
 		return false // No patterns set, skip all files
 	}
 
 	// Check ignore patterns first (most restrictive)
-	if len(GlobalFilePattern.IgnorePatterns) > 0 {
-		for _, pattern := range GlobalFilePattern.IgnorePatterns {
+	if len(fp.IgnorePatterns) > 0 {
+		for _, pattern := range fp.IgnorePatterns {
 			if pattern.MatchString(filename) {
-				GlobalLogger.Infof("file %s: matched IGNORE_PATTERN %s, skipping", filename, pattern)
+				logger.Infof("file %s: matched IGNORE_PATTERN %s, skipping", filename, pattern)
 				return false
 			}
 		}
 	}
 
-	for _, pattern := range GlobalFilePattern.AllowPatterns {
+	for _, pattern := range fp.AllowPatterns {
 		if pattern.MatchString(filename) {
 			return true
 		}
 	}
-	GlobalLogger.Infof("file %s: does not match any ALLOW_PATTERN, skipping", filename)
+	logger.Infof("file %s: does not match any ALLOW_PATTERN, skipping", filename)
 	return false
 }
 
+// compilePatterns compiles the semicolon-separated regex patterns of a pattern string
+func compilePatterns(patternStr string) ([]*regexp.Regexp, error) {
+	var patterns []*regexp.Regexp
+	for _, p := range parsePatternString(patternStr) {
+		compiled, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex %q: %w", p, err)
+		}
+		patterns = append(patterns, compiled)
+	}
+	return patterns, nil
+}
+
 // MatchesPattern checks if a filename matches a specific regex pattern
 // Returns true if the pattern is empty (no pattern set) or matches
 // This is a utility function for testing compiled regex patterns
@@ -186,3 +270,30 @@ func MatchesIgnorePatterns(filename string) bool {
 	}
 	return false
 }
+
+// IsAgeCheckExempt checks if a file matches any of the age check exempt patterns
+// Returns true if the event age check should be bypassed for this file
+func IsAgeCheckExempt(filename string) bool {
+	if GlobalFilePattern == nil {
+		return false
+	}
+	for _, pattern := range GlobalFilePattern.AgeCheckExemptPatterns {
+		if pattern.MatchString(filename) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsManifestFile checks if a file matches any of the manifest patterns (MANIFEST_PATTERN)
+func IsManifestFile(filename string) bool {
+	if GlobalFilePattern == nil {
+		return false
+	}
+	for _, pattern := range GlobalFilePattern.ManifestPatterns {
+		if pattern.MatchString(filename) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,88 @@
+package loader
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// withFilePatterns replaces GlobalFilePattern for the duration of the test
+func withFilePatterns(t *testing.T, patterns *FilePattern) {
+	t.Helper()
+	previous := GlobalFilePattern
+	GlobalFilePattern = patterns
+	t.Cleanup(func() { GlobalFilePattern = previous })
+}
+
+// mustCompilePatterns compiles a semicolon-separated pattern string
+func mustCompilePatterns(t *testing.T, patternStr string) []*regexp.Regexp {
+	t.Helper()
+	patterns, err := compilePatterns(patternStr)
+	if err != nil {
+		t.Fatalf("compilePatterns(%q) error = %v", patternStr, err)
+	}
+	return patterns
+}
+
+func TestIsAgeCheckExempt(t *testing.T) {
+	t.Setenv("AGE_CHECK_EXEMPT_PATTERNS", `backfill/.*; history_.*\.csv`)
+	withFilePatterns(t, &FilePattern{AgeCheckExemptPatterns: loadAgeCheckExemptPatterns()})
+
+	tests := []struct {
+		filename string
+		want     bool
+	}{
+		{"backfill/CR300_19531_Table1.csv", true},
+		{"upload/history_2023.csv", true},
+		{"upload/CR300_19531_Table1.csv", false},
+	}
+	for _, tt := range tests {
+		if got := IsAgeCheckExempt(tt.filename); got != tt.want {
+			t.Errorf("IsAgeCheckExempt(%q) = %v, want %v", tt.filename, got, tt.want)
+		}
+	}
+
+	withFilePatterns(t, nil)
+	if IsAgeCheckExempt("backfill/CR300_19531_Table1.csv") {
+		t.Errorf("IsAgeCheckExempt() without patterns = true")
+	}
+}
+
+func TestShouldProcessNoAllowPatterns(t *testing.T) {
+	noAllowPatternsOnce = sync.Once{}
+	t.Cleanup(func() { noAllowPatternsOnce = sync.Once{} })
+	withFilePatterns(t, &FilePattern{})
+	logs := captureLogs(t)
+
+	for _, filename := range []string{"a.csv", "b.csv", "c.csv"} {
+		if ShouldProcessFile(filename) {
+			t.Errorf("ShouldProcessFile(%q) = true without ALLOW_PATTERNS", filename)
+		}
+	}
+	if got := strings.Count(logs.String(), "no ALLOW_PATTERNS"); got != 1 {
+		t.Errorf("\"no ALLOW_PATTERNS\" logged %d times at info level, want once:\n%s", got, logs)
+	}
+}
+
+func TestShouldProcessFile(t *testing.T) {
+	withFilePatterns(t, &FilePattern{
+		AllowPatterns:  mustCompilePatterns(t, `\.csv$;\.dat$`),
+		IgnorePatterns: mustCompilePatterns(t, `^debug/`),
+	})
+
+	tests := []struct {
+		filename string
+		want     bool
+	}{
+		{"upload/CR300_19531_Table1.csv", true},
+		{"upload/CR300_19531_Table1.dat", true},
+		{"debug/CR300_19531_Table1.csv", false},
+		{"upload/notes.txt", false},
+	}
+	for _, tt := range tests {
+		if got := ShouldProcessFile(tt.filename); got != tt.want {
+			t.Errorf("ShouldProcessFile(%q) = %v, want %v", tt.filename, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package loader
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+// sharedStorageClient is the GCS client shared by all events of the instance
+var (
+	sharedStorageClient   *storage.Client
+	sharedStorageClientMu sync.Mutex
+)
+
+// storageEmulatorHost returns the GCS emulator address (STORAGE_EMULATOR_HOST), "" for the real GCS
+func storageEmulatorHost() string {
+	return strings.TrimSpace(os.Getenv("STORAGE_EMULATOR_HOST"))
+}
+
+// storageClient returns the shared GCS client, creating it on first use
+// With STORAGE_EMULATOR_HOST set (e.g. "localhost:4443" for fake-gcs-server), the client library sends
+// every request (reads, copies to load_failed/, manifests, archives) to the emulator without credentials
+func storageClient() (*storage.Client, error) {
+	sharedStorageClientMu.Lock()
+	defer sharedStorageClientMu.Unlock()
+
+	if sharedStorageClient != nil {
+		return sharedStorageClient, nil
+	}
+	// Not bound to an event context: the client outlives the event that created it
+	client, err := storage.NewClient(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	if host := storageEmulatorHost(); host != "" {
+		GlobalLogger.Infof("Using the GCS emulator at %s (STORAGE_EMULATOR_HOST)", host)
+	}
+	sharedStorageClient = client
+	return client, nil
+}
+
+// closeStorageClient closes the shared GCS client, if created
+func closeStorageClient() error {
+	sharedStorageClientMu.Lock()
+	defer sharedStorageClientMu.Unlock()
+
+	if sharedStorageClient == nil {
+		return nil
+	}
+	err := sharedStorageClient.Close()
+	sharedStorageClient = nil
+	return err
+}
+
+// bucketHandle returns the handle for a GCS bucket
+// When GCS_BILLING_PROJECT is set, requests are billed to that project (requester-pays buckets),
+// except against the emulator which has no billing
+func bucketHandle(client *storage.Client, bucket string) *storage.BucketHandle {
+	handle := client.Bucket(bucket)
+	if GlobalConfig != nil && GlobalConfig.GCSBillingProject != "" && storageEmulatorHost() == "" {
+		handle = handle.UserProject(GlobalConfig.GCSBillingProject)
+	}
+	return handle
+}
+
+// objectGenerationKey is the context key of the GCS generation of the file being processed
+type objectGenerationKey struct{}
+
+// withObjectGeneration returns a context carrying the GCS generation of the file being processed
+// The generation is only carried when STORE_GENERATION is enabled
+func withObjectGeneration(ctx context.Context, generation int64) context.Context {
+	if GlobalConfig == nil || !GlobalConfig.StoreGeneration {
+		return ctx
+	}
+	return context.WithValue(ctx, objectGenerationKey{}, generation)
+}
+
+// applyGeneration adds the "gen" field holding the GCS generation of the source file, if carried by the context
+func applyGeneration(ctx context.Context, doc map[string]interface{}) {
+	if generation, ok := ctx.Value(objectGenerationKey{}).(int64); ok {
+		doc["gen"] = generation
+	}
+}
+
+// GCSManifest is the result manifest written to GCS for each processed file (WRITE_GCS_MANIFEST)
+type GCSManifest struct {
+	File        string `json:"file"`
+	Bucket      string `json:"bucket"`
+	FileType    string `json:"file_type"`
+	DeviceID    string `json:"device_id"`
+	Inserted    int64  `json:"inserted"`
+	Skipped     int64  `json:"skipped"`
+	ProcessedAt string `json:"processed_at"`
+}
+
+// manifestObjectName returns the name of the manifest object of a file: <GCS_MANIFEST_PREFIX><filename>.json
+func manifestObjectName(filename string) string {
+	return GlobalConfig.GCSManifestPrefix + filename + ".json"
+}
+
+// isResultManifestObject checks if a file is under GCS_MANIFEST_PREFIX (written by writeGCSManifest, never processed)
+func isResultManifestObject(filename string) bool {
+	return GlobalConfig != nil && GlobalConfig.WriteGCSManifest && strings.HasPrefix(filename, GlobalConfig.GCSManifestPrefix)
+}
+
+// writeGCSManifest writes the result manifest of a successfully processed file to its bucket
+// Does nothing unless WRITE_GCS_MANIFEST is enabled
+func writeGCSManifest(ctx context.Context, bucket string, filename string, result *ProcessResult) error {
+	if GlobalConfig == nil || !GlobalConfig.WriteGCSManifest {
+		return nil
+	}
+
+	manifest := GCSManifest{
+		File:        filename,
+		Bucket:      bucket,
+		FileType:    result.FileType,
+		DeviceID:    result.DeviceID,
+		Inserted:    result.Inserted,
+		Skipped:     result.Skipped,
+		ProcessedAt: nowFunc().UTC().Format(time.RFC3339),
+	}
+	content, err := json.Marshal(manifest)
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %w", err)
+	}
+
+	client, err := storageClient()
+	if err != nil {
+		return fmt.Errorf("failed to create GCS client: %w", err)
+	}
+
+	writer := bucketHandle(client, bucket).Object(manifestObjectName(filename)).NewWriter(ctx)
+	writer.ContentType = "application/json"
+	if _, err := writer.Write(content); err != nil {
+		writer.Close()
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("failed to close manifest: %w", err)
+	}
+	return nil
+}
+
+// openObject opens a GCS object for reading and returns its generation
+// On a permission error, the object is fetched over HTTP from a signed URL if SIGNED_URL_FALLBACK is enabled
+// (not against the emulator: signed URLs point to the real GCS)
+func openObject(ctx context.Context, bucketObj *storage.BucketHandle, filename string) (io.ReadCloser, int64, error) {
+	reader, err := bucketObj.Object(filename).NewReader(ctx)
+	if err == nil {
+		return reader, reader.Attrs.Generation, nil
+	}
+	if GlobalConfig == nil || !GlobalConfig.SignedURLFallback || storageEmulatorHost() != "" || !isPermissionError(err) {
+		return nil, 0, err
+	}
+
+	LoggerFrom(ctx).Warnf("file %s: direct read denied, falling back to signed URL: %v", filename, err)
+	url, err := signedURL(bucketObj, filename)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to sign URL: %w", err)
+	}
+	return fetchSignedURL(ctx, url)
+}
+
+// isPermissionError checks if a GCS error is an authorization failure (HTTP 401/403)
+func isPermissionError(err error) bool {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Code == http.StatusForbidden || apiErr.Code == http.StatusUnauthorized
+	}
+	return false
+}
+
+// signedURL returns a V4 signed GET URL of an object
+// Signed with the SIGNED_URL_PRIVATE_KEY_FILE key if set, else through the IAM signBlob API of SIGNED_URL_ACCESS_ID
+// (or of the detected service account if unset)
+func signedURL(bucketObj *storage.BucketHandle, filename string) (string, error) {
+	opts := &storage.SignedURLOptions{
+		Method:         http.MethodGet,
+		Scheme:         storage.SigningSchemeV4,
+		Expires:        time.Now().Add(time.Duration(GlobalConfig.SignedURLExpirySeconds) * time.Second),
+		GoogleAccessID: GlobalConfig.SignedURLAccessID,
+	}
+	if path := GlobalConfig.SignedURLPrivateKeyFile; path != "" {
+		key, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to read SIGNED_URL_PRIVATE_KEY_FILE %s: %w", path, err)
+		}
+		opts.PrivateKey = key
+	}
+	return bucketObj.SignedURL(filename, opts)
+}
+
+// fetchSignedURL downloads an object from a signed URL
+// The generation is read from the x-goog-generation response header (0 if absent)
+func fetchSignedURL(ctx context.Context, url string) (io.ReadCloser, int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("signed URL request failed: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, 0, fmt.Errorf("signed URL request failed: %s", resp.Status)
+	}
+	generation, _ := strconv.ParseInt(resp.Header.Get("x-goog-generation"), 10, 64)
+	return resp.Body, generation, nil
+}
+
+// isArchivedObject checks if a file is under ARCHIVE_PREFIX (written by archiveProcessedFile, never processed)
+func isArchivedObject(filename string) bool {
+	return GlobalConfig != nil && GlobalConfig.ArchiveProcessed && strings.HasPrefix(filename, GlobalConfig.ArchivePrefix)
+}
+
+// archiveProcessedFile moves a successfully processed file to <ARCHIVE_PREFIX><filename>
+// Does nothing unless ARCHIVE_PROCESSED is enabled
+// Must only be called once the records of the file are written: with micro-batching, ProcessFile
+// only succeeds after the flush of the file's records (see recordBatcher.wait)
+// The server-side copy completes before the source is deleted, so a crash leaves the file in both
+// places rather than in neither. Both steps are conditioned on the processed generation, so a newer
+// upload of the same name is neither archived nor deleted
+func archiveProcessedFile(ctx context.Context, bucket string, filename string, generation int64) error {
+	if GlobalConfig == nil || !GlobalConfig.ArchiveProcessed {
+		return nil
+	}
+
+	client, err := storageClient()
+	if err != nil {
+		return fmt.Errorf("failed to create GCS client: %w", err)
+	}
+	bucketObj := bucketHandle(client, bucket)
+	source := bucketObj.Object(filename)
+	if generation > 0 {
+		source = source.Generation(generation).If(storage.Conditions{GenerationMatch: generation})
+	}
+	archiveName := GlobalConfig.ArchivePrefix + filename
+
+	if _, err := bucketObj.Object(archiveName).CopierFrom(source).Run(ctx); err != nil {
+		return fmt.Errorf("failed to copy to %s: %w", archiveName, err)
+	}
+	if err := source.Delete(ctx); err != nil {
+		return fmt.Errorf("copied to %s but failed to delete the source: %w", archiveName, err)
+	}
+
+	LoggerFrom(ctx).Infof("file %s: archived to %s", filename, archiveName)
+	return nil
+}
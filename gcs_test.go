@@ -0,0 +1,814 @@
+package loader
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+)
+
+// fakeGCS is an in-memory GCS server implementing the JSON API calls made by the loader
+type fakeGCS struct {
+	*httptest.Server
+	mu          sync.Mutex
+	objects     map[string][]byte
+	generation  int64
+	generations map[string]int64
+	// contentTypes holds the content type of the objects that have one other than text/csv
+	contentTypes map[string]string
+	// times holds the creation and update times of the objects that have them, as RFC 3339 strings
+	times map[string][2]string
+	// failUploads is the number of next uploads failing with 503 Service Unavailable
+	failUploads int
+	// queries records the query string of each request, by "METHOD path"
+	queries map[string][]url.Values
+}
+
+// newFakeGCS starts a fake GCS server, closed when the test ends
+func newFakeGCS(t *testing.T) *fakeGCS {
+	t.Helper()
+	f := &fakeGCS{objects: make(map[string][]byte), generations: make(map[string]int64), contentTypes: make(map[string]string), times: make(map[string][2]string), queries: make(map[string][]url.Values)}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.handle))
+	t.Cleanup(f.Close)
+	return f
+}
+
+// useFakeGCS makes storageClient return a client of a new fake GCS server (STORAGE_EMULATOR_HOST)
+func useFakeGCS(t *testing.T) *fakeGCS {
+	t.Helper()
+	f := newFakeGCS(t)
+	t.Setenv("STORAGE_EMULATOR_HOST", strings.TrimPrefix(f.URL, "http://"))
+	if err := closeStorageClient(); err != nil {
+		t.Fatalf("closeStorageClient() error = %v", err)
+	}
+	t.Cleanup(func() { closeStorageClient() })
+	return f
+}
+
+// put stores an object as a new generation
+func (f *fakeGCS) put(bucket string, name string, content []byte) int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.generation++
+	f.objects[bucket+"/"+name] = content
+	f.generations[bucket+"/"+name] = f.generation
+	return f.generation
+}
+
+// get returns an object and whether it exists
+func (f *fakeGCS) get(bucket string, name string) ([]byte, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	content, exists := f.objects[bucket+"/"+name]
+	return content, exists
+}
+
+// requests returns the query strings of the requests received for "METHOD path" and forgets all requests
+func (f *fakeGCS) requests(key string) []url.Values {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	queries := f.queries[key]
+	f.queries = make(map[string][]url.Values)
+	return queries
+}
+
+// objectPath splits an escaped "/b/<bucket>/o/<object>" path suffix
+func objectPath(escaped string) (bucket string, name string) {
+	parts := strings.SplitN(escaped, "/", 4)
+	if len(parts) < 4 || parts[0] != "b" || parts[2] != "o" {
+		return "", ""
+	}
+	bucket, _ = url.PathUnescape(parts[1])
+	name, _ = url.PathUnescape(parts[3])
+	return bucket, name
+}
+
+func (f *fakeGCS) handle(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.EscapedPath()
+	f.mu.Lock()
+	f.queries[r.Method+" "+path] = append(f.queries[r.Method+" "+path], r.URL.Query())
+	f.mu.Unlock()
+
+	switch {
+	case r.Method == http.MethodPost && strings.HasPrefix(path, "/upload/storage/v1/b/") && f.takeUploadFailure():
+		http.Error(w, `{"error":{"code":503,"message":"Service Unavailable"}}`, http.StatusServiceUnavailable)
+	case r.Method == http.MethodPost && strings.HasPrefix(path, "/upload/storage/v1/b/"):
+		f.upload(w, r, strings.TrimPrefix(path, "/upload/storage/v1/b/"))
+	case r.Method == http.MethodPost && strings.Contains(path, "/rewriteTo/"):
+		source, destination, _ := strings.Cut(strings.TrimPrefix(path, "/storage/v1/"), "/rewriteTo/")
+		srcBucket, srcName := objectPath(source)
+		dstBucket, dstName := objectPath(destination)
+		content, exists := f.get(srcBucket, srcName)
+		if !exists {
+			http.Error(w, `{"error":{"code":404,"message":"Not Found"}}`, http.StatusNotFound)
+			return
+		}
+		if !f.generationMatches(srcBucket, srcName, r.URL.Query(), "sourceGeneration", "ifSourceGenerationMatch") {
+			http.Error(w, `{"error":{"code":412,"message":"Precondition Failed"}}`, http.StatusPreconditionFailed)
+			return
+		}
+		f.put(dstBucket, dstName, content)
+		resource := f.attrs(dstBucket, dstName, content)
+		json.NewEncoder(w).Encode(map[string]interface{}{"kind": "storage#rewriteResponse", "done": true, "resource": resource})
+	case strings.HasPrefix(path, "/storage/v1/b/") || strings.HasPrefix(path, "/download/storage/v1/b/"):
+		bucket, name := objectPath(strings.TrimPrefix(strings.TrimPrefix(path, "/download"), "/storage/v1/"))
+		f.object(w, r, bucket, name)
+	default:
+		// XML API reads: /<bucket>/<object>
+		bucket, escapedName, _ := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+		name, _ := url.PathUnescape(escapedName)
+		f.object(w, r, bucket, name)
+	}
+}
+
+// object serves the metadata, content or deletion of an object
+func (f *fakeGCS) object(w http.ResponseWriter, r *http.Request, bucket string, name string) {
+	content, exists := f.get(bucket, name)
+	if !exists {
+		http.Error(w, `{"error":{"code":404,"message":"Not Found"}}`, http.StatusNotFound)
+		return
+	}
+	switch {
+	case r.Method == http.MethodDelete && !f.generationMatches(bucket, name, r.URL.Query(), "generation", "ifGenerationMatch"):
+		http.Error(w, `{"error":{"code":412,"message":"Precondition Failed"}}`, http.StatusPreconditionFailed)
+	case r.Method == http.MethodDelete:
+		f.mu.Lock()
+		delete(f.objects, bucket+"/"+name)
+		delete(f.generations, bucket+"/"+name)
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	case r.URL.Query().Get("alt") == "json" || (strings.HasPrefix(r.URL.Path, "/storage/v1/") && r.URL.Query().Get("alt") != "media"):
+		json.NewEncoder(w).Encode(f.attrs(bucket, name, content))
+	default:
+		w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+		w.Header().Set("X-Goog-Generation", fmt.Sprint(f.generationOf(bucket, name)))
+		w.Write(content)
+	}
+}
+
+// upload stores an object sent with a multipart upload
+func (f *fakeGCS) upload(w http.ResponseWriter, r *http.Request, escapedBucket string) {
+	bucket, _ := url.PathUnescape(strings.TrimSuffix(escapedBucket, "/o"))
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	reader := multipart.NewReader(r.Body, params["boundary"])
+	var metadata struct {
+		Name        string `json:"name"`
+		ContentType string `json:"contentType"`
+	}
+	part, err := reader.NextPart()
+	if err == nil {
+		err = json.NewDecoder(part).Decode(&metadata)
+	}
+	if err == nil {
+		part, err = reader.NextPart()
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	content, _ := io.ReadAll(part)
+	f.put(bucket, metadata.Name, content)
+	if metadata.ContentType != "" {
+		f.setContentType(bucket, metadata.Name, metadata.ContentType)
+	}
+	json.NewEncoder(w).Encode(f.attrs(bucket, metadata.Name, content))
+}
+
+// takeUploadFailure reports whether the current upload must fail (see failUploads)
+func (f *fakeGCS) takeUploadFailure() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failUploads <= 0 {
+		return false
+	}
+	f.failUploads--
+	return true
+}
+
+// setContentType sets the content type of an object
+func (f *fakeGCS) setContentType(bucket string, name string, contentType string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.contentTypes[bucket+"/"+name] = contentType
+}
+
+// contentTypeOf returns the content type of an object (text/csv by default)
+func (f *fakeGCS) contentTypeOf(bucket string, name string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if contentType, exists := f.contentTypes[bucket+"/"+name]; exists {
+		return contentType
+	}
+	return "text/csv"
+}
+
+// setTimes sets the creation and update times of an object
+func (f *fakeGCS) setTimes(bucket string, name string, created time.Time, updated time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.times[bucket+"/"+name] = [2]string{created.Format(time.RFC3339Nano), updated.Format(time.RFC3339Nano)}
+}
+
+// generationOf returns the generation of an object (0 if it does not exist)
+func (f *fakeGCS) generationOf(bucket string, name string) int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.generations[bucket+"/"+name]
+}
+
+// generationMatches checks the generation query parameters of a request against the current generation of an object
+func (f *fakeGCS) generationMatches(bucket string, name string, query url.Values, keys ...string) bool {
+	current := fmt.Sprint(f.generationOf(bucket, name))
+	for _, key := range keys {
+		if v := query.Get(key); v != "" && v != current {
+			return false
+		}
+	}
+	return true
+}
+
+// attrs returns the JSON API resource of an object
+func (f *fakeGCS) attrs(bucket string, name string, content []byte) map[string]interface{} {
+	attrs := map[string]interface{}{
+		"kind":           "storage#object",
+		"bucket":         bucket,
+		"name":           name,
+		"size":           fmt.Sprint(len(content)),
+		"generation":     fmt.Sprint(f.generationOf(bucket, name)),
+		"metageneration": "1",
+		"contentType":    f.contentTypeOf(bucket, name),
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if times, exists := f.times[bucket+"/"+name]; exists {
+		attrs["timeCreated"], attrs["updated"] = times[0], times[1]
+	}
+	return attrs
+}
+
+func TestBucketHandleBillingProject(t *testing.T) {
+	f := newFakeGCS(t)
+	f.put("b", "upload/a.csv", []byte("content"))
+	t.Setenv("STORAGE_EMULATOR_HOST", "")
+	client, err := storage.NewClient(context.Background(), option.WithEndpoint(f.URL+"/storage/v1/"), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatalf("storage.NewClient() error = %v", err)
+	}
+	defer client.Close()
+
+	tests := []struct {
+		project string
+		want    string
+	}{
+		{"", ""},
+		{"billing-project", "billing-project"},
+	}
+	for _, tt := range tests {
+		withConfig(t, func(c *Config) { c.GCSBillingProject = tt.project })
+		if _, err := bucketHandle(client, "b").Object("upload/a.csv").Attrs(context.Background()); err != nil {
+			t.Fatalf("Attrs() error = %v", err)
+		}
+		queries := f.requests("GET /storage/v1/b/b/o/upload%2Fa.csv")
+		if len(queries) != 1 || queries[0].Get("userProject") != tt.want {
+			t.Errorf("GCS_BILLING_PROJECT=%q: requests %v, want userProject=%q", tt.project, queries, tt.want)
+		}
+	}
+
+	// The emulator has no billing
+	withConfig(t, func(c *Config) { c.GCSBillingProject = "billing-project" })
+	t.Setenv("STORAGE_EMULATOR_HOST", strings.TrimPrefix(f.URL, "http://"))
+	if _, err := bucketHandle(client, "b").Object("upload/a.csv").Attrs(context.Background()); err != nil {
+		t.Fatalf("Attrs() error = %v", err)
+	}
+	if queries := f.requests("GET /storage/v1/b/b/o/upload%2Fa.csv"); len(queries) != 1 || queries[0].Get("userProject") != "" {
+		t.Errorf("emulator: requests %v, want no userProject", queries)
+	}
+}
+
+func TestWriteGCSManifest(t *testing.T) {
+	f := useFakeGCS(t)
+	withNow(t, time.Date(2025, time.January, 2, 3, 4, 5, 0, time.UTC))
+	result := &ProcessResult{FileType: "csv", DeviceID: "CR300_19531", Inserted: 12, Skipped: 3}
+
+	withConfig(t, func(c *Config) { c.WriteGCSManifest = false })
+	if err := writeGCSManifest(context.Background(), "uploads", "upload/a.csv", result); err != nil {
+		t.Fatalf("writeGCSManifest() disabled: error = %v", err)
+	}
+	if _, exists := f.get("uploads", "processed/upload/a.csv.json"); exists {
+		t.Fatalf("manifest written with WRITE_GCS_MANIFEST=false")
+	}
+
+	withConfig(t, func(c *Config) { c.WriteGCSManifest, c.GCSManifestPrefix = true, "processed/" })
+	if err := writeGCSManifest(context.Background(), "uploads", "upload/a.csv", result); err != nil {
+		t.Fatalf("writeGCSManifest() error = %v", err)
+	}
+	content, exists := f.get("uploads", "processed/upload/a.csv.json")
+	if !exists {
+		t.Fatalf("manifest not written")
+	}
+	var manifest GCSManifest
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		t.Fatalf("invalid manifest %s: %v", content, err)
+	}
+	want := GCSManifest{File: "upload/a.csv", Bucket: "uploads", FileType: "csv", DeviceID: "CR300_19531", Inserted: 12, Skipped: 3, ProcessedAt: "2025-01-02T03:04:05Z"}
+	if manifest != want {
+		t.Errorf("manifest = %+v, want %+v", manifest, want)
+	}
+
+	// Manifests are never processed as data files
+	if !isResultManifestObject("processed/upload/a.csv.json") || isResultManifestObject("upload/a.csv") {
+		t.Errorf("isResultManifestObject() does not match the manifest prefix only")
+	}
+	withConfig(t, func(c *Config) { c.WriteGCSManifest = false })
+	if isResultManifestObject("processed/upload/a.csv.json") {
+		t.Errorf("isResultManifestObject() = true with WRITE_GCS_MANIFEST=false")
+	}
+}
+
+func TestHelloGCSSkipsResultManifests(t *testing.T) {
+	now := time.Date(2025, time.January, 2, 12, 0, 0, 0, time.UTC)
+	withNow(t, now)
+	withConfig(t, func(c *Config) { c.WriteGCSManifest, c.GCSManifestPrefix = true, "processed/" })
+	withFilePatterns(t, &FilePattern{AllowPatterns: mustCompilePatterns(t, `.*`)})
+	logs := captureLogs(t)
+	GlobalLogger.includeDebug = true
+	t.Cleanup(func() { GlobalLogger.includeDebug = false })
+
+	if err := helloGCS(context.Background(), newStorageEvent(t, StorageObjectData{Name: "processed/upload/a.csv.json", Bucket: "uploads"}, now)); err != nil {
+		t.Fatalf("helloGCS() error = %v", err)
+	}
+	if !strings.Contains(logs.String(), "result manifest, skipping") {
+		t.Errorf("result manifest not skipped:\n%s", logs)
+	}
+}
+
+func TestProcessFileGeneration(t *testing.T) {
+	f := useFakeGCS(t)
+	f.put("uploads", "upload/CR300_19531_Table1.csv", []byte("previous version"))
+	generation := f.put("uploads", "upload/CR300_19531_Table1.csv", toa5CSV(`"TIMESTAMP","RECORD","water"`, `"2025-01-02 03:04:05",1,1.5`))
+
+	withConfig(t, func(c *Config) { c.StoreGeneration = true })
+	result, err := ProcessFile(context.Background(), "uploads", "upload/CR300_19531_Table1.csv")
+	if !errors.Is(err, ErrMongoNotConnected) {
+		t.Errorf("ProcessFile() error = %v, want ErrMongoNotConnected", err)
+	}
+	if result.Generation != generation || generation < 2 {
+		t.Errorf("result generation = %d, want %d", result.Generation, generation)
+	}
+
+	// Records and KV documents carry the generation only with STORE_GENERATION
+	box := KVBox{ID: "RIENVHK4", Metrics: []Metric{{Code: "DR1", Name: "drain_1"}}}
+	for _, store := range []bool{true, false} {
+		withConfig(t, func(c *Config) { c.StoreGeneration = store })
+		ctx := withObjectGeneration(context.Background(), generation)
+
+		record := map[string]interface{}{"_id": int64(1735761845)}
+		applyGeneration(ctx, record)
+		doc := (&KVFormat{Name: "lake"}).kvTargets(ctx, box, 1735787040, 1735787100, map[string]float64{"drain_1": 3})[0].Doc
+		for name, fields := range map[string]map[string]interface{}{"record": record, "KV document": doc} {
+			gen, exists := fields["gen"]
+			if exists != store || (store && gen != generation) {
+				t.Errorf("STORE_GENERATION=%v: %s gen = %v (set: %v)", store, name, gen, exists)
+			}
+		}
+	}
+}
+
+func TestCopyToFailedFolderRetries(t *testing.T) {
+	f := useFakeGCS(t)
+	content := []byte("unparseable content")
+	f.put("uploads", "upload/a.csv", content)
+	logs := captureLogs(t)
+
+	// A failed copy is retried
+	withConfig(t, func(c *Config) { c.FailedCopyRetries = 1 })
+	f.failUploads = 1
+	if err := copyToFailedFolder(context.Background(), "uploads", "upload/a.csv"); err != nil {
+		t.Fatalf("copyToFailedFolder() error = %v", err)
+	}
+	if copied, _ := f.get("uploads", "load_failed/upload/a.csv"); string(copied) != string(content) {
+		t.Errorf("load_failed copy = %q, want %q", copied, content)
+	}
+	if !strings.Contains(logs.String(), "(attempt 1/2)") {
+		t.Errorf("failed attempt not logged:\n%s", logs)
+	}
+
+	// Once the retries are exhausted, the lost copy is logged with the file size
+	logs.Reset()
+	withConfig(t, func(c *Config) { c.FailedCopyRetries = 0 })
+	f.failUploads = 1
+	if err := copyToFailedFolder(context.Background(), "uploads", "upload/b.csv"); err == nil {
+		t.Errorf("copyToFailedFolder() of a missing file: no error")
+	}
+	f.put("uploads", "upload/c.csv", content)
+	if err := copyToFailedFolder(context.Background(), "uploads", "upload/c.csv"); err == nil {
+		t.Fatalf("copyToFailedFolder() with a failing upload and no retries: no error")
+	}
+	if !strings.Contains(logs.String(), fmt.Sprintf("lost after 1 attempt(s) (bucket: uploads, size: %d bytes)", len(content))) {
+		t.Errorf("lost copy not logged with its size:\n%s", logs)
+	}
+}
+
+func TestProcessFileContentType(t *testing.T) {
+	f := useFakeGCS(t)
+	content := toa5CSV(`"TIMESTAMP","RECORD","water"`, `"2025-01-02 03:04:05",1,1.5`)
+	f.put("uploads", "upload/a.csv", content)
+	f.setContentType("uploads", "upload/a.csv", "text/csv; charset=utf-8")
+	f.put("uploads", "upload/b.csv", []byte{0x89, 'P', 'N', 'G'})
+	f.setContentType("uploads", "upload/b.csv", "image/png")
+
+	// Allowed: downloaded and parsed (failing without MongoDB)
+	t.Setenv("ALLOWED_CONTENT_TYPES", "Text/CSV;text/plain")
+	withConfig(t, func(c *Config) { c.AllowedContentTypes = parseListEnv("ALLOWED_CONTENT_TYPES") })
+	if _, err := ProcessFile(context.Background(), "uploads", "upload/a.csv"); !errors.Is(err, ErrMongoNotConnected) {
+		t.Errorf("allowed content type: ProcessFile() error = %v, want ErrMongoNotConnected", err)
+	}
+
+	// Disallowed: skipped before the download
+	logs := captureLogs(t)
+	f.requests("")
+	result, err := ProcessFile(context.Background(), "uploads", "upload/b.csv")
+	if err != nil || result.Inserted != 0 {
+		t.Errorf("disallowed content type: ProcessFile() = %+v, %v, want skipped", result, err)
+	}
+	if !strings.Contains(logs.String(), `content type "image/png" not in ALLOWED_CONTENT_TYPES`) {
+		t.Errorf("skip not logged:\n%s", logs)
+	}
+	if downloads := f.requests("GET /uploads/upload%2Fb.csv"); len(downloads) != 0 {
+		t.Errorf("disallowed file downloaded")
+	}
+
+	// Without ALLOWED_CONTENT_TYPES, any content type is processed
+	withConfig(t, func(c *Config) { c.AllowedContentTypes = nil })
+	if _, err := ProcessFile(context.Background(), "uploads", "upload/b.csv"); err == nil {
+		t.Errorf("ProcessFile() of a binary file without ALLOWED_CONTENT_TYPES: no parse error")
+	}
+}
+
+func TestHelloGCSCopyFailed(t *testing.T) {
+	now := time.Date(2025, time.January, 2, 12, 0, 0, 0, time.UTC)
+	withNow(t, now)
+	withFilePatterns(t, &FilePattern{AllowPatterns: mustCompilePatterns(t, `\.csv$`)})
+	f := useFakeGCS(t)
+	content := []byte("not a TOA5 file")
+
+	for _, copyFailed := range []bool{true, false} {
+		withConfig(t, func(c *Config) { c.CopyFailed = copyFailed })
+		name := fmt.Sprintf("upload/copy_%v.csv", copyFailed)
+		f.put("uploads", name, content)
+		logs := captureLogs(t)
+		if err := helloGCS(context.Background(), newStorageEvent(t, StorageObjectData{Name: name, Bucket: "uploads"}, now)); err != nil {
+			t.Fatalf("COPY_FAILED=%v: helloGCS() error = %v", copyFailed, err)
+		}
+		if !strings.Contains(logs.String(), "file processing error") {
+			t.Fatalf("COPY_FAILED=%v: file did not fail:\n%s", copyFailed, logs)
+		}
+		_, copied := f.get("uploads", "load_failed/"+name)
+		if copied != copyFailed {
+			t.Errorf("COPY_FAILED=%v: load_failed copy exists = %v", copyFailed, copied)
+		}
+	}
+}
+
+func TestHelloGCSProcessHours(t *testing.T) {
+	// 23:30 in TIMEZONE_OFFSET
+	now := time.Date(2025, time.January, 2, 23, 30, 0, 0, GlobalConfig.TimezoneLocation)
+	withNow(t, now)
+	withFilePatterns(t, &FilePattern{AllowPatterns: mustCompilePatterns(t, `\.csv$`)})
+	f := useFakeGCS(t)
+	f.put("uploads", "upload/a.csv", []byte("not a TOA5 file"))
+	event := newStorageEvent(t, StorageObjectData{Name: "upload/a.csv", Bucket: "uploads"}, now)
+
+	tests := []struct {
+		window, mode string
+		wantErr      bool
+		wantLog      string
+	}{
+		{"6-22", ProcessHoursModeDefer, true, "outside PROCESS_HOURS 6-22, deferring"},
+		{"6-22", ProcessHoursModeSkip, false, "outside PROCESS_HOURS 6-22, skipping"},
+		{"22-5", ProcessHoursModeDefer, false, "file processing error"},
+	}
+	for _, tt := range tests {
+		withConfig(t, func(c *Config) {
+			c.ProcessHours = parseHourWindow(tt.window)
+			c.ProcessHoursMode = tt.mode
+			c.CopyFailed = false
+		})
+		logs := captureLogs(t)
+		if err := helloGCS(context.Background(), event); (err != nil) != tt.wantErr {
+			t.Errorf("PROCESS_HOURS=%s (%s): helloGCS() error = %v, wantErr %v", tt.window, tt.mode, err, tt.wantErr)
+		}
+		if !strings.Contains(logs.String(), tt.wantLog) {
+			t.Errorf("PROCESS_HOURS=%s (%s): logs lack %q:\n%s", tt.window, tt.mode, tt.wantLog, logs)
+		}
+	}
+}
+
+func TestIsPermissionError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&googleapi.Error{Code: http.StatusForbidden}, true},
+		{fmt.Errorf("open: %w", &googleapi.Error{Code: http.StatusUnauthorized}), true},
+		{&googleapi.Error{Code: http.StatusNotFound}, false},
+		{storage.ErrObjectNotExist, false},
+		{errors.New("connection reset"), false},
+	}
+	for _, tt := range tests {
+		if got := isPermissionError(tt.err); got != tt.want {
+			t.Errorf("isPermissionError(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestFetchSignedURL(t *testing.T) {
+	content := toa5CSV(`"TIMESTAMP","RECORD","water"`, `"2025-01-02 03:04:05",1,1.5`)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/uploads/upload/a.csv" || r.URL.Query().Get("X-Goog-Signature") != "sig" {
+			http.Error(w, "AccessDenied", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("x-goog-generation", "1735787040123456")
+		w.Write(content)
+	}))
+	defer server.Close()
+
+	reader, generation, err := fetchSignedURL(context.Background(), server.URL+"/uploads/upload/a.csv?X-Goog-Signature=sig")
+	if err != nil {
+		t.Fatalf("fetchSignedURL() error = %v", err)
+	}
+	defer reader.Close()
+	if got, _ := io.ReadAll(reader); string(got) != string(content) || generation != 1735787040123456 {
+		t.Errorf("fetchSignedURL() = %q, generation %d, want the content and generation 1735787040123456", got, generation)
+	}
+
+	if _, _, err := fetchSignedURL(context.Background(), server.URL+"/uploads/upload/a.csv?X-Goog-Signature=expired"); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("denied signed URL: fetchSignedURL() error = %v, want 403", err)
+	}
+}
+
+func TestSignedURLPrivateKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "key.pem")
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := os.WriteFile(keyFile, keyPEM, 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	withConfig(t, func(c *Config) {
+		c.SignedURLAccessID = "loader@project.iam.gserviceaccount.com"
+		c.SignedURLPrivateKeyFile = keyFile
+		c.SignedURLExpirySeconds = 300
+	})
+	client, err := storage.NewClient(context.Background(), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatalf("storage.NewClient() error = %v", err)
+	}
+	defer client.Close()
+
+	signed, err := signedURL(client.Bucket("uploads"), "upload/a.csv")
+	if err != nil {
+		t.Fatalf("signedURL() error = %v", err)
+	}
+	u, err := url.Parse(signed)
+	if err != nil {
+		t.Fatalf("url.Parse(%s) error = %v", signed, err)
+	}
+	query := u.Query()
+	// The expiry is measured from the signing time: a second may have elapsed
+	if expires := query.Get("X-Goog-Expires"); expires != "300" && expires != "299" {
+		t.Errorf("signedURL() expires in %s seconds, want SIGNED_URL_EXPIRY_SECONDS (300)", expires)
+	}
+	if !strings.HasSuffix(u.Path, "/uploads/upload/a.csv") || query.Get("X-Goog-Signature") == "" ||
+		!strings.HasPrefix(query.Get("X-Goog-Credential"), "loader@project.iam.gserviceaccount.com/") {
+		t.Errorf("signedURL() = %s, want a V4 URL of uploads/upload/a.csv signed by SIGNED_URL_ACCESS_ID", signed)
+	}
+
+	withConfig(t, func(c *Config) { c.SignedURLPrivateKeyFile = filepath.Join(t.TempDir(), "missing.pem") })
+	if _, err := signedURL(client.Bucket("uploads"), "upload/a.csv"); err == nil || !strings.Contains(err.Error(), "SIGNED_URL_PRIVATE_KEY_FILE") {
+		t.Errorf("missing key file: signedURL() error = %v", err)
+	}
+}
+
+func TestArchiveProcessedFile(t *testing.T) {
+	f := useFakeGCS(t)
+	content := []byte("processed content")
+	generation := f.put("uploads", "upload/a.csv", content)
+
+	// Disabled: the file stays in place
+	withConfig(t, func(c *Config) { c.ArchiveProcessed = false })
+	if err := archiveProcessedFile(context.Background(), "uploads", "upload/a.csv", generation); err != nil {
+		t.Fatalf("disabled: archiveProcessedFile() error = %v", err)
+	}
+	if _, exists := f.get("uploads", "upload/a.csv"); !exists {
+		t.Fatal("disabled: source moved")
+	}
+
+	withConfig(t, func(c *Config) {
+		c.ArchiveProcessed = true
+		c.ArchivePrefix = "archive/"
+	})
+	if err := archiveProcessedFile(context.Background(), "uploads", "upload/a.csv", generation); err != nil {
+		t.Fatalf("archiveProcessedFile() error = %v", err)
+	}
+	if archived, _ := f.get("uploads", "archive/upload/a.csv"); string(archived) != string(content) {
+		t.Errorf("archive/upload/a.csv = %q, want %q", archived, content)
+	}
+	if _, exists := f.get("uploads", "upload/a.csv"); exists {
+		t.Error("source not deleted after the copy")
+	}
+	if !isArchivedObject("archive/upload/a.csv") || isArchivedObject("upload/a.csv") {
+		t.Error("isArchivedObject() does not match ARCHIVE_PREFIX")
+	}
+
+	// A newer upload of the same name is neither archived nor deleted
+	processed := f.put("uploads", "upload/b.csv", []byte("old"))
+	f.put("uploads", "upload/b.csv", []byte("new"))
+	if err := archiveProcessedFile(context.Background(), "uploads", "upload/b.csv", processed); err == nil {
+		t.Error("newer generation: archiveProcessedFile() error = nil")
+	}
+	if current, _ := f.get("uploads", "upload/b.csv"); string(current) != "new" {
+		t.Errorf("newer generation: source = %q, want it kept", current)
+	}
+	if _, exists := f.get("uploads", "archive/upload/b.csv"); exists {
+		t.Error("newer generation archived")
+	}
+}
+
+func TestHelloGCSMaxLineBytes(t *testing.T) {
+	now := time.Date(2025, time.January, 2, 12, 0, 0, 0, time.UTC)
+	withNow(t, now)
+	withFilePatterns(t, &FilePattern{AllowPatterns: mustCompilePatterns(t, `\.csv$`)})
+	withConfig(t, func(c *Config) {
+		c.MaxLineBytes = 1024
+		c.CopyFailed = true
+	})
+	f := useFakeGCS(t)
+	content := bytes.Repeat([]byte("x"), 4096)
+	f.put("uploads", "upload/blob.csv", content)
+	logs := captureLogs(t)
+
+	if err := helloGCS(context.Background(), newStorageEvent(t, StorageObjectData{Name: "upload/blob.csv", Bucket: "uploads"}, now)); err != nil {
+		t.Fatalf("helloGCS() error = %v", err)
+	}
+	if !strings.Contains(logs.String(), "exceeding MAX_LINE_BYTES (1024)") {
+		t.Errorf("oversized line not logged:\n%s", logs)
+	}
+	if copied, _ := f.get("uploads", "load_failed/upload/blob.csv"); len(copied) != len(content) {
+		t.Error("file with an oversized line not copied to load_failed/")
+	}
+}
+
+func TestEventAgeTime(t *testing.T) {
+	f := useFakeGCS(t)
+	withEventAge(t, 3600, 0)
+	eventTime := time.Date(2025, time.January, 2, 12, 0, 0, 0, time.UTC)
+	created, updated := eventTime.Add(-48*time.Hour), eventTime.Add(-time.Hour)
+	f.put("uploads", "upload/a.csv", []byte("content"))
+	f.setTimes("uploads", "upload/a.csv", created, updated)
+
+	// The payload timestamps are only used when the object attributes can't be read
+	payloadUpdated := eventTime.Add(-2 * time.Hour)
+	tests := []struct {
+		source string
+		name   string
+		want   time.Time
+	}{
+		{AgeSourceEvent, "upload/a.csv", eventTime},
+		{AgeSourceObjectUpdated, "upload/a.csv", updated},
+		{AgeSourceObjectCreated, "upload/a.csv", created},
+		{AgeSourceObjectUpdated, "upload/missing.csv", payloadUpdated},
+	}
+	for _, tt := range tests {
+		withConfig(t, func(c *Config) { c.AgeSource = tt.source })
+		event := newStorageEvent(t, StorageObjectData{Name: tt.name, Bucket: "uploads", Updated: payloadUpdated.Format(time.RFC3339)}, eventTime)
+		if got := eventAgeTime(context.Background(), event); !got.Equal(tt.want) {
+			t.Errorf("AGE_SOURCE=%s, %s: eventAgeTime() = %v, want %v", tt.source, tt.name, got, tt.want)
+		}
+	}
+
+	// Age checking disabled: the object is not read
+	withEventAge(t, 0, 0)
+	f.requests("")
+	event := newStorageEvent(t, StorageObjectData{Name: "upload/a.csv", Bucket: "uploads"}, eventTime)
+	if got := eventAgeTime(context.Background(), event); !got.Equal(eventTime) || len(f.queries) != 0 {
+		t.Errorf("MAX_EVENT_AGE_SECONDS=0: eventAgeTime() = %v after %d requests, want the event time", got, len(f.queries))
+	}
+}
+
+func TestStorageEmulatorHost(t *testing.T) {
+	t.Setenv("STORAGE_EMULATOR_HOST", " localhost:4443 ")
+	if got := storageEmulatorHost(); got != "localhost:4443" {
+		t.Errorf("storageEmulatorHost() = %q, want localhost:4443", got)
+	}
+	t.Setenv("STORAGE_EMULATOR_HOST", "")
+	if got := storageEmulatorHost(); got != "" {
+		t.Errorf("storageEmulatorHost() = %q without emulator, want empty", got)
+	}
+}
+
+// TestStorageEmulatorIntegration runs against an external GCS emulator (e.g. fake-gcs-server)
+// and is skipped unless STORAGE_EMULATOR_HOST is set
+func TestStorageEmulatorIntegration(t *testing.T) {
+	if storageEmulatorHost() == "" {
+		t.Skip("STORAGE_EMULATOR_HOST not set")
+	}
+	if err := closeStorageClient(); err != nil {
+		t.Fatalf("closeStorageClient() error = %v", err)
+	}
+	t.Cleanup(func() { closeStorageClient() })
+	ctx := context.Background()
+	client, err := storageClient()
+	if err != nil {
+		t.Fatalf("storageClient() error = %v", err)
+	}
+
+	bucket := fmt.Sprintf("loader-test-%d", time.Now().UnixNano())
+	if err := client.Bucket(bucket).Create(ctx, "test-project", nil); err != nil {
+		t.Fatalf("failed to create bucket %s: %v", bucket, err)
+	}
+	w := client.Bucket(bucket).Object("upload/a.csv").NewWriter(ctx)
+	if _, err := w.Write([]byte("not a TOA5 file")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("failed to upload: %v", err)
+	}
+
+	var parseErr *ParseError
+	if _, err := ProcessFile(ctx, bucket, "upload/a.csv"); !errors.As(err, &parseErr) {
+		t.Errorf("ProcessFile() error = %v, want a ParseError", err)
+	}
+	if err := copyToFailedFolder(ctx, bucket, "upload/a.csv"); err != nil {
+		t.Fatalf("copyToFailedFolder() error = %v", err)
+	}
+	reader, err := client.Bucket(bucket).Object("load_failed/upload/a.csv").NewReader(ctx)
+	if err != nil {
+		t.Fatalf("load_failed/ copy not found: %v", err)
+	}
+	defer reader.Close()
+	if got, _ := io.ReadAll(reader); string(got) != "not a TOA5 file" {
+		t.Errorf("load_failed/ copy = %q", got)
+	}
+}
+
+func TestHelloGCSRetryOnMongoError(t *testing.T) {
+	now := time.Date(2025, time.January, 2, 12, 0, 0, 0, time.UTC)
+	withNow(t, now)
+	withFilePatterns(t, &FilePattern{AllowPatterns: mustCompilePatterns(t, `\.csv$`)})
+	f := useFakeGCS(t)
+	// MongoDB is not initialized in unit tests: storing the records fails with a MongoDB error
+	f.put("uploads", "upload/valid.csv", toa5CSV(`"TIMESTAMP","RECORD","water"`, `"2025-01-02 03:04:05",1,1.5`))
+	f.put("uploads", "upload/invalid.csv", []byte("not a TOA5 file"))
+
+	tests := []struct {
+		file    string
+		class   string
+		wantErr bool
+	}{
+		{"upload/valid.csv", ErrorTypeMongo, true},
+		{"upload/missing.csv", ErrorTypeStorage, true},
+		{"upload/invalid.csv", ErrorTypeParse, false},
+	}
+	for _, tt := range tests {
+		for _, retry := range []bool{true, false} {
+			withConfig(t, func(c *Config) {
+				c.RetryOnMongoError = retry
+				c.CopyFailed = false
+				c.QuarantineThreshold = 0
+			})
+			err := helloGCS(context.Background(), newStorageEvent(t, StorageObjectData{Name: tt.file, Bucket: "uploads"}, now))
+			if want := retry && tt.wantErr; (err != nil) != want {
+				t.Errorf("%s error, RETRY_ON_MONGO_ERROR=%v: helloGCS() error = %v, want error %v", tt.class, retry, err, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package loader
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strings"
+)
+
+// gzipMagic is the header of gzip streams
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// isGzipContent checks if content is a gzip stream
+// GCS objects stored with Content-Encoding: gzip are decompressed by the reader and never match
+func isGzipContent(content []byte) bool {
+	return bytes.HasPrefix(content, gzipMagic)
+}
+
+// gunzip decompresses gzip content
+func gunzip(content []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return io.ReadAll(zr)
+}
+
+// trimGzipSuffix removes a ".gz" extension from a filename (case-insensitive)
+// e.g. "HoAmChua_TramTT/20251129190000.txt.gz" -> "HoAmChua_TramTT/20251129190000.txt"
+func trimGzipSuffix(filename string) string {
+	if strings.HasSuffix(strings.ToLower(filename), ".gz") {
+		return filename[:len(filename)-len(".gz")]
+	}
+	return filename
+}
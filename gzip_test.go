@@ -0,0 +1,100 @@
+package loader
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// gzipped compresses content
+func gzipped(t testing.TB, content []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(content); err != nil {
+		t.Fatalf("gzip Write() error = %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("gzip Close() error = %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestTrimGzipSuffix(t *testing.T) {
+	tests := map[string]string{
+		"HoAmChua_TramTT/20251129190000.txt.gz": "HoAmChua_TramTT/20251129190000.txt",
+		"upload/a.CSV.GZ":                       "upload/a.CSV",
+		"upload/a.csv":                          "upload/a.csv",
+		"upload/gz":                             "upload/gz",
+	}
+	for filename, want := range tests {
+		if got := trimGzipSuffix(filename); got != want {
+			t.Errorf("trimGzipSuffix(%q) = %q, want %q", filename, got, want)
+		}
+	}
+}
+
+func TestProcessReaderGzipCSV(t *testing.T) {
+	content := toa5CSV(`"TIMESTAMP","RECORD","water"`, `"2025-01-02 03:04:05",1,1.5`)
+	result, err := ProcessReader(context.Background(), "upload/CR300_19531_Table1.csv.gz", bytes.NewReader(gzipped(t, content)))
+	if !errors.Is(err, ErrMongoNotConnected) || result.DeviceID != "CR300_19531" {
+		t.Errorf("ProcessReader() = %+v, %v, want device CR300_19531 and ErrMongoNotConnected", result, err)
+	}
+
+	// Corrupt gzip content is a parse error
+	corrupt := gzipped(t, content)[:20]
+	var parseErr *ParseError
+	if _, err := ProcessReader(context.Background(), "upload/a.csv.gz", bytes.NewReader(corrupt)); !errors.As(err, &parseErr) {
+		t.Errorf("ProcessReader(corrupt) error = %v, want a ParseError", err)
+	}
+}
+
+func TestProcessReaderGzipKV(t *testing.T) {
+	tests := []struct {
+		name     string
+		filename string
+		content  string
+		fileType string
+		boxes    int
+		want     int64
+	}{
+		{
+			"AmChua", "HoAmChua_TramTT/20251129190000.txt.gz", "rain_1 1.5\nwaterup 12.25\n",
+			FileTypeAmChua, len(AmChuaBoxes), time.Date(2025, time.November, 29, 19, 0, 0, 0, GlobalConfig.TimezoneLocation).Unix(),
+		},
+		{
+			"Baria", "HoSongRay_KenhSongRay/MNK_SongRay_20251227200009.txt.gz", "MNK_SongRay\t12.5\nDomocong\t1\n",
+			FileTypeBaria, 1, time.Date(2025, time.December, 27, 20, 0, 0, 0, GlobalConfig.TimezoneLocation).Unix(),
+		},
+	}
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			withMockMongo(mt)
+			for i := 0; i < tt.boxes; i++ {
+				mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}))
+			}
+
+			result, err := ProcessReader(context.Background(), tt.filename, bytes.NewReader(gzipped(mt, []byte(tt.content))))
+			if err != nil || result.FileType != tt.fileType || result.Inserted != int64(tt.boxes) {
+				mt.Fatalf("ProcessReader() = %+v, %v, want %d %s documents", result, err, tt.boxes, tt.fileType)
+			}
+			// The timestamp is parsed from the name without ".gz"
+			docs := insertedDocuments(mt)
+			if len(docs) != tt.boxes {
+				mt.Fatalf("inserted %d documents, want %d", len(docs), tt.boxes)
+			}
+			for _, doc := range docs {
+				if got := doc.Lookup("_id").Int64(); got != tt.want {
+					mt.Errorf("inserted _id = %d, want %d", got, tt.want)
+				}
+			}
+		})
+	}
+}
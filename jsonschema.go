@@ -0,0 +1,205 @@
+package loader
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// JSONSchema is the subset of JSON Schema used to validate NDJSON readings:
+// type, required, properties, additionalProperties (boolean), enum, minimum and maximum
+type JSONSchema struct {
+	Type                 interface{}            `json:"type"`
+	Required             []string               `json:"required"`
+	Properties           map[string]*JSONSchema `json:"properties"`
+	AdditionalProperties *bool                  `json:"additionalProperties"`
+	Enum                 []interface{}          `json:"enum"`
+	Minimum              *float64               `json:"minimum"`
+	Maximum              *float64               `json:"maximum"`
+}
+
+// jsonReadingSchema is the schema NDJSON readings must conform to (nil = no validation)
+var jsonReadingSchema *JSONSchema
+
+// InitJSONSchema loads the NDJSON reading schema
+// Environment variables:
+//
+//	JSON_SCHEMA_FILE - path of a JSON Schema file validating each NDJSON reading before mapping (default: no validation)
+func InitJSONSchema() {
+	path := os.Getenv("JSON_SCHEMA_FILE")
+	if path == "" {
+		return
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		GlobalLogger.Fatalf("failed to read JSON_SCHEMA_FILE %s: %v", path, err)
+	}
+	schema, err := ParseJSONSchema(data)
+	if err != nil {
+		GlobalLogger.Fatalf("invalid JSON schema in %s: %v", path, err)
+	}
+	jsonReadingSchema = schema
+	GlobalLogger.Infof("NDJSON readings are validated against %s", path)
+}
+
+// ParseJSONSchema parses a JSON Schema document
+func ParseJSONSchema(data []byte) (*JSONSchema, error) {
+	var schema JSONSchema
+	if err := json.Unmarshal(data, &schema); err != nil {
+		return nil, err
+	}
+	if err := schema.check(); err != nil {
+		return nil, err
+	}
+	return &schema, nil
+}
+
+// check rejects type keywords of the wrong shape, so errors surface at startup rather than per file
+func (s *JSONSchema) check() error {
+	for _, t := range s.types() {
+		if !slices.Contains([]string{"object", "array", "string", "number", "integer", "boolean", "null"}, t) {
+			return fmt.Errorf("unsupported type %q", t)
+		}
+	}
+	for name, property := range s.Properties {
+		if property == nil {
+			continue
+		}
+		if err := property.check(); err != nil {
+			return fmt.Errorf("property %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// types returns the allowed type names ("type" is a string or a list of strings)
+func (s *JSONSchema) types() []string {
+	switch t := s.Type.(type) {
+	case string:
+		return []string{t}
+	case []interface{}:
+		var types []string
+		for _, v := range t {
+			types = append(types, fmt.Sprint(v))
+		}
+		return types
+	}
+	return nil
+}
+
+// Validate checks a decoded JSON value against the schema
+// Numbers may be float64 or json.Number (decoder.UseNumber)
+func (s *JSONSchema) Validate(value interface{}) error {
+	return s.validate("", value)
+}
+
+func (s *JSONSchema) validate(path string, value interface{}) error {
+	if s == nil {
+		return nil
+	}
+	where := path
+	if where == "" {
+		where = "reading"
+	}
+
+	if types := s.types(); len(types) > 0 && !slices.ContainsFunc(types, func(t string) bool { return jsonHasType(value, t) }) {
+		return fmt.Errorf("%s: expected %s, got %s", where, strings.Join(types, " or "), jsonTypeOf(value))
+	}
+
+	if len(s.Enum) > 0 && !slices.ContainsFunc(s.Enum, func(e interface{}) bool { return jsonEqual(e, value) }) {
+		return fmt.Errorf("%s: value %v is not one of %v", where, value, s.Enum)
+	}
+
+	if v, ok := jsonFloat(value); ok {
+		if s.Minimum != nil && v < *s.Minimum {
+			return fmt.Errorf("%s: %v is less than minimum %v", where, v, *s.Minimum)
+		}
+		if s.Maximum != nil && v > *s.Maximum {
+			return fmt.Errorf("%s: %v is greater than maximum %v", where, v, *s.Maximum)
+		}
+	}
+
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	for _, key := range s.Required {
+		if _, exists := object[key]; !exists {
+			return fmt.Errorf("%s: missing required property %s", where, key)
+		}
+	}
+	for key, v := range object {
+		property, declared := s.Properties[key]
+		if !declared {
+			if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+				return fmt.Errorf("%s: unexpected property %s", where, key)
+			}
+			continue
+		}
+		if err := property.validate(strings.TrimPrefix(path+"."+key, "."), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// jsonHasType checks if a decoded JSON value is of a JSON Schema type
+func jsonHasType(value interface{}, t string) bool {
+	switch t {
+	case "integer":
+		switch v := value.(type) {
+		case json.Number:
+			_, err := v.Int64()
+			return err == nil
+		case float64:
+			return v == float64(int64(v))
+		}
+		return false
+	case "number":
+		_, ok := jsonFloat(value)
+		return ok
+	}
+	return jsonTypeOf(value) == t
+}
+
+// jsonTypeOf returns the JSON Schema type name of a decoded JSON value
+func jsonTypeOf(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case json.Number, float64:
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// jsonFloat returns the value of a decoded JSON number
+func jsonFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// jsonEqual compares decoded JSON scalars, numbers by value
+func jsonEqual(a, b interface{}) bool {
+	if x, ok := jsonFloat(a); ok {
+		y, ok := jsonFloat(b)
+		return ok && x == y
+	}
+	return a == b
+}
@@ -0,0 +1,111 @@
+package loader
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testReadingSchema = `{
+	"type": "object",
+	"required": ["device_id", "time"],
+	"additionalProperties": false,
+	"properties": {
+		"device_id": {"type": "string", "enum": ["CR300_19531", "CR300_19532"]},
+		"time": {"type": ["string", "integer"]},
+		"n": {"type": "integer", "minimum": 0},
+		"WAU": {"type": "number", "minimum": -10, "maximum": 100}
+	}
+}`
+
+// withJSONSchema sets the NDJSON reading schema for the duration of the test
+func withJSONSchema(t *testing.T, schema *JSONSchema) {
+	t.Helper()
+	previous := jsonReadingSchema
+	jsonReadingSchema = schema
+	t.Cleanup(func() { jsonReadingSchema = previous })
+}
+
+func TestParseJSONSchema(t *testing.T) {
+	if _, err := ParseJSONSchema([]byte(testReadingSchema)); err != nil {
+		t.Fatalf("ParseJSONSchema() error = %v", err)
+	}
+	invalid := map[string]string{
+		"invalid JSON":              `{"type": `,
+		"unsupported type":          `{"type": "date"}`,
+		"unsupported property type": `{"type": "object", "properties": {"time": {"type": ["string", "timestamp"]}}}`,
+	}
+	for name, schema := range invalid {
+		if _, err := ParseJSONSchema([]byte(schema)); err == nil {
+			t.Errorf("%s: ParseJSONSchema() error = nil", name)
+		}
+	}
+}
+
+func TestJSONSchemaValidate(t *testing.T) {
+	schema, err := ParseJSONSchema([]byte(testReadingSchema))
+	if err != nil {
+		t.Fatalf("ParseJSONSchema() error = %v", err)
+	}
+	tests := []struct {
+		reading string
+		want    string
+	}{
+		{`{"device_id": "CR300_19531", "time": "2025-12-31 23:58:00", "n": 1, "WAU": 12.5}`, ""},
+		{`{"device_id": "CR300_19531", "time": 1767200280}`, ""},
+		{`{"device_id": "CR300_19531"}`, "missing required property time"},
+		{`{"device_id": "CR300_19999", "time": 1767200280}`, "device_id: value CR300_19999 is not one of"},
+		{`{"device_id": "CR300_19531", "time": 1767200280.5}`, "time: expected string or integer, got number"},
+		{`{"device_id": "CR300_19531", "time": 1767200280, "n": -1}`, "n: -1 is less than minimum 0"},
+		{`{"device_id": "CR300_19531", "time": 1767200280, "WAU": 120}`, "WAU: 120 is greater than maximum 100"},
+		{`{"device_id": "CR300_19531", "time": 1767200280, "WAD": 1}`, "unexpected property WAD"},
+		{`["CR300_19531"]`, "reading: expected object, got array"},
+	}
+	for _, tt := range tests {
+		var reading interface{}
+		decoder := json.NewDecoder(strings.NewReader(tt.reading))
+		decoder.UseNumber()
+		if err := decoder.Decode(&reading); err != nil {
+			t.Fatalf("Decode(%s) error = %v", tt.reading, err)
+		}
+		err := schema.Validate(reading)
+		if tt.want == "" && err != nil {
+			t.Errorf("Validate(%s) error = %v, want nil", tt.reading, err)
+		}
+		if tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)) {
+			t.Errorf("Validate(%s) error = %v, want %q", tt.reading, err, tt.want)
+		}
+	}
+
+	// Without a schema, everything is valid
+	var none *JSONSchema
+	if err := none.Validate("anything"); err != nil {
+		t.Errorf("nil schema: Validate() error = %v", err)
+	}
+}
+
+func TestInitJSONSchema(t *testing.T) {
+	withJSONSchema(t, nil)
+	path := filepath.Join(t.TempDir(), "reading.schema.json")
+	if err := os.WriteFile(path, []byte(testReadingSchema), 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	t.Setenv("JSON_SCHEMA_FILE", path)
+	InitJSONSchema()
+	if jsonReadingSchema == nil || len(jsonReadingSchema.Required) != 2 {
+		t.Fatalf("InitJSONSchema() schema = %+v", jsonReadingSchema)
+	}
+
+	// Conforming files are extracted, non-conforming files fail with the validation error
+	conforming := `{"device_id": "CR300_19531", "time": 1767200280, "WAU": 12.5}`
+	if _, err := ExtractNDJSON("a.ndjson", []byte(conforming)); err != nil {
+		t.Errorf("conforming file: ExtractNDJSON() error = %v", err)
+	}
+	nonConforming := conforming + "\n" + `{"device_id": "CR300_19531", "time": 1767200340, "WAU": "high"}`
+	_, err := ExtractNDJSON("a.ndjson", []byte(nonConforming))
+	if err == nil || !strings.Contains(err.Error(), "line 2: schema validation failed: WAU: expected number, got string") {
+		t.Errorf("non-conforming file: ExtractNDJSON() error = %v", err)
+	}
+}
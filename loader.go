@@ -3,13 +3,28 @@ package loader
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
 	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"maps"
+	"math"
+	"mime"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"cloud.google.com/go/storage"
 	"github.com/GoogleCloudPlatform/functions-framework-go/functions"
@@ -45,9 +60,92 @@ var FieldNameMapping = []FieldMapping{
 	{Code: "TIS", Alias: "tilt_shift"},
 }
 
-// AliasToCode creates a map from alias to code
+// fieldMappingTables holds the lookup tables built from a field mapping list
+// Tables are never mutated once published: a reload builds and swaps new tables (copy-on-write)
+type fieldMappingTables struct {
+	aliasToCode map[string]string
+	codeToAlias map[string]string
+}
+
+// fieldMappings holds the current lookup tables, safe for concurrent reads and reloads
+var fieldMappings atomic.Pointer[fieldMappingTables]
+
+// AliasToCode maps each column alias to its code
+// Deprecated: use LookupCode. The map is replaced (never mutated) by SetFieldMappings and is not
+// safe to read during a reload
 var AliasToCode map[string]string
 
+// fieldMappingsMu serializes publishing the tables and AliasToCode
+var fieldMappingsMu sync.Mutex
+
+// storeFieldMappings publishes lookup tables and a copy of their alias map as AliasToCode
+func storeFieldMappings(tables *fieldMappingTables) {
+	fieldMappingsMu.Lock()
+	defer fieldMappingsMu.Unlock()
+	fieldMappings.Store(tables)
+	if tables == nil {
+		AliasToCode = nil
+		return
+	}
+	AliasToCode = maps.Clone(tables.aliasToCode)
+}
+
+// SetFieldMappings builds the lookup tables from a mapping list and swaps them in atomically
+// A file being parsed keeps using the tables it started with
+// Collisions (an alias mapped to two codes, or a code with two aliases; the last entry wins) are logged;
+// with STRICT_MAPPINGS=true they are returned as an error and the current tables are kept
+func SetFieldMappings(mappings []FieldMapping) error {
+	tables := &fieldMappingTables{
+		aliasToCode: make(map[string]string, len(mappings)),
+		codeToAlias: make(map[string]string, len(mappings)),
+	}
+	var collisions []string
+	for _, mapping := range mappings {
+		if code, exists := tables.aliasToCode[mapping.Alias]; exists && code != mapping.Code {
+			collisions = append(collisions, fmt.Sprintf("alias %s maps to %s and %s", mapping.Alias, code, mapping.Code))
+		}
+		if alias, exists := tables.codeToAlias[mapping.Code]; exists && alias != mapping.Alias {
+			collisions = append(collisions, fmt.Sprintf("code %s has aliases %s and %s", mapping.Code, alias, mapping.Alias))
+		}
+		tables.aliasToCode[mapping.Alias] = mapping.Code
+		tables.codeToAlias[mapping.Code] = mapping.Alias
+	}
+
+	if len(collisions) > 0 {
+		// Read from the environment: the built-in mappings are set before InitConfig
+		if parseBoolEnv("STRICT_MAPPINGS", false) {
+			return fmt.Errorf("field mapping collisions (STRICT_MAPPINGS): %s", strings.Join(collisions, "; "))
+		}
+		GlobalLogger.Warnf("field mapping collisions, the last entry wins: %s", strings.Join(collisions, "; "))
+	}
+	storeFieldMappings(tables)
+	return nil
+}
+
+// LookupCode returns the code of a column alias
+func LookupCode(alias string) (string, bool) {
+	return fieldMappings.Load().code(alias)
+}
+
+// code returns the code of a column alias in these tables
+func (t *fieldMappingTables) code(alias string) (string, bool) {
+	if t == nil {
+		return "", false
+	}
+	code, exists := t.aliasToCode[alias]
+	return code, exists
+}
+
+// LookupAlias returns the alias of a field code
+func LookupAlias(code string) (string, bool) {
+	tables := fieldMappings.Load()
+	if tables == nil {
+		return "", false
+	}
+	alias, exists := tables.codeToAlias[code]
+	return alias, exists
+}
+
 // Global MongoDB connection and database (reused across events)
 // Now moved to mongodb.go as MongoDatabase and MongoClient variables
 
@@ -63,30 +161,102 @@ var EVENT_MAX_AGE_SECONDS int64 = 86400
 // MIN_EVENT_AGE_SECONDS is the minimum allowed event age (5 minutes)
 const MIN_EVENT_AGE_SECONDS int64 = 300
 
-func init() {
-	AliasToCode = make(map[string]string)
-	for _, mapping := range FieldNameMapping {
-		AliasToCode[mapping.Alias] = mapping.Code
-	}
+// EVENT_AGE_GRACE_SECONDS is a grace period added to EVENT_MAX_AGE_SECONDS before an event is skipped
+// Events within the grace zone are processed (and logged at debug level) to avoid flapping at the boundary
+// Can be configured via EVENT_AGE_GRACE_SECONDS environment variable (default: 0)
+var EVENT_AGE_GRACE_SECONDS int64 = 0
 
+// nowFunc returns the current time; replaced in tests to control the clock
+var nowFunc = time.Now
+
+func init() {
 	// Initialize logger first
 	InitLogger()
 
+	// Field mappings are used by InitConfig (COLUMN_BLACKLIST aliases)
+	if err := SetFieldMappings(FieldNameMapping); err != nil {
+		GlobalLogger.Fatalf("%v", err)
+	}
+
 	// Initialize config (debug flags)
 	InitConfig()
 
 	// Load glob patterns from environment
 	InitFilePatterns()
 
-	// Initialize MongoDB connection at startup
-	InitMongoDB()
+	// Load externalized KV formats from environment
+	InitKVFormats()
+
+	// Load per-bucket settings from environment
+	InitBucketConfig()
+	InitJSONSchema()
+	InitTransformScript()
 
 	// Load max event age configuration from environment
 	initEventAgeConfig()
 }
 
+// runtimeSetup guards the one-time connection to MongoDB and the shutdown handler setup
+// Unit tests set the globals (MongoDatabase, ...) directly and mark it as done in TestMain
+var runtimeSetup sync.Once
+
+// setupRuntime connects to MongoDB, optionally verifies the indexes and installs the shutdown handler
+// Called by the function entry points (helloGCS, manualLoad) before the first event or request is handled
+func setupRuntime() {
+	runtimeSetup.Do(func() {
+		InitMongoDB()
+
+		// Optionally verify (and repair) sensor data collection indexes
+		if parseBoolEnv("VERIFY_INDEXES", false) {
+			ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+			if err := VerifyIndexes(ctx); err != nil {
+				GlobalLogger.Errorf("index verification failed: %v", err)
+			}
+			cancel()
+		}
+
+		// Flush buffered records and close the connections when the instance is stopped
+		go handleShutdownSignals()
+	})
+}
+
+// shutdownTimeout bounds the Shutdown run when the instance is stopped
+const shutdownTimeout = 10 * time.Second
+
+// handleShutdownSignals runs Shutdown when the platform stops the instance (SIGTERM) or on SIGINT, then exits
+func handleShutdownSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	sig := <-signals
+
+	GlobalLogger.Infof("received %v", sig)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	err := Shutdown(ctx)
+	cancel()
+	if err != nil {
+		GlobalLogger.Warnf("shutdown: %v", err)
+		GlobalLogger.Flush()
+	}
+	os.Exit(0)
+}
+
+// Shutdown releases the resources held by the loader
+// Flushes the buffered records, stops the MongoDB keep-alive goroutine, disconnects from MongoDB
+// and flushes the logger. Called on SIGTERM (see handleShutdownSignals)
+func Shutdown(ctx context.Context) error {
+	GlobalLogger.Info("Shutting down loader")
+	defer GlobalLogger.Flush()
+	globalBatcher.Flush(ctx)
+	if err := closeStorageClient(); err != nil {
+		GlobalLogger.Warnf("failed to close GCS client: %v", err)
+	}
+	return closeMongoDB(ctx)
+}
+
 // initEventAgeConfig loads the maximum event age configuration from environment variables
 func initEventAgeConfig() {
+	initEventAgeGraceConfig()
+
 	maxAgeStr := os.Getenv("MAX_EVENT_AGE_SECONDS")
 	if maxAgeStr == "" {
 		GlobalLogger.Infof("MAX_EVENT_AGE_SECONDS not set, using default: %d seconds (24 hours)\n", EVENT_MAX_AGE_SECONDS)
@@ -121,189 +291,1152 @@ func initEventAgeConfig() {
 	}
 }
 
-// isEventTooOld checks if an event is older than the configured threshold
+// initEventAgeGraceConfig loads the event age grace period from environment variables
+func initEventAgeGraceConfig() {
+	graceStr := os.Getenv("EVENT_AGE_GRACE_SECONDS")
+	if graceStr == "" {
+		return
+	}
+
+	grace, err := strconv.ParseInt(graceStr, 10, 64)
+	if err != nil || grace < 0 {
+		GlobalLogger.Warnf("Invalid EVENT_AGE_GRACE_SECONDS value '%s', using default: %d seconds\n", graceStr, EVENT_AGE_GRACE_SECONDS)
+		return
+	}
+
+	EVENT_AGE_GRACE_SECONDS = grace
+	GlobalLogger.Infof("Event age grace period set to: %d seconds\n", EVENT_AGE_GRACE_SECONDS)
+}
+
+// isEventTooOld checks if an event is older than the configured threshold (plus grace period)
 // Returns true if event should be skipped, false if it should be processed
-func isEventTooOld(eventTime time.Time) bool {
+func isEventTooOld(ctx context.Context, eventTime time.Time) bool {
 	if EVENT_MAX_AGE_SECONDS == 0 {
 		// Age checking disabled
 		return false
 	}
 
-	age := time.Since(eventTime)
+	age := nowFunc().Sub(eventTime)
 	maxAge := time.Duration(EVENT_MAX_AGE_SECONDS) * time.Second
+	grace := time.Duration(EVENT_AGE_GRACE_SECONDS) * time.Second
+
+	if age > maxAge && age <= maxAge+grace {
+		LoggerFrom(ctx).Debugf("event age %v is within the grace period (max: %v, grace: %v), processing\n", age, maxAge, grace)
+		return false
+	}
+
+	return age > maxAge+grace
+}
 
-	return age > maxAge
+// newCSVReader creates a CSV reader honoring CSV_COMMENT and CSV_LAZY_QUOTES
+func newCSVReader(content string) *csv.Reader {
+	reader := csv.NewReader(strings.NewReader(content))
+	if GlobalConfig != nil {
+		reader.Comment = GlobalConfig.CSVComment
+		reader.LazyQuotes = GlobalConfig.CSVLazyQuotes
+	}
+	return reader
+}
+
+// removeCommentLines drops the lines starting with the CSV_COMMENT character
+// Done before locating the header lines so comments don't shift the line indexes
+func removeCommentLines(lines []string) []string {
+	if GlobalConfig == nil || GlobalConfig.CSVComment == 0 {
+		return lines
+	}
+	comment := string(GlobalConfig.CSVComment)
+	var kept []string
+	for _, line := range lines {
+		if !strings.HasPrefix(strings.TrimSpace(line), comment) {
+			kept = append(kept, line)
+		}
+	}
+	return kept
+}
+
+// ParseHeader parses the TOA5 header of CSV content without parsing the data rows
+// Returns the device ID derived from the meta line and the column names
+// DEVICE_ID_FROM_COLUMN is not applied: it needs the data rows
+func ParseHeader(content []byte) (deviceID string, columns []string, err error) {
+	// Only the first non-comment lines are needed
+	var header []string
+	for len(content) > 0 && len(header) < 2 {
+		line := content
+		if idx := bytes.IndexByte(content, '\n'); idx != -1 {
+			line, content = content[:idx], content[idx+1:]
+		} else {
+			content = nil
+		}
+		if len(header) == 0 && len(bytes.TrimSpace(line)) == 0 {
+			continue // leading blank lines, as trimmed by ExtractData
+		}
+		header = append(header, removeCommentLines([]string{string(line)})...)
+	}
+	if len(header) < 2 {
+		return "", nil, fmt.Errorf("CSV has insufficient header lines (got %d, need 2)", len(header))
+	}
+
+	meta, columns, err := parseHeaderLines(header[0], header[1])
+	if err != nil {
+		return "", nil, err
+	}
+	// "TOA5","T1","CR300","19531" -> CR300_19531
+	if len(meta) < 4 {
+		return "", nil, fmt.Errorf("meta data has insufficient fields (got %d, need 4)", len(meta))
+	}
+	return fmt.Sprintf("%s_%s", meta[2], meta[3]), columns, nil
+}
+
+// parseHeaderLines parses the meta and columns lines of a TOA5 file
+func parseHeaderLines(metaLine string, columnsLine string) (meta []string, columns []string, err error) {
+	meta, err = newCSVReader(metaLine).Read()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse meta line: %w", err)
+	}
+	columns, err = newCSVReader(columnsLine).Read()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse columns line: %w", err)
+	}
+	return meta, columns, nil
 }
 
 // ExtractData extracts and formats data from CSV content
 func ExtractData(filename string, content []byte) (map[string]interface{}, error) {
-	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	return extractData(context.Background(), filename, content)
+}
 
-	if len(lines) < 5 {
+// extractData is ExtractData logging with the logger of ctx
+func extractData(ctx context.Context, filename string, content []byte) (map[string]interface{}, error) {
+	deadline := newParseDeadline()
+	lines := removeCommentLines(strings.Split(strings.TrimSpace(string(content)), "\n"))
+
+	// TOA5 layout: meta line, columns line, two more header lines, then data from line 4 (index 4)
+	columnsIndex, dataStart := 1, 4
+	if GlobalConfig != nil && GlobalConfig.AutoDetectDataStart {
+		var found bool
+		columnsIndex, dataStart, found = detectDataStart(lines)
+		if !found {
+			return nil, fmt.Errorf("file %s: no data line found (AUTO_DETECT_DATA_START)", filename)
+		}
+	} else if len(lines) < 5 {
 		return nil, fmt.Errorf("file %s: CSV has insufficient lines (got %d, need 5)", filename, len(lines))
 	}
 
-	// Parse meta line
-	metaReader := csv.NewReader(strings.NewReader(lines[0]))
-	meta, err := metaReader.Read()
+	meta, columns, err := parseHeaderLines(lines[0], lines[columnsIndex])
 	if err != nil {
-		return nil, fmt.Errorf("file %s: failed to parse meta line: %w", filename, err)
+		return nil, fmt.Errorf("file %s: %w", filename, err)
 	}
 
-	// Parse columns line
-	columnsReader := csv.NewReader(strings.NewReader(lines[1]))
-	columns, err := columnsReader.Read()
-	if err != nil {
-		return nil, fmt.Errorf("file %s: failed to parse columns line: %w", filename, err)
+	// Parse CSV starting from the first data line
+	csvContent := strings.Join(lines[dataStart:], "\n")
+	csvReader := newCSVReader(csvContent)
+	csvReader.FieldsPerRecord = -1 // Allow variable number of fields
+	var records [][]string
+	for {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("file %s: failed to parse CSV records: %w", filename, err)
+		}
+		records = append(records, record)
+		if deadline.exceeded(len(records)) {
+			return nil, fmt.Errorf("file %s: %w after reading %d rows", filename, ErrParseTimeout, len(records))
+		}
 	}
 
-	// Parse CSV starting from line 4 (index 4)
-	csvContent := strings.Join(lines[4:], "\n")
-	csvReader := csv.NewReader(strings.NewReader(csvContent))
-	csvReader.FieldsPerRecord = -1 // Allow variable number of fields
-	records, err := csvReader.ReadAll()
-	if err != nil {
-		return nil, fmt.Errorf("file %s: failed to parse CSV records: %w", filename, err)
+	return extractObject(ctx, filename, meta, columns, records, deadline)
+}
+
+// ErrParseTimeout is returned when parsing a file takes longer than MAX_PARSE_TIME_MS
+var ErrParseTimeout = errors.New("parse timeout (MAX_PARSE_TIME_MS)")
+
+// parseDeadline is the time by which a file must be parsed (zero = no limit)
+type parseDeadline time.Time
+
+// parseTimeCheckRows is the number of rows between parse deadline checks
+const parseTimeCheckRows = 1024
+
+// newParseDeadline returns the parse deadline of a file starting to be parsed now (MAX_PARSE_TIME_MS)
+func newParseDeadline() parseDeadline {
+	if GlobalConfig == nil || GlobalConfig.MaxParseTimeMS <= 0 {
+		return parseDeadline{}
+	}
+	return parseDeadline(time.Now().Add(time.Duration(GlobalConfig.MaxParseTimeMS) * time.Millisecond))
+}
+
+// exceeded checks, every parseTimeCheckRows rows, if the deadline has passed
+func (d parseDeadline) exceeded(rows int) bool {
+	t := time.Time(d)
+	return !t.IsZero() && rows%parseTimeCheckRows == 0 && time.Now().After(t)
+}
+
+// detectDataStart locates the columns line and the first data line of CSV lines with a variable
+// number of header lines: data starts at the first line after the meta line whose first field parses
+// as a timestamp, and the columns line is the header line with the most recognized column names
+// (line 1 if none is recognized)
+func detectDataStart(lines []string) (columnsIndex int, dataStart int, found bool) {
+	for i := 2; i < len(lines); i++ {
+		fields, err := newCSVReader(lines[i]).Read()
+		if err != nil || len(fields) < 1 {
+			continue
+		}
+		if _, err := parseRecordTime(strings.TrimSpace(fields[0])); err == nil {
+			dataStart = i
+			found = true
+			break
+		}
+	}
+	if !found {
+		return 0, 0, false
 	}
 
-	return ExtractObject(filename, meta, columns, records)
+	columnsIndex = 1
+	best := 0
+	for i := 1; i < dataStart; i++ {
+		fields, err := newCSVReader(lines[i]).Read()
+		if err != nil {
+			continue
+		}
+		if n := countRecognizedColumns(fields); n > best {
+			columnsIndex, best = i, n
+		}
+	}
+	return columnsIndex, dataStart, true
+}
+
+// countRecognizedColumns counts the fields that are known column names (TIMESTAMP, RECORD, codes and aliases)
+func countRecognizedColumns(fields []string) int {
+	count := 0
+	for _, field := range fields {
+		field = strings.TrimSpace(field)
+		if field == "TIMESTAMP" || field == "RECORD" {
+			count++
+			continue
+		}
+		if _, exists := LookupCode(field); exists {
+			count++
+			continue
+		}
+		if _, exists := LookupAlias(field); exists {
+			count++
+		}
+	}
+	return count
 }
 
 // ExtractObject converts raw records to objects with proper formatting
 func ExtractObject(filename string, meta []string, columns []string, data [][]string) (map[string]interface{}, error) {
-	// "TOA5","T1","CR300","19531" -> CR300_19531
-	if len(meta) < 4 {
-		return nil, fmt.Errorf("file %s: meta data has insufficient fields (got %d, need 4)", filename, len(meta))
-	}
+	return extractObject(context.Background(), filename, meta, columns, data, newParseDeadline())
+}
 
-	deviceID := fmt.Sprintf("%s_%s", meta[2], meta[3])
+// extractObject is ExtractObject with the parse deadline of the file (MAX_PARSE_TIME_MS)
+func extractObject(ctx context.Context, filename string, meta []string, columns []string, data [][]string, deadline parseDeadline) (map[string]interface{}, error) {
+	// DEVICE_ID_FROM_COLUMN overrides the meta line derivation
+	deviceID, deviceIDIndex := deviceIDFromColumn(ctx, columns, data)
+	if deviceID == "" {
+		// "TOA5","T1","CR300","19531" -> CR300_19531
+		if len(meta) < 4 {
+			return nil, fmt.Errorf("file %s: meta data has insufficient fields (got %d, need 4)", filename, len(meta))
+		}
+		deviceID = fmt.Sprintf("%s_%s", meta[2], meta[3])
+	}
+	deviceID = canonicalDeviceID(ctx, filename, deviceID)
 	var records []SensorRecord
 
-	for _, row := range data {
-		if len(row) < 2 {
+	// Snapshot the field mappings so a concurrent reload can't change names mid-file
+	mappings := fieldMappings.Load()
+
+	// COMPOSITE_FIELDS source columns are combined, not stored as is
+	composites := compositeFieldIndexes(columns)
+
+	// STATION_COLUMN values route rows to boxes (STATION_TO_BOX), they are not readings
+	stationIndex := stationColumnIndex(columns)
+
+	// Stored field names in CSV column order, and the original name of renamed columns (STORE_ORIGINAL_NAMES)
+	var fields []string
+	originalNames := make(map[string]string)
+	for i := valueColumnStart(); i < len(columns); i++ {
+		k := columns[i]
+		if i == deviceIDIndex || i == stationIndex || isBlacklistedColumn(k) {
+			continue
+		}
+		if composite, exists := composites.fieldAt[i]; exists {
+			fields = append(fields, composite.Field)
+			continue
+		}
+		if composites.sources[i] {
 			continue
 		}
+		if isQualityColumn(k) {
+			k = "q"
+		} else if field, exists := mappings.code(k); exists {
+			k = field
+		}
+		if k != columns[i] {
+			originalNames[k] = columns[i]
+		}
+		fields = append(fields, k)
+	}
+	storeOriginalNames := GlobalConfig != nil && GlobalConfig.StoreOriginalNames && len(originalNames) > 0
 
-		// Parse timestamp
-		t, err := time.ParseInLocation("2006-01-02 15:04:05", row[0], GlobalConfig.TimezoneLocation)
+	parser := &rowParser{columns: columns, deviceIDIndex: deviceIDIndex, stationIndex: stationIndex, composites: composites, mappings: mappings}
+	var stations []string
+	for i, row := range data {
+		if deadline.exceeded(i + 1) {
+			return nil, fmt.Errorf("file %s: %w after parsing %d of %d rows", filename, ErrParseTimeout, i, len(data))
+		}
+		record, err := parser.parse(row)
 		if err != nil {
-			GlobalLogger.Warnf("%s invalid time: %s", deviceID, row[0])
+			if !errors.Is(err, errShortRow) {
+				LoggerFrom(ctx).Warnf("%s %v", deviceID, err)
+			}
 			continue
 		}
+		if storeOriginalNames {
+			record["_cols"] = originalNames
+		}
+		records = append(records, record)
+		if stationIndex >= 0 {
+			station := ""
+			if stationIndex < len(row) {
+				station = strings.TrimSpace(row[stationIndex])
+			}
+			stations = append(stations, station)
+		}
+	}
+
+	result := map[string]interface{}{
+		"device_id": deviceID,
+		"records":   records,
+		"fields":    fields,
+	}
+	// Station of each record, when rows are routed by STATION_COLUMN
+	if stationIndex >= 0 {
+		result["stations"] = stations
+	}
+	return result, nil
+}
 
-		ts := t.Unix()
-		n, err := strconv.ParseFloat(row[1], 64)
+// errShortRow is returned for rows without timestamp and n (skipped silently by ExtractObject)
+var errShortRow = errors.New("row has too few fields")
+
+// NoNColumn is the N_COLUMN_INDEX value of files without a record number column
+const NoNColumn = -1
+
+// valueColumnStart returns the index of the first sensor value column:
+// 2 after timestamp and n, or 1 when N_COLUMN_INDEX=-1
+func valueColumnStart() int {
+	if GlobalConfig != nil && GlobalConfig.NColumnIndex == NoNColumn {
+		return 1
+	}
+	return 2
+}
+
+// rowParser parses the data rows of a CSV file
+type rowParser struct {
+	columns       []string
+	deviceIDIndex int
+	stationIndex  int
+	composites    compositeIndexes
+	mappings      *fieldMappingTables
+}
+
+// ValidateRow parses a single data row with the same logic as ExtractObject
+// Returns the parsed record, or an error describing why the row would be dropped
+func ValidateRow(columns []string, row []string) (SensorRecord, error) {
+	deviceIDIndex := -1
+	if GlobalConfig != nil && GlobalConfig.DeviceIDColumn != "" {
+		deviceIDIndex = slices.Index(columns, GlobalConfig.DeviceIDColumn)
+	}
+	parser := &rowParser{
+		columns:       columns,
+		deviceIDIndex: deviceIDIndex,
+		stationIndex:  stationColumnIndex(columns),
+		composites:    compositeFieldIndexes(columns),
+		mappings:      fieldMappings.Load(),
+	}
+	return parser.parse(row)
+}
+
+// parse converts a data row to a record: timestamp, n (unless N_COLUMN_INDEX=-1), then the mapped field values
+func (p *rowParser) parse(row []string) (SensorRecord, error) {
+	columns := p.columns
+	start := valueColumnStart()
+	if len(row) < start {
+		return nil, errShortRow
+	}
+
+	// Parse timestamp
+	t, err := parseRecordTime(row[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid time: %s", row[0])
+	}
+
+	ts := t.Unix()
+	if isTimestampTooOld(ts) {
+		return nil, fmt.Errorf("suspicious timestamp before MIN_VALID_TIMESTAMP, dropping row: %s", row[0])
+	}
+
+	record := SensorRecord{"_id": ts}
+	if start > 1 {
+		n, err := parseNumber(row[1])
 		if err != nil {
-			GlobalLogger.Warnf("%s invalid n value: %s", deviceID, row[1])
+			return nil, fmt.Errorf("invalid n value: %s", row[1])
+		}
+		record["n"] = n
+	}
+	applyBSONDate(record, ts)
+
+	for i := start; i < len(row) && i < len(columns); i++ {
+		// The device ID and station columns are not readings, blacklisted columns are never stored
+		if i == p.deviceIDIndex || i == p.stationIndex || isBlacklistedColumn(columns[i]) {
+			continue
+		}
+
+		// Combine split-value columns at the position of the integer column
+		if composite, exists := p.composites.fieldAt[i]; exists {
+			if v, ok := composite.combine(row, i, p.composites.fracIndex[i]); ok {
+				applyBitFlags(record, composite.Field, v)
+				record[composite.Field] = storedValue(convertField(composite.Field, v))
+			}
+			continue
+		}
+		if p.composites.sources[i] {
+			continue
+		}
+
+		// Keep the quality/status flag even when it is not numeric
+		if isQualityColumn(columns[i]) {
+			record["q"] = parseQualityValue(row[i])
 			continue
 		}
 
-		record := SensorRecord{
-			"_id": ts,
-			"n":   n,
+		v, err := parseNumber(row[i])
+		if err != nil {
+			continue
 		}
 
-		for i := 2; i < len(row) && i < len(columns); i++ {
-			v, err := strconv.ParseFloat(row[i], 64)
-			if err != nil {
-				continue
+		k := columns[i]
+		if field, exists := p.mappings.code(k); exists {
+			k = field
+		}
+		if isMissingValue(v) {
+			if GlobalConfig.MissingValueMode == MissingValueNull {
+				record[k] = nil
 			}
+			continue
+		}
+		applyBitFlags(record, k, v)
+		record[k] = storedValue(convertField(k, v))
+	}
+	return record, nil
+}
+
+// canonicalDeviceID returns the canonical ID of a derived device ID (DEVICE_ID_ALIASES), or the ID itself
+func canonicalDeviceID(ctx context.Context, filename string, deviceID string) string {
+	if GlobalConfig == nil {
+		return deviceID
+	}
+	canonical, ok := GlobalConfig.DeviceIDAliases[deviceID]
+	if !ok {
+		return deviceID
+	}
+	LoggerFrom(ctx).Infof("file %s: device ID %s aliased to %s", filename, deviceID, canonical)
+	return canonical
+}
+
+// deviceIDFromColumn returns the device ID held by the DEVICE_ID_FROM_COLUMN column and the column index
+// The device ID is the first non-empty value of the column; returns ("", index) if none is found
+// and ("", -1) if the option is not set or the column is absent
+func deviceIDFromColumn(ctx context.Context, columns []string, data [][]string) (string, int) {
+	if GlobalConfig == nil || GlobalConfig.DeviceIDColumn == "" {
+		return "", -1
+	}
 
-			k := columns[i]
-			if field, exists := AliasToCode[k]; exists {
-				record[field] = v
-			} else {
-				record[k] = v
+	index := -1
+	for i, column := range columns {
+		if column == GlobalConfig.DeviceIDColumn {
+			index = i
+			break
+		}
+	}
+	if index == -1 {
+		LoggerFrom(ctx).Warnf("device ID column %s not found, using meta line", GlobalConfig.DeviceIDColumn)
+		return "", -1
+	}
+
+	for _, row := range data {
+		if index < len(row) {
+			if value := strings.TrimSpace(row[index]); value != "" {
+				return value, index
 			}
 		}
+	}
+	LoggerFrom(ctx).Warnf("device ID column %s has no value, using meta line", GlobalConfig.DeviceIDColumn)
+	return "", index
+}
 
-		records = append(records, record)
+// stationColumnIndex returns the index of the STATION_COLUMN column, or -1 if rows are not routed by station
+func stationColumnIndex(columns []string) int {
+	if GlobalConfig == nil || GlobalConfig.StationColumn == "" || len(GlobalConfig.StationToBox) == 0 {
+		return -1
 	}
+	return slices.Index(columns, GlobalConfig.StationColumn)
+}
 
-	return map[string]interface{}{
-		"device_id": deviceID,
-		"records":   records,
-	}, nil
+// isTimestampTooOld checks if a record timestamp is before MIN_VALID_TIMESTAMP
+// Catches epoch (1970-01-01) timestamps produced by empty or zero values
+func isTimestampTooOld(ts int64) bool {
+	if GlobalConfig == nil {
+		return false
+	}
+	return GlobalConfig.MinValidTimestamp > 0 && ts < GlobalConfig.MinValidTimestamp
+}
+
+// ExtractAndDump parses CSV content via ExtractData and writes the result as pretty JSON
+// No database interaction: used to check how a file parses
+func ExtractAndDump(filename string, content []byte, w io.Writer) error {
+	result, err := ExtractData(filename, content)
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(result); err != nil {
+		return fmt.Errorf("file %s: failed to write JSON: %w", filename, err)
+	}
+	return nil
+}
+
+// isBlacklistedColumn checks if a column is listed in COLUMN_BLACKLIST by name, by code or by alias
+// Aliases are resolved against the current field mappings, so a reload applies to the blacklist too
+func isBlacklistedColumn(column string) bool {
+	if GlobalConfig == nil || len(GlobalConfig.ColumnBlacklist) == 0 {
+		return false
+	}
+	if GlobalConfig.ColumnBlacklist[column] {
+		return true
+	}
+	tables := fieldMappings.Load()
+	code := column
+	if c, exists := tables.code(column); exists {
+		code = c
+	}
+	for name := range GlobalConfig.ColumnBlacklist {
+		if name == code {
+			return true
+		}
+		if c, exists := tables.code(name); exists && c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// convertField applies the FIELD_CONVERSIONS unit conversion of a field, if any
+func convertField(field string, v float64) float64 {
+	if GlobalConfig == nil {
+		return v
+	}
+	if conversion, exists := GlobalConfig.FieldConversions[field]; exists {
+		return conversion.Apply(v)
+	}
+	return v
+}
+
+// storedValue returns the value stored for a reading: with DETECT_INT=true, values without a
+// fractional part are stored as int64 (5 instead of 5.0); other values stay float64
+func storedValue(v float64) interface{} {
+	if GlobalConfig == nil || !GlobalConfig.DetectInt {
+		return v
+	}
+	if v == math.Trunc(v) && v >= math.MinInt64 && v < math.MaxInt64 {
+		return int64(v)
+	}
+	return v
+}
+
+// applyBitFlags expands a packed numeric field into the boolean fields configured in BITFLAG_FIELDS
+// The packed value itself is kept in the record
+func applyBitFlags(record SensorRecord, field string, v float64) {
+	if GlobalConfig == nil {
+		return
+	}
+	flags, exists := GlobalConfig.BitFlagFields[field]
+	if !exists {
+		return
+	}
+
+	bits := int64(v)
+	for _, flag := range flags {
+		record[flag.Name] = bits&(1<<flag.Bit) != 0
+	}
+}
+
+// MinuteCSVTimeLayout is the layout of second-less timestamps accepted with FLEXIBLE_TIME=true
+const MinuteCSVTimeLayout = "2006-01-02 15:04"
+
+// csvTimeLayouts returns the layouts tried, in order, when parsing a CSV timestamp
+// With FLEXIBLE_TIME=true and no CSV_TIME_LAYOUT, second-less timestamps are also accepted (seconds = 0)
+func csvTimeLayouts() []string {
+	if GlobalConfig != nil && GlobalConfig.CSVTimeLayout != "" {
+		return []string{GlobalConfig.CSVTimeLayout, DefaultCSVTimeLayout}
+	}
+	if GlobalConfig != nil && GlobalConfig.FlexibleTime {
+		return []string{DefaultCSVTimeLayout, MinuteCSVTimeLayout}
+	}
+	return []string{DefaultCSVTimeLayout}
+}
+
+// parseRecordTime parses a CSV timestamp in the configured timezone
+// CSV_TIME_LAYOUT is tried first, then the default layout (and the minute layout with FLEXIBLE_TIME)
+func parseRecordTime(value string) (time.Time, error) {
+	var err error
+	for _, layout := range csvTimeLayouts() {
+		var t time.Time
+		t, err = time.ParseInLocation(layout, value, GlobalConfig.TimezoneLocation)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, err
+}
+
+// parseNumber parses a numeric field value
+// With DECIMAL_COMMA=true a comma is read as the decimal separator ("12,34" -> 12.34).
+// This assumes commas are never used as thousands separators: "1,234,5" fails to parse
+func parseNumber(s string) (float64, error) {
+	if GlobalConfig != nil && GlobalConfig.DecimalComma {
+		s = strings.Replace(s, ",", ".", 1)
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// isQualityColumn checks if the column is the configured QUALITY_COLUMN
+func isQualityColumn(column string) bool {
+	if GlobalConfig == nil || GlobalConfig.QualityColumn == "" {
+		return false
+	}
+	return column == GlobalConfig.QualityColumn
+}
+
+// parseQualityValue returns the quality value as a number when possible, otherwise as the raw string
+func parseQualityValue(raw string) interface{} {
+	raw = strings.TrimSpace(raw)
+	if v, err := parseNumber(raw); err == nil {
+		return v
+	}
+	return raw
+}
+
+// IsDatFile checks if the filename is a Campbell Scientific .dat file
+// These are TOA5 CSV files with a different extension and go through ExtractData
+func IsDatFile(filename string) bool {
+	return strings.EqualFold(filepath.Ext(filename), ".dat")
+}
+
+// PROCESS_HOURS_MODE values
+const (
+	ProcessHoursModeDefer = "defer"
+	ProcessHoursModeSkip  = "skip"
+)
+
+// MIN_RECORDS_MODE values
+const (
+	MinRecordsModeWarn = "warn"
+	MinRecordsModeFail = "fail"
+)
+
+// MISSING_VALUE_MODE values
+const (
+	// MissingValueDrop omits sentinel values from the record
+	MissingValueDrop = "drop"
+	// MissingValueNull stores null for sentinel values
+	MissingValueNull = "null"
+)
+
+// isMissingValue checks if a value is one of the MISSING_VALUE_SENTINELS
+func isMissingValue(v float64) bool {
+	if GlobalConfig == nil {
+		return false
+	}
+	for _, sentinel := range GlobalConfig.MissingValueSentinels {
+		if v == sentinel || (math.IsNaN(v) && math.IsNaN(sentinel)) {
+			return true
+		}
+	}
+	return false
+}
+
+// File type detectors, see DETECTOR_PRECEDENCE
+const (
+	DetectorDat    = "dat"
+	DetectorAmChua = "amchua"
+	DetectorBaria  = "baria"
+	DetectorKV     = "kv"
+)
+
+// DefaultDetectorPrecedence is the default order in which file type detectors are consulted
+var DefaultDetectorPrecedence = []string{DetectorDat, DetectorAmChua, DetectorBaria, DetectorKV}
+
+// fileTypeDetectors maps a detector name to its match function
+var fileTypeDetectors = map[string]func(filename string) bool{
+	DetectorDat:    IsDatFile,
+	DetectorAmChua: IsAmChuaFile,
+	DetectorBaria:  IsBariaFile,
+	DetectorKV:     func(filename string) bool { return MatchKVFormat(filename) != nil },
+}
+
+// detectFileType returns the name of the detector routing the file, or "" for plain CSV files
+// When several detectors match, a warning is logged and DETECTOR_PRECEDENCE decides
+func detectFileType(ctx context.Context, filename string) string {
+	precedence := DefaultDetectorPrecedence
+	if GlobalConfig != nil && len(GlobalConfig.DetectorPrecedence) > 0 {
+		precedence = GlobalConfig.DetectorPrecedence
+	}
+
+	var matched []string
+	for _, name := range precedence {
+		if fileTypeDetectors[name](filename) {
+			matched = append(matched, name)
+		}
+	}
+	if len(matched) == 0 {
+		return ""
+	}
+	if len(matched) > 1 {
+		LoggerFrom(ctx).Warnf("file %s: ambiguous file type, detectors %v all match, using %s (DETECTOR_PRECEDENCE)", filename, matched, matched[0])
+	}
+	return matched[0]
+}
+
+// File types reported in ProcessResult
+const (
+	FileTypeCSV    = "csv"
+	FileTypeAmChua = "amchua"
+	FileTypeBaria  = "baria"
+	FileTypeZip    = "zip"
+	// FileTypeManifest - a MANIFEST_PATTERN object listing data files
+	FileTypeManifest = "manifest"
+)
+
+// applyFileType adds the "ft" field holding the source file type (STORE_FILE_TYPE)
+func applyFileType(doc map[string]interface{}, fileType string) {
+	if GlobalConfig == nil || !GlobalConfig.StoreFileType {
+		return
+	}
+	doc["ft"] = fileType
+}
+
+// ProcessResult holds the outcome of processing a single file
+type ProcessResult struct {
+	// DeviceID - device ID of a CSV file, or the comma-separated box IDs of a KV file or zip archive
+	DeviceID string
+	// Inserted - number of documents inserted (records for CSV files, one per box for KV files)
+	Inserted int64
+	// MetricsWritten - number of metric values read from the file in the inserted KV documents
+	MetricsWritten int64
+	// Skipped - number of parsed documents not inserted (already stored, duplicate or unknown device)
+	Skipped int64
+	// FileType - "csv", "amchua", "baria", "zip" or the name of a KV_FORMATS format
+	FileType string
+	// Generation - GCS generation of the processed object (0 if unknown)
+	Generation int64
 }
 
 // ProcessCSVFile processes CSV file and inserts into MongoDB
 // Uses the global MongoDatabase connection
 // Special handling for HoAmChua_TramTT files
+// TOA5 .dat files are processed identically to .csv files
+// .zip archives are processed entry by entry (see ProcessZipReader)
+// Returns the number of inserted documents; see ProcessFile for the detailed result
 func ProcessCSVFile(ctx context.Context, bucket string, filename string) (int64, error) {
-	client, err := storage.NewClient(ctx)
+	result, err := ProcessFile(ctx, bucket, filename)
+	return result.Inserted, err
+}
+
+// ProcessFile processes a file like ProcessCSVFile and returns the detailed result
+// The result is never nil, even on error (fields are filled as far as processing got)
+func ProcessFile(ctx context.Context, bucket string, filename string) (*ProcessResult, error) {
+	logger := LoggerFrom(ctx)
+	result := &ProcessResult{FileType: FileTypeCSV}
+
+	// Apply the per-bucket settings (BUCKET_CONFIG), if any
+	ctx = withBucketSettings(ctx, BucketSettingsFor(bucket))
+
+	client, err := storageClient()
 	if err != nil {
-		return 0, fmt.Errorf("file %s: failed to create GCS client: %w", filename, err)
+		return result, fmt.Errorf("file %s: failed to create GCS client: %w", filename, err)
 	}
-	defer client.Close()
 
-	bucketObj := client.Bucket(bucket)
+	bucketObj := bucketHandle(client, bucket)
 	file := bucketObj.Object(filename)
 
-	reader, err := file.NewReader(ctx)
+	// Skip misrouted uploads (images, binaries) before downloading them
+	if GlobalConfig != nil && len(GlobalConfig.AllowedContentTypes) > 0 {
+		attrs, err := file.Attrs(ctx)
+		if err != nil {
+			return result, fmt.Errorf("file %s: failed to read GCS attributes (bucket: %s): %w", filename, bucket, err)
+		}
+		if !isAllowedContentType(attrs.ContentType) {
+			logger.Warnf("file %s: content type %q not in ALLOWED_CONTENT_TYPES, skipping", filename, attrs.ContentType)
+			return result, nil
+		}
+	}
+
+	reader, generation, err := openObject(ctx, bucketObj, filename)
 	if err != nil {
-		return 0, fmt.Errorf("file %s: failed to open GCS file (bucket: %s): %w", filename, bucket, err)
+		return result, fmt.Errorf("file %s: failed to open GCS file (bucket: %s): %w", filename, bucket, err)
 	}
 	defer reader.Close()
 
+	// Tag records with the object generation (STORE_GENERATION)
+	ctx = withObjectGeneration(ctx, generation)
+
+	process := ProcessReader
+	if IsZipFile(filename) {
+		process = ProcessZipReader
+	}
+	result, err = process(ctx, filename, reader)
+	result.Generation = generation
+	return result, err
+}
+
+// logSampleRecords logs the first LOG_SAMPLE_RECORDS parsed records of a file at info level
+func logSampleRecords(ctx context.Context, filename string, records []SensorRecord) {
+	if GlobalConfig == nil || GlobalConfig.LogSampleRecords <= 0 {
+		return
+	}
+	n := min(GlobalConfig.LogSampleRecords, len(records))
+	for i, record := range records[:n] {
+		LoggerFrom(ctx).Infof("file %s: sample record [%d/%d]: %+v", filename, i+1, len(records), record)
+	}
+}
+
+// checkMaxLineBytes returns an error if a line of the content is longer than MAX_LINE_BYTES
+func checkMaxLineBytes(content []byte) error {
+	if GlobalConfig == nil || GlobalConfig.MaxLineBytes <= 0 {
+		return nil
+	}
+	for lineNum := 1; len(content) > 0; lineNum++ {
+		end := bytes.IndexByte(content, '\n')
+		if end == -1 {
+			end = len(content)
+		}
+		if end > GlobalConfig.MaxLineBytes {
+			return fmt.Errorf("line %d is %d bytes long, exceeding MAX_LINE_BYTES (%d)", lineNum, end, GlobalConfig.MaxLineBytes)
+		}
+		content = content[min(end+1, len(content)):]
+	}
+	return nil
+}
+
+// logFailedContent logs the start of the content of a file that failed to parse (LOG_FAILED_CONTENT)
+// At most LOG_FAILED_CONTENT_MAX_BYTES are dumped: as text if printable, else as a hex dump
+func logFailedContent(ctx context.Context, filename string, content []byte) {
+	if GlobalConfig == nil || !GlobalConfig.LogFailedContent {
+		return
+	}
+
+	dump := content
+	if max := GlobalConfig.LogFailedContentMaxBytes; max > 0 && len(dump) > max {
+		dump = dump[:max]
+	}
+	truncated := ""
+	if len(dump) < len(content) {
+		truncated = fmt.Sprintf(", truncated to %d", len(dump))
+	}
+
+	if isPrintableText(dump) {
+		LoggerFrom(ctx).Errorf("file %s: failed content (%d bytes%s):\n%s", filename, len(content), truncated, dump)
+	} else {
+		LoggerFrom(ctx).Errorf("file %s: failed content (%d bytes%s, hex):\n%s", filename, len(content), truncated, hex.Dump(dump))
+	}
+}
+
+// isPrintableText checks if content is valid UTF-8 without control characters other than whitespace
+func isPrintableText(content []byte) bool {
+	if !utf8.Valid(content) {
+		return false
+	}
+	for _, r := range string(content) {
+		if unicode.IsControl(r) && r != '\n' && r != '\r' && r != '\t' {
+			return false
+		}
+	}
+	return true
+}
+
+// checkMinRecords checks the number of records (or KV values) parsed from a file against MIN_RECORDS
+// Below the threshold a warning is logged, or an error returned with MIN_RECORDS_MODE=fail
+func checkMinRecords(ctx context.Context, filename string, count int, unit string) error {
+	if GlobalConfig == nil || GlobalConfig.MinRecords <= 0 || count >= GlobalConfig.MinRecords {
+		return nil
+	}
+	if GlobalConfig.MinRecordsMode == MinRecordsModeFail {
+		return fmt.Errorf("file %s: only %d %s parsed (MIN_RECORDS: %d)", filename, count, unit, GlobalConfig.MinRecords)
+	}
+	LoggerFrom(ctx).Warnf("file %s: only %d %s parsed (MIN_RECORDS: %d)", filename, count, unit, GlobalConfig.MinRecords)
+	return nil
+}
+
+// isAllowedContentType checks a GCS content type against ALLOWED_CONTENT_TYPES
+// Parameters such as "; charset=utf-8" are ignored and the comparison is case-insensitive
+func isAllowedContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = strings.ToLower(strings.TrimSpace(contentType))
+	}
+	return slices.Contains(GlobalConfig.AllowedContentTypes, mediaType)
+}
+
+// ProcessReader processes the content of a file read from r
+// The file type is detected from the filename, as for ProcessFile
+func ProcessReader(ctx context.Context, filename string, r io.Reader) (*ProcessResult, error) {
+	logger := LoggerFrom(ctx)
+	result := &ProcessResult{FileType: FileTypeCSV}
+
+	// Log the inserted record count of long ingestions (PROGRESS_EVERY)
+	ctx = withInsertProgress(ctx, filename)
+
 	// Read file content
 	var buf bytes.Buffer
-	if _, err := io.Copy(&buf, reader); err != nil {
-		return 0, fmt.Errorf("file %s: failed to read GCS file: %w", filename, err)
+	if _, err := io.Copy(&buf, r); err != nil {
+		return result, fmt.Errorf("file %s: failed to read file: %w", filename, err)
+	}
+
+	// Gzipped uploads of any type are decompressed before the file type dispatch;
+	// the dispatch and the filename timestamps use the name without ".gz"
+	if isGzipContent(buf.Bytes()) {
+		content, err := gunzip(buf.Bytes())
+		if err != nil {
+			return result, &ParseError{Err: fmt.Errorf("file %s: failed to decompress gzip content: %w", filename, err)}
+		}
+		name := trimGzipSuffix(filename)
+		logger.Infof("file %s: decompressed gzip content (%d -> %d bytes), processing as %s", filename, buf.Len(), len(content), name)
+		filename = name
+		buf.Reset()
+		buf.Write(content)
 	}
 
-	// Check if this is an AmChua file
-	if IsAmChuaFile(filename) {
-		return ProcessAmChuaFile(ctx, filename, buf.Bytes())
+	switch detectFileType(ctx, filename) {
+	case DetectorDat:
+		// TOA5 .dat files are CSV content: never route them to the KV processors
+		logger.Infof("file %s: TOA5 .dat file, processing as CSV\n", filename)
+	case DetectorAmChua:
+		return ProcessKVFileResult(ctx, AmChuaKVFormat(), filename, buf.Bytes())
+	case DetectorBaria:
+		return ProcessKVFileResult(ctx, BariaKVFormat(), filename, buf.Bytes())
+	case DetectorKV:
+		// KV file configured via KV_FORMATS
+		return ProcessKVFileResult(ctx, MatchKVFormat(filename), filename, buf.Bytes())
 	}
 
-	// Check if this is an BaRia file 
-	if IsBariaFile(filename) {
-		return ProcessBariaFile(ctx, filename, buf.Bytes())
+	// Reject pathological content (e.g. a binary blob without newlines) before the CSV reader buffers it
+	if err := checkMaxLineBytes(buf.Bytes()); err != nil {
+		logFailedContent(ctx, filename, buf.Bytes())
+		return result, &ParseError{Err: fmt.Errorf("file %s: %w", filename, err)}
 	}
 
 	// Extract and format data
-	result, err := ExtractData(filename, buf.Bytes())
+	extract := extractData
+	if IsNDJSONFile(filename) {
+		extract = extractNDJSON
+	}
+	data, err := extract(ctx, filename, buf.Bytes())
 	if err != nil {
-		return 0, fmt.Errorf("file %s: %w", filename, err)
+		logFailedContent(ctx, filename, buf.Bytes())
+		return result, &ParseError{Err: fmt.Errorf("file %s: %w", filename, err)}
+	}
+
+	deviceID := data["device_id"].(string)
+	records := data["records"].([]SensorRecord)
+	fields := data["fields"].([]string)
+	result.DeviceID = deviceID
+
+	if err := checkMinRecords(ctx, filename, len(records), "records"); err != nil {
+		result.Skipped = int64(len(records))
+		return result, &ParseError{Err: err}
 	}
 
-	deviceID := result["device_id"].(string)
-	records := result["records"].([]SensorRecord)
+	// CSV timestamps are parsed in TIMEZONE_OFFSET: apply the bucket timezone, if any
+	reinterpretRecords(records, GlobalConfig.TimezoneLocation, timezoneFor(ctx))
+	for _, record := range records {
+		applyGeneration(ctx, record)
+		applyFileType(record, result.FileType)
+	}
+	// Derived fields (TRANSFORM_SCRIPT)
+	fields = applyTransforms(ctx, filename, records, fields)
+	logSampleRecords(ctx, filename, records)
 
-	// Find the box device
+	// Consolidated multi-station files: each station's records go to its box (STATION_TO_BOX)
+	if stations, ok := data["stations"].([]string); ok {
+		return insertStationRecords(ctx, result, filename, records, stations, fields)
+	}
+
+	// Find the box device (or create it, UNKNOWN_DEVICE_POLICY=autocreate)
 	box, err := FindBoxByDeviceID(ctx, deviceID)
+	if errors.Is(err, ErrUnknownDevice) && GlobalConfig.UnknownDevicePolicy == UnknownDeviceAutoCreate {
+		box, err = CreateBox(ctx, deviceID)
+		if err == nil {
+			logger.Infof("file %s: created box for unknown device %s", filename, deviceID)
+		}
+	}
 	if err != nil {
-		GlobalLogger.Warnf("file %s: %v\n", filename, err)
-		return 0, nil
+		result.Skipped = int64(len(records))
+		return result, unknownDevice(ctx, filename, err)
 	}
 
+	inserted, err := insertBoxRecords(ctx, filename, deviceID, box, records, fields)
+	if err != nil {
+		return result, err
+	}
+	result.Inserted = inserted
+	result.Skipped = int64(len(records)) - inserted
+	return result, nil
+}
+
+// insertBoxRecords inserts the records of a box and updates its last_seen (UPDATE_LAST_SEEN)
+func insertBoxRecords(ctx context.Context, filename string, deviceID string, box *Box, records []SensorRecord, fields []string) (int64, error) {
+	// Denormalize static device metadata onto the readings (BOX_ENRICH_FIELDS)
+	enrichRecords(box, records)
+
 	// Insert sensor records
-	inserted, err := InsertSensorRecords(ctx, filename, deviceID, box, records)
+	inserted, err := InsertSensorRecords(ctx, filename, deviceID, box, records, fields...)
 	if err != nil {
-		return 0, fmt.Errorf("file %s: %w", filename, err)
+		return inserted, fmt.Errorf("file %s: %w", filename, err)
 	}
 
+	// Newest timestamp, read after InsertSensorRecords re-based the records on the box timezone
+	if newest := newestRecordTimestamp(records); GlobalConfig.UpdateLastSeen && newest > 0 {
+		if err := UpdateLastSeen(ctx, box, newest); err != nil {
+			LoggerFrom(ctx).Warnf("file %s: %v", filename, err)
+		}
+	}
 	return inserted, nil
 }
 
+// insertStationRecords inserts the records of a consolidated file into the box of their station
+// Stations without a STATION_TO_BOX entry or box follow UNKNOWN_DEVICE_POLICY
+func insertStationRecords(ctx context.Context, result *ProcessResult, filename string, records []SensorRecord, stations []string, fields []string) (*ProcessResult, error) {
+	var order []string
+	byStation := make(map[string][]SensorRecord)
+	for i, record := range records {
+		station := stations[i]
+		if _, exists := byStation[station]; !exists {
+			order = append(order, station)
+		}
+		byStation[station] = append(byStation[station], record)
+	}
+
+	var boxIDs []string
+	for _, station := range order {
+		stationRecords := byStation[station]
+		boxID, mapped := GlobalConfig.StationToBox[station]
+		if !mapped {
+			result.Skipped += int64(len(stationRecords))
+			if err := unknownDevice(ctx, filename, fmt.Errorf("station %q has no STATION_TO_BOX entry", station)); err != nil {
+				return result, err
+			}
+			continue
+		}
+
+		box, err := FindBoxByID(ctx, boxID)
+		if err != nil {
+			result.Skipped += int64(len(stationRecords))
+			if err := unknownDevice(ctx, filename, fmt.Errorf("station %s: %w", station, err)); err != nil {
+				return result, err
+			}
+			continue
+		}
+
+		inserted, err := insertBoxRecords(ctx, filename, station, box, stationRecords, fields)
+		result.Inserted += inserted
+		if err != nil {
+			return result, err
+		}
+		result.Skipped += int64(len(stationRecords)) - inserted
+		boxIDs = append(boxIDs, boxID)
+	}
+	result.DeviceID = strings.Join(boxIDs, ",")
+	return result, nil
+}
+
+// UNKNOWN_DEVICE_POLICY values
+const (
+	// UnknownDeviceSkip logs a warning and skips the records (original behavior)
+	UnknownDeviceSkip = "skip"
+	// UnknownDeviceFail fails the file, which is copied to load_failed
+	UnknownDeviceFail = "fail"
+	// UnknownDeviceAutoCreate creates the box of an unknown device from BOX_TEMPLATE
+	// (stations without a STATION_TO_BOX entry are skipped)
+	UnknownDeviceAutoCreate = "autocreate"
+)
+
+// unknownDevice applies UNKNOWN_DEVICE_POLICY to a device or station without a box
+// Returns the error to fail the file with, or nil after logging a warning
+// A lookup without MongoDB connection always fails the file: the device may well exist
+func unknownDevice(ctx context.Context, filename string, err error) error {
+	if errors.Is(err, ErrMongoNotConnected) || (GlobalConfig != nil && GlobalConfig.UnknownDevicePolicy == UnknownDeviceFail) {
+		return fmt.Errorf("file %s: %w", filename, err)
+	}
+	LoggerFrom(ctx).Warnf("file %s: %v\n", filename, err)
+	return nil
+}
+
 // copyToFailedFolder copies a failed file to the load_failed folder in GCS
 // This helps with debugging and recovery of files that couldn't be processed
+// The copy is retried FAILED_COPY_RETRIES times with exponential backoff before giving up
 func copyToFailedFolder(ctx context.Context, bucket string, filename string) error {
-	client, err := storage.NewClient(ctx)
+	logger := LoggerFrom(ctx)
+	retries := 0
+	if GlobalConfig != nil {
+		retries = GlobalConfig.FailedCopyRetries
+	}
+
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		size, err := copyToFailedFolderOnce(ctx, bucket, filename)
+		if err == nil {
+			return nil
+		}
+		if attempt >= retries || ctx.Err() != nil {
+			// Last resort: record what was lost
+			logger.Errorf("file %s: copy to load_failed folder lost after %d attempt(s) (bucket: %s, size: %d bytes): %v", filename, attempt+1, bucket, size, err)
+			return err
+		}
+
+		logger.Warnf("file %s: copy to load_failed folder failed (attempt %d/%d): %v, retrying in %s", filename, attempt+1, retries+1, err, backoff)
+		select {
+		case <-ctx.Done():
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// copyToFailedFolderOnce makes a single attempt at copying a failed file to the load_failed folder
+// Returns the size of the source file (-1 if unknown)
+func copyToFailedFolderOnce(ctx context.Context, bucket string, filename string) (int64, error) {
+	logger := LoggerFrom(ctx)
+	client, err := storageClient()
 	if err != nil {
-		return fmt.Errorf("failed to create GCS client: %w", err)
+		return -1, fmt.Errorf("failed to create GCS client: %w", err)
 	}
-	defer client.Close()
 
-	bucketObj := client.Bucket(bucket)
+	bucketObj := bucketHandle(client, bucket)
 	sourceObj := bucketObj.Object(filename)
 
 	// Read the source file
 	reader, err := sourceObj.NewReader(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to read source file: %w", err)
+		return -1, fmt.Errorf("failed to read source file: %w", err)
 	}
 	defer reader.Close()
+	size := reader.Attrs.Size
 
 	// Create destination path: load_failed/<original_filename>
 	failedFilename := fmt.Sprintf("load_failed/%s", filename)
@@ -312,14 +1445,15 @@ func copyToFailedFolder(ctx context.Context, bucket string, filename string) err
 	// Write to destination
 	writer := destObj.NewWriter(ctx)
 	if _, err := io.Copy(writer, reader); err != nil {
-		return fmt.Errorf("failed to copy to load_failed folder: %w", err)
+		writer.Close()
+		return size, fmt.Errorf("failed to copy to load_failed folder: %w", err)
 	}
 	if err := writer.Close(); err != nil {
-		return fmt.Errorf("failed to close destination file: %w", err)
+		return size, fmt.Errorf("failed to close destination file: %w", err)
 	}
 
-	GlobalLogger.Infof("file %s: copied to load_failed folder for debugging\n", filename)
-	return nil
+	logger.Infof("file %s: copied to load_failed folder for debugging\n", filename)
+	return size, nil
 }
 
 // StorageObjectData represents the Cloud Storage event payload
@@ -327,62 +1461,293 @@ type StorageObjectData struct {
 	Name           string `json:"name"`
 	Bucket         string `json:"bucket"`
 	Metageneration string `json:"metageneration"`
+	Generation     string `json:"generation"`
 	TimeCreated    string `json:"timeCreated"`
 	Updated        string `json:"updated"`
 }
 
+// ErrMalformedEvent marks event payloads that can never be processed (invalid JSON, missing name or bucket)
+// helloGCS drops these events instead of returning an error: a platform retry would fail the same way
+var ErrMalformedEvent = errors.New("malformed event payload")
+
+// parseStorageEvent decodes the Cloud Storage event payload
+// Errors wrapping ErrMalformedEvent are permanent; other errors (e.g. an empty payload from
+// an interrupted delivery or an undecodable transport encoding) may succeed on retry
+func parseStorageEvent(ce cloudevents.Event) (StorageObjectData, error) {
+	var data StorageObjectData
+	if len(ce.Data()) == 0 {
+		return data, fmt.Errorf("empty event data")
+	}
+	// JSON payloads are decoded directly: DataAs doesn't wrap the JSON error, so it can't be classified
+	contentType := ce.DataContentType()
+	if contentType == "" || strings.Contains(contentType, "json") {
+		if err := json.Unmarshal(ce.Data(), &data); err != nil {
+			return data, fmt.Errorf("%w: invalid JSON: %v", ErrMalformedEvent, err)
+		}
+	} else if err := ce.DataAs(&data); err != nil {
+		return data, fmt.Errorf("failed to parse event data: %w", err)
+	}
+
+	if data.Name == "" {
+		return data, fmt.Errorf("%w: missing file name in event", ErrMalformedEvent)
+	}
+	if data.Bucket == "" {
+		return data, fmt.Errorf("%w: missing bucket in event", ErrMalformedEvent)
+	}
+	return data, nil
+}
+
+// isMetadataUpdate checks if the event was produced by a metadata-only change on an object
+// Returns false when SKIP_METADATA_UPDATES is disabled or the metageneration is unknown
+func isMetadataUpdate(data StorageObjectData) bool {
+	if GlobalConfig == nil || !GlobalConfig.SkipMetadataUpdates {
+		return false
+	}
+	return data.Metageneration != "" && data.Metageneration != "1"
+}
+
+// eventObjectName returns the object name carried by a Cloud Storage event, or "" if unavailable
+func eventObjectName(ce cloudevents.Event) string {
+	var data StorageObjectData
+	if err := ce.DataAs(&data); err != nil {
+		return ""
+	}
+	return data.Name
+}
+
+// AGE_SOURCE values: the timestamp compared with MAX_EVENT_AGE_SECONDS
+const (
+	AgeSourceEvent         = "event"
+	AgeSourceObjectUpdated = "object-updated"
+	AgeSourceObjectCreated = "object-created"
+)
+
+// eventAgeTime returns the timestamp driving the event age check (AGE_SOURCE)
+// Object times are read from the object attributes; if the object can't be read, the times of
+// the event payload are used, then the event time
+func eventAgeTime(ctx context.Context, ce cloudevents.Event) time.Time {
+	if GlobalConfig == nil || GlobalConfig.AgeSource == AgeSourceEvent || EVENT_MAX_AGE_SECONDS == 0 {
+		return ce.Time()
+	}
+
+	var data StorageObjectData
+	if err := ce.DataAs(&data); err != nil || data.Name == "" || data.Bucket == "" {
+		return ce.Time()
+	}
+
+	created, updated := data.TimeCreated, data.Updated
+	attrs, err := objectAttrs(ctx, data.Bucket, data.Name)
+	if err == nil {
+		created, updated = attrs.Created.Format(time.RFC3339Nano), attrs.Updated.Format(time.RFC3339Nano)
+	} else {
+		LoggerFrom(ctx).Warnf("file %s: failed to read object attributes for the age check, using the event payload: %v", data.Name, err)
+	}
+
+	value := updated
+	if GlobalConfig.AgeSource == AgeSourceObjectCreated {
+		value = created
+	}
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return ce.Time()
+	}
+	return t
+}
+
+// objectAttrs reads the attributes of a GCS object with the shared client
+func objectAttrs(ctx context.Context, bucket string, filename string) (*storage.ObjectAttrs, error) {
+	client, err := storageClient()
+	if err != nil {
+		return nil, err
+	}
+	return bucketHandle(client, bucket).Object(filename).Attrs(ctx)
+}
+
+// inProcessWindow checks if t falls within PROCESS_HOURS (clock hours in TIMEZONE_OFFSET)
+// Always true when no window is configured
+func inProcessWindow(t time.Time) bool {
+	if GlobalConfig == nil || GlobalConfig.ProcessHours == nil {
+		return true
+	}
+	return GlobalConfig.ProcessHours.Contains(t.In(GlobalConfig.TimezoneLocation).Hour())
+}
+
+// eventTraceID returns the trace ID of an event: the W3C traceparent extension if present
+// ("00-<trace id>-<span id>-<flags>"), otherwise a random per-event ID
+func eventTraceID(ce cloudevents.Event) string {
+	if traceparent, ok := ce.Extensions()["traceparent"].(string); ok {
+		if traceID := traceIDFromTraceparent(traceparent); traceID != "" {
+			return traceID
+		}
+	}
+	if traceID := randomTraceID(); traceID != "" {
+		return traceID
+	}
+	return ce.ID()
+}
+
+// traceIDFromTraceparent returns the trace ID of a W3C traceparent value, or "" if malformed
+func traceIDFromTraceparent(traceparent string) string {
+	if parts := strings.Split(traceparent, "-"); len(parts) == 4 && len(parts[1]) == 32 {
+		return parts[1]
+	}
+	return ""
+}
+
+// randomTraceID returns a random 32 hex digit trace ID, or "" if the random source fails
+func randomTraceID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(id)
+}
+
 // helloGCS handles Cloud Events from Cloud Storage
 func helloGCS(ctx context.Context, ce cloudevents.Event) error {
+	setupRuntime()
+
+	// Tie every log line of this event together (LOG_TRACE)
+	logger := GlobalLogger.WithTrace(eventTraceID(ce))
+	ctx = WithLogger(ctx, logger)
+
 	eventID := ce.ID()
-	GlobalLogger.Infof("Event ID: %s\n", eventID)
-	GlobalLogger.Infof("Event Type: %s\n", ce.Type())
+	logger.Infof("Event ID: %s\n", eventID)
+	logger.Infof("Event Type: %s\n", ce.Type())
 
 	// Check event age to prevent processing old stale events
-	eventTime := ce.Time()
-	if !eventTime.IsZero() && isEventTooOld(eventTime) {
-		age := time.Since(eventTime)
-		maxAgeDisplay := EVENT_MAX_AGE_SECONDS / 3600
-		GlobalLogger.Warnf("Event ID %s: Skipping - event is too old (%v, max: %d seconds / %d hours)\n", eventID, age, EVENT_MAX_AGE_SECONDS, maxAgeDisplay)
-		return nil // Silently succeed to prevent retries
+	// (AGE_SOURCE selects the event time or the object creation/update time)
+	eventTime := eventAgeTime(ctx, ce)
+	if !eventTime.IsZero() && isEventTooOld(ctx, eventTime) {
+		age := nowFunc().Sub(eventTime)
+		if name := eventObjectName(ce); name != "" && IsAgeCheckExempt(name) {
+			logger.Infof("Event ID %s: file %s is exempt from the age check (%v old), processing\n", eventID, name, age)
+		} else {
+			maxAgeDisplay := EVENT_MAX_AGE_SECONDS / 3600
+			logger.Warnf("Event ID %s: Skipping - event is too old (%v, max: %d seconds / %d hours)\n", eventID, age, EVENT_MAX_AGE_SECONDS, maxAgeDisplay)
+			return nil // Silently succeed to prevent retries
+		}
 	}
 
 	// Parse the Cloud Storage event data
-	var data StorageObjectData
-	if err := ce.DataAs(&data); err != nil {
-		return fmt.Errorf("failed to parse event data: %w", err)
+	// Malformed or incomplete payloads can't be fixed by redelivery: log and succeed
+	// Other failures are returned so the platform retries the event
+	data, err := parseStorageEvent(ce)
+	if err != nil {
+		if errors.Is(err, ErrMalformedEvent) {
+			logger.Errorf("Event ID %s: %v, dropping event", eventID, err)
+			return nil
+		}
+		return err
 	}
 
 	filename := data.Name
 	bucketName := data.Bucket
 
-	if filename == "" {
-		return fmt.Errorf("missing file name in event")
+	logger.Infof("Bucket: %s\n", bucketName)
+	logger.Infof("File: %s\n", filename)
+
+	// Skip metadata-only updates: only the initial object creation has metageneration 1
+	if isMetadataUpdate(data) {
+		logger.Infof("file %s: skipping metadata-only update (metageneration=%s)\n", filename, data.Metageneration)
+		return nil
+	}
+
+	// Result manifests are written to the same bucket: don't process them
+	if isResultManifestObject(filename) {
+		logger.Debugf("file %s: result manifest, skipping", filename)
+		return nil
 	}
 
-	if bucketName == "" {
-		return fmt.Errorf("missing bucket in event")
+	// Check allow and ignore patterns (per-bucket patterns take precedence)
+	// Manifests (MANIFEST_PATTERN) don't need to match ALLOW_PATTERNS
+	manifest := IsManifestFile(filename)
+	if !manifest && !BucketSettingsFor(bucketName).FilePattern().shouldProcess(ctx, filename) {
+		return nil
+	}
+
+	// Archiving writes to the same bucket: don't process the archive copies
+	if isArchivedObject(filename) {
+		logger.Debugf("file %s: archived file, skipping", filename)
+		return nil
+	}
+
+	// Outside PROCESS_HOURS, defer the event (platform retry) or skip it
+	if !inProcessWindow(nowFunc()) {
+		if GlobalConfig.ProcessHoursMode == ProcessHoursModeSkip {
+			logger.Warnf("file %s: outside PROCESS_HOURS %s, skipping", filename, GlobalConfig.ProcessHours)
+			return nil
+		}
+		logger.Infof("file %s: outside PROCESS_HOURS %s, deferring", filename, GlobalConfig.ProcessHours)
+		return fmt.Errorf("file %s: outside PROCESS_HOURS %s, retry later", filename, GlobalConfig.ProcessHours)
 	}
 
-	GlobalLogger.Infof("Bucket: %s\n", bucketName)
-	GlobalLogger.Infof("File: %s\n", filename)
+	// Files that failed QUARANTINE_THRESHOLD times are not reprocessed
+	if IsQuarantined(ctx, bucketName, filename) {
+		logger.Debugf("file %s: quarantined after repeated failures, skipping", filename)
+		return nil
+	}
 
-	// Check allow and ignore patterns
-	if !ShouldProcessFile(filename) {
+	// Generations already processed are not reprocessed (SKIP_PROCESSED_FILES)
+	generation, _ := strconv.ParseInt(data.Generation, 10, 64)
+	if IsProcessed(ctx, bucketName, filename, generation) {
+		logger.Infof("file %s: generation %d already processed, skipping", filename, generation)
 		return nil
 	}
 
-	// Process the CSV file (using global MongoDB connection)
-	_, err := ProcessCSVFile(ctx, bucketName, filename)
+	// Process the CSV file (using global MongoDB connection), or the files listed by a manifest
+	process := ProcessFile
+	if manifest {
+		process = ProcessManifest
+	}
+	start := time.Now()
+	result, err := process(ctx, bucketName, filename)
+	logSummary(ctx, filename, result, time.Since(start), err)
 	if err != nil {
-		// Copy failed file to load_failed folder for debugging
-		if copyErr := copyToFailedFolder(ctx, bucketName, filename); copyErr != nil {
-			GlobalLogger.Errorf("file %s: error copying to load_failed folder: %v\n", filename, copyErr)
+		// Transient MongoDB/GCS failures are retried by the platform (RETRY_ON_MONGO_ERROR)
+		// The failure is still counted, so QUARANTINE_THRESHOLD bounds the retries
+		if isRetryableError(err) {
+			logger.Errorf("file processing error %s (%s, retrying): %s", filename, classifyError(err), err)
+			if _, qErr := recordFailure(ctx, bucketName, filename, result.FileType, err); qErr != nil {
+				logger.Warnf("file %s: %v", filename, qErr)
+			}
+			return err
+		}
+
+		// Copy failed file to load_failed folder for debugging (unless COPY_FAILED=false)
+		if GlobalConfig.CopyFailed {
+			if copyErr := copyToFailedFolder(ctx, bucketName, filename); copyErr != nil {
+				logger.Errorf("file %s: error copying to load_failed folder: %v\n", filename, copyErr)
+			}
+		}
+		logger.Errorf("file processing error %s: %s", filename, err)
+
+		quarantined, qErr := recordFailure(ctx, bucketName, filename, result.FileType, err)
+		if qErr != nil {
+			logger.Warnf("file %s: %v", filename, qErr)
+		} else if quarantined {
+			logger.Errorf("file %s: quarantined after %d failures, it will not be reprocessed (remove it from %s to retry)", filename, GlobalConfig.QuarantineThreshold, QuarantineCollection)
 		}
-		GlobalLogger.Errorf("file processing error %s: %s", filename, err)
 		return nil
 	}
+	clearFailures(ctx, bucketName, filename)
+	if err := markProcessed(ctx, bucketName, filename, result); err != nil {
+		logger.Warnf("file %s: %v", filename, err)
+	}
 
-	GlobalLogger.Infof("file %s: processed successfully\n", filename)
+	if err := writeGCSManifest(ctx, bucketName, filename, result); err != nil {
+		logger.Warnf("file %s: failed to write GCS manifest: %v", filename, err)
+	}
+	// The records are written at this point, also with micro-batching: the source can be deleted
+	if err := archiveProcessedFile(ctx, bucketName, filename, result.Generation); err != nil {
+		logger.Warnf("file %s: failed to archive: %v", filename, err)
+	}
+
+	if result.MetricsWritten > 0 {
+		logger.Infof("file %s: processed successfully (type: %s, inserted: %d documents, %d metric values, skipped: %d)\n", filename, result.FileType, result.Inserted, result.MetricsWritten, result.Skipped)
+	} else {
+		logger.Infof("file %s: processed successfully (type: %s, inserted: %d documents, skipped: %d)\n", filename, result.FileType, result.Inserted, result.Skipped)
+	}
 	return nil
 }
 
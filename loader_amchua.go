@@ -4,16 +4,25 @@ import (
 	"context"
 	"fmt"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"time"
-
-	"go.mongodb.org/mongo-driver/bson"
 )
 
+// Metric maps a key of a KV file (Name) to the stored field code (Code)
+// The stored value is value*Scale + Offset (an unset or zero Scale means 1)
 type Metric struct {
-	Code string `json:"code"`
-	Name string `json:"name"`
+	Code   string  `json:"code"`
+	Name   string  `json:"name"`
+	Scale  float64 `json:"scale,omitempty"`
+	Offset float64 `json:"offset,omitempty"`
+}
+
+// Apply returns the stored value of a metric value read from a file
+func (m Metric) Apply(v float64) float64 {
+	if m.Scale != 0 {
+		v *= m.Scale
+	}
+	return v + m.Offset
 }
 
 // AmChuaBox represents a box configuration for HoAmChua_TramTT files
@@ -70,7 +79,7 @@ func IsAmChuaFile(filename string) bool {
 }
 
 // parseFilenameForTimestamp extracts the date and time from the filename,
-// converts it to a UTC Unix timestamp, and rounds it to the nearest minute.
+// converts it to a UTC Unix timestamp, and truncates it according to KV_TRUNCATE (minute by default).
 func parseFilenameForTimestamp(filename string) (int64, error) {
 	// The expected format for the date/time part: YYYYMMDDhhmmss
 	const timeLayout = "20060102150405"
@@ -86,100 +95,44 @@ func parseFilenameForTimestamp(filename string) (int64, error) {
 	}
 
 	// 2. Parse the time string
-	t, err := time.ParseInLocation(timeLayout, base, GlobalConfig.TimezoneLocation)
+	t, err := time.ParseInLocation(timeLayout, base, configTimezone())
 	if err != nil {
 		return 0, fmt.Errorf("failed to parse time string '%s': %w", base, err)
 	}
 
-	// 3. Round (truncate) the time to the minute.
-	// This sets seconds and nanoseconds to zero, effectively finding the
+	// 3. Truncate the time (KV_TRUNCATE).
+	// By default this sets seconds and nanoseconds to zero, effectively finding the
 	// timestamp for the start of the minute.
-	tRounded := t.Truncate(time.Minute)
+	tRounded := truncateKVTime(t)
 
 	// 4. Return the Unix timestamp (seconds since epoch)
 	return tRounded.Unix(), nil
 }
 
-// ProcessAmChuaFile processes a HoAmChua_TramTT file
-// Reads tab-separated key-value pairs and inserts them into MongoDB for each configured box
-func ProcessAmChuaFile(ctx context.Context, filename string, content []byte) (int64, error) {
-	// Convert timestamp to Unix
-	ts, err := parseFilenameForTimestamp(filename)
-	if err != nil {
-		return 0, fmt.Errorf("file %s: %w", filename, err)
-	}
-
-	// Parse tab-separated or space-separated values from content
-	contentStr := strings.TrimSpace(string(content))
-	lines := strings.Split(contentStr, "\n")
-
-	// Build key-value map from lines
-	valueMap := make(map[string]float64)
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if line == "" {
-			continue
-		}
-
-		parts := strings.Fields(line)
-
-		if len(parts) >= 2 {
-			key := strings.TrimSpace(parts[0])
-			value, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
-			if err != nil {
-				GlobalLogger.Infof("parse value failed %s %s: %s\n", filename, key, parts[1])
-				return 0, nil
-			}
-			valueMap[key] = value
-		}
-	}
-
-	GlobalLogger.Infof("file %s: processing with timestamp %d (%s)\n", filename, ts, time.Unix(ts, 0).UTC().Format("2006-01-02 15:04:05"))
-
-	// Process for each configured box
-	insertedCount := int64(0)
-	now := time.Now().Unix()
-
+// AmChuaKVFormat returns the KV format preset for HoAmChua_TramTT files
+// Every AmChuaBoxes entry receives a document per file (one per metric with AMCHUA_FANOUT_METRICS)
+// The preset keeps the original AmChua error handling: a non-numeric value drops the whole file
+// and insert errors are only logged
+func AmChuaKVFormat() *KVFormat {
+	boxes := make([]KVBox, 0, len(AmChuaBoxes))
 	for _, box := range AmChuaBoxes {
-		// Build document for this box
-		doc := bson.M{
-			"_id": ts,
-			"c":   now, // current timestamp
-		}
-
-		// Add metrics from valueMap
-		for _, metric := range box.Metrics {
-			if value, exists := valueMap[metric.Name]; exists {
-				doc[metric.Code] = value
-			} else {
-				doc[metric.Code] = 0
-			}
-		}
-
-		// Insert into collection
-		colName := fmt.Sprintf("sensor_data_%s", box.ID)
-		collection := MongoDatabase.Collection(colName)
-
-		// Print record before insert if debug flag is enabled
-		if GlobalConfig != nil && GlobalConfig.Debug {
-			GlobalLogger.Infof("file %s: [DEBUG] inserting record into collection %s: %+v", filename, box.ID, doc)
-		}
-
-		_, err := collection.InsertOne(ctx, doc)
-		if err != nil {
-			// Check if it's a duplicate key error (which we can ignore)
-			if strings.Contains(err.Error(), "duplicate key") {
-				GlobalLogger.Warnf("file %s: duplicate record for box %s at timestamp %d\n", filename, box.ID, ts)
-				continue
-			}
-			GlobalLogger.Warnf("file %s: error inserting record for box %s: %v\n", filename, box.ID, err)
-			continue
-		}
-
-		insertedCount++
-		GlobalLogger.Debugf("file %s: inserted record into sensor_data_%s\n", filename, box.ID)
+		boxes = append(boxes, KVBox{ID: box.ID, Metrics: box.Metrics})
+	}
+	return &KVFormat{
+		Name:            FileTypeAmChua,
+		Match:           "HoAmChua_TramTT",
+		TimestampSource: KVTimestampSourceFilename,
+		Boxes:           boxes,
+		FanOutMetrics:   GlobalConfig != nil && GlobalConfig.AmChuaFanOut,
+
+		DropOnInvalidValue: true,
+		IgnoreInsertErrors: true,
 	}
+}
 
-	GlobalLogger.Infof("file %s: inserted %d records from AmChua file\n", filename, insertedCount)
-	return insertedCount, nil
+// ProcessAmChuaFile processes a HoAmChua_TramTT file
+// Reads tab-separated or space-separated key-value pairs and inserts them into MongoDB for each configured box
+// Returns the number of documents inserted (one per box)
+func ProcessAmChuaFile(ctx context.Context, filename string, content []byte) (int64, error) {
+	return ProcessKVFile(ctx, AmChuaKVFormat(), filename, content)
 }
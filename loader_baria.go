@@ -4,11 +4,9 @@ import (
 	"context"
 	"fmt"
 	"path/filepath"
-	"strconv"
+	"regexp"
 	"strings"
 	"time"
-
-	"go.mongodb.org/mongo-driver/bson"
 )
 
 type BoxBR struct {
@@ -85,113 +83,96 @@ func IsBariaFile(filename string) bool {
 func MatchBariaBox(filename string) *BoxBR {
 	path := filepath.ToSlash(filename)
 
-	for _, box := range BoxesBR {
-		if strings.Contains(path, box.Path) {
-			return &box
+	// Prefer the longest matching path: station names may share a prefix
+	var match *BoxBR
+	for i := range BoxesBR {
+		box := &BoxesBR[i]
+		if strings.Contains(path, box.Path) && (match == nil || len(box.Path) > len(match.Path)) {
+			match = box
 		}
 	}
-	return nil
+	if match == nil {
+		return nil
+	}
+	box := *match
+	return &box
 }
 
 //
 // ===== PROCESS FILE =====
 //
 
+// digitRunPattern matches runs of digits in a filename (timestamp candidates)
+var digitRunPattern = regexp.MustCompile(`[0-9]+`)
+
+// ParseBariaTimestampFromFilename extracts the timestamp from a Baria filename
+// The timestamp is the last "_"-separated segment (e.g. "MNH_SongRay_20251227200009.txt");
+// if that segment is not exactly 14 digits, the last 14-digit run in the name is used
+// (e.g. "MNH_20251227200009_retry.txt")
 func ParseBariaTimestampFromFilename(filename string) (int64, error) {
 	base := filepath.Base(filename)
 	base = strings.TrimSuffix(base, filepath.Ext(base))
 
-	idx := strings.LastIndex(base, "_")
-	if idx == -1 {
-		return 0, fmt.Errorf("invalid baria filename: %s", base)
+	tsStr := ""
+	if idx := strings.LastIndex(base, "_"); idx != -1 && isTimestampDigits(base[idx+1:]) {
+		tsStr = base[idx+1:] // 20251227200009
+	} else {
+		for _, run := range digitRunPattern.FindAllString(base, -1) {
+			if isTimestampDigits(run) {
+				tsStr = run
+			}
+		}
+	}
+	if tsStr == "" {
+		return 0, fmt.Errorf("invalid baria filename: %s (no 14-digit timestamp)", base)
 	}
-
-	tsStr := base[idx+1:] // 20251227200009
 
 	t, err := time.ParseInLocation(
 		"20060102150405",
 		tsStr,
-		GlobalConfig.TimezoneLocation,
+		configTimezone(),
 	)
 	if err != nil {
 		return 0, err
 	}
 
-	return t.Truncate(time.Minute).Unix(), nil
+	return truncateKVTime(t).Unix(), nil
 }
 
-func ProcessBariaFile(
-	ctx context.Context,
-	filename string,
-	content []byte,
-) (int64, error) {
-
-	// 1. Match box theo path
-	box := MatchBariaBox(filename)
-
-	// 2. Parse timestamp từ filename (sau dấu _)
-	ts, err := ParseBariaTimestampFromFilename(filename)
-	if err != nil {
-		return 0, fmt.Errorf("file %s: %w", filename, err)
+// isTimestampDigits checks if s is exactly 14 digits (YYYYMMDDhhmmss)
+func isTimestampDigits(s string) bool {
+	if len(s) != 14 {
+		return false
 	}
-
-	// 3. Parse content (TAB-separated)
-	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
-	valueMap := make(map[string]float64)
-
-	for _, line := range lines {
-		parts := strings.Split(line, "\t")
-		if len(parts) < 2 {
-			continue
-		}
-
-		key := strings.TrimSpace(parts[0])
-		valStr := strings.TrimSpace(parts[1])
-
-		v, err := strconv.ParseFloat(valStr, 64)
-		if err != nil {
-			GlobalLogger.Warnf("file %s: parse failed %s=%s", filename, key, valStr)
-			continue
-		}
-
-		valueMap[key] = v
-	}
-
-	// 4. Build document
-	doc := bson.M{
-		"_id": ts,
-		"c":   time.Now().Unix(),
-	}
-
-	for _, m := range box.Metrics {
-		if v, ok := valueMap[m.Name]; ok {
-			doc[m.Code] = v
-		} else {
-			doc[m.Code] = 0
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
 		}
 	}
+	return true
+}
 
-	// 5. Insert Mongo
-	col := MongoDatabase.Collection(
-		fmt.Sprintf("sensor_data_%s", box.ID),
-	)
-
-	if GlobalConfig != nil && GlobalConfig.Debug {
-		GlobalLogger.Infof("[DEBUG] insert %s → %s : %+v", filename, box.ID, doc)
+// BariaKVFormat returns the KV format preset for Baria station files
+// The box is selected by matching its Path against the filename
+func BariaKVFormat() *KVFormat {
+	boxes := make([]KVBox, 0, len(BoxesBR))
+	for _, box := range BoxesBR {
+		boxes = append(boxes, KVBox{ID: box.ID, Path: box.Path, Metrics: box.Metrics})
 	}
-
-	_, err = col.InsertOne(ctx, doc)
-	if err != nil {
-		if strings.Contains(err.Error(), "duplicate key") {
-			GlobalLogger.Warnf(
-				"file %s: duplicate ts %d for box %s",
-				filename, ts, box.ID,
-			)
-			return 0, nil // chặn CSV
-		}
-		return 0, err
+	return &KVFormat{
+		Name:            FileTypeBaria,
+		Delimiter:       "\t",
+		TimestampSource: KVTimestampSourceFilenameSuffix,
+		Boxes:           boxes,
 	}
+}
 
-	GlobalLogger.Infof("file %s: inserted record for box %s", filename, box.ID)
-	return 1, nil
+// ProcessBariaFile processes a Baria station file (TAB-separated key-value pairs)
+// Returns the number of documents inserted (one per box)
+func ProcessBariaFile(
+	ctx context.Context,
+	filename string,
+	content []byte,
+) (int64, error) {
+	return ProcessKVFile(ctx, BariaKVFormat(), filename, content)
 }
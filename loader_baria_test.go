@@ -0,0 +1,81 @@
+package loader
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseBariaTimestampFromFilename(t *testing.T) {
+	want := time.Date(2025, time.December, 27, 20, 0, 0, 0, GlobalConfig.TimezoneLocation).Unix()
+	tests := []struct {
+		filename string
+		wantErr  bool
+	}{
+		{"HoSongRay_KenhSongRay/MNK_SongRay_20251227200009.txt", false},
+		{"HoDaBang_TramDoMN+MoCong/MNH_Da_Ban_01_20251227200009.txt", false},
+		{"HoSongRay_HaLuu/MNHL_20251227200009_retry.txt", false},
+		{"HoSongRay_HaLuu/MNHL_SongRay.txt", true},
+		{"HoSongRay_HaLuu/MNHL_2025122720.txt", true},
+	}
+	for _, tt := range tests {
+		got, err := ParseBariaTimestampFromFilename(tt.filename)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseBariaTimestampFromFilename(%q) error = %v, wantErr %v", tt.filename, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && got != want {
+			t.Errorf("ParseBariaTimestampFromFilename(%q) = %d, want %d", tt.filename, got, want)
+		}
+	}
+}
+
+func TestMatchBariaBoxLongestPath(t *testing.T) {
+	previous := BoxesBR
+	BoxesBR = []BoxBR{
+		{ID: "SHORT", Path: "HoKimLong_TramDo"},
+		{ID: "LONG", Path: "HoKimLong_TramDoMoCong"},
+		{ID: "OTHER", Path: "HoKimLong_TramDoMucNuoc"},
+	}
+	t.Cleanup(func() { BoxesBR = previous })
+
+	tests := map[string]string{
+		"HoKimLong_TramDoMoCong/Domocong_20251227200009.txt":   "LONG",
+		"HoKimLong_TramDoMucNuoc/MNH_20251227200009.txt":       "OTHER",
+		"HoKimLong_TramDo/MNH_20251227200009.txt":              "SHORT",
+		"HoKimLong_TramDoMoCongMoi/MNH_20251227200009.txt":     "LONG",
+		"HoSongRay_KenhSongRay/MNK_SongRay_20251227200009.txt": "",
+	}
+	for filename, want := range tests {
+		got := ""
+		if box := MatchBariaBox(filename); box != nil {
+			got = box.ID
+		}
+		if got != want {
+			t.Errorf("MatchBariaBox(%q) = %q, want %q", filename, got, want)
+		}
+	}
+}
+
+func TestKVFormatMatchBoxesLongestPath(t *testing.T) {
+	format := &KVFormat{Name: FileTypeBaria, Boxes: []KVBox{
+		{ID: "ALL"},
+		{ID: "SHORT", Path: "HoKimLong_TramDo"},
+		{ID: "LONG", Path: "HoKimLong_TramDoMoCong"},
+	}}
+	logs := captureLogs(t)
+
+	boxes := format.MatchBoxes("HoKimLong_TramDoMoCong/Domocong_20251227200009.txt")
+	if len(boxes) != 2 || boxes[0].ID != "ALL" || boxes[1].ID != "LONG" {
+		t.Errorf("MatchBoxes() = %+v, want the path-less box and the longest path", boxes)
+	}
+	if !strings.Contains(logs.String(), "box paths [HoKimLong_TramDo HoKimLong_TramDoMoCong] all match, using the longest") {
+		t.Errorf("multiple matches not logged:\n%s", logs)
+	}
+
+	logs.Reset()
+	boxes = format.MatchBoxes("HoKimLong_TramDo/MNH_20251227200009.txt")
+	if len(boxes) != 2 || boxes[1].ID != "SHORT" || strings.Contains(logs.String(), "all match") {
+		t.Errorf("single match: MatchBoxes() = %+v, logs:\n%s", boxes, logs)
+	}
+}
@@ -0,0 +1,605 @@
+package loader
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Units of the "c" (ingest time) field (INGEST_TIME_UNIT)
+const (
+	IngestTimeUnitSeconds      = "s"
+	IngestTimeUnitMilliseconds = "ms"
+)
+
+// MISSING_METRIC_POLICY values
+const (
+	// MissingMetricZero stores 0 for a missing metric (original behavior)
+	MissingMetricZero = "zero"
+	// MissingMetricSkip omits the missing metric from the document
+	MissingMetricSkip = "skip"
+	// MissingMetricNull stores null for a missing metric
+	MissingMetricNull = "null"
+)
+
+// KV timestamp sources
+const (
+	// KVTimestampSourceFilename parses the whole base filename as YYYYMMDDhhmmss (AmChua style)
+	KVTimestampSourceFilename = "filename"
+	// KVTimestampSourceFilenameSuffix parses the segment after the last "_" as YYYYMMDDhhmmss (Baria style)
+	KVTimestampSourceFilenameSuffix = "filename_suffix"
+)
+
+// KVBox represents a box receiving values from a key-value file
+type KVBox struct {
+	ID string `json:"id"`
+	// Path is matched as a substring of the filename; empty means the box receives every file of the format
+	Path    string   `json:"path"`
+	Metrics []Metric `json:"metrics"`
+}
+
+// KVFormat describes a key-value file format (one "key<delimiter>value" pair per line)
+// The AmChua and Baria processors are presets of this format
+type KVFormat struct {
+	Name string `json:"name"`
+	// Match is a substring identifying files of this format; if empty, a file matches when any box Path matches
+	Match string `json:"match"`
+	// Delimiter between key and value; empty means any whitespace
+	Delimiter string `json:"delimiter"`
+	// TimestampSource is "filename" (default) or "filename_suffix"
+	TimestampSource string  `json:"timestamp_source"`
+	Boxes           []KVBox `json:"boxes"`
+	// FanOutMetrics stores each metric in its own sensor_data_<box ID>_<code> collection instead of one document per box
+	FanOutMetrics bool `json:"fan_out_metrics"`
+	// DropOnInvalidValue drops the whole file, without an error, when a value is not numeric
+	// (otherwise the line is skipped and the other values are stored)
+	DropOnInvalidValue bool `json:"drop_on_invalid_value"`
+	// IgnoreInsertErrors only logs insert errors instead of failing the file
+	IgnoreInsertErrors bool `json:"ignore_insert_errors"`
+}
+
+// GlobalKVFormats holds the KV formats loaded from KV_FORMATS / KV_FORMATS_FILE
+var GlobalKVFormats []*KVFormat
+
+// InitKVFormats loads the externalized KV formats from environment variables
+// Environment variables:
+//
+//	KV_FORMATS - JSON array of KV formats
+//	KV_FORMATS_FILE - path to a JSON file holding the array (used when KV_FORMATS is not set)
+//
+// Example: [{"name":"lake","match":"HoMoi_","delimiter":"\t","timestamp_source":"filename_suffix",
+// "boxes":[{"id":"ABCD1234","metrics":[{"code":"WAU","name":"MNH"}]}]}]
+func InitKVFormats() {
+	raw := os.Getenv("KV_FORMATS")
+	source := "KV_FORMATS"
+	if raw == "" {
+		path := os.Getenv("KV_FORMATS_FILE")
+		if path == "" {
+			GlobalLogger.Info("KV_FORMATS not set, only built-in KV formats (AmChua, Baria) are enabled")
+			return
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			GlobalLogger.Fatalf("failed to read KV_FORMATS_FILE %s: %v", path, err)
+		}
+		raw = string(data)
+		source = path
+	}
+
+	var formats []*KVFormat
+	if err := json.Unmarshal([]byte(raw), &formats); err != nil {
+		GlobalLogger.Fatalf("invalid KV formats in %s: %v", source, err)
+	}
+	for _, format := range formats {
+		if err := format.validate(); err != nil {
+			GlobalLogger.Fatalf("invalid KV formats in %s: %v", source, err)
+		}
+	}
+
+	GlobalKVFormats = formats
+	GlobalLogger.Infof("Loaded %d KV format(s) from %s", len(formats), source)
+}
+
+// validate checks a KV format and fills in defaults
+func (f *KVFormat) validate() error {
+	if f.Name == "" {
+		return fmt.Errorf("KV format is missing a name")
+	}
+	if len(f.Boxes) == 0 {
+		return fmt.Errorf("KV format %s has no boxes", f.Name)
+	}
+	switch f.TimestampSource {
+	case "":
+		f.TimestampSource = KVTimestampSourceFilename
+	case KVTimestampSourceFilename, KVTimestampSourceFilenameSuffix:
+	default:
+		return fmt.Errorf("KV format %s has unknown timestamp_source %q", f.Name, f.TimestampSource)
+	}
+	for _, box := range f.Boxes {
+		if box.ID == "" {
+			return fmt.Errorf("KV format %s has a box without id", f.Name)
+		}
+		if f.Match == "" && box.Path == "" {
+			return fmt.Errorf("KV format %s: box %s needs a path when the format has no match", f.Name, box.ID)
+		}
+	}
+	return nil
+}
+
+// Matches checks if the filename belongs to this format
+func (f *KVFormat) Matches(filename string) bool {
+	if f.Match != "" {
+		return strings.Contains(filename, f.Match)
+	}
+	boxes, _ := f.matchingBoxes(filename)
+	return len(boxes) > 0
+}
+
+// MatchBoxes returns the boxes receiving values from the file
+// Boxes without a Path always receive values; otherwise the box with the longest matching Path is used,
+// so "HoKimLong_TramDoMucNuoc" wins over "HoKimLong_TramDo". Several matching paths are logged
+func (f *KVFormat) MatchBoxes(filename string) []KVBox {
+	return f.matchBoxes(context.Background(), filename)
+}
+
+// matchBoxes is MatchBoxes logging with the logger of ctx
+func (f *KVFormat) matchBoxes(ctx context.Context, filename string) []KVBox {
+	boxes, matchedPaths := f.matchingBoxes(filename)
+	if len(matchedPaths) > 1 {
+		LoggerFrom(ctx).Warnf("file %s: %s box paths %v all match, using the longest", filename, f.Name, matchedPaths)
+	}
+	return boxes
+}
+
+// matchingBoxes returns the boxes receiving values from the file and every matching box Path
+func (f *KVFormat) matchingBoxes(filename string) ([]KVBox, []string) {
+	path := filepath.ToSlash(filename)
+
+	var boxes []KVBox
+	var matchedPaths []string
+	best := -1
+	for i, box := range f.Boxes {
+		if box.Path == "" {
+			boxes = append(boxes, box)
+			continue
+		}
+		if strings.Contains(path, box.Path) {
+			matchedPaths = append(matchedPaths, box.Path)
+			if best == -1 || len(box.Path) > len(f.Boxes[best].Path) {
+				best = i
+			}
+		}
+	}
+	if best != -1 {
+		boxes = append(boxes, f.Boxes[best])
+	}
+	return boxes, matchedPaths
+}
+
+// MatchKVFormat returns the first configured KV format matching the filename, or nil
+func MatchKVFormat(filename string) *KVFormat {
+	for _, format := range GlobalKVFormats {
+		if format.Matches(filename) {
+			return format
+		}
+	}
+	return nil
+}
+
+// KV_TIMESTAMP_FALLBACK modes
+const (
+	// KVTimestampFallbackFail returns the filename parse error (file goes to load_failed)
+	KVTimestampFallbackFail = "fail"
+	// KVTimestampFallbackNow uses the current time
+	KVTimestampFallbackNow = "now"
+	// KVTimestampFallbackContent uses a timestamp line found in the file body
+	KVTimestampFallbackContent = "content"
+)
+
+// KV_DUPLICATE_POLICY values: handling of a KV document whose timestamp is already stored
+const (
+	// KVDuplicateSkip keeps the stored document and counts the new one as skipped
+	KVDuplicateSkip = "skip"
+	// KVDuplicateUpsert replaces the stored document with the new one
+	KVDuplicateUpsert = "upsert"
+	// KVDuplicateError keeps the stored document and fails the file
+	KVDuplicateError = "error"
+)
+
+// kvDuplicatePolicy returns KV_DUPLICATE_POLICY (skip before InitConfig)
+func kvDuplicatePolicy() string {
+	if GlobalConfig == nil || GlobalConfig.KVDuplicatePolicy == "" {
+		return KVDuplicateSkip
+	}
+	return GlobalConfig.KVDuplicatePolicy
+}
+
+// KV_TRUNCATE modes
+const (
+	// KVTruncateMinute truncates KV timestamps to the minute
+	KVTruncateMinute = "minute"
+	// KVTruncateSecond truncates KV timestamps to the second
+	KVTruncateSecond = "second"
+	// KVTruncateNone keeps KV timestamps as parsed
+	KVTruncateNone = "none"
+)
+
+// truncateKVTime truncates a KV file timestamp according to KV_TRUNCATE (minute by default)
+// Stored _id values are Unix seconds, so "second" and "none" only differ for sub-second times
+func truncateKVTime(t time.Time) time.Time {
+	mode := KVTruncateMinute
+	if GlobalConfig != nil && GlobalConfig.KVTruncate != "" {
+		mode = GlobalConfig.KVTruncate
+	}
+
+	switch mode {
+	case KVTruncateSecond:
+		return t.Truncate(time.Second)
+	case KVTruncateNone:
+		return t
+	}
+	return t.Truncate(time.Minute)
+}
+
+// kvTimestampKeys are the keys recognized on a KV content line holding the file timestamp
+// e.g. "Time	2025-11-29 19:00:00"
+var kvTimestampKeys = map[string]bool{
+	"time":      true,
+	"timestamp": true,
+	"datetime":  true,
+	"date_time": true,
+}
+
+// kvTimestampLayouts are the layouts tried when reading a timestamp from KV content
+var kvTimestampLayouts = []string{
+	"20060102150405",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	"2006/01/02 15:04:05",
+}
+
+// parseKVTimestampLine returns the timestamp held by a KV content line, if any
+// The line is either a bare timestamp or a timestamp key followed by the timestamp
+func parseKVTimestampLine(line string) (time.Time, bool) {
+	value := strings.TrimSpace(line)
+	if parts := strings.Fields(value); len(parts) >= 2 && kvTimestampKeys[strings.ToLower(parts[0])] {
+		value = strings.Join(parts[1:], " ")
+	}
+
+	for _, layout := range kvTimestampLayouts {
+		t, err := time.ParseInLocation(layout, value, configTimezone())
+		if err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// resolveKVTimestamp applies KV_TIMESTAMP_FALLBACK after the filename timestamp failed to parse
+// Returns the fallback timestamp (truncated according to KV_TRUNCATE) or the original error in "fail" mode
+func resolveKVTimestamp(ctx context.Context, filename string, content []byte, parseErr error) (int64, error) {
+	mode := KVTimestampFallbackFail
+	if GlobalConfig != nil {
+		mode = GlobalConfig.KVTimestampFallback
+	}
+
+	switch mode {
+	case KVTimestampFallbackNow:
+		ts := truncateKVTime(time.Now()).Unix()
+		LoggerFrom(ctx).Warnf("file %s: %v, using current time %d\n", filename, parseErr, ts)
+		return ts, nil
+
+	case KVTimestampFallbackContent:
+		for _, line := range strings.Split(string(content), "\n") {
+			if t, ok := parseKVTimestampLine(line); ok {
+				ts := truncateKVTime(t).Unix()
+				LoggerFrom(ctx).Warnf("file %s: %v, using timestamp %d from content\n", filename, parseErr, ts)
+				return ts, nil
+			}
+		}
+		return 0, fmt.Errorf("%w (no timestamp line found in content)", parseErr)
+	}
+
+	return 0, parseErr
+}
+
+// parseTimestamp reads the file timestamp according to the format's timestamp source
+func (f *KVFormat) parseTimestamp(filename string) (int64, error) {
+	if f.TimestampSource == KVTimestampSourceFilenameSuffix {
+		return ParseBariaTimestampFromFilename(filename)
+	}
+	return parseFilenameForTimestamp(filename)
+}
+
+// parseValues builds the key-value map from the file content
+// Also returns the number of valid key-value lines, of skipped lines (no value, or not numeric)
+// and of the skipped lines with a non-numeric value; blank lines and the content timestamp line are neither
+func (f *KVFormat) parseValues(ctx context.Context, filename string, content []byte) (valueMap map[string]float64, valid int, skipped int, invalid int) {
+	valueMap = make(map[string]float64)
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		// Skip the timestamp line used by KV_TIMESTAMP_FALLBACK=content
+		if _, ok := parseKVTimestampLine(line); ok {
+			continue
+		}
+
+		var parts []string
+		if f.Delimiter == "" {
+			parts = strings.Fields(line)
+		} else {
+			parts = strings.Split(line, f.Delimiter)
+		}
+		if len(parts) < 2 {
+			skipped++
+			continue
+		}
+
+		key := strings.TrimSpace(parts[0])
+		valStr := strings.TrimSpace(parts[1])
+		value, err := parseNumber(valStr)
+		if err != nil {
+			LoggerFrom(ctx).Warnf("file %s: parse value failed %s=%s", filename, key, valStr)
+			skipped++
+			invalid++
+			continue
+		}
+		valueMap[key] = value
+		valid++
+	}
+	return valueMap, valid, skipped, invalid
+}
+
+// populatedMetrics returns the number of distinct metric names of the boxes present in the value map
+func populatedMetrics(boxes []KVBox, valueMap map[string]float64) int {
+	found := make(map[string]bool)
+	for _, box := range boxes {
+		for _, metric := range box.Metrics {
+			if _, exists := valueMap[metric.Name]; exists {
+				found[metric.Name] = true
+			}
+		}
+	}
+	return len(found)
+}
+
+// kvTarget is a document built from a KV file and the ID of its sensor data collection
+type kvTarget struct {
+	// ID - box ID, or "<box ID>_<metric code>" when metrics are fanned out
+	ID     string
+	Doc    bson.M
+	Fields []string
+	// Metrics - number of metric values read from the file in Doc
+	Metrics int64
+}
+
+// kvTargets builds the documents of a box: one document with all its metrics, or with
+// FanOutMetrics one document per metric for the sensor_data_<box ID>_<code> collections
+func (f *KVFormat) kvTargets(ctx context.Context, box KVBox, ts int64, now int64, valueMap map[string]float64) []kvTarget {
+	newTarget := func(id string) kvTarget {
+		doc := bson.M{
+			"_id": ts,
+			"c":   now, // ingest time, in INGEST_TIME_UNIT
+		}
+		applyBSONDate(doc, ts)
+		applyGeneration(ctx, doc)
+		applyFileType(doc, f.Name)
+		return kvTarget{ID: id, Doc: doc}
+	}
+	addMetric := func(target *kvTarget, metric Metric) {
+		target.Fields = append(target.Fields, metric.Code)
+		if value, exists := valueMap[metric.Name]; exists {
+			target.Doc[metric.Code] = storedValue(metric.Apply(value))
+			target.Metrics++
+		} else {
+			setMissingMetric(target.Doc, metric.Code)
+		}
+	}
+
+	if !f.FanOutMetrics {
+		target := newTarget(box.ID)
+		for _, metric := range box.Metrics {
+			addMetric(&target, metric)
+		}
+		return []kvTarget{target}
+	}
+
+	var targets []kvTarget
+	for _, metric := range box.Metrics {
+		target := newTarget(box.ID + "_" + metric.Code)
+		addMetric(&target, metric)
+		if _, stored := target.Doc[metric.Code]; !stored {
+			continue // missing metric with MISSING_METRIC_POLICY=skip: no document
+		}
+		targets = append(targets, target)
+	}
+	return targets
+}
+
+// ingestTime returns the current Unix time stored as the "c" (ingest) field, in INGEST_TIME_UNIT
+func ingestTime() int64 {
+	if GlobalConfig != nil && GlobalConfig.IngestTimeUnit == IngestTimeUnitMilliseconds {
+		return nowFunc().UnixMilli()
+	}
+	return nowFunc().Unix()
+}
+
+// setMissingMetric applies MISSING_METRIC_POLICY for a metric absent from the file
+func setMissingMetric(doc bson.M, code string) {
+	policy := MissingMetricZero
+	if GlobalConfig != nil {
+		policy = GlobalConfig.MissingMetricPolicy
+	}
+
+	switch policy {
+	case MissingMetricSkip:
+		// Field omitted
+	case MissingMetricNull:
+		doc[code] = nil
+	default:
+		doc[code] = 0
+	}
+}
+
+// ProcessKVFile processes a key-value file according to the given format
+// Inserts one document per matched box and returns the number of documents inserted
+// (not the number of metric values, see ProcessResult.MetricsWritten)
+func ProcessKVFile(ctx context.Context, format *KVFormat, filename string, content []byte) (int64, error) {
+	result, err := ProcessKVFileResult(ctx, format, filename, content)
+	return result.Inserted, err
+}
+
+// ProcessKVFileResult processes a key-value file according to the given format
+// Returns the detailed result (never nil): the device ID lists the matched box IDs
+func ProcessKVFileResult(ctx context.Context, format *KVFormat, filename string, content []byte) (*ProcessResult, error) {
+	logger := LoggerFrom(ctx)
+	result := &ProcessResult{FileType: format.Name}
+
+	if err := requireMongo(); err != nil {
+		return result, fmt.Errorf("file %s: %w", filename, err)
+	}
+
+	boxes := format.matchBoxes(ctx, filename)
+	if len(boxes) == 0 {
+		return result, fmt.Errorf("file %s: no %s box matches the filename", filename, format.Name)
+	}
+
+	boxIDs := make([]string, 0, len(boxes))
+	for _, box := range boxes {
+		boxIDs = append(boxIDs, box.ID)
+	}
+	result.DeviceID = strings.Join(boxIDs, ",")
+
+	// Convert timestamp to Unix
+	ts, err := format.parseTimestamp(filename)
+	if err == nil {
+		// Filename timestamps are parsed in TIMEZONE_OFFSET: apply the bucket timezone, if any
+		ts = reinterpretTimestamp(ts, configTimezone(), timezoneFor(ctx))
+	} else {
+		ts, err = resolveKVTimestamp(ctx, filename, content, err)
+		if err != nil {
+			logFailedContent(ctx, filename, content)
+			return result, &ParseError{Err: fmt.Errorf("file %s: %w", filename, err)}
+		}
+	}
+
+	valueMap, valid, skipped, invalid := format.parseValues(ctx, filename, content)
+	if invalid > 0 && format.DropOnInvalidValue {
+		logger.Infof("file %s: %d non-numeric %s value(s), dropping the file", filename, invalid, format.Name)
+		return result, nil
+	}
+	if skipped > 0 {
+		logger.Warnf("file %s: skipped %d of %d %s lines (no value or not numeric)", filename, skipped, valid+skipped, format.Name)
+	}
+	minLines, minMetrics := 0, 0
+	if GlobalConfig != nil {
+		minLines, minMetrics = GlobalConfig.KVMinValidLines, GlobalConfig.KVMinMetrics
+	}
+	// Fail rather than store a document of missing (zero) metrics
+	if valid < minLines {
+		logFailedContent(ctx, filename, content)
+		return result, &ParseError{Err: fmt.Errorf("file %s: only %d valid %s lines, below KV_MIN_VALID_LINES (%d)", filename, valid, format.Name, minLines)}
+	}
+	// An empty or unrelated value map would store documents of zero (missing) metrics for every box
+	found := populatedMetrics(boxes, valueMap)
+	if found == 0 {
+		logger.Warnf("file %s: no box metric found in %d value(s), not storing", filename, len(valueMap))
+		logFailedContent(ctx, filename, content)
+		return result, &ParseError{Err: fmt.Errorf("file %s: no box metrics found", filename)}
+	}
+	if found < minMetrics {
+		logger.Warnf("file %s: only %d box metric(s) found in %d value(s), below KV_MIN_METRICS (%d), not storing", filename, found, len(valueMap), minMetrics)
+		logFailedContent(ctx, filename, content)
+		return result, &ParseError{Err: fmt.Errorf("file %s: only %d box metrics found, below KV_MIN_METRICS (%d)", filename, found, minMetrics)}
+	}
+	if err := checkMinRecords(ctx, filename, len(valueMap), "values"); err != nil {
+		logFailedContent(ctx, filename, content)
+		return result, &ParseError{Err: err}
+	}
+
+	logger.Infof("file %s: processing %s file with timestamp %d (%s)\n", filename, format.Name, ts, time.Unix(ts, 0).UTC().Format("2006-01-02 15:04:05"))
+
+	// Process for each matched box
+	// _id and c are Unix epoch times (timezone-agnostic): the timezone only matters when parsing the file
+	now := ingestTime()
+	var insertErr error
+
+	var targets []kvTarget
+	for _, box := range boxes {
+		targets = append(targets, format.kvTargets(ctx, box, ts, now, valueMap)...)
+	}
+	samples := make([]SensorRecord, 0, len(targets))
+	for _, target := range targets {
+		samples = append(samples, SensorRecord(target.Doc))
+	}
+	logSampleRecords(ctx, filename, samples)
+
+	for _, target := range targets {
+		applySharedCollectionKey(target.ID, target.Doc)
+
+		// Insert into collection
+		colName := sensorCollectionNameAt(ctx, target.ID, ts)
+		db := databaseFor(format.Name)
+		if err := reserveCollection(ctx, db, colName); err != nil {
+			return result, fmt.Errorf("file %s: %w", filename, err)
+		}
+		collection := db.Collection(colName)
+
+		// Print record before insert if debug flag is enabled
+		if GlobalConfig != nil && GlobalConfig.Debug {
+			logger.Infof("file %s: [DEBUG] inserting record into collection %s: %+v", filename, colName, target.Doc)
+		}
+
+		_, err := collection.InsertOne(ctx, orderedDocument(target.Doc, target.Fields))
+		if err != nil {
+			// Check if it's a duplicate key error (which we can ignore)
+			if strings.Contains(err.Error(), "duplicate key") {
+				switch kvDuplicatePolicy() {
+				case KVDuplicateUpsert:
+					if _, err := collection.ReplaceOne(ctx, bson.M{"_id": target.Doc["_id"]}, orderedDocument(target.Doc, target.Fields), options.Replace().SetUpsert(true)); err != nil {
+						logger.Warnf("file %s: error replacing record for box %s: %v\n", filename, target.ID, err)
+						if insertErr == nil {
+							insertErr = fmt.Errorf("file %s: failed to replace record in %s: %w", filename, colName, err)
+						}
+						continue
+					}
+					logger.Infof("file %s: replaced existing record for box %s at timestamp %d\n", filename, target.ID, ts)
+					result.Inserted++
+					result.MetricsWritten += target.Metrics
+				case KVDuplicateError:
+					logger.Errorf("file %s: duplicate record for box %s at timestamp %d\n", filename, target.ID, ts)
+					result.Skipped++
+					if insertErr == nil {
+						insertErr = fmt.Errorf("file %s: record for box %s at timestamp %d already exists in %s (KV_DUPLICATE_POLICY=error)", filename, target.ID, ts, colName)
+					}
+				default:
+					logger.Warnf("file %s: duplicate record for box %s at timestamp %d\n", filename, target.ID, ts)
+					result.Skipped++
+				}
+				continue
+			}
+			logger.Warnf("file %s: error inserting record for box %s: %v\n", filename, target.ID, err)
+			if insertErr == nil && !format.IgnoreInsertErrors {
+				insertErr = fmt.Errorf("file %s: failed to insert record into %s: %w", filename, colName, err)
+			}
+			continue
+		}
+
+		result.Inserted++
+		result.MetricsWritten += target.Metrics
+		logger.Debugf("file %s: inserted record into %s\n", filename, colName)
+	}
+
+	logger.Infof("file %s: inserted %d documents (%d metric values) from %s file\n", filename, result.Inserted, result.MetricsWritten, format.Name)
+	return result, insertErr
+}
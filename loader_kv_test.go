@@ -0,0 +1,356 @@
+package loader
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestResolveKVTimestamp(t *testing.T) {
+	ctx := context.Background()
+	parseErr := errors.New("invalid filename timestamp")
+	content := []byte("rain_1 1.5\nTime\t2025-11-29 19:00:25\nwaterup 2")
+	want := time.Date(2025, time.November, 29, 19, 0, 0, 0, GlobalConfig.TimezoneLocation).Unix()
+
+	withConfig(t, func(c *Config) { c.KVTimestampFallback = KVTimestampFallbackFail })
+	if _, err := resolveKVTimestamp(ctx, "a.txt", content, parseErr); !errors.Is(err, parseErr) {
+		t.Errorf("fail: error = %v, want the filename parse error", err)
+	}
+
+	withConfig(t, func(c *Config) { c.KVTimestampFallback = KVTimestampFallbackContent })
+	ts, err := resolveKVTimestamp(ctx, "a.txt", content, parseErr)
+	if err != nil || ts != want {
+		t.Errorf("content: got (%d, %v), want (%d, nil)", ts, err, want)
+	}
+	if _, err := resolveKVTimestamp(ctx, "a.txt", []byte("rain_1 1.5"), parseErr); !errors.Is(err, parseErr) {
+		t.Errorf("content without timestamp line: error = %v, want the filename parse error", err)
+	}
+
+	withConfig(t, func(c *Config) { c.KVTimestampFallback = KVTimestampFallbackNow })
+	before := time.Now().Truncate(time.Minute).Unix()
+	ts, err = resolveKVTimestamp(ctx, "a.txt", content, parseErr)
+	if err != nil || ts < before || ts > time.Now().Unix() {
+		t.Errorf("now: got (%d, %v), want the current minute", ts, err)
+	}
+}
+
+func TestParseKVTimestampLine(t *testing.T) {
+	want := time.Date(2025, time.November, 29, 19, 0, 25, 0, GlobalConfig.TimezoneLocation)
+	tests := []struct {
+		line string
+		ok   bool
+	}{
+		{"Time\t2025-11-29 19:00:25", true},
+		{"timestamp 2025-11-29T19:00:25", true},
+		{"DateTime 2025/11/29 19:00:25", true},
+		{"20251129190025", true},
+		{"rain_1 1.5", false},
+		{"Time soon", false},
+	}
+	for _, tt := range tests {
+		got, ok := parseKVTimestampLine(tt.line)
+		if ok != tt.ok || (ok && !got.Equal(want)) {
+			t.Errorf("parseKVTimestampLine(%q) = (%v, %v), want ok=%v", tt.line, got, ok, tt.ok)
+		}
+	}
+}
+
+func TestKVFormatValidate(t *testing.T) {
+	metrics := []Metric{{Code: "WAU", Name: "MNH"}}
+	tests := []struct {
+		name    string
+		format  KVFormat
+		wantErr bool
+	}{
+		{"valid", KVFormat{Name: "lake", Match: "HoMoi_", Boxes: []KVBox{{ID: "A", Metrics: metrics}}}, false},
+		{"missing name", KVFormat{Match: "HoMoi_", Boxes: []KVBox{{ID: "A"}}}, true},
+		{"no boxes", KVFormat{Name: "lake", Match: "HoMoi_"}, true},
+		{"box without id", KVFormat{Name: "lake", Match: "HoMoi_", Boxes: []KVBox{{Metrics: metrics}}}, true},
+		{"no match and no path", KVFormat{Name: "lake", Boxes: []KVBox{{ID: "A"}}}, true},
+		{"path without match", KVFormat{Name: "lake", Boxes: []KVBox{{ID: "A", Path: "HoMoi_Tram1"}}}, false},
+		{"unknown timestamp source", KVFormat{Name: "lake", Match: "HoMoi_", TimestampSource: "content", Boxes: []KVBox{{ID: "A"}}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.format.validate()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && tt.format.TimestampSource != KVTimestampSourceFilename {
+				t.Errorf("TimestampSource = %q, want default %q", tt.format.TimestampSource, KVTimestampSourceFilename)
+			}
+		})
+	}
+}
+
+func TestInitKVFormats(t *testing.T) {
+	previous := GlobalKVFormats
+	t.Cleanup(func() { GlobalKVFormats = previous })
+	t.Setenv("KV_FORMATS", `[{"name":"lake","match":"HoMoi_","delimiter":"\t","timestamp_source":"filename_suffix",
+		"boxes":[{"id":"ABCD1234","metrics":[{"code":"WAU","name":"MNH"}]}]}]`)
+
+	InitKVFormats()
+	if len(GlobalKVFormats) != 1 {
+		t.Fatalf("got %d formats, want 1", len(GlobalKVFormats))
+	}
+	format := MatchKVFormat("upload/HoMoi_Tram1_20251227200009.txt")
+	if format == nil || format.Name != "lake" {
+		t.Fatalf("MatchKVFormat() = %v, want lake", format)
+	}
+	if format.Delimiter != "\t" || format.TimestampSource != KVTimestampSourceFilenameSuffix {
+		t.Errorf("format = %+v, want tab delimiter and filename_suffix timestamps", format)
+	}
+	if MatchKVFormat("CR300_19531_Table1.csv") != nil {
+		t.Errorf("MatchKVFormat() matched a CSV file")
+	}
+	if got := detectFileType(context.Background(), "HoMoi_Tram1_20251227200009.txt"); got != DetectorKV {
+		t.Errorf("detectFileType() = %q, want %q", got, DetectorKV)
+	}
+}
+
+func TestKVFormatParseValues(t *testing.T) {
+	ctx := context.Background()
+	content := []byte("MNH\t12.5\nDomocong\t1\n\nTime\t2025-11-29 19:00:00\nbroken\nstate\topen\n")
+
+	format := &KVFormat{Name: "lake", Delimiter: "\t"}
+	valueMap, valid, skipped, invalid := format.parseValues(ctx, "a.txt", content)
+	if valid != 2 || skipped != 2 || invalid != 1 {
+		t.Errorf("got valid=%d skipped=%d invalid=%d, want 2, 2, 1", valid, skipped, invalid)
+	}
+	if valueMap["MNH"] != 12.5 || valueMap["Domocong"] != 1 || len(valueMap) != 2 {
+		t.Errorf("valueMap = %v", valueMap)
+	}
+
+	// Without a delimiter, keys and values are separated by any whitespace
+	format = &KVFormat{Name: "lake"}
+	valueMap, valid, _, _ = format.parseValues(ctx, "a.txt", []byte("rain_1   1.5\nwaterup\t2"))
+	if valid != 2 || valueMap["rain_1"] != 1.5 || valueMap["waterup"] != 2 {
+		t.Errorf("whitespace delimiter: valueMap = %v, valid = %d", valueMap, valid)
+	}
+}
+
+func TestKVFormatPresets(t *testing.T) {
+	amchua := AmChuaKVFormat()
+	if !amchua.DropOnInvalidValue || !amchua.IgnoreInsertErrors {
+		t.Errorf("AmChua preset: DropOnInvalidValue=%v IgnoreInsertErrors=%v, want the original error handling", amchua.DropOnInvalidValue, amchua.IgnoreInsertErrors)
+	}
+	if len(amchua.Boxes) != len(AmChuaBoxes) || !amchua.Matches("upload/HoAmChua_TramTT/2025/11/29/20251129190000.txt") {
+		t.Errorf("AmChua preset: %d boxes, want %d and a match on HoAmChua_TramTT", len(amchua.Boxes), len(AmChuaBoxes))
+	}
+	if boxes := amchua.MatchBoxes("HoAmChua_TramTT/20251129190000.txt"); len(boxes) != len(AmChuaBoxes) {
+		t.Errorf("AmChua preset: %d boxes receive the file, want all %d", len(boxes), len(AmChuaBoxes))
+	}
+
+	baria := BariaKVFormat()
+	if baria.DropOnInvalidValue || baria.IgnoreInsertErrors {
+		t.Errorf("Baria preset: DropOnInvalidValue=%v IgnoreInsertErrors=%v, want false", baria.DropOnInvalidValue, baria.IgnoreInsertErrors)
+	}
+	if baria.Delimiter != "\t" || baria.TimestampSource != KVTimestampSourceFilenameSuffix {
+		t.Errorf("Baria preset = %+v", baria)
+	}
+}
+
+func TestKVTargetsMissingMetricPolicy(t *testing.T) {
+	ctx := context.Background()
+	box := KVBox{ID: "RIENVHK4", Metrics: []Metric{{Code: "DR1", Name: "drain_1"}, {Code: "DR2", Name: "drain_2"}}}
+	valueMap := map[string]float64{"drain_1": 3}
+
+	tests := []struct {
+		policy    string
+		wantDR2   interface{}
+		wantFound bool
+	}{
+		{MissingMetricZero, 0, true},
+		{MissingMetricNull, nil, true},
+		{MissingMetricSkip, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			withConfig(t, func(c *Config) { c.MissingMetricPolicy = tt.policy })
+
+			targets := (&KVFormat{Name: "lake"}).kvTargets(ctx, box, 1735787040, 1735787100, valueMap)
+			if len(targets) != 1 {
+				t.Fatalf("got %d documents, want 1", len(targets))
+			}
+			doc := targets[0].Doc
+			if doc["_id"] != int64(1735787040) || doc["c"] != int64(1735787100) || doc["DR1"] != 3.0 {
+				t.Errorf("document = %v", doc)
+			}
+			if got, found := doc["DR2"]; found != tt.wantFound || got != tt.wantDR2 {
+				t.Errorf("DR2 = (%v, %v), want (%v, %v)", got, found, tt.wantDR2, tt.wantFound)
+			}
+			if targets[0].Metrics != 1 {
+				t.Errorf("Metrics = %d, want 1 (missing metrics are not counted)", targets[0].Metrics)
+			}
+
+			// Fanned-out metrics: a skipped missing metric produces no document
+			fanned := (&KVFormat{Name: "lake", FanOutMetrics: true}).kvTargets(ctx, box, 1735787040, 1735787100, valueMap)
+			wantDocs := 2
+			if !tt.wantFound {
+				wantDocs = 1
+			}
+			if len(fanned) != wantDocs || fanned[0].ID != "RIENVHK4_DR1" {
+				t.Errorf("fan-out: got %d documents (first %q), want %d", len(fanned), fanned[0].ID, wantDocs)
+			}
+		})
+	}
+}
+
+func TestKVTargetsMetricCounts(t *testing.T) {
+	withConfig(t, func(c *Config) { c.MissingMetricPolicy = MissingMetricZero })
+	boxes := []KVBox{
+		{ID: "RIENVHK4", Metrics: []Metric{{Code: "DR1", Name: "drain_1"}, {Code: "DR2", Name: "drain_2"}}},
+		{ID: "RIENVHK5", Metrics: []Metric{{Code: "TE", Name: "temp"}, {Code: "HU", Name: "humidity"}, {Code: "WA", Name: "water"}}},
+	}
+	valueMap := map[string]float64{"drain_1": 3, "drain_2": 4, "temp": 21.5, "water": 0.2}
+
+	// One document per box, metric values counted across boxes as ProcessKVFileResult does
+	var documents, metrics int64
+	for _, box := range boxes {
+		for _, target := range (&KVFormat{Name: "lake"}).kvTargets(context.Background(), box, 1735787040, 1735787100, valueMap) {
+			documents++
+			metrics += target.Metrics
+		}
+	}
+	if documents != 2 {
+		t.Errorf("documents = %d, want 2 (one per box)", documents)
+	}
+	if metrics != 4 {
+		t.Errorf("metric values = %d, want 4 (the missing humidity is stored as zero but not counted)", metrics)
+	}
+}
+
+func TestIngestTime(t *testing.T) {
+	now := time.Date(2025, 1, 2, 3, 4, 5, 678e6, time.UTC)
+	withNow(t, now)
+	tests := []struct {
+		unit string
+		want int64
+	}{
+		{IngestTimeUnitSeconds, now.Unix()},
+		{IngestTimeUnitMilliseconds, now.UnixMilli()},
+	}
+	for _, tt := range tests {
+		withConfig(t, func(c *Config) { c.IngestTimeUnit = tt.unit })
+		if got := ingestTime(); got != tt.want {
+			t.Errorf("INGEST_TIME_UNIT=%s: ingestTime() = %d, want %d", tt.unit, got, tt.want)
+		}
+
+		// The c field carries the ingest time as is, next to the _id in Unix seconds
+		box := KVBox{ID: "RIENVHK4", Metrics: []Metric{{Code: "WA", Name: "water"}}}
+		targets := (&KVFormat{Name: "lake"}).kvTargets(context.Background(), box, 1735787040, ingestTime(), map[string]float64{"water": 1})
+		if len(targets) != 1 || targets[0].Doc["c"] != tt.want || targets[0].Doc["_id"] != int64(1735787040) {
+			t.Errorf("INGEST_TIME_UNIT=%s: documents = %+v, want c %d", tt.unit, targets, tt.want)
+		}
+	}
+}
+
+func TestMetricApply(t *testing.T) {
+	tests := []struct {
+		metric Metric
+		value  float64
+		want   float64
+	}{
+		{Metric{Code: "WA"}, 12.5, 12.5},
+		{Metric{Code: "WA", Scale: 0.5}, 12.5, 6.25},
+		{Metric{Code: "WA", Offset: -100}, 112.5, 12.5},
+		{Metric{Code: "WA", Scale: 2, Offset: 1}, 12.5, 26},
+	}
+	for _, tt := range tests {
+		if got := tt.metric.Apply(tt.value); got != tt.want {
+			t.Errorf("%+v.Apply(%v) = %v, want %v", tt.metric, tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestKVTargetsScaledMetrics(t *testing.T) {
+	var metrics []Metric
+	if err := json.Unmarshal([]byte(`[{"code": "WA", "name": "water_cm", "scale": 0.01, "offset": -2}, {"code": "TE", "name": "temp"}]`), &metrics); err != nil {
+		t.Fatalf("json.Unmarshal() error = %v", err)
+	}
+	box := KVBox{ID: "RIENVHK4", Metrics: metrics}
+	targets := (&KVFormat{Name: "lake"}).kvTargets(context.Background(), box, 1735787040, 1735787100, map[string]float64{"water_cm": 1250, "temp": 21.5})
+	if len(targets) != 1 {
+		t.Fatalf("kvTargets() = %d documents, want 1", len(targets))
+	}
+	if doc := targets[0].Doc; doc["WA"] != 10.5 || doc["TE"] != 21.5 {
+		t.Errorf("document = %v, want WA 10.5 (scaled and offset) and TE 21.5 (as is)", doc)
+	}
+}
+
+func TestKVTargetsFanOut(t *testing.T) {
+	box := KVBox{ID: "RIENVHK4", Metrics: []Metric{{Code: "WA", Name: "water"}, {Code: "TE", Name: "temp"}}}
+	valueMap := map[string]float64{"water": 1.5, "temp": 21.5}
+
+	combined := (&KVFormat{Name: "lake"}).kvTargets(context.Background(), box, 1735787040, 1735787100, valueMap)
+	if len(combined) != 1 || combined[0].ID != "RIENVHK4" || combined[0].Doc["WA"] != 1.5 || combined[0].Doc["TE"] != 21.5 {
+		t.Errorf("combined: kvTargets() = %+v, want one RIENVHK4 document with WA and TE", combined)
+	}
+
+	fanOut := (&KVFormat{Name: "lake", FanOutMetrics: true}).kvTargets(context.Background(), box, 1735787040, 1735787100, valueMap)
+	if len(fanOut) != 2 {
+		t.Fatalf("fan-out: kvTargets() = %+v, want one document per metric", fanOut)
+	}
+	for i, want := range []struct {
+		id, code string
+		value    float64
+	}{{"RIENVHK4_WA", "WA", 1.5}, {"RIENVHK4_TE", "TE", 21.5}} {
+		target := fanOut[i]
+		if target.ID != want.id || target.Doc[want.code] != want.value || len(target.Fields) != 1 || target.Doc["_id"] != int64(1735787040) {
+			t.Errorf("fan-out document %d = %+v, want %s with %s %v", i, target, want.id, want.code, want.value)
+		}
+	}
+
+	// Missing metrics skipped by MISSING_METRIC_POLICY produce no fan-out document
+	withConfig(t, func(c *Config) { c.MissingMetricPolicy = MissingMetricSkip })
+	fanOut = (&KVFormat{Name: "lake", FanOutMetrics: true}).kvTargets(context.Background(), box, 1735787040, 1735787100, map[string]float64{"temp": 21.5})
+	if len(fanOut) != 1 || fanOut[0].ID != "RIENVHK4_TE" {
+		t.Errorf("fan-out with a missing metric: kvTargets() = %+v, want only RIENVHK4_TE", fanOut)
+	}
+}
+
+func TestAmChuaFanOutConfig(t *testing.T) {
+	withConfig(t, func(c *Config) { c.AmChuaFanOut = false })
+	if AmChuaKVFormat().FanOutMetrics {
+		t.Error("AmChua metrics fanned out by default")
+	}
+	withConfig(t, func(c *Config) { c.AmChuaFanOut = true })
+	if !AmChuaKVFormat().FanOutMetrics {
+		t.Error("AMCHUA_FANOUT_METRICS=true: AmChua metrics not fanned out")
+	}
+}
+
+func TestKVTruncate(t *testing.T) {
+	base := time.Date(2025, time.December, 27, 20, 0, 0, 0, GlobalConfig.TimezoneLocation).Unix()
+	tests := []struct {
+		mode string
+		want int64
+	}{
+		{"", base},
+		{KVTruncateMinute, base},
+		{KVTruncateSecond, base + 9},
+		{KVTruncateNone, base + 9},
+	}
+	for _, tt := range tests {
+		withConfig(t, func(c *Config) { c.KVTruncate = tt.mode })
+		if got, err := ParseBariaTimestampFromFilename("HoSongRay_KenhSongRay/MNK_SongRay_20251227200009.txt"); err != nil || got != tt.want {
+			t.Errorf("KV_TRUNCATE=%q: Baria _id = %d, %v, want %d", tt.mode, got, err, tt.want)
+		}
+		if got, err := parseFilenameForTimestamp("upload/HoAmChua_TramTT/2025/12/27/20251227200009.txt"); err != nil || got != tt.want {
+			t.Errorf("KV_TRUNCATE=%q: AmChua _id = %d, %v, want %d", tt.mode, got, err, tt.want)
+		}
+	}
+
+	// "second" and "none" only differ below the second
+	precise := time.Date(2025, time.December, 27, 20, 0, 9, 500, time.UTC)
+	withConfig(t, func(c *Config) { c.KVTruncate = KVTruncateSecond })
+	if got := truncateKVTime(precise); got.Nanosecond() != 0 || got.Second() != 9 {
+		t.Errorf("KV_TRUNCATE=second: truncateKVTime() = %v", got)
+	}
+	withConfig(t, func(c *Config) { c.KVTruncate = KVTruncateNone })
+	if got := truncateKVTime(precise); !got.Equal(precise) {
+		t.Errorf("KV_TRUNCATE=none: truncateKVTime() = %v, want %v", got, precise)
+	}
+}
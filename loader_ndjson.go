@@ -0,0 +1,153 @@
+package loader
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// NDJSON reading keys with a special meaning
+const (
+	ndjsonDeviceIDKey = "device_id"
+	ndjsonTimeKey     = "time"
+)
+
+// IsNDJSONFile checks if the file is a newline-delimited JSON sensor stream (.ndjson or .jsonl)
+func IsNDJSONFile(filename string) bool {
+	ext := strings.ToLower(filepath.Ext(filename))
+	return ext == ".ndjson" || ext == ".jsonl"
+}
+
+// ExtractNDJSON parses newline-delimited JSON content, one reading object per line, e.g.
+//
+//	{"device_id": "CR300_19531", "time": "2025-12-31 23:58:00", "n": 1, "WAU": 12.5}
+//
+// "time" is a string in the CSV time layout or Unix seconds; other values are numbers or numeric strings
+// All lines must carry the same device_id and conform to JSON_SCHEMA_FILE, if set. Blank lines are ignored
+// Returns the same structure as ExtractData: device_id, records and fields (in first-seen order, sorted per line)
+func ExtractNDJSON(filename string, content []byte) (map[string]interface{}, error) {
+	return extractNDJSON(context.Background(), filename, content)
+}
+
+// extractNDJSON is ExtractNDJSON logging with the logger of ctx
+func extractNDJSON(ctx context.Context, filename string, content []byte) (map[string]interface{}, error) {
+	var deviceID string
+	var records []SensorRecord
+	var fields []string
+	seenFields := make(map[string]bool)
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(make([]byte, 0, 64*1024), 10*1024*1024)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var reading map[string]interface{}
+		decoder := json.NewDecoder(bytes.NewReader(line))
+		decoder.UseNumber()
+		if err := decoder.Decode(&reading); err != nil {
+			return nil, fmt.Errorf("file %s: line %d: invalid JSON: %w", filename, lineNum, err)
+		}
+		if err := jsonReadingSchema.Validate(reading); err != nil {
+			return nil, fmt.Errorf("file %s: line %d: schema validation failed: %w", filename, lineNum, err)
+		}
+
+		lineDeviceID, _ := reading[ndjsonDeviceIDKey].(string)
+		if lineDeviceID == "" {
+			return nil, fmt.Errorf("file %s: line %d: missing %s", filename, lineNum, ndjsonDeviceIDKey)
+		}
+		if deviceID == "" {
+			deviceID = lineDeviceID
+		} else if lineDeviceID != deviceID {
+			return nil, fmt.Errorf("file %s: line %d: device_id %s differs from %s", filename, lineNum, lineDeviceID, deviceID)
+		}
+
+		ts, err := ndjsonTimestamp(reading[ndjsonTimeKey])
+		if err != nil {
+			return nil, fmt.Errorf("file %s: line %d: %w", filename, lineNum, err)
+		}
+		if isTimestampTooOld(ts) {
+			LoggerFrom(ctx).Warnf("%s suspicious timestamp before MIN_VALID_TIMESTAMP, dropping line %d", deviceID, lineNum)
+			continue
+		}
+
+		record := SensorRecord{"_id": ts}
+		applyBSONDate(record, ts)
+
+		// JSON objects are unordered: visit keys sorted for a stable field order
+		for _, k := range slices.Sorted(maps.Keys(reading)) {
+			raw := reading[k]
+			if k == ndjsonDeviceIDKey || k == ndjsonTimeKey || isBlacklistedColumn(k) {
+				continue
+			}
+
+			if isQualityColumn(k) {
+				record["q"] = parseQualityValue(fmt.Sprint(raw))
+				k = "q"
+			} else {
+				v, err := parseNumber(fmt.Sprint(raw))
+				if err != nil {
+					LoggerFrom(ctx).Warnf("%s line %d: invalid %s value: %v", deviceID, lineNum, k, raw)
+					continue
+				}
+				if field, exists := LookupCode(k); exists {
+					k = field
+				}
+				applyBitFlags(record, k, v)
+				record[k] = storedValue(convertField(k, v))
+			}
+
+			if k != "n" && !seenFields[k] {
+				seenFields[k] = true
+				fields = append(fields, k)
+			}
+		}
+
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("file %s: line %d: %w", filename, lineNum+1, err)
+	}
+	if deviceID == "" {
+		return nil, fmt.Errorf("file %s: no readings", filename)
+	}
+
+	return map[string]interface{}{
+		"device_id": deviceID,
+		"records":   records,
+		"fields":    fields,
+	}, nil
+}
+
+// ndjsonTimestamp returns the Unix timestamp of an NDJSON "time" value
+// Accepts Unix seconds or a string in the CSV time layout
+func ndjsonTimestamp(value interface{}) (int64, error) {
+	switch v := value.(type) {
+	case json.Number:
+		ts, err := v.Int64()
+		if err != nil {
+			return 0, fmt.Errorf("invalid %s: %s", ndjsonTimeKey, v)
+		}
+		return ts, nil
+	case string:
+		t, err := parseRecordTime(v)
+		if err != nil {
+			return 0, fmt.Errorf("invalid %s: %s", ndjsonTimeKey, v)
+		}
+		return t.Unix(), nil
+	case nil:
+		return 0, fmt.Errorf("missing %s", ndjsonTimeKey)
+	default:
+		return 0, fmt.Errorf("invalid %s: %v", ndjsonTimeKey, v)
+	}
+}
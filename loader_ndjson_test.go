@@ -0,0 +1,77 @@
+package loader
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExtractNDJSON(t *testing.T) {
+	content := []byte(`{"device_id": "CR300_19531", "time": "2025-01-02 03:04:05", "n": 1, "water": 1.5, "TE": "21.5"}
+
+{"device_id": "CR300_19531", "time": 1735761905, "n": 2, "water": 1.6, "HU": "n/a"}
+`)
+	data, err := ExtractNDJSON("a.ndjson", content)
+	if err != nil {
+		t.Fatalf("ExtractNDJSON() error = %v", err)
+	}
+	if data["device_id"] != "CR300_19531" {
+		t.Errorf("device_id = %v", data["device_id"])
+	}
+	records := data["records"].([]SensorRecord)
+	if len(records) != 2 {
+		t.Fatalf("got %d records, want 2 (blank line ignored)", len(records))
+	}
+	if records[0]["_id"] != int64(1735761845) || records[0]["WA"] != 1.5 || records[0]["TE"] != 21.5 {
+		t.Errorf("record 0 = %v", records[0])
+	}
+	if records[1]["_id"] != int64(1735761905) || records[1]["WA"] != 1.6 {
+		t.Errorf("record 1 = %v", records[1])
+	}
+	if _, exists := records[1]["HU"]; exists {
+		t.Errorf("non-numeric value stored: %v", records[1])
+	}
+	if fields := data["fields"].([]string); !reflect.DeepEqual(fields, []string{"TE", "WA"}) {
+		t.Errorf("fields = %v, want [TE WA]", fields)
+	}
+}
+
+func TestExtractNDJSONErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"malformed line", "{\"device_id\": \"A\", \"time\": 1735761845}\n{\"device_id\": \"A\", \"time\"", "line 2: invalid JSON"},
+		{"missing device", `{"time": 1735761845, "WA": 1}`, "line 1: missing device_id"},
+		{"mixed devices", "{\"device_id\": \"A\", \"time\": 1735761845}\n\n{\"device_id\": \"B\", \"time\": 1735761905}", "line 3: device_id B differs from A"},
+		{"missing time", `{"device_id": "A", "WA": 1}`, "line 1: missing time"},
+		{"invalid time", `{"device_id": "A", "time": "yesterday"}`, "line 1: invalid time"},
+		{"empty", "\n\n", "no readings"},
+	}
+	for _, tt := range tests {
+		_, err := ExtractNDJSON("a.jsonl", []byte(tt.content))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: error = %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestIsNDJSONFile(t *testing.T) {
+	for filename, want := range map[string]bool{"a.ndjson": true, "upload/a.JSONL": true, "a.json": false, "a.csv": false} {
+		if got := IsNDJSONFile(filename); got != want {
+			t.Errorf("IsNDJSONFile(%q) = %v, want %v", filename, got, want)
+		}
+	}
+}
+
+func TestProcessReaderNDJSON(t *testing.T) {
+	content := `{"device_id": "CR300_19531", "time": 1735761845, "WA": 1.5}`
+	// NDJSON records go through the CSV insert path: without MongoDB, it fails after parsing
+	result, err := ProcessReader(context.Background(), "upload/a.ndjson", strings.NewReader(content))
+	if !errors.Is(err, ErrMongoNotConnected) || result.DeviceID != "CR300_19531" {
+		t.Errorf("ProcessReader() = %+v, %v, want device CR300_19531 and ErrMongoNotConnected", result, err)
+	}
+}
@@ -0,0 +1,160 @@
+package loader
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// prefixCandidate is a file listed under a prefix
+type prefixCandidate struct {
+	Name    string
+	Updated time.Time
+}
+
+// ProcessPrefix processes every file under a GCS prefix that passes the allow/ignore patterns
+// With PREFIX_NEWEST_PER_DEVICE=true, the files are grouped by device ID and only the most
+// recently updated file of each device is processed ("current state only" refresh)
+// Returns the aggregated result; file errors are logged and the first one is returned at the end
+func ProcessPrefix(ctx context.Context, bucket string, prefix string) (*ProcessResult, error) {
+	result := &ProcessResult{}
+
+	client, err := storageClient()
+	if err != nil {
+		return result, fmt.Errorf("prefix %s: failed to create GCS client: %w", prefix, err)
+	}
+	bucketObj := bucketHandle(client, bucket)
+	patterns := BucketSettingsFor(bucket).FilePattern()
+
+	var candidates []prefixCandidate
+	it := bucketObj.Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return result, fmt.Errorf("prefix %s: failed to list objects (bucket: %s): %w", prefix, bucket, err)
+		}
+		if strings.HasSuffix(attrs.Name, "/") || !patterns.shouldProcess(ctx, attrs.Name) {
+			continue
+		}
+		candidates = append(candidates, prefixCandidate{Name: attrs.Name, Updated: attrs.Updated})
+	}
+
+	if GlobalConfig != nil && GlobalConfig.PrefixNewestPerDevice {
+		candidates = newestPerDevice(ctx, bucketObj, candidates)
+	}
+	LoggerFrom(ctx).Infof("prefix %s: processing %d file(s)", prefix, len(candidates))
+
+	var firstErr error
+	for _, candidate := range candidates {
+		fileResult, err := ProcessFile(ctx, bucket, candidate.Name)
+		result.Inserted += fileResult.Inserted
+		result.MetricsWritten += fileResult.MetricsWritten
+		result.Skipped += fileResult.Skipped
+		if err != nil {
+			LoggerFrom(ctx).Errorf("file processing error %s: %s", candidate.Name, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return result, firstErr
+}
+
+// newestPerDevice keeps the most recently updated candidate of each device
+// Files whose device ID can't be derived are kept as is
+func newestPerDevice(ctx context.Context, bucketObj *storage.BucketHandle, candidates []prefixCandidate) []prefixCandidate {
+	logger := LoggerFrom(ctx)
+	newest := make(map[string]int)
+	var kept []prefixCandidate
+	for _, candidate := range candidates {
+		deviceID, err := deviceIDForObject(ctx, bucketObj, candidate.Name)
+		if err != nil {
+			logger.Warnf("file %s: can't derive device ID, keeping file: %v", candidate.Name, err)
+			kept = append(kept, candidate)
+			continue
+		}
+
+		idx, exists := newest[deviceID]
+		if !exists {
+			newest[deviceID] = len(kept)
+			kept = append(kept, candidate)
+			continue
+		}
+		if candidate.Updated.After(kept[idx].Updated) {
+			logger.Debugf("file %s: superseded by newer file %s of device %s", kept[idx].Name, candidate.Name, deviceID)
+			kept[idx] = candidate
+		} else {
+			logger.Debugf("file %s: superseded by newer file %s of device %s", candidate.Name, kept[idx].Name, deviceID)
+		}
+	}
+	return kept
+}
+
+// deviceIDForObject derives the device ID of a file the way ProcessReader would
+// KV files are identified by their file type and matched box IDs; CSV and NDJSON files are parsed
+func deviceIDForObject(ctx context.Context, bucketObj *storage.BucketHandle, filename string) (string, error) {
+	if detector := detectFileType(ctx, filename); detector != "" && detector != DetectorDat {
+		var format *KVFormat
+		switch detector {
+		case DetectorAmChua:
+			format = AmChuaKVFormat()
+		case DetectorBaria:
+			format = BariaKVFormat()
+		default:
+			format = MatchKVFormat(filename)
+		}
+		var ids []string
+		for _, box := range format.matchBoxes(ctx, filename) {
+			ids = append(ids, box.ID)
+		}
+		return format.Name + ":" + strings.Join(ids, ","), nil
+	}
+	if IsZipFile(filename) {
+		return "", fmt.Errorf("zip archives hold several devices")
+	}
+
+	// The meta line is enough unless the device ID comes from a data column
+	headerOnly := !IsNDJSONFile(filename) && (GlobalConfig == nil || GlobalConfig.DeviceIDColumn == "")
+	if headerOnly {
+		reader, err := bucketObj.Object(filename).NewRangeReader(ctx, 0, 64*1024)
+		if err != nil {
+			return "", err
+		}
+		defer reader.Close()
+		head, err := io.ReadAll(reader)
+		if err != nil {
+			return "", err
+		}
+		deviceID, _, err := ParseHeader(head)
+		return deviceID, err
+	}
+
+	reader, err := bucketObj.Object(filename).NewReader(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, reader); err != nil {
+		return "", err
+	}
+
+	extract := extractData
+	if IsNDJSONFile(filename) {
+		extract = extractNDJSON
+	}
+	data, err := extract(ctx, filename, buf.Bytes())
+	if err != nil {
+		return "", err
+	}
+	return data["device_id"].(string), nil
+}
@@ -0,0 +1,43 @@
+package loader
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewestPerDevice(t *testing.T) {
+	f := useFakeGCS(t)
+	first := toa5CSV(`"TIMESTAMP","RECORD","water"`, `"2025-01-02 03:04:05",1,1.5`)
+	second := []byte(strings.Replace(string(first), `"19531"`, `"20417"`, 1))
+	f.put("uploads", "backfill/19531_a.csv", first)
+	f.put("uploads", "backfill/19531_b.csv", first)
+	f.put("uploads", "backfill/19531_c.csv", first)
+	f.put("uploads", "backfill/20417_a.csv", second)
+	f.put("uploads", "backfill/broken.csv", []byte("not a TOA5 file"))
+
+	client, err := storageClient()
+	if err != nil {
+		t.Fatalf("storageClient() error = %v", err)
+	}
+	day := time.Date(2025, time.January, 2, 0, 0, 0, 0, time.UTC)
+	candidates := []prefixCandidate{
+		{Name: "backfill/19531_a.csv", Updated: day.Add(time.Hour)},
+		{Name: "backfill/20417_a.csv", Updated: day},
+		{Name: "backfill/19531_b.csv", Updated: day.Add(3 * time.Hour)},
+		{Name: "backfill/broken.csv", Updated: day},
+		{Name: "backfill/19531_c.csv", Updated: day.Add(2 * time.Hour)},
+	}
+
+	// Only the most recently updated file of each device is kept, in first-seen device order
+	var got []string
+	for _, candidate := range newestPerDevice(context.Background(), bucketHandle(client, "uploads"), candidates) {
+		got = append(got, candidate.Name)
+	}
+	want := []string{"backfill/19531_b.csv", "backfill/20417_a.csv", "backfill/broken.csv"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("newestPerDevice() = %v, want %v", got, want)
+	}
+}
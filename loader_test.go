@@ -0,0 +1,1268 @@
+package loader
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestMain(m *testing.M) {
+	GlobalLogger.SetWriter(io.Discard)
+	// No database connection nor shutdown handler: tests set MongoDatabase directly
+	runtimeSetup.Do(func() {})
+	os.Exit(m.Run())
+}
+
+func TestIsMetadataUpdate(t *testing.T) {
+	tests := []struct {
+		name           string
+		skip           bool
+		metageneration string
+		want           bool
+	}{
+		{"disabled", false, "2", false},
+		{"new object", true, "1", false},
+		{"metadata update", true, "2", true},
+		{"unknown metageneration", true, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) { c.SkipMetadataUpdates = tt.skip })
+			data := StorageObjectData{Name: "a.csv", Bucket: "b", Metageneration: tt.metageneration}
+			if got := isMetadataUpdate(data); got != tt.want {
+				t.Errorf("isMetadataUpdate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// toa5CSV builds a TOA5 CSV file of device CR300_19531 with the given columns line and data rows
+func toa5CSV(columns string, rows ...string) []byte {
+	lines := []string{
+		`"TOA5","T1","CR300","19531","CR300.Std","CPU:prog.CR3","1","Table1"`,
+		columns,
+		`"TS","RN","m","V"`,
+		`"","","Smp","Smp"`,
+	}
+	return []byte(strings.Join(append(lines, rows...), "\n"))
+}
+
+// extractRecords parses CSV content with ExtractData and returns its records
+func extractRecords(t *testing.T, content []byte) []SensorRecord {
+	t.Helper()
+	data, err := ExtractData("CR300_19531_Table1.csv", content)
+	if err != nil {
+		t.Fatalf("ExtractData() error = %v", err)
+	}
+	return data["records"].([]SensorRecord)
+}
+
+func TestExtractDataQualityColumn(t *testing.T) {
+	content := toa5CSV(`"TIMESTAMP","RECORD","water","Flag"`,
+		`"2025-01-02 03:04:05",1,1.5,"OK"`,
+		`"2025-01-02 03:05:05",2,1.6,2`,
+	)
+
+	withConfig(t, func(c *Config) { c.QualityColumn = "Flag" })
+	records := extractRecords(t, content)
+	if len(records) != 2 {
+		t.Fatalf("got %d records, want 2", len(records))
+	}
+	if records[0]["q"] != "OK" {
+		t.Errorf("record 0: q = %v, want OK", records[0]["q"])
+	}
+	if records[1]["q"] != 2.0 {
+		t.Errorf("record 1: q = %v, want 2", records[1]["q"])
+	}
+	if _, exists := records[0]["Flag"]; exists {
+		t.Errorf("record 0: the quality column is also stored under its name")
+	}
+
+	withConfig(t, func(c *Config) { c.QualityColumn = "" })
+	records = extractRecords(t, content)
+	if _, exists := records[0]["q"]; exists {
+		t.Errorf("without QUALITY_COLUMN: q = %v, want none", records[0]["q"])
+	}
+	if _, exists := records[0]["Flag"]; exists {
+		t.Errorf("without QUALITY_COLUMN: non-numeric Flag value stored")
+	}
+}
+
+func TestIsDatFile(t *testing.T) {
+	tests := []struct {
+		filename string
+		want     bool
+	}{
+		{"CR300_19531_Table1.dat", true},
+		{"logger/CR300_19531_Table1.DAT", true},
+		{"CR300_19531_Table1.csv", false},
+		{"CR300_19531_Table1.dat.csv", false},
+		{"data", false},
+	}
+	for _, tt := range tests {
+		if got := IsDatFile(tt.filename); got != tt.want {
+			t.Errorf("IsDatFile(%q) = %v, want %v", tt.filename, got, tt.want)
+		}
+	}
+	if got := detectFileType(context.Background(), "CR300_19531_Table1.dat"); got != DetectorDat {
+		t.Errorf("detectFileType(.dat) = %q, want %q", got, DetectorDat)
+	}
+	if got := detectFileType(context.Background(), "CR300_19531_Table1.csv"); got != "" {
+		t.Errorf("detectFileType(.csv) = %q, want plain CSV", got)
+	}
+}
+
+func TestExtractDataBitFlags(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.BitFlagFields = map[string][]BitFlag{"TI": {{Bit: 0, Name: "tilt_x"}, {Bit: 2, Name: "tilt_z"}}}
+	})
+	records := extractRecords(t, toa5CSV(`"TIMESTAMP","RECORD","TI"`, `"2025-01-02 03:04:05",1,5`, `"2025-01-02 03:05:05",2,2`))
+
+	tests := []struct {
+		tiltX, tiltZ bool
+	}{
+		{true, true},
+		{false, false},
+	}
+	for i, tt := range tests {
+		if records[i]["tilt_x"] != tt.tiltX || records[i]["tilt_z"] != tt.tiltZ {
+			t.Errorf("record %d: tilt_x=%v tilt_z=%v, want %v %v", i, records[i]["tilt_x"], records[i]["tilt_z"], tt.tiltX, tt.tiltZ)
+		}
+	}
+	if records[0]["TI"] != 5.0 {
+		t.Errorf("packed value TI = %v, want 5 (kept)", records[0]["TI"])
+	}
+}
+
+// withNow fixes the clock returned by nowFunc for the duration of the test
+func withNow(t *testing.T, now time.Time) {
+	t.Helper()
+	previous := nowFunc
+	nowFunc = func() time.Time { return now }
+	t.Cleanup(func() { nowFunc = previous })
+}
+
+// withEventAge sets the maximum event age and grace period for the duration of the test
+func withEventAge(t *testing.T, maxAge int64, grace int64) {
+	t.Helper()
+	previousMaxAge, previousGrace := EVENT_MAX_AGE_SECONDS, EVENT_AGE_GRACE_SECONDS
+	EVENT_MAX_AGE_SECONDS, EVENT_AGE_GRACE_SECONDS = maxAge, grace
+	t.Cleanup(func() { EVENT_MAX_AGE_SECONDS, EVENT_AGE_GRACE_SECONDS = previousMaxAge, previousGrace })
+}
+
+func TestIsEventTooOld(t *testing.T) {
+	now := time.Date(2025, time.January, 2, 12, 0, 0, 0, time.UTC)
+	withNow(t, now)
+
+	tests := []struct {
+		name   string
+		maxAge int64
+		grace  int64
+		age    time.Duration
+		want   bool
+	}{
+		{"recent", 3600, 0, 30 * time.Minute, false},
+		{"too old", 3600, 0, 61 * time.Minute, true},
+		{"within grace", 3600, 300, 64 * time.Minute, false},
+		{"past grace", 3600, 300, 66 * time.Minute, true},
+		{"disabled", 0, 0, 48 * time.Hour, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withEventAge(t, tt.maxAge, tt.grace)
+			if got := isEventTooOld(context.Background(), now.Add(-tt.age)); got != tt.want {
+				t.Errorf("isEventTooOld() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInitEventAgeGraceConfig(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int64
+	}{
+		{"", 60},
+		{"120", 120},
+		{"-5", 60},
+		{"soon", 60},
+	}
+	for _, tt := range tests {
+		withEventAge(t, EVENT_MAX_AGE_SECONDS, 60)
+		t.Setenv("EVENT_AGE_GRACE_SECONDS", tt.value)
+		initEventAgeGraceConfig()
+		if EVENT_AGE_GRACE_SECONDS != tt.want {
+			t.Errorf("EVENT_AGE_GRACE_SECONDS=%q: got %d, want %d", tt.value, EVENT_AGE_GRACE_SECONDS, tt.want)
+		}
+	}
+}
+
+func TestExtractAndDump(t *testing.T) {
+	content := toa5CSV(`"TIMESTAMP","RECORD","water"`, `"2025-01-02 03:04:05",1,1.5`)
+
+	var out bytes.Buffer
+	if err := ExtractAndDump("CR300_19531_Table1.csv", content, &out); err != nil {
+		t.Fatalf("ExtractAndDump() error = %v", err)
+	}
+	var dumped struct {
+		DeviceID string                   `json:"device_id"`
+		Records  []map[string]interface{} `json:"records"`
+		Fields   []string                 `json:"fields"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &dumped); err != nil {
+		t.Fatalf("output is not JSON: %v\n%s", err, out.String())
+	}
+	if dumped.DeviceID != "CR300_19531" || len(dumped.Records) != 1 || dumped.Records[0]["WA"] != 1.5 {
+		t.Errorf("dumped = %+v", dumped)
+	}
+	if !reflect.DeepEqual(dumped.Fields, []string{"WA"}) {
+		t.Errorf("fields = %v, want [WA]", dumped.Fields)
+	}
+
+	if err := ExtractAndDump("bad.csv", []byte("not a TOA5 file"), &out); err == nil {
+		t.Errorf("ExtractAndDump() of invalid content: no error")
+	}
+}
+
+// captureLogs redirects the global logger output to a buffer for the duration of the test
+func captureLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	GlobalLogger.SetWriter(&buf)
+	t.Cleanup(func() { GlobalLogger.SetWriter(io.Discard) })
+	return &buf
+}
+
+// newStorageEvent builds a Cloud Storage object finalized event
+func newStorageEvent(t *testing.T, data StorageObjectData, eventTime time.Time) cloudevents.Event {
+	t.Helper()
+	ce := cloudevents.NewEvent()
+	ce.SetID("event-1")
+	ce.SetType("google.cloud.storage.object.v1.finalized")
+	ce.SetSource("//storage.googleapis.com/projects/_/buckets/" + data.Bucket)
+	ce.SetTime(eventTime)
+	if err := ce.SetData(cloudevents.ApplicationJSON, data); err != nil {
+		t.Fatalf("SetData() error = %v", err)
+	}
+	return ce
+}
+
+func TestHelloGCSEventAge(t *testing.T) {
+	now := time.Date(2025, time.January, 2, 12, 0, 0, 0, time.UTC)
+	withNow(t, now)
+	withEventAge(t, 3600, 0)
+	t.Setenv("AGE_CHECK_EXEMPT_PATTERNS", `^backfill/`)
+	withFilePatterns(t, &FilePattern{AgeCheckExemptPatterns: loadAgeCheckExemptPatterns()})
+
+	logs := captureLogs(t)
+	old := now.Add(-2 * time.Hour)
+	if err := helloGCS(context.Background(), newStorageEvent(t, StorageObjectData{Name: "upload/a.csv", Bucket: "b"}, old)); err != nil {
+		t.Fatalf("helloGCS() error = %v", err)
+	}
+	if !strings.Contains(logs.String(), "Skipping - event is too old") {
+		t.Errorf("old event not skipped:\n%s", logs)
+	}
+
+	logs.Reset()
+	if err := helloGCS(context.Background(), newStorageEvent(t, StorageObjectData{Name: "backfill/a.csv", Bucket: "b"}, old)); err != nil {
+		t.Fatalf("helloGCS() error = %v", err)
+	}
+	if !strings.Contains(logs.String(), "exempt from the age check") || strings.Contains(logs.String(), "too old") {
+		t.Errorf("exempt file not processed:\n%s", logs)
+	}
+}
+
+func TestProcessReaderResult(t *testing.T) {
+	ctx := context.Background()
+
+	content := toa5CSV(`"TIMESTAMP","RECORD","water"`, `"2025-01-02 03:04:05",1,1.5`)
+	result, err := ProcessReader(ctx, "CR300_19531_Table1.csv", bytes.NewReader(content))
+	if !errors.Is(err, ErrMongoNotConnected) {
+		t.Errorf("CSV file: error = %v, want ErrMongoNotConnected", err)
+	}
+	if result == nil || result.FileType != FileTypeCSV || result.DeviceID != "CR300_19531" || result.Inserted != 0 {
+		t.Errorf("CSV file: result = %+v", result)
+	}
+
+	result, err = ProcessReader(ctx, "broken.csv", strings.NewReader("not a TOA5 file"))
+	var parseErr *ParseError
+	if !errors.As(err, &parseErr) {
+		t.Errorf("invalid CSV file: error = %v, want a ParseError", err)
+	}
+	if result == nil || result.FileType != FileTypeCSV {
+		t.Errorf("invalid CSV file: result = %+v", result)
+	}
+
+	result, _ = ProcessReader(ctx, "HoAmChua_TramTT/20251129190000.txt", strings.NewReader("rain_1 1.5"))
+	if result == nil || result.FileType != FileTypeAmChua {
+		t.Errorf("AmChua file: result = %+v, want file type %s", result, FileTypeAmChua)
+	}
+}
+
+func TestExtractDataBSONDate(t *testing.T) {
+	content := toa5CSV(`"TIMESTAMP","RECORD","water"`, `"2025-01-02 03:04:05",1,1.5`)
+	want := time.Date(2025, time.January, 2, 3, 4, 5, 0, GlobalConfig.TimezoneLocation)
+
+	withConfig(t, func(c *Config) { c.StoreBSONDate = false })
+	if record := extractRecords(t, content)[0]; record["ts"] != nil || record["_id"] != want.Unix() {
+		t.Errorf("without STORE_BSON_DATE: record = %v", record)
+	}
+
+	withConfig(t, func(c *Config) { c.StoreBSONDate = true })
+	record := extractRecords(t, content)[0]
+	if record["_id"] != want.Unix() || record["ts"] != primitive.NewDateTimeFromTime(want) {
+		t.Errorf("with STORE_BSON_DATE: record = %v, want ts %v", record, want)
+	}
+}
+
+func TestExtractDataCSVOptions(t *testing.T) {
+	commented := toa5CSV(`"TIMESTAMP","RECORD","water"`,
+		`# exported by LoggerNet`,
+		`"2025-01-02 03:04:05",1,1.5`,
+		`# maintenance visit`,
+		`"2025-01-02 03:05:05",2,1.6`,
+	)
+	withConfig(t, func(c *Config) { c.CSVComment = '#' })
+	if records := extractRecords(t, commented); len(records) != 2 {
+		t.Errorf("CSV_COMMENT: got %d records, want 2", len(records))
+	}
+
+	// A comment line before the meta line must not shift the header lines
+	withConfig(t, func(c *Config) { c.CSVComment = '#' })
+	records := extractRecords(t, append([]byte("# header comment\n"), commented...))
+	if len(records) != 2 || records[0]["WA"] != 1.5 {
+		t.Errorf("CSV_COMMENT before the meta line: got %v", records)
+	}
+
+	lazy := toa5CSV(`"TIMESTAMP","RECORD","water","note"`, `"2025-01-02 03:04:05",1,1.5,"sensor "A" cleaned"`)
+	withConfig(t, func(c *Config) { c.CSVLazyQuotes = false })
+	if _, err := ExtractData("CR300_19531_Table1.csv", lazy); err == nil {
+		t.Errorf("without CSV_LAZY_QUOTES: embedded quotes parsed without error")
+	}
+	withConfig(t, func(c *Config) { c.CSVLazyQuotes = true })
+	if records := extractRecords(t, lazy); len(records) != 1 || records[0]["WA"] != 1.5 {
+		t.Errorf("CSV_LAZY_QUOTES: got %v", records)
+	}
+}
+
+func TestExtractDataMinValidTimestamp(t *testing.T) {
+	content := toa5CSV(`"TIMESTAMP","RECORD","water"`,
+		`"1970-01-01 00:00:00",1,1.5`,
+		`"1970-01-02 00:00:00",2,1.6`,
+		`"2025-01-02 03:04:05",3,1.7`,
+	)
+
+	withConfig(t, func(c *Config) { c.MinValidTimestamp = defaultMinValidTimestamp })
+	records := extractRecords(t, content)
+	if len(records) != 1 || records[0]["WA"] != 1.7 {
+		t.Errorf("epoch and near-epoch rows not dropped: %v", records)
+	}
+
+	withConfig(t, func(c *Config) { c.MinValidTimestamp = 0 })
+	if records := extractRecords(t, content); len(records) != 3 {
+		t.Errorf("MIN_VALID_TIMESTAMP=0: got %d records, want 3", len(records))
+	}
+}
+
+func TestExtractDataDeviceIDFromColumn(t *testing.T) {
+	content := toa5CSV(`"TIMESTAMP","RECORD","Station","water"`,
+		`"2025-01-02 03:04:05",1,"",1.5`,
+		`"2025-01-02 03:05:05",2,"LAKE_07",1.6`,
+	)
+	tests := []struct {
+		column string
+		want   string
+	}{
+		{"Station", "LAKE_07"},
+		{"Missing", "CR300_19531"},
+		{"", "CR300_19531"},
+	}
+	for _, tt := range tests {
+		withConfig(t, func(c *Config) { c.DeviceIDColumn = tt.column })
+		data, err := ExtractData("CR300_19531_Table1.csv", content)
+		if err != nil {
+			t.Fatalf("DEVICE_ID_FROM_COLUMN=%q: ExtractData() error = %v", tt.column, err)
+		}
+		if got := data["device_id"]; got != tt.want {
+			t.Errorf("DEVICE_ID_FROM_COLUMN=%q: device ID = %v, want %s", tt.column, got, tt.want)
+		}
+		for _, record := range data["records"].([]SensorRecord) {
+			if _, exists := record["Station"]; exists {
+				t.Errorf("DEVICE_ID_FROM_COLUMN=%q: device ID column stored as a field", tt.column)
+			}
+		}
+	}
+}
+
+func TestParseNumberDecimalComma(t *testing.T) {
+	tests := []struct {
+		s            string
+		decimalComma bool
+		want         float64
+		wantErr      bool
+	}{
+		{"12.34", false, 12.34, false},
+		{"12,34", false, 0, true},
+		{"12,34", true, 12.34, false},
+		{"12.34", true, 12.34, false},
+		{"-0,5", true, -0.5, false},
+		// Thousands separators are not supported
+		{"1,234,5", true, 0, true},
+	}
+	for _, tt := range tests {
+		withConfig(t, func(c *Config) { c.DecimalComma = tt.decimalComma })
+		got, err := parseNumber(tt.s)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("DECIMAL_COMMA=%v parseNumber(%q) = %v, %v, want %v (error: %v)", tt.decimalComma, tt.s, got, err, tt.want, tt.wantErr)
+		}
+	}
+
+	withConfig(t, func(c *Config) { c.DecimalComma = true })
+	records := extractRecords(t, toa5CSV(`"TIMESTAMP","RECORD","water"`, `"2025-01-02 03:04:05",1,"1,5"`))
+	if records[0]["WA"] != 1.5 {
+		t.Errorf("CSV comma-decimal value: WA = %v, want 1.5", records[0]["WA"])
+	}
+	valueMap, valid, _, _ := (&KVFormat{Name: "lake", Delimiter: "\t"}).parseValues(context.Background(), "a.txt", []byte("MNH\t12,5\n"))
+	if valid != 1 || valueMap["MNH"] != 12.5 {
+		t.Errorf("KV comma-decimal value: valueMap = %v", valueMap)
+	}
+}
+
+func TestExtractDataCSVTimeLayout(t *testing.T) {
+	// 2025-01-02 03:04:05 in GMT+7
+	const want = int64(1735761845)
+	tests := []struct {
+		layout    string
+		timestamp string
+	}{
+		{"2006/01/02 15:04:05", "2025/01/02 03:04:05"},
+		{"2006-01-02T15:04:05Z07:00", "2025-01-01T20:04:05Z"},
+		// The default layout is the fallback of a custom layout
+		{"2006/01/02 15:04:05", "2025-01-02 03:04:05"},
+		{"", "2025-01-02 03:04:05"},
+	}
+	for _, tt := range tests {
+		withConfig(t, func(c *Config) { c.CSVTimeLayout = tt.layout })
+		records := extractRecords(t, toa5CSV(`"TIMESTAMP","RECORD","water"`, `"`+tt.timestamp+`",1,1.5`))
+		if len(records) != 1 || records[0]["_id"] != want {
+			t.Errorf("CSV_TIME_LAYOUT=%q, timestamp %q: got %v, want _id %d", tt.layout, tt.timestamp, records, want)
+		}
+	}
+
+	withConfig(t, func(c *Config) { c.CSVTimeLayout = "" })
+	if records := extractRecords(t, toa5CSV(`"TIMESTAMP","RECORD","water"`, `"2025/01/02 03:04:05",1,1.5`)); len(records) != 0 {
+		t.Errorf("slash-separated timestamp parsed without CSV_TIME_LAYOUT: %v", records)
+	}
+}
+
+func TestDetectFileTypePrecedence(t *testing.T) {
+	// Matches both the AmChua and the Baria detectors
+	const ambiguous = "upload/HoSongRay_KenhSongRay/HoAmChua_TramTT_20250102030405.txt"
+	if !IsAmChuaFile(ambiguous) || !IsBariaFile(ambiguous) {
+		t.Fatalf("%s does not match both detectors", ambiguous)
+	}
+
+	tests := []struct {
+		precedence string
+		want       string
+	}{
+		{"", DetectorAmChua},
+		{"baria", DetectorBaria},
+		{"kv, baria", DetectorBaria},
+		{"amchua,baria", DetectorAmChua},
+	}
+	for _, tt := range tests {
+		withConfig(t, func(c *Config) { c.DetectorPrecedence = parseDetectorPrecedence(tt.precedence) })
+		logs := captureLogs(t)
+		if got := detectFileType(context.Background(), ambiguous); got != tt.want {
+			t.Errorf("DETECTOR_PRECEDENCE=%q: detectFileType() = %q, want %q", tt.precedence, got, tt.want)
+		}
+		if !strings.Contains(logs.String(), "ambiguous file type") {
+			t.Errorf("DETECTOR_PRECEDENCE=%q: ambiguous match not logged:\n%s", tt.precedence, logs)
+		}
+	}
+
+	logs := captureLogs(t)
+	if got := detectFileType(context.Background(), "upload/HoAmChua_TramTT_20250102030405.txt"); got != DetectorAmChua || strings.Contains(logs.String(), "ambiguous") {
+		t.Errorf("single match: detectFileType() = %q, logs:\n%s", got, logs)
+	}
+}
+
+func TestParseDetectorPrecedence(t *testing.T) {
+	tests := []struct {
+		val  string
+		want []string
+	}{
+		{"", DefaultDetectorPrecedence},
+		{"kv", []string{DetectorKV, DetectorDat, DetectorAmChua, DetectorBaria}},
+		{" Baria , dat, baria", []string{DetectorBaria, DetectorDat, DetectorAmChua, DetectorKV}},
+	}
+	for _, tt := range tests {
+		if got := parseDetectorPrecedence(tt.val); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseDetectorPrecedence(%q) = %v, want %v", tt.val, got, tt.want)
+		}
+	}
+}
+
+func TestParseHeader(t *testing.T) {
+	wantColumns := []string{"TIMESTAMP", "RECORD", "water"}
+
+	// The data rows are not parsed: a broken row does not matter
+	content := toa5CSV(`"TIMESTAMP","RECORD","water"`, `"2025-01-02 03:04:05",1,1.5`, `"broken`)
+	deviceID, columns, err := ParseHeader(append([]byte("\n\n"), content...))
+	if err != nil || deviceID != "CR300_19531" || !reflect.DeepEqual(columns, wantColumns) {
+		t.Errorf("ParseHeader() = %q, %v, %v, want CR300_19531 %v", deviceID, columns, err, wantColumns)
+	}
+
+	// The header alone is enough, e.g. the start of a large file
+	deviceID, columns, err = ParseHeader([]byte(`"TOA5","T1","CR300","19531"` + "\n" + `"TIMESTAMP","RECORD","water"`))
+	if err != nil || deviceID != "CR300_19531" || !reflect.DeepEqual(columns, wantColumns) {
+		t.Errorf("ParseHeader(header only) = %q, %v, %v", deviceID, columns, err)
+	}
+
+	withConfig(t, func(c *Config) { c.CSVComment = '#' })
+	if deviceID, _, err := ParseHeader(append([]byte("# exported\n"), content...)); err != nil || deviceID != "CR300_19531" {
+		t.Errorf("ParseHeader(comment line) = %q, %v", deviceID, err)
+	}
+
+	errorTests := []struct {
+		content string
+		want    string
+	}{
+		{`"TOA5","T1","CR300","19531"`, "insufficient header lines"},
+		{"\"TOA5\",\"T1\"\n\"TIMESTAMP\"", "meta data has insufficient fields"},
+		{"\"TOA5\n\"TIMESTAMP\"", "failed to parse meta line"},
+	}
+	for _, tt := range errorTests {
+		if _, _, err := ParseHeader([]byte(tt.content)); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("ParseHeader(%q) error = %v, want %q", tt.content, err, tt.want)
+		}
+	}
+}
+
+func TestExtractDataFieldConversions(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.FieldConversions = map[string]FieldConversion{"WA": {Scale: 0.5}, "TE": {Scale: 1, Offset: 273.15}}
+	})
+	records := extractRecords(t, toa5CSV(`"TIMESTAMP","RECORD","water","TE","HU"`, `"2025-01-02 03:04:05",1,15,20,60`))
+	if records[0]["WA"] != 7.5 || records[0]["TE"] != 293.15 || records[0]["HU"] != 60.0 {
+		t.Errorf("converted record = %v, want WA=7.5 TE=293.15 HU=60", records[0])
+	}
+}
+
+func TestExtractDataColumnBlacklist(t *testing.T) {
+	content := toa5CSV(`"TIMESTAMP","RECORD","water","TE","BattV_Min"`, `"2025-01-02 03:04:05",1,1.5,20,12.6`)
+	tests := []struct {
+		blacklist string
+		dropped   []string
+		kept      []string
+	}{
+		// Blacklisting the alias also drops the column stored under its code, and the other way round
+		{"water;BattV_Min", []string{"WA", "BattV_Min"}, []string{"TE"}},
+		{"WA, TE", []string{"WA", "TE"}, []string{"BattV_Min"}},
+		{"", nil, []string{"WA", "TE", "BattV_Min"}},
+	}
+	for _, tt := range tests {
+		withConfig(t, func(c *Config) { c.ColumnBlacklist = parseColumnBlacklist(tt.blacklist) })
+		data, err := ExtractData("CR300_19531_Table1.csv", content)
+		if err != nil {
+			t.Fatalf("ExtractData() error = %v", err)
+		}
+		record := data["records"].([]SensorRecord)[0]
+		fields := data["fields"].([]string)
+		for _, field := range tt.dropped {
+			if _, exists := record[field]; exists || slices.Contains(fields, field) {
+				t.Errorf("COLUMN_BLACKLIST=%q: %s stored: %v", tt.blacklist, field, record)
+			}
+		}
+		for _, field := range tt.kept {
+			if _, exists := record[field]; !exists {
+				t.Errorf("COLUMN_BLACKLIST=%q: %s dropped: %v", tt.blacklist, field, record)
+			}
+		}
+	}
+}
+
+func TestColumnBlacklistFollowsFieldMappings(t *testing.T) {
+	withConfig(t, func(c *Config) { c.ColumnBlacklist = parseColumnBlacklist("water") })
+	withFieldMappings(t, []FieldMapping{{Code: "WA", Alias: "water"}})
+	if !isBlacklistedColumn("WA") || !isBlacklistedColumn("water") {
+		t.Error("water or WA not blacklisted with water -> WA")
+	}
+
+	// After a reload the alias resolves to the new code only
+	withFieldMappings(t, []FieldMapping{{Code: "WX", Alias: "water"}})
+	if !isBlacklistedColumn("WX") {
+		t.Error("WX not blacklisted after remapping water -> WX")
+	}
+	if isBlacklistedColumn("WA") {
+		t.Error("WA still blacklisted after remapping water -> WX")
+	}
+}
+
+func TestExtractDataAutoDetectDataStart(t *testing.T) {
+	const meta = `"TOA5","T1","CR300","19531","CR300.Std","CPU:prog.CR3","1","Table1"`
+	const columns = `"TIMESTAMP","RECORD","water"`
+	const rows = "\"2025-01-02 03:04:05\",1,1.5\n\"2025-01-02 03:05:05\",2,1.6"
+	tests := []struct {
+		name   string
+		header []string
+	}{
+		{"3 header lines", []string{meta, columns, `"TS","RN","m"`}},
+		{"4 header lines", []string{meta, columns, `"TS","RN","m"`, `"","","Smp"`}},
+		{"5 header lines", []string{meta, `"program","v2"`, columns, `"TS","RN","m"`, `"","","Smp"`}},
+	}
+	for _, tt := range tests {
+		content := []byte(strings.Join(tt.header, "\n") + "\n" + rows)
+
+		withConfig(t, func(c *Config) { c.AutoDetectDataStart = true })
+		records := extractRecords(t, content)
+		if len(records) != 2 || records[0]["WA"] != 1.5 || records[1]["WA"] != 1.6 {
+			t.Errorf("%s: records = %v, want the 2 data rows", tt.name, records)
+		}
+
+		// The fixed layout reads the columns from line 1: the 5-line file loses its water values
+		withConfig(t, func(c *Config) { c.AutoDetectDataStart = false })
+		data, err := ExtractData("CR300_19531_Table1.csv", content)
+		if len(tt.header) == 5 && err == nil {
+			for _, record := range data["records"].([]SensorRecord) {
+				if _, exists := record["WA"]; exists {
+					t.Errorf("%s without AUTO_DETECT_DATA_START: columns found", tt.name)
+				}
+			}
+		}
+	}
+}
+
+func TestDetectDataStart(t *testing.T) {
+	tests := []struct {
+		lines                 []string
+		wantColumns, wantData int
+		wantFound             bool
+	}{
+		{[]string{`"TOA5"`, `"TIMESTAMP","RECORD","water"`, `"2025-01-02 03:04:05",1,1.5`}, 1, 2, true},
+		{[]string{`"TOA5"`, `"program"`, `"TIMESTAMP","RECORD","water"`, `"TS","RN","m"`, `"2025-01-02 03:04:05",1,1.5`}, 2, 4, true},
+		{[]string{`"TOA5"`, `"a","b"`, `"c","d"`, `"2025-01-02 03:04:05",1`}, 1, 3, true},
+		{[]string{`"TOA5"`, `"TIMESTAMP","RECORD"`, `"TS","RN"`}, 0, 0, false},
+	}
+	for i, tt := range tests {
+		columns, data, found := detectDataStart(tt.lines)
+		if columns != tt.wantColumns || data != tt.wantData || found != tt.wantFound {
+			t.Errorf("case %d: detectDataStart() = %d, %d, %v, want %d, %d, %v", i, columns, data, found, tt.wantColumns, tt.wantData, tt.wantFound)
+		}
+	}
+}
+
+func TestHelloGCSMalformedEvents(t *testing.T) {
+	now := time.Date(2025, time.January, 2, 12, 0, 0, 0, time.UTC)
+	withNow(t, now)
+	rawEvent := func(contentType string, data []byte) cloudevents.Event {
+		ce := cloudevents.NewEvent()
+		ce.SetID("event-1")
+		ce.SetType("google.cloud.storage.object.v1.finalized")
+		ce.SetSource("//storage.googleapis.com/projects/_/buckets/b")
+		ce.SetTime(now)
+		if data != nil {
+			if err := ce.SetData(contentType, data); err != nil {
+				t.Fatalf("SetData() error = %v", err)
+			}
+		}
+		return ce
+	}
+
+	// Permanent failures: dropped without platform retry
+	dropped := []struct {
+		name string
+		ce   cloudevents.Event
+		want string
+	}{
+		{"invalid JSON", rawEvent(cloudevents.ApplicationJSON, []byte(`{"name": "a.csv",`)), "invalid JSON"},
+		{"missing name", rawEvent(cloudevents.ApplicationJSON, []byte(`{"bucket": "b"}`)), "missing file name"},
+		{"missing bucket", rawEvent(cloudevents.ApplicationJSON, []byte(`{"name": "a.csv"}`)), "missing bucket"},
+	}
+	for _, tt := range dropped {
+		logs := captureLogs(t)
+		if err := helloGCS(context.Background(), tt.ce); err != nil {
+			t.Errorf("%s: helloGCS() error = %v, want the event dropped", tt.name, err)
+		}
+		if !strings.Contains(logs.String(), tt.want) || !strings.Contains(logs.String(), "dropping event") {
+			t.Errorf("%s: drop not logged:\n%s", tt.name, logs)
+		}
+	}
+
+	// Possibly transient failures: returned so the platform retries
+	retried := []struct {
+		name string
+		ce   cloudevents.Event
+	}{
+		{"empty payload", rawEvent(cloudevents.ApplicationJSON, nil)},
+		{"undecodable encoding", rawEvent("application/xml", []byte(`<object name="a.csv"`))},
+	}
+	for _, tt := range retried {
+		err := helloGCS(context.Background(), tt.ce)
+		if err == nil || errors.Is(err, ErrMalformedEvent) {
+			t.Errorf("%s: helloGCS() error = %v, want a retryable error", tt.name, err)
+		}
+	}
+}
+
+// withFieldMappings sets the field mappings for the duration of the test
+func withFieldMappings(t *testing.T, mappings []FieldMapping) {
+	t.Helper()
+	previous := fieldMappings.Load()
+	if err := SetFieldMappings(mappings); err != nil {
+		t.Fatalf("SetFieldMappings() error = %v", err)
+	}
+	t.Cleanup(func() { storeFieldMappings(previous) })
+}
+
+func TestSetFieldMappings(t *testing.T) {
+	withFieldMappings(t, []FieldMapping{{Code: "WA", Alias: "water"}, {Code: "TE", Alias: "temp"}})
+	if code, exists := LookupCode("water"); !exists || code != "WA" {
+		t.Errorf("LookupCode(water) = %q, %v, want WA, true", code, exists)
+	}
+	if alias, exists := LookupAlias("TE"); !exists || alias != "temp" {
+		t.Errorf("LookupAlias(TE) = %q, %v, want temp, true", alias, exists)
+	}
+
+	// A reload replaces the tables as a whole
+	if err := SetFieldMappings([]FieldMapping{{Code: "WX", Alias: "water"}}); err != nil {
+		t.Fatalf("SetFieldMappings() error = %v", err)
+	}
+	if code, _ := LookupCode("water"); code != "WX" {
+		t.Errorf("LookupCode(water) = %q after reload, want WX", code)
+	}
+	if _, exists := LookupCode("temp"); exists {
+		t.Error("LookupCode(temp) found after reload without it")
+	}
+	if want := map[string]string{"water": "WX"}; !maps.Equal(AliasToCode, want) {
+		t.Errorf("AliasToCode = %v after reload, want %v", AliasToCode, want)
+	}
+}
+
+func TestSetFieldMappingsCollisions(t *testing.T) {
+	withFieldMappings(t, []FieldMapping{{Code: "WA", Alias: "water"}})
+	colliding := []FieldMapping{{Code: "WA", Alias: "water"}, {Code: "WX", Alias: "water"}, {Code: "WX", Alias: "wtr"}}
+
+	logs := captureLogs(t)
+	if err := SetFieldMappings(colliding); err != nil {
+		t.Fatalf("SetFieldMappings() error = %v", err)
+	}
+	for _, want := range []string{"alias water maps to WA and WX", "code WX has aliases water and wtr"} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("collision %q not logged:\n%s", want, logs)
+		}
+	}
+	// The last entry wins
+	if code, _ := LookupCode("water"); code != "WX" {
+		t.Errorf("LookupCode(water) = %q, want WX", code)
+	}
+
+	// STRICT_MAPPINGS rejects the mappings and keeps the current tables
+	withFieldMappings(t, []FieldMapping{{Code: "WA", Alias: "water"}})
+	t.Setenv("STRICT_MAPPINGS", "true")
+	err := SetFieldMappings(colliding)
+	if err == nil || !strings.Contains(err.Error(), "alias water maps to WA and WX") {
+		t.Errorf("SetFieldMappings() error = %v, want the collisions", err)
+	}
+	if code, _ := LookupCode("water"); code != "WA" {
+		t.Errorf("LookupCode(water) = %q after a rejected reload, want WA", code)
+	}
+	if err := SetFieldMappings([]FieldMapping{{Code: "WA", Alias: "water"}, {Code: "WA", Alias: "water"}}); err != nil {
+		t.Errorf("SetFieldMappings(duplicate entry) error = %v, want none", err)
+	}
+}
+
+func TestSetFieldMappingsConcurrentReload(t *testing.T) {
+	sets := [][]FieldMapping{
+		{{Code: "WA", Alias: "water"}, {Code: "TE", Alias: "temp"}},
+		{{Code: "WX", Alias: "water"}, {Code: "TE", Alias: "temp"}},
+	}
+	withFieldMappings(t, sets[0])
+	content := toa5CSV(`"TIMESTAMP","RECORD","water","temp"`, `"2025-01-02 03:04:05",1,1.5,20`)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if code, exists := LookupCode("water"); !exists || (code != "WA" && code != "WX") {
+					errs <- fmt.Errorf("LookupCode(water) = %q, %v during reload", code, exists)
+					return
+				}
+				result, err := ExtractData("a.csv", content)
+				if err != nil {
+					errs <- err
+					return
+				}
+				// A file is parsed with a single table set: both columns are mapped
+				record := result["records"].([]SensorRecord)[0]
+				if _, exists := record["TE"]; !exists {
+					errs <- fmt.Errorf("record %v: temp not mapped during reload", record)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 200; i++ {
+		if err := SetFieldMappings(sets[i%2]); err != nil {
+			t.Fatalf("SetFieldMappings() error = %v", err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestEventTraceID(t *testing.T) {
+	ce := cloudevents.NewEvent()
+	ce.SetID("event-1")
+	ce.SetExtension("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if got := eventTraceID(ce); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("eventTraceID() = %q, want the traceparent trace ID", got)
+	}
+
+	// Malformed or missing traceparent: a random ID per event
+	ce.SetExtension("traceparent", "00-short-01")
+	first, second := eventTraceID(ce), eventTraceID(cloudevents.NewEvent())
+	if len(first) != 32 || len(second) != 32 || first == second {
+		t.Errorf("eventTraceID() = %q, %q, want distinct random 32 digit IDs", first, second)
+	}
+}
+
+func TestHelloGCSTrace(t *testing.T) {
+	withLogTrace(t)
+	logs := captureLogs(t)
+	ce := cloudevents.NewEvent()
+	ce.SetID("event-1")
+	ce.SetType("google.cloud.storage.object.v1.finalized")
+	ce.SetSource("//storage.googleapis.com/projects/_/buckets/b")
+	ce.SetExtension("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if err := ce.SetData(cloudevents.ApplicationJSON, []byte(`{"name": "a.csv"}`)); err != nil {
+		t.Fatalf("SetData() error = %v", err)
+	}
+	if err := helloGCS(context.Background(), ce); err != nil {
+		t.Fatalf("helloGCS() error = %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	if len(lines) < 3 {
+		t.Fatalf("logged %q, want the event lines", lines)
+	}
+	for _, line := range lines {
+		// Messages ending with a newline leave blank lines
+		if line != "" && !strings.Contains(line, "trace=4bf92f3577b34da6a3ce929d0e0e4736 ") {
+			t.Errorf("line %q lacks the event trace", line)
+		}
+	}
+}
+
+func TestCheckMinRecords(t *testing.T) {
+	tests := []struct {
+		name     string
+		min      int
+		mode     string
+		count    int
+		wantErr  bool
+		wantWarn bool
+	}{
+		{"no check", 0, MinRecordsModeFail, 0, false, false},
+		{"zero records warn", 2, MinRecordsModeWarn, 0, false, true},
+		{"few records fail", 2, MinRecordsModeFail, 1, true, false},
+		{"enough records", 2, MinRecordsModeFail, 2, false, false},
+		{"many records", 2, MinRecordsModeWarn, 100, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.MinRecords = tt.min
+				c.MinRecordsMode = tt.mode
+			})
+			logs := captureLogs(t)
+			err := checkMinRecords(context.Background(), "a.csv", tt.count, "records")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkMinRecords(%d) error = %v, wantErr %v", tt.count, err, tt.wantErr)
+			}
+			if warned := strings.Contains(logs.String(), "MIN_RECORDS"); warned != tt.wantWarn {
+				t.Errorf("checkMinRecords(%d) logged %q, want warning %v", tt.count, logs, tt.wantWarn)
+			}
+		})
+	}
+}
+
+func TestProcessReaderMinRecords(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.MinRecords = 2
+		c.MinRecordsMode = MinRecordsModeFail
+	})
+	few := toa5CSV(`"TIMESTAMP","RECORD","water"`, `"2025-01-02 03:04:05",1,1.5`)
+	result, err := ProcessReader(context.Background(), "CR300_19531_Table1.csv", bytes.NewReader(few))
+	var parseErr *ParseError
+	if !errors.As(err, &parseErr) || result.Skipped != 1 {
+		t.Errorf("few records: ProcessReader() = %+v, %v, want a ParseError and 1 skipped", result, err)
+	}
+
+	many := toa5CSV(`"TIMESTAMP","RECORD","water"`, `"2025-01-02 03:04:05",1,1.5`, `"2025-01-02 03:05:05",2,1.6`)
+	if _, err := ProcessReader(context.Background(), "CR300_19531_Table1.csv", bytes.NewReader(many)); !errors.Is(err, ErrMongoNotConnected) {
+		t.Errorf("enough records: ProcessReader() error = %v, want ErrMongoNotConnected", err)
+	}
+}
+
+func TestValidateRow(t *testing.T) {
+	columns := []string{"TIMESTAMP", "RECORD", "water", "temp"}
+	ts := time.Date(2025, time.January, 2, 3, 4, 5, 0, GlobalConfig.TimezoneLocation).Unix()
+
+	record, err := ValidateRow(columns, []string{"2025-01-02 03:04:05", "7", "1.5", "n/a"})
+	if err != nil {
+		t.Fatalf("ValidateRow() error = %v", err)
+	}
+	// Mapped to the field code; the non-numeric temp is left out
+	if record["_id"] != ts || record["n"] != 7.0 || record["WA"] != 1.5 {
+		t.Errorf("ValidateRow() = %v, want _id %d, n 7 and WA 1.5", record, ts)
+	}
+	if _, exists := record["TE"]; exists {
+		t.Errorf("ValidateRow() = %v, want no TE", record)
+	}
+
+	invalid := []struct {
+		name string
+		row  []string
+		want string
+	}{
+		{"invalid time", []string{"yesterday", "7", "1.5"}, "invalid time"},
+		{"invalid n", []string{"2025-01-02 03:04:05", "seven", "1.5"}, "invalid n value"},
+		{"too old", []string{"1970-01-01 00:00:05", "7", "1.5"}, "MIN_VALID_TIMESTAMP"},
+		{"short row", []string{"2025-01-02 03:04:05"}, errShortRow.Error()},
+	}
+	for _, tt := range invalid {
+		if _, err := ValidateRow(columns, tt.row); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: ValidateRow() error = %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestLogFailedContent(t *testing.T) {
+	tests := []struct {
+		name     string
+		enabled  bool
+		content  string
+		wantLogs []string
+		notLogs  []string
+	}{
+		{"disabled", false, "not a TOA5 file", nil, []string{"failed content"}},
+		{"text", true, "not a TOA5 file", []string{"failed content (15 bytes):\nnot a TOA5 file"}, nil},
+		{"truncated", true, "not a TOA5 file" + strings.Repeat("x", 100), []string{"(115 bytes, truncated to 20):\nnot a TOA5 filexxxxx\n"}, []string{"xxxxxx"}},
+		{"binary", true, "\x89PNG\r\n\x1a\n", []string{"(8 bytes, hex):", "89 50 4e 47"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.LogFailedContent = tt.enabled
+				c.LogFailedContentMaxBytes = 20
+			})
+			logs := captureLogs(t)
+			// Parse failures dump the content
+			if _, err := ProcessReader(context.Background(), "broken.csv", strings.NewReader(tt.content)); err == nil {
+				t.Fatal("ProcessReader() error = nil, want a parse error")
+			}
+			for _, want := range tt.wantLogs {
+				if !strings.Contains(logs.String(), want) {
+					t.Errorf("logs lack %q:\n%s", want, logs)
+				}
+			}
+			for _, unwanted := range tt.notLogs {
+				if strings.Contains(logs.String(), unwanted) {
+					t.Errorf("logs contain %q:\n%s", unwanted, logs)
+				}
+			}
+		})
+	}
+}
+
+func TestExtractDataWithoutNColumn(t *testing.T) {
+	withConfig(t, func(c *Config) { c.NColumnIndex = NoNColumn })
+	records := extractRecords(t, toa5CSV(`"TIMESTAMP","water","temp"`,
+		`"2025-01-02 03:04:05",1.5,20`,
+		`"2025-01-02 03:05:05",1.6`,
+	))
+	if len(records) != 2 {
+		t.Fatalf("ExtractData() = %d records, want 2", len(records))
+	}
+	if records[0]["WA"] != 1.5 || records[0]["TE"] != 20.0 || records[1]["WA"] != 1.6 {
+		t.Errorf("records = %v, want the values from index 1 on", records)
+	}
+	for i, record := range records {
+		if _, exists := record["n"]; exists {
+			t.Errorf("record %d = %v, want no n", i, record)
+		}
+	}
+
+	// With the default N_COLUMN_INDEX the first value column is read as n
+	withConfig(t, func(c *Config) { c.NColumnIndex = 1 })
+	records = extractRecords(t, toa5CSV(`"TIMESTAMP","water","temp"`, `"2025-01-02 03:04:05",1.5,20`))
+	if _, exists := records[0]["WA"]; exists || records[0]["n"] != 1.5 {
+		t.Errorf("default N_COLUMN_INDEX: record = %v, want water read as n", records[0])
+	}
+}
+
+func TestExtractDataStoreOriginalNames(t *testing.T) {
+	content := toa5CSV(`"TIMESTAMP","RECORD","water","TE","Flag"`, `"2025-01-02 03:04:05",1,1.5,20,"OK"`)
+
+	records := extractRecords(t, content)
+	if _, exists := records[0]["_cols"]; exists {
+		t.Errorf("STORE_ORIGINAL_NAMES disabled: record = %v, want no _cols", records[0])
+	}
+
+	withConfig(t, func(c *Config) {
+		c.StoreOriginalNames = true
+		c.QualityColumn = "Flag"
+	})
+	records = extractRecords(t, content)
+	// Only renamed columns are recorded: TE is stored under its own name
+	want := map[string]string{"WA": "water", "q": "Flag"}
+	if got := records[0]["_cols"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("_cols = %v, want %v", got, want)
+	}
+
+	// Nothing renamed: no _cols
+	records = extractRecords(t, toa5CSV(`"TIMESTAMP","RECORD","TE"`, `"2025-01-02 03:04:05",1,20`))
+	if _, exists := records[0]["_cols"]; exists {
+		t.Errorf("no renamed column: record = %v, want no _cols", records[0])
+	}
+}
+
+func TestExtractDataMissingValueSentinels(t *testing.T) {
+	content := toa5CSV(`"TIMESTAMP","RECORD","water","temp","volt"`,
+		`"2025-01-02 03:04:05",1,-9999,20,NAN`,
+		`"2025-01-02 03:05:05",2,1.5,-99,12.5`,
+		`"2025-01-02 03:06:05",3,-9999.0,-98,"NAN"`,
+	)
+	withConfig(t, func(c *Config) { c.MissingValueSentinels = parseMissingValueSentinels("-9999;-99;NAN") })
+
+	tests := []struct {
+		mode string
+		want []SensorRecord
+	}{
+		{MissingValueDrop, []SensorRecord{{"TE": 20.0}, {"WA": 1.5, "VO": 12.5}, {"TE": -98.0}}},
+		{MissingValueNull, []SensorRecord{{"WA": nil, "TE": 20.0, "VO": nil}, {"WA": 1.5, "TE": nil, "VO": 12.5}, {"WA": nil, "TE": -98.0, "VO": nil}}},
+	}
+	for _, tt := range tests {
+		withConfig(t, func(c *Config) { c.MissingValueMode = tt.mode })
+		records := extractRecords(t, content)
+		if len(records) != len(tt.want) {
+			t.Fatalf("%s: %d records, want %d", tt.mode, len(records), len(tt.want))
+		}
+		for i, record := range records {
+			got := SensorRecord{}
+			for _, field := range []string{"WA", "TE", "VO"} {
+				if v, exists := record[field]; exists {
+					got[field] = v
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want[i]) {
+				t.Errorf("%s: record %d readings = %v, want %v", tt.mode, i, got, tt.want[i])
+			}
+		}
+	}
+}
+
+func TestCheckMaxLineBytes(t *testing.T) {
+	tests := []struct {
+		name    string
+		max     int
+		content string
+		want    string
+	}{
+		{"no limit", 0, strings.Repeat("x", 100), ""},
+		{"within limit", 10, "0123456789\n0123456789\n", ""},
+		{"last line without newline", 10, "0123456789\n01234567890", "line 2 is 11 bytes long, exceeding MAX_LINE_BYTES (10)"},
+		{"oversized first line", 10, strings.Repeat("x", 1000) + "\nshort\n", "line 1 is 1000 bytes long"},
+		{"empty", 10, "", ""},
+	}
+	for _, tt := range tests {
+		withConfig(t, func(c *Config) { c.MaxLineBytes = tt.max })
+		err := checkMaxLineBytes([]byte(tt.content))
+		if tt.want == "" && err != nil {
+			t.Errorf("%s: checkMaxLineBytes() error = %v", tt.name, err)
+		}
+		if tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)) {
+			t.Errorf("%s: checkMaxLineBytes() error = %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestProcessReaderMaxLineBytes(t *testing.T) {
+	withConfig(t, func(c *Config) { c.MaxLineBytes = 256 })
+	valid := toa5CSV(`"TIMESTAMP","RECORD","water"`, `"2025-01-02 03:04:05",1,1.5`)
+	if _, err := ProcessReader(context.Background(), "CR300_19531_Table1.csv", bytes.NewReader(valid)); !errors.Is(err, ErrMongoNotConnected) {
+		t.Errorf("valid file: ProcessReader() error = %v, want ErrMongoNotConnected", err)
+	}
+
+	// A binary blob without newlines
+	blob := append(append([]byte{}, valid...), bytes.Repeat([]byte{0xff, 0x00}, 4096)...)
+	_, err := ProcessReader(context.Background(), "CR300_19531_Table1.csv", bytes.NewReader(blob))
+	var parseErr *ParseError
+	if !errors.As(err, &parseErr) || !strings.Contains(err.Error(), "exceeding MAX_LINE_BYTES (256)") {
+		t.Errorf("oversized line: ProcessReader() error = %v, want a MAX_LINE_BYTES ParseError", err)
+	}
+}
+
+func TestLogSampleRecords(t *testing.T) {
+	rows := make([]string, 0, 5)
+	for i := 1; i <= 5; i++ {
+		rows = append(rows, fmt.Sprintf(`"2025-01-02 03:0%d:05",%d,1.%d`, i, i, i))
+	}
+	content := toa5CSV(`"TIMESTAMP","RECORD","water"`, rows...)
+
+	tests := []struct {
+		sample int
+		want   int
+	}{
+		{0, 0},
+		{3, 3},
+		// More than the file has: every record once
+		{10, 5},
+	}
+	for _, tt := range tests {
+		withConfig(t, func(c *Config) { c.LogSampleRecords = tt.sample })
+		logs := captureLogs(t)
+		ProcessReader(context.Background(), "CR300_19531_Table1.csv", bytes.NewReader(content))
+		if got := strings.Count(logs.String(), "sample record ["); got != tt.want {
+			t.Errorf("LOG_SAMPLE_RECORDS=%d: %d records sampled, want %d:\n%s", tt.sample, got, tt.want, logs)
+		}
+		if tt.want > 0 && !strings.Contains(logs.String(), fmt.Sprintf("sample record [%d/5]", tt.want)) {
+			t.Errorf("LOG_SAMPLE_RECORDS=%d: sample numbering missing:\n%s", tt.sample, logs)
+		}
+	}
+}
+
+func TestParseDeadline(t *testing.T) {
+	if (parseDeadline{}).exceeded(parseTimeCheckRows) {
+		t.Error("zero deadline exceeded")
+	}
+	past := parseDeadline(time.Now().Add(-time.Second))
+	if !past.exceeded(parseTimeCheckRows) || !past.exceeded(2*parseTimeCheckRows) {
+		t.Error("past deadline not exceeded at a check row")
+	}
+	// Checked every parseTimeCheckRows rows only
+	if past.exceeded(parseTimeCheckRows - 1) {
+		t.Error("deadline checked between check rows")
+	}
+	if parseDeadline(time.Now().Add(time.Hour)).exceeded(parseTimeCheckRows) {
+		t.Error("future deadline exceeded")
+	}
+}
+
+func TestExtractDataMaxParseTime(t *testing.T) {
+	rows := make([]string, 0, 100000)
+	start := time.Date(2025, time.January, 2, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < cap(rows); i++ {
+		rows = append(rows, fmt.Sprintf(`"%s",%d,1.5,20,12.5`, start.Add(time.Duration(i)*time.Second).Format("2006-01-02 15:04:05"), i))
+	}
+	content := toa5CSV(`"TIMESTAMP","RECORD","water","temp","volt"`, rows...)
+
+	withConfig(t, func(c *Config) { c.MaxParseTimeMS = 1 })
+	if _, err := ExtractData("large.csv", content); !errors.Is(err, ErrParseTimeout) {
+		t.Errorf("MAX_PARSE_TIME_MS=1: ExtractData() error = %v, want ErrParseTimeout", err)
+	}
+
+	withConfig(t, func(c *Config) { c.MaxParseTimeMS = 0 })
+	if records := extractRecords(t, content); len(records) != len(rows) {
+		t.Errorf("no parse time limit: %d records, want %d", len(records), len(rows))
+	}
+}
+
+func TestExtractDataFlexibleTime(t *testing.T) {
+	content := toa5CSV(`"TIMESTAMP","RECORD","water"`,
+		`"2025-01-02 03:04:05",1,1.5`,
+		`"2025-01-02 03:05",2,1.6`,
+	)
+	minute := time.Date(2025, time.January, 2, 3, 5, 0, 0, GlobalConfig.TimezoneLocation).Unix()
+
+	// Strict by default: the second-less row is dropped
+	if records := extractRecords(t, content); len(records) != 1 {
+		t.Errorf("strict: %d records, want 1", len(records))
+	}
+
+	withConfig(t, func(c *Config) { c.FlexibleTime = true })
+	records := extractRecords(t, content)
+	if len(records) != 2 || records[1]["_id"] != minute {
+		t.Errorf("FLEXIBLE_TIME=true: records = %v, want the second-less row at %d", records, minute)
+	}
+
+	// CSV_TIME_LAYOUT forces its layout (and the default one)
+	withConfig(t, func(c *Config) { c.CSVTimeLayout = "02/01/2006 15:04:05" })
+	if records := extractRecords(t, content); len(records) != 1 {
+		t.Errorf("FLEXIBLE_TIME with CSV_TIME_LAYOUT: %d records, want 1", len(records))
+	}
+}
+
+func TestExtractDataDetectInt(t *testing.T) {
+	content := toa5CSV(`"TIMESTAMP","RECORD","water","temp"`, `"2025-01-02 03:04:05",7,5,20.25`)
+
+	records := extractRecords(t, content)
+	if got := records[0]["WA"]; got != 5.0 {
+		t.Errorf("DETECT_INT disabled: WA = %#v, want float64 5", got)
+	}
+
+	withConfig(t, func(c *Config) { c.DetectInt = true })
+	records = extractRecords(t, content)
+	if got := records[0]["WA"]; got != int64(5) {
+		t.Errorf("WA = %#v, want int64 5", got)
+	}
+	if got := records[0]["TE"]; got != 20.25 {
+		t.Errorf("TE = %#v, want float64 20.25", got)
+	}
+	// _id and n keep their types
+	if got := records[0]["n"]; got != 7.0 {
+		t.Errorf("n = %#v, want float64 7", got)
+	}
+	if _, ok := records[0]["_id"].(int64); !ok {
+		t.Errorf("_id = %#v, want an int64 timestamp", records[0]["_id"])
+	}
+}
+
+func TestStoredValue(t *testing.T) {
+	withConfig(t, func(c *Config) { c.DetectInt = true })
+	tests := []struct {
+		v    float64
+		want interface{}
+	}{
+		{5, int64(5)},
+		{-3, int64(-3)},
+		{0.5, 0.5},
+		{1e300, 1e300},
+		{math.Inf(1), math.Inf(1)},
+	}
+	for _, tt := range tests {
+		if got := storedValue(tt.v); got != tt.want {
+			t.Errorf("storedValue(%v) = %#v, want %#v", tt.v, got, tt.want)
+		}
+	}
+}
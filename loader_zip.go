@@ -0,0 +1,88 @@
+package loader
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// IsZipFile checks if the file is a zip archive
+func IsZipFile(filename string) bool {
+	return strings.EqualFold(filepath.Ext(filename), ".zip")
+}
+
+// isCSVEntry checks if a zip archive entry is CSV content (.csv or TOA5 .dat)
+func isCSVEntry(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	return ext == ".csv" || ext == ".dat"
+}
+
+// ProcessZipReader processes a zip archive holding multiple CSV files
+// Each CSV entry matching the allow/ignore patterns is processed through ProcessReader
+// and the counts are aggregated; other entries are skipped
+// Entry errors are logged and the first one is returned after all entries are processed
+func ProcessZipReader(ctx context.Context, filename string, r io.Reader) (*ProcessResult, error) {
+	logger := LoggerFrom(ctx)
+	result := &ProcessResult{FileType: FileTypeZip}
+
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, r); err != nil {
+		return result, fmt.Errorf("file %s: failed to read GCS file: %w", filename, err)
+	}
+
+	archive, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		return result, fmt.Errorf("file %s: invalid or corrupt zip archive: %w", filename, err)
+	}
+
+	patterns := bucketSettingsFrom(ctx).FilePattern()
+	var deviceIDs []string
+	var firstErr error
+	for _, entry := range archive.File {
+		if entry.FileInfo().IsDir() {
+			continue
+		}
+		if !isCSVEntry(entry.Name) {
+			logger.Debugf("file %s: skipping non-CSV zip entry %s", filename, entry.Name)
+			continue
+		}
+		if !patterns.shouldProcess(ctx, entry.Name) {
+			continue
+		}
+
+		entryResult, err := processZipEntry(ctx, filename, entry)
+		result.Inserted += entryResult.Inserted
+		result.Skipped += entryResult.Skipped
+		if entryResult.DeviceID != "" {
+			deviceIDs = append(deviceIDs, entryResult.DeviceID)
+		}
+		if err != nil {
+			logger.Warnf("file %s: zip entry %s: %v", filename, entry.Name, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		logger.Infof("file %s: zip entry %s processed (inserted: %d, skipped: %d)", filename, entry.Name, entryResult.Inserted, entryResult.Skipped)
+	}
+	result.DeviceID = strings.Join(deviceIDs, ",")
+
+	if firstErr != nil {
+		return result, fmt.Errorf("file %s: %w", filename, firstErr)
+	}
+	return result, nil
+}
+
+// processZipEntry processes a single zip archive entry
+func processZipEntry(ctx context.Context, filename string, entry *zip.File) (*ProcessResult, error) {
+	rc, err := entry.Open()
+	if err != nil {
+		return &ProcessResult{FileType: FileTypeCSV}, fmt.Errorf("failed to open zip entry (archive %s may be corrupt): %w", filename, err)
+	}
+	defer rc.Close()
+	return ProcessReader(ctx, entry.Name, rc)
+}
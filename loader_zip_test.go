@@ -0,0 +1,66 @@
+package loader
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// zipArchive builds a zip archive of the given entries, in order
+func zipArchive(t *testing.T, entries ...[2]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for _, entry := range entries {
+		f, err := w.Create(entry[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte(entry[1]))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestProcessZipReader(t *testing.T) {
+	ctx := context.Background()
+	withFilePatterns(t, &FilePattern{
+		AllowPatterns:  mustCompilePatterns(t, `\.(csv|dat)$`),
+		IgnorePatterns: mustCompilePatterns(t, `^tmp/`),
+	})
+	first := string(toa5CSV(`"TIMESTAMP","RECORD","water"`, `"2025-01-02 03:04:05",1,1.5`))
+	second := strings.Replace(first, `"19531"`, `"20417"`, 1)
+
+	archive := zipArchive(t,
+		[2]string{"day/CR300_19531_Table1.csv", first},
+		[2]string{"day/readme.txt", "not a data file"},
+		[2]string{"tmp/CR300_19531_Table1.csv", first},
+		[2]string{"day/CR300_20417_Table1.dat", second},
+	)
+	// Every CSV entry is processed: without MongoDB, each fails after parsing
+	result, err := ProcessZipReader(ctx, "day.zip", bytes.NewReader(archive))
+	if !errors.Is(err, ErrMongoNotConnected) {
+		t.Errorf("ProcessZipReader() error = %v, want ErrMongoNotConnected", err)
+	}
+	if result.FileType != FileTypeZip || result.DeviceID != "CR300_19531,CR300_20417" {
+		t.Errorf("result = %+v, want the device IDs of the two CSV entries", result)
+	}
+
+	_, err = ProcessZipReader(ctx, "corrupt.zip", bytes.NewReader(archive[:len(archive)/2]))
+	if err == nil || !strings.Contains(err.Error(), "invalid or corrupt zip archive") {
+		t.Errorf("corrupt archive: error = %v", err)
+	}
+}
+
+func TestIsZipFile(t *testing.T) {
+	for filename, want := range map[string]bool{"day.zip": true, "upload/DAY.ZIP": true, "day.zip.csv": false, "zip": false} {
+		if got := IsZipFile(filename); got != want {
+			t.Errorf("IsZipFile(%q) = %v, want %v", filename, got, want)
+		}
+	}
+}
@@ -1,7 +1,9 @@
 package loader
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"os"
 	"strings"
 	"time"
@@ -24,6 +26,22 @@ type Logger struct {
 	includeTimestamp bool
 	// Whether to include log level in output
 	includeLevel bool
+	// Whether to output debug level messages
+	includeDebug bool
+	// Output destination (default: os.Stdout)
+	writer io.Writer
+	// Whether event loggers include the trace ID
+	includeTrace bool
+	// Trace ID of the event being logged ("" for the global logger)
+	trace string
+}
+
+// loggerKey is the context key of the event logger
+type loggerKey struct{}
+
+// flusher is implemented by buffered writers (e.g. *bufio.Writer)
+type flusher interface {
+	Flush() error
 }
 
 // GlobalLogger is the global logger instance
@@ -34,9 +52,13 @@ var GlobalLogger *Logger
 //
 //	LOG_TIMESTAMP - "true"/"false" - whether to include timestamps (default: true)
 //	LOG_LEVEL - "true"/"false" - whether to include log level (default: true)
+//	DEBUG - "true"/"false" - whether to output debug level messages (default: false)
+//	  Before DEBUG gated them, debug level messages were always output: set DEBUG=true to keep them
+//	LOG_TRACE - "true"/"false" - whether event log lines include a trace=<id> field (default: false)
 func InitLogger() {
 	includeTimestamp := true
 	includeLevel := true
+	includeDebug := strings.ToLower(os.Getenv("DEBUG")) == "true"
 
 	// Read LOG_TIMESTAMP config
 	if ts := os.Getenv("LOG_TIMESTAMP"); ts != "" {
@@ -51,9 +73,73 @@ func InitLogger() {
 	GlobalLogger = &Logger{
 		includeTimestamp: includeTimestamp,
 		includeLevel:     includeLevel,
+		includeDebug:     includeDebug,
+		writer:           os.Stdout,
+		includeTrace:     strings.ToLower(os.Getenv("LOG_TRACE")) == "true",
+	}
+
+	GlobalLogger.Infof("Logger initialized (timestamp=%v, level=%v, debug=%v, trace=%v)", includeTimestamp, includeLevel, includeDebug, GlobalLogger.includeTrace)
+}
+
+// WithTrace returns a logger adding trace=<id> to every line (the logger itself if LOG_TRACE is disabled)
+func (l *Logger) WithTrace(trace string) *Logger {
+	if !l.includeTrace || trace == "" {
+		return l
 	}
+	traced := *l
+	traced.trace = trace
+	return &traced
+}
 
-	GlobalLogger.Infof("Logger initialized (timestamp=%v, level=%v)", includeTimestamp, includeLevel)
+// WithLogger returns a context carrying the event logger
+func WithLogger(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// LoggerFrom returns the event logger carried by the context, or GlobalLogger
+func LoggerFrom(ctx context.Context) *Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*Logger); ok {
+		return l
+	}
+	return GlobalLogger
+}
+
+// SetWriter sets the output destination of the logger
+// Buffered writers are flushed by Flush, Fatal and Shutdown
+func (l *Logger) SetWriter(w io.Writer) {
+	l.Flush()
+	l.writer = w
+}
+
+// Flush flushes buffered log output, if the writer is buffered
+// No-op for the default unbuffered stdout writer
+func (l *Logger) Flush() {
+	if l == nil {
+		return
+	}
+	if f, ok := l.writer.(flusher); ok {
+		if err := f.Flush(); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to flush log output: %v\n", err)
+		}
+	}
+}
+
+// println writes a formatted log line to the logger's writer
+func (l *Logger) println(level LogLevel, message string) {
+	w := l.writer
+	if w == nil {
+		w = os.Stdout
+	}
+	fmt.Fprintln(w, l.formatMessage(level, message))
+}
+
+// Raw writes a line as is, without timestamp or level (machine-parseable output)
+func (l *Logger) Raw(line string) {
+	w := l.writer
+	if w == nil {
+		w = os.Stdout
+	}
+	fmt.Fprintln(w, line)
 }
 
 // formatMessage formats a log message with optional timestamp and level
@@ -69,18 +155,26 @@ func (l *Logger) formatMessage(level LogLevel, message string) string {
 		parts = append(parts, fmt.Sprintf("[%s]", level))
 	}
 
+	if l.trace != "" {
+		parts = append(parts, "trace="+l.trace)
+	}
+
 	parts = append(parts, message)
 
 	return strings.Join(parts, " ")
 }
 
 // Debug logs a debug message
+// Debug messages are only output when DEBUG is enabled
 func (l *Logger) Debug(message string) {
 	if l == nil {
 		fmt.Println(message)
 		return
 	}
-	fmt.Println(l.formatMessage(LogLevelDebug, message))
+	if !l.includeDebug {
+		return
+	}
+	l.println(LogLevelDebug, message)
 }
 
 // Debugf logs a formatted debug message
@@ -94,7 +188,7 @@ func (l *Logger) Info(message string) {
 		fmt.Println(message)
 		return
 	}
-	fmt.Println(l.formatMessage(LogLevelInfo, message))
+	l.println(LogLevelInfo, message)
 }
 
 // Infof logs a formatted info message
@@ -108,7 +202,7 @@ func (l *Logger) Warn(message string) {
 		fmt.Println(message)
 		return
 	}
-	fmt.Println(l.formatMessage(LogLevelWarn, message))
+	l.println(LogLevelWarn, message)
 }
 
 // Warnf logs a formatted warning message
@@ -122,7 +216,7 @@ func (l *Logger) Error(message string) {
 		fmt.Println(message)
 		return
 	}
-	fmt.Println(l.formatMessage(LogLevelError, message))
+	l.println(LogLevelError, message)
 }
 
 // Errorf logs a formatted error message
@@ -136,7 +230,8 @@ func (l *Logger) Fatal(message string) {
 		fmt.Println(message)
 		os.Exit(1)
 	}
-	fmt.Println(l.formatMessage(LogLevelFatal, message))
+	l.println(LogLevelFatal, message)
+	l.Flush()
 	os.Exit(1)
 }
 
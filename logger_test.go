@@ -0,0 +1,104 @@
+package loader
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// flushCounter is a buffered writer counting its flushes
+type flushCounter struct {
+	bytes.Buffer
+	flushes int
+}
+
+func (w *flushCounter) Flush() error {
+	w.flushes++
+	return nil
+}
+
+func TestLoggerFlush(t *testing.T) {
+	var nilLogger *Logger
+	nilLogger.Flush() // must not panic
+
+	w := &flushCounter{}
+	GlobalLogger.SetWriter(w)
+	t.Cleanup(func() { GlobalLogger.SetWriter(io.Discard) })
+
+	GlobalLogger.Info("buffered")
+	GlobalLogger.Flush()
+	if w.flushes != 1 {
+		t.Errorf("Flush() flushed %d times, want 1", w.flushes)
+	}
+
+	// Shutdown flushes the logger once the resources are released
+	w.flushes = 0
+	if err := Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown() error = %v", err)
+	}
+	if w.flushes == 0 {
+		t.Errorf("Shutdown() did not flush the logger")
+	}
+
+	// Replacing the writer flushes the previous one
+	w.flushes = 0
+	GlobalLogger.SetWriter(io.Discard)
+	if w.flushes != 1 {
+		t.Errorf("SetWriter() flushed the previous writer %d times, want 1", w.flushes)
+	}
+}
+
+func TestLoggerFatalFlushes(t *testing.T) {
+	if os.Getenv("LOADER_TEST_FATAL") == "1" {
+		// Buffered output is only written to stdout if Fatal flushes before exiting
+		w := bufio.NewWriterSize(os.Stdout, 4096)
+		GlobalLogger.SetWriter(w)
+		GlobalLogger.Fatal("fatal message")
+		return
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestLoggerFatalFlushes$")
+	cmd.Env = append(os.Environ(), "LOADER_TEST_FATAL=1")
+	out, err := cmd.Output()
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 1 {
+		t.Fatalf("Fatal() exit: %v, want exit status 1", err)
+	}
+	if !strings.Contains(string(out), "fatal message") {
+		t.Errorf("buffered fatal message lost, output:\n%s", out)
+	}
+}
+
+// withLogTrace enables LOG_TRACE on the global logger for the duration of the test
+func withLogTrace(t *testing.T) {
+	t.Helper()
+	GlobalLogger.includeTrace = true
+	t.Cleanup(func() { GlobalLogger.includeTrace = false })
+}
+
+func TestLoggerWithTrace(t *testing.T) {
+	if traced := GlobalLogger.WithTrace("abc"); traced != GlobalLogger {
+		t.Error("WithTrace() returned a new logger with LOG_TRACE disabled")
+	}
+
+	withLogTrace(t)
+	if traced := GlobalLogger.WithTrace(""); traced != GlobalLogger {
+		t.Error("WithTrace(\"\") returned a new logger")
+	}
+	logs := captureLogs(t)
+	traced := GlobalLogger.WithTrace("abc")
+	traced.Info("first")
+	traced.Warnf("second %d", 2)
+	GlobalLogger.Info("global")
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	if len(lines) != 3 || !strings.Contains(lines[0], "trace=abc first") || !strings.Contains(lines[1], "trace=abc second 2") {
+		t.Errorf("traced lines = %q, want trace=abc on each", lines)
+	}
+	if strings.Contains(lines[len(lines)-1], "trace=") {
+		t.Errorf("global logger line %q has a trace", lines[len(lines)-1])
+	}
+}
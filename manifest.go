@@ -0,0 +1,89 @@
+package loader
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ParseManifest reads the data file names of a manifest: one object name per line
+// Blank lines and lines starting with # are ignored
+func ParseManifest(r io.Reader) ([]string, error) {
+	var files []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		files = append(files, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// ProcessManifest processes the data files listed in a manifest object, in manifest order
+// Files are read from the bucket of the manifest and processed like event files (see ProcessFile)
+// A failing file doesn't stop the following ones: counts are aggregated over the successful files
+// and the errors of all failed files are returned together
+func ProcessManifest(ctx context.Context, bucket string, manifestName string) (*ProcessResult, error) {
+	logger := LoggerFrom(ctx)
+	result := &ProcessResult{FileType: FileTypeManifest}
+
+	client, err := storageClient()
+	if err != nil {
+		return result, fmt.Errorf("file %s: failed to create GCS client: %w", manifestName, err)
+	}
+	reader, generation, err := openObject(ctx, bucketHandle(client, bucket), manifestName)
+	if err != nil {
+		return result, fmt.Errorf("file %s: failed to open GCS file (bucket: %s): %w", manifestName, bucket, err)
+	}
+	defer reader.Close()
+	result.Generation = generation
+
+	files, err := ParseManifest(reader)
+	if err != nil {
+		return result, fmt.Errorf("file %s: failed to read manifest: %w", manifestName, err)
+	}
+	if len(files) == 0 {
+		logger.Warnf("file %s: manifest lists no files", manifestName)
+		return result, nil
+	}
+	logger.Infof("file %s: manifest lists %d file(s)", manifestName, len(files))
+
+	var errs []error
+	for i, filename := range files {
+		if filename == manifestName || IsManifestFile(filename) {
+			errs = append(errs, &ParseError{Err: fmt.Errorf("file %s: manifests can't reference manifests", filename)})
+			continue
+		}
+		if isProcessedObject(ctx, bucket, filename) {
+			logger.Infof("file %s: [%d/%d] already processed, skipping", filename, i+1, len(files))
+			continue
+		}
+
+		fileResult, err := ProcessFile(ctx, bucket, filename)
+		if err != nil {
+			logger.Errorf("file %s: [%d/%d] processing error: %v", filename, i+1, len(files), err)
+			errs = append(errs, err)
+			continue
+		}
+		if err := markProcessed(ctx, bucket, filename, fileResult); err != nil {
+			logger.Warnf("file %s: %v", filename, err)
+		}
+		logger.Infof("file %s: [%d/%d] processed (type: %s, inserted: %d, skipped: %d)", filename, i+1, len(files), fileResult.FileType, fileResult.Inserted, fileResult.Skipped)
+		result.Inserted += fileResult.Inserted
+		result.MetricsWritten += fileResult.MetricsWritten
+		result.Skipped += fileResult.Skipped
+	}
+
+	if len(errs) > 0 {
+		return result, fmt.Errorf("file %s: %d of %d manifest file(s) failed: %w", manifestName, len(errs), len(files), errors.Join(errs...))
+	}
+	return result, nil
+}
@@ -0,0 +1,79 @@
+package loader
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestParseManifest(t *testing.T) {
+	files, err := ParseManifest(strings.NewReader("# hourly upload\nupload/a.csv\n\n  upload/b.csv  \n#upload/c.csv\n"))
+	if err != nil {
+		t.Fatalf("ParseManifest() error = %v", err)
+	}
+	if want := []string{"upload/a.csv", "upload/b.csv"}; !reflect.DeepEqual(files, want) {
+		t.Errorf("ParseManifest() = %q, want %q", files, want)
+	}
+}
+
+func TestProcessManifest(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("several files", func(mt *mtest.T) {
+		withMockMongo(mt)
+		withFilePatterns(mt.T, &FilePattern{ManifestPatterns: mustCompilePatterns(mt.T, `\.manifest$`)})
+		f := useFakeGCS(mt.T)
+		f.put("uploads", "upload/a.csv", toa5CSV(`"TIMESTAMP","RECORD","water"`, `"2025-01-02 03:04:05",1,1.5`, `"2025-01-02 03:05:05",2,1.6`))
+		f.put("uploads", "upload/b.csv", toa5CSV(`"TIMESTAMP","RECORD","water"`, `"2025-01-02 04:04:05",3,1.7`))
+		f.put("uploads", "upload/batch.manifest", []byte("upload/a.csv\nupload/other.manifest\nupload/b.csv\nupload/missing.csv\n"))
+		for _, n := range []int{2, 1} {
+			mt.AddMockResponses(
+				boxResponse("RIENVHK4", "CR300_19531"),
+				mtest.CreateCursorResponse(0, "test.sensor_data_RIENVHK4", mtest.FirstBatch),
+				mtest.CreateSuccessResponse(bson.E{Key: "n", Value: n}),
+			)
+		}
+
+		result, err := ProcessManifest(context.Background(), "uploads", "upload/batch.manifest")
+		if result.FileType != FileTypeManifest || result.Inserted != 3 || result.Generation == 0 {
+			mt.Errorf("ProcessManifest() result = %+v, want 3 inserted records", result)
+		}
+		if err == nil || !strings.Contains(err.Error(), "2 of 4 manifest file(s) failed") {
+			mt.Fatalf("ProcessManifest() error = %v, want 2 failed files", err)
+		}
+		for _, want := range []string{"upload/other.manifest: manifests can't reference manifests", "upload/missing.csv: failed to open GCS file"} {
+			if !strings.Contains(err.Error(), want) {
+				mt.Errorf("error %q does not contain %q", err, want)
+			}
+		}
+		var parseErr *ParseError
+		if !errors.As(err, &parseErr) {
+			mt.Errorf("nested manifest error is not a ParseError")
+		}
+
+		// Files are processed in manifest order
+		var inserts []string
+		for _, event := range mt.GetAllStartedEvents() {
+			if event.CommandName == "insert" {
+				inserts = append(inserts, event.Command.Lookup("documents").Array().Index(0).Value().Document().Lookup("WA").String())
+			}
+		}
+		if want := []string{`{"$numberDouble":"1.5"}`, `{"$numberDouble":"1.7"}`}; !reflect.DeepEqual(inserts, want) {
+			mt.Errorf("inserted first records %v, want %v", inserts, want)
+		}
+	})
+
+	mt.Run("empty manifest", func(mt *mtest.T) {
+		withMockMongo(mt)
+		f := useFakeGCS(mt.T)
+		f.put("uploads", "upload/empty.manifest", []byte("# nothing yet\n"))
+		result, err := ProcessManifest(context.Background(), "uploads", "upload/empty.manifest")
+		if err != nil || result.Inserted != 0 {
+			mt.Errorf("ProcessManifest() = %+v, %v, want nothing processed", result, err)
+		}
+	})
+}
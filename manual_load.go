@@ -0,0 +1,136 @@
+package loader
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/GoogleCloudPlatform/functions-framework-go/functions"
+)
+
+// maxManualLoadBodyBytes limits the size of a manual load request body
+const maxManualLoadBodyBytes = 1 << 20
+
+// ManualLoadRequest is the JSON body of a manual load: files of a bucket to process in order
+type ManualLoadRequest struct {
+	Bucket string   `json:"bucket"`
+	Files  []string `json:"files"`
+	// Force processes files even if their generation was already processed (SKIP_PROCESSED_FILES)
+	Force bool `json:"force"`
+}
+
+// ManualLoadFileResult is the outcome of one file of a manual load
+type ManualLoadFileResult struct {
+	File           string `json:"file"`
+	FileType       string `json:"file_type"`
+	DeviceID       string `json:"device_id,omitempty"`
+	Inserted       int64  `json:"inserted"`
+	MetricsWritten int64  `json:"metrics_written,omitempty"`
+	Skipped        int64  `json:"skipped"`
+	Error          string `json:"error,omitempty"`
+	// AlreadyProcessed - the file generation was already processed and was skipped
+	AlreadyProcessed bool `json:"already_processed,omitempty"`
+}
+
+// ManualLoadResponse is the JSON response of a manual load, with per-file results and totals
+type ManualLoadResponse struct {
+	Bucket   string                 `json:"bucket"`
+	Results  []ManualLoadFileResult `json:"results"`
+	Inserted int64                  `json:"inserted"`
+	Skipped  int64                  `json:"skipped"`
+	Failed   int                    `json:"failed"`
+}
+
+// manualLoad is an HTTP function processing the files named in the request body, for scripted
+// batch loads that don't wait for GCS events, e.g.
+//
+//	POST {"bucket": "sensor-uploads", "files": ["CR300_19531/a.csv", "CR300_19531/b.csv"]}
+//
+// Files are processed like event files but failures are only reported, not copied to load_failed/
+// The response is 200 with per-file results even when some files fail
+func manualLoad(w http.ResponseWriter, r *http.Request) {
+	setupRuntime()
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req ManualLoadRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxManualLoadBodyBytes))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	if req.Bucket == "" || len(req.Files) == 0 {
+		http.Error(w, "bucket and files are required", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	logger := GlobalLogger.WithTrace(requestTraceID(r))
+	ctx = WithLogger(ctx, logger)
+	logger.Infof("manual load: %d file(s) from bucket %s", len(req.Files), req.Bucket)
+
+	resp := ManualLoadResponse{Bucket: req.Bucket, Results: make([]ManualLoadFileResult, 0, len(req.Files))}
+	for _, filename := range req.Files {
+		if !req.Force && isProcessedObject(ctx, req.Bucket, filename) {
+			logger.Infof("file %s: already processed, skipping (set force to reprocess)", filename)
+			resp.Results = append(resp.Results, ManualLoadFileResult{File: filename, AlreadyProcessed: true})
+			continue
+		}
+
+		result, err := ProcessFile(ctx, req.Bucket, filename)
+		fileResult := ManualLoadFileResult{
+			File:           filename,
+			FileType:       result.FileType,
+			DeviceID:       result.DeviceID,
+			Inserted:       result.Inserted,
+			MetricsWritten: result.MetricsWritten,
+			Skipped:        result.Skipped,
+		}
+		if err != nil {
+			logger.Errorf("file processing error %s: %s", filename, err)
+			fileResult.Error = err.Error()
+			resp.Failed++
+		} else if err := markProcessed(ctx, req.Bucket, filename, result); err != nil {
+			logger.Warnf("file %s: %v", filename, err)
+		}
+		resp.Inserted += result.Inserted
+		resp.Skipped += result.Skipped
+		resp.Results = append(resp.Results, fileResult)
+	}
+	logger.Infof("manual load: %d file(s) processed, %d failed, inserted: %d, skipped: %d", len(req.Files), resp.Failed, resp.Inserted, resp.Skipped)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		logger.Warnf("manual load: failed to write response: %v", err)
+	}
+}
+
+// isProcessedObject checks if the current generation of an object was already processed (SKIP_PROCESSED_FILES)
+func isProcessedObject(ctx context.Context, bucket string, filename string) bool {
+	if !processedIndexEnabled() {
+		return false
+	}
+	attrs, err := objectAttrs(ctx, bucket, filename)
+	if err != nil {
+		return false
+	}
+	return IsProcessed(ctx, bucket, filename, attrs.Generation)
+}
+
+// requestTraceID returns the trace ID of an HTTP request (traceparent header), or a random ID
+func requestTraceID(r *http.Request) string {
+	if traceID := traceIDFromTraceparent(r.Header.Get("traceparent")); traceID != "" {
+		return traceID
+	}
+	return randomTraceID()
+}
+
+func init() {
+	functions.HTTP("manualLoad", manualLoad)
+}
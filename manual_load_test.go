@@ -0,0 +1,77 @@
+package loader
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestManualLoad(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("multiple files", func(mt *mtest.T) {
+		withMockMongo(mt)
+		f := useFakeGCS(mt.T)
+		f.put("uploads", "upload/a.csv", toa5CSV(`"TIMESTAMP","RECORD","water"`, `"2025-01-02 03:04:05",1,1.5`, `"2025-01-02 03:05:05",2,1.6`))
+		f.put("uploads", "upload/b.csv", []byte("not a TOA5 file"))
+		mt.AddMockResponses(
+			boxResponse("RIENVHK4", "CR300_19531"),
+			mtest.CreateCursorResponse(0, "test.sensor_data_RIENVHK4", mtest.FirstBatch),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 2}),
+		)
+
+		body := `{"bucket": "uploads", "files": ["upload/a.csv", "upload/b.csv", "upload/missing.csv"]}`
+		w := httptest.NewRecorder()
+		manualLoad(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" {
+			mt.Fatalf("manualLoad() = %d %q: %s", w.Code, w.Header().Get("Content-Type"), w.Body)
+		}
+
+		var resp ManualLoadResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			mt.Fatalf("invalid response %s: %v", w.Body, err)
+		}
+		if resp.Bucket != "uploads" || resp.Inserted != 2 || resp.Failed != 2 || len(resp.Results) != 3 {
+			mt.Fatalf("response = %+v, want 2 inserted and 2 failed files out of 3", resp)
+		}
+		if r := resp.Results[0]; r.File != "upload/a.csv" || r.DeviceID != "CR300_19531" || r.Inserted != 2 || r.Error != "" {
+			mt.Errorf("a.csv result = %+v, want 2 records of CR300_19531", r)
+		}
+		if r := resp.Results[1]; r.File != "upload/b.csv" || r.Error == "" {
+			mt.Errorf("b.csv result = %+v, want a parse error", r)
+		}
+		if r := resp.Results[2]; r.File != "upload/missing.csv" || !strings.Contains(r.Error, "failed to open GCS file") {
+			mt.Errorf("missing.csv result = %+v, want an open error", r)
+		}
+		// Failures are only reported
+		if _, copied := f.get("uploads", "load_failed/upload/b.csv"); copied {
+			mt.Error("manual load copied a failed file to load_failed/")
+		}
+	})
+}
+
+func TestManualLoadInvalidRequests(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		body   string
+		want   int
+	}{
+		{"GET", http.MethodGet, "", http.StatusMethodNotAllowed},
+		{"invalid JSON", http.MethodPost, `{"bucket": `, http.StatusBadRequest},
+		{"unknown field", http.MethodPost, `{"bucket": "uploads", "file": "a.csv"}`, http.StatusBadRequest},
+		{"no files", http.MethodPost, `{"bucket": "uploads", "files": []}`, http.StatusBadRequest},
+		{"no bucket", http.MethodPost, `{"files": ["a.csv"]}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		manualLoad(w, httptest.NewRequest(tt.method, "/", strings.NewReader(tt.body)))
+		if w.Code != tt.want {
+			t.Errorf("%s: manualLoad() = %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+}
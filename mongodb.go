@@ -2,12 +2,20 @@ package loader
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"math"
 	"os"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
@@ -16,6 +24,25 @@ import (
 type Box struct {
 	ID       interface{} `bson:"_id"`
 	DeviceID string      `bson:"device_id"`
+	// Timezone - optional timezone of the station: IANA name (e.g. "Asia/Ho_Chi_Minh") or UTC offset in hours (e.g. "8")
+	Timezone string `bson:"timezone"`
+	// Metadata - the other fields of the box document (e.g. lat, lon, name), see BOX_ENRICH_FIELDS
+	Metadata bson.M `bson:",inline"`
+}
+
+// Location returns the timezone of the box, or nil if none is set
+func (b *Box) Location() (*time.Location, error) {
+	if b == nil || b.Timezone == "" {
+		return nil, nil
+	}
+	if offset, err := strconv.Atoi(b.Timezone); err == nil {
+		return time.FixedZone(fmt.Sprintf("GMT%+d", offset), offset*3600), nil
+	}
+	loc, err := time.LoadLocation(b.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid box timezone %q: %w", b.Timezone, err)
+	}
+	return loc, nil
 }
 
 // SensorRecord represents a sensor data record
@@ -26,8 +53,19 @@ type SensorRecord map[string]interface{}
 var MongoClient *mongo.Client
 var MongoDatabase *mongo.Database
 
-// InitMongoDB initializes the global MongoDB connection
+// This is called once, before the first event or request is handled (see setupRuntime), and reused for all events
 // This is called once at startup and reused for all events
+// Environment variables:
+//
+//	DB_URL - MongoDB connection string (required)
+//	DB_NAME - database name (required)
+//	DB_NAME_<FILE TYPE> - database for a file type, e.g. DB_NAME_CSV, DB_NAME_AMCHUA, DB_NAME_BARIA (default: DB_NAME)
+//	MONGO_KEEPALIVE_SECONDS - ping interval of the background keep-alive, keeping the connection pool warm (default: 0, disabled)
+//	MONGO_STARTUP_TIMEOUT_SECONDS - timeout of each startup connection attempt (default: 30)
+//	MONGO_COMPRESSORS - comma-separated wire protocol compressors: snappy, zlib, zstd (default: none)
+//	MONGO_STARTUP_RETRIES - startup connection retries with exponential backoff before exiting (default: 0)
+//	VERIFY_INDEXES - "true"/"false" - run VerifyIndexes at startup (default: false)
+//	REPAIR_INDEXES - "true"/"false" - let VerifyIndexes create missing _id indexes (default: false)
 func InitMongoDB() {
 	dbURL := os.Getenv("DB_URL")
 	if dbURL == "" {
@@ -39,23 +77,403 @@ func InitMongoDB() {
 		GlobalLogger.Fatal("missing DB_NAME env variable")
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
+	mongoCompressors = parseMongoCompressors(os.Getenv("MONGO_COMPRESSORS"))
+	if len(mongoCompressors) > 0 {
+		GlobalLogger.Infof("MongoDB wire compression enabled: %s", strings.Join(mongoCompressors, ","))
+	}
+
+	timeout := time.Duration(parseIntEnv("MONGO_STARTUP_TIMEOUT_SECONDS", 30)) * time.Second
+	retries := parseIntEnv("MONGO_STARTUP_RETRIES", 0)
 
 	var err error
-	MongoClient, err = mongo.Connect(ctx, options.Client().ApplyURI(dbURL))
+	MongoClient, err = connectMongoWithRetry(dbURL, timeout, retries)
 	if err != nil {
-		GlobalLogger.Fatalf("failed to connect to MongoDB: %v", err)
+		GlobalLogger.Fatalf("%v", err)
+	}
+
+	MongoDatabase = MongoClient.Database(dbName)
+	GlobalLogger.Infof("MongoDB connection initialized for database: %s", dbName)
+
+	MongoDatabaseNames = loadDatabaseNames()
+
+	// Start the keep-alive goroutine if configured
+	if keepAlive := parseIntEnv("MONGO_KEEPALIVE_SECONDS", 0); keepAlive > 0 {
+		startMongoKeepAlive(MongoClient, time.Duration(keepAlive)*time.Second)
+	}
+}
+
+// MongoDatabaseNames maps a file type to the database its records are stored in
+// Loaded from DB_NAME_<FILE TYPE> env variables; file types without an entry use MongoDatabase
+var MongoDatabaseNames map[string]string
+
+// loadDatabaseNames loads the per-file-type database names from DB_NAME_<FILE TYPE> env variables
+func loadDatabaseNames() map[string]string {
+	names := make(map[string]string)
+	for _, env := range os.Environ() {
+		key, value, _ := strings.Cut(env, "=")
+		if !strings.HasPrefix(key, "DB_NAME_") || value == "" {
+			continue
+		}
+		fileType := strings.ToLower(strings.TrimPrefix(key, "DB_NAME_"))
+		names[fileType] = value
+		GlobalLogger.Infof("Records of file type %s are stored in database: %s", fileType, value)
+	}
+	return names
+}
+
+// databaseFor returns the database storing the records of a file type
+// The client is shared: only the database handle differs from MongoDatabase
+func databaseFor(fileType string) *mongo.Database {
+	if name, exists := MongoDatabaseNames[strings.ToLower(fileType)]; exists && MongoClient != nil {
+		return MongoClient.Database(name)
+	}
+	return MongoDatabase
+}
+
+// mongoCompressors holds the wire protocol compressors from MONGO_COMPRESSORS
+var mongoCompressors []string
+
+// supportedMongoCompressors lists the compressors accepted in MONGO_COMPRESSORS
+var supportedMongoCompressors = []string{"snappy", "zlib", "zstd"}
+
+// parseMongoCompressors parses a comma-separated list of wire protocol compressors
+// Unknown compressors are fatal
+func parseMongoCompressors(val string) []string {
+	var compressors []string
+	for _, name := range strings.Split(val, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if !slices.Contains(supportedMongoCompressors, name) {
+			GlobalLogger.Fatalf("invalid MONGO_COMPRESSORS entry %q, allowed: %v", name, supportedMongoCompressors)
+		}
+		compressors = append(compressors, name)
+	}
+	return compressors
+}
+
+// mongoClientOptions returns the client options used for every MongoDB connection
+func mongoClientOptions(dbURL string) *options.ClientOptions {
+	opts := options.Client().ApplyURI(dbURL)
+	if len(mongoCompressors) > 0 {
+		opts.SetCompressors(mongoCompressors)
+	}
+	return opts
+}
+
+// connectMongoFunc connects to MongoDB (replaceable for testing)
+var connectMongoFunc = connectMongo
+
+// mongoStartupMaxBackoff caps the delay between startup connection attempts
+const mongoStartupMaxBackoff = 30 * time.Second
+
+// connectMongoWithRetry connects to MongoDB at startup, each attempt bounded by timeout
+// Failed attempts are retried up to retries times with exponential backoff (1s, 2s, 4s, ... capped at 30s)
+func connectMongoWithRetry(dbURL string, timeout time.Duration, retries int) (*mongo.Client, error) {
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		client, err := connectMongoFunc(ctx, dbURL)
+		cancel()
+		if err == nil {
+			return client, nil
+		}
+		if attempt >= retries {
+			return nil, err
+		}
+
+		GlobalLogger.Warnf("MongoDB startup connection attempt %d/%d failed: %v, retrying in %s", attempt+1, retries+1, err, backoff)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, mongoStartupMaxBackoff)
+	}
+}
+
+// connectMongo connects to MongoDB and tests the connection
+func connectMongo(ctx context.Context, dbURL string) (*mongo.Client, error) {
+	client, err := mongo.Connect(ctx, mongoClientOptions(dbURL))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to MongoDB: %w", err)
 	}
 
 	// Test the connection
-	err = MongoClient.Ping(ctx, nil)
+	if err := client.Ping(ctx, nil); err != nil {
+		client.Disconnect(context.Background())
+		return nil, fmt.Errorf("failed to ping MongoDB: %w", err)
+	}
+	return client, nil
+}
+
+// mongoKeepAliveStop signals the keep-alive goroutine to stop (nil when not running)
+var mongoKeepAliveStop chan struct{}
+
+// mongoKeepAliveDone is closed when the keep-alive goroutine has stopped
+var mongoKeepAliveDone chan struct{}
+
+// startMongoKeepAlive starts a goroutine that pings MongoDB every interval
+// Configured via MONGO_KEEPALIVE_SECONDS (0 = disabled); stopped by Shutdown
+// The pings keep the connection pool warm; the driver itself reconnects dropped connections, so the
+// shared client is never replaced (handlers use it concurrently)
+func startMongoKeepAlive(client *mongo.Client, interval time.Duration) {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	mongoKeepAliveStop = stop
+	mongoKeepAliveDone = done
+
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		healthy := true
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				healthy = mongoKeepAlive(client, interval, healthy)
+			}
+		}
+	}()
+
+	GlobalLogger.Infof("MongoDB keep-alive started (every %v)", interval)
+}
+
+// mongoKeepAlive pings MongoDB once and returns whether the ping succeeded
+// Failures and recoveries are logged once per outage
+func mongoKeepAlive(client *mongo.Client, timeout time.Duration, wasHealthy bool) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := client.Ping(ctx, nil); err != nil {
+		if wasHealthy {
+			GlobalLogger.Warnf("MongoDB keep-alive ping failed: %v, the driver reconnects on the next operation", err)
+		}
+		return false
+	}
+	if !wasHealthy {
+		GlobalLogger.Info("MongoDB keep-alive: connection recovered")
+	}
+	return true
+}
+
+// stopMongoKeepAlive stops the keep-alive goroutine and waits for it to exit
+func stopMongoKeepAlive() {
+	if mongoKeepAliveStop == nil {
+		return
+	}
+	close(mongoKeepAliveStop)
+	<-mongoKeepAliveDone
+	mongoKeepAliveStop = nil
+	mongoKeepAliveDone = nil
+}
+
+// closeMongoDB stops the keep-alive goroutine and disconnects the global client
+func closeMongoDB(ctx context.Context) error {
+	stopMongoKeepAlive()
+	if MongoClient == nil {
+		return nil
+	}
+	if err := MongoClient.Disconnect(ctx); err != nil {
+		return fmt.Errorf("failed to disconnect from MongoDB: %w", err)
+	}
+	MongoClient = nil
+	MongoDatabase = nil
+	return nil
+}
+
+// requireMongo checks that the global MongoDB database is initialized
+// Returns an error instead of letting MongoDatabase.Collection panic on a nil database
+func requireMongo() error {
+	if MongoDatabase == nil {
+		return fmt.Errorf("%w (InitMongoDB did not run or failed)", ErrMongoNotConnected)
+	}
+	return nil
+}
+
+// ErrMongoNotConnected is returned by MongoDB operations before InitMongoDB succeeded
+var ErrMongoNotConnected = errors.New("MongoDB is not initialized")
+
+// FormatBoxID renders a box _id for use in collection names
+// ObjectIDs are rendered as their hex string and numbers without decimals or exponents
+func FormatBoxID(id interface{}) (string, error) {
+	switch v := id.(type) {
+	case string:
+		if v == "" {
+			return "", fmt.Errorf("empty box _id")
+		}
+		return v, nil
+	case primitive.ObjectID:
+		return v.Hex(), nil
+	case int:
+		return strconv.FormatInt(int64(v), 10), nil
+	case int32:
+		return strconv.FormatInt(int64(v), 10), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		if v != math.Trunc(v) || math.IsInf(v, 0) {
+			return "", fmt.Errorf("non-integer box _id: %v", v)
+		}
+		return strconv.FormatInt(int64(v), 10), nil
+	default:
+		return "", fmt.Errorf("unsupported box _id type: %T", id)
+	}
+}
+
+// validateCollectionName checks that a collection name is legal in MongoDB
+func validateCollectionName(name string) error {
+	switch {
+	case name == "":
+		return fmt.Errorf("empty collection name")
+	case len(name) > 120:
+		return fmt.Errorf("collection name too long (%d bytes): %s", len(name), name)
+	case strings.ContainsAny(name, "$\x00"):
+		return fmt.Errorf("collection name contains an illegal character: %q", name)
+	case strings.HasPrefix(name, "system."):
+		return fmt.Errorf("collection name uses the reserved system. prefix: %s", name)
+	}
+	return nil
+}
+
+// collectionGuard tracks the collections used by this instance for MAX_COLLECTIONS
+var collectionGuard = struct {
+	sync.Mutex
+	// known - collections already checked ("db.collection")
+	known map[string]bool
+	// created - number of collections that did not exist when first used
+	created int
+}{known: make(map[string]bool)}
+
+// reserveCollection checks MAX_COLLECTIONS before writing to a collection
+// Existing collections are always allowed; a collection that does not exist yet counts against the
+// per-instance limit and is refused once the limit is reached
+func reserveCollection(ctx context.Context, db *mongo.Database, name string) error {
+	if GlobalConfig == nil || GlobalConfig.MaxCollections <= 0 {
+		return nil
+	}
+
+	key := db.Name() + "." + name
+	collectionGuard.Lock()
+	defer collectionGuard.Unlock()
+
+	if collectionGuard.known[key] {
+		return nil
+	}
+
+	names, err := db.ListCollectionNames(ctx, bson.M{"name": name})
 	if err != nil {
-		GlobalLogger.Fatalf("failed to ping MongoDB: %v", err)
+		return fmt.Errorf("failed to check collection %s: %w", name, err)
 	}
+	if len(names) == 0 {
+		if collectionGuard.created >= GlobalConfig.MaxCollections {
+			LoggerFrom(ctx).Errorf("MAX_COLLECTIONS (%d) reached, refusing to create collection %s", GlobalConfig.MaxCollections, key)
+			return fmt.Errorf("MAX_COLLECTIONS (%d) reached, refusing to create collection %s", GlobalConfig.MaxCollections, name)
+		}
+		collectionGuard.created++
+	}
+	collectionGuard.known[key] = true
+	return nil
+}
 
-	MongoDatabase = MongoClient.Database(dbName)
-	GlobalLogger.Infof("MongoDB connection initialized for database: %s", dbName)
+// sensorCollectionName returns the sensor data collection name for a box
+// The "sensor_data_" prefix can be overridden per bucket (BUCKET_CONFIG collection_prefix)
+// With HASH_COLLECTIONS=N, boxes share N collections selected by hashing the box ID
+func sensorCollectionName(ctx context.Context, boxID string) string {
+	prefix := collectionPrefixFor(ctx)
+	if GlobalConfig != nil && GlobalConfig.HashCollections > 0 {
+		return fmt.Sprintf("%sshared_%d", prefix, hashCollectionIndex(boxID, GlobalConfig.HashCollections))
+	}
+	return prefix + boxID
+}
+
+// sensorCollectionNameAt returns the sensor data collection name for a box record at a Unix timestamp
+// With YEARLY_COLLECTIONS, the year of the timestamp (in TIMEZONE_OFFSET) is appended: sensor_data_<box ID>_<YYYY>
+func sensorCollectionNameAt(ctx context.Context, boxID string, ts int64) string {
+	name := sensorCollectionName(ctx, boxID)
+	if GlobalConfig == nil || !GlobalConfig.YearlyCollections {
+		return name
+	}
+	return fmt.Sprintf("%s_%d", name, collectionYear(ts))
+}
+
+// collectionYear returns the year of a Unix timestamp in TIMEZONE_OFFSET
+func collectionYear(ts int64) int {
+	loc := time.UTC
+	if GlobalConfig != nil && GlobalConfig.TimezoneLocation != nil {
+		loc = GlobalConfig.TimezoneLocation
+	}
+	return time.Unix(ts, 0).In(loc).Year()
+}
+
+// recordsByCollection groups the records of a box by sensor data collection, in first-seen order
+// Without YEARLY_COLLECTIONS there is a single group. Records with an invalid _id go to the
+// current year collection, where FilterNewRecords drops them
+func recordsByCollection(ctx context.Context, boxID string, records []SensorRecord) ([]string, map[string][]SensorRecord) {
+	var names []string
+	groups := make(map[string][]SensorRecord)
+	for _, record := range records {
+		ts, err := recordTimestamp(record)
+		if err != nil {
+			ts = nowFunc().Unix()
+		}
+		name := sensorCollectionNameAt(ctx, boxID, ts)
+		if _, exists := groups[name]; !exists {
+			names = append(names, name)
+		}
+		groups[name] = append(groups[name], record)
+	}
+	return names, groups
+}
+
+// hashCollectionIndex returns the shared collection index (0..n-1) for a box ID
+// The FNV-1a hash is stable across instances and restarts
+func hashCollectionIndex(boxID string, n int) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(boxID))
+	return h.Sum32() % uint32(n)
+}
+
+// isSharedCollection checks if boxes share hashed collections (HASH_COLLECTIONS > 0)
+func isSharedCollection() bool {
+	return GlobalConfig != nil && GlobalConfig.HashCollections > 0
+}
+
+// sensorRecordFilter returns the filter selecting a box's records in its sensor data collection
+func sensorRecordFilter(boxID string) bson.M {
+	if isSharedCollection() {
+		return bson.M{"box_id": boxID}
+	}
+	return bson.M{}
+}
+
+// applySharedCollectionKey prepares a document for a shared (hashed) collection
+// The timestamp _id becomes {box_id, ts} so boxes sharing a collection don't collide,
+// and box_id is stored as a field for querying. No-op unless HASH_COLLECTIONS is set
+func applySharedCollectionKey(boxID string, doc map[string]interface{}) {
+	if !isSharedCollection() {
+		return
+	}
+	doc["_id"] = bson.D{{Key: "box_id", Value: boxID}, {Key: "ts", Value: doc["_id"]}}
+	doc["box_id"] = boxID
+}
+
+// recordTimestamp returns the Unix timestamp of a stored record
+// Handles both plain timestamp _id values and the {box_id, ts} _id of shared collections
+func recordTimestamp(record SensorRecord) (int64, error) {
+	switch id := record["_id"].(type) {
+	case bson.D:
+		for _, e := range id {
+			if e.Key == "ts" {
+				return GetInt64FromInterface(e.Value)
+			}
+		}
+		return 0, fmt.Errorf("compound _id has no ts field")
+	case bson.M:
+		return GetInt64FromInterface(id["ts"])
+	default:
+		return GetInt64FromInterface(id)
+	}
 }
 
 // GetInt64FromInterface safely converts interface{} to int64
@@ -75,39 +493,170 @@ func GetInt64FromInterface(v interface{}) (int64, error) {
 	}
 }
 
+// applyBSONDate adds the "ts" BSON datetime field derived from the Unix timestamp
+// No-op unless STORE_BSON_DATE is enabled
+func applyBSONDate(doc map[string]interface{}, ts int64) {
+	if GlobalConfig == nil || !GlobalConfig.StoreBSONDate {
+		return
+	}
+	doc["ts"] = primitive.NewDateTimeFromTime(time.Unix(ts, 0))
+}
+
+// orderedDocument returns the document to insert for a record
+// With ORDERED_FIELDS=true the record becomes a bson.D: _id, ts, n, c, gen, then the fields in fieldOrder,
+// then any remaining fields sorted by name. Otherwise the record is returned as is
+func orderedDocument(record map[string]interface{}, fieldOrder []string) interface{} {
+	if GlobalConfig == nil || !GlobalConfig.OrderedFields {
+		return record
+	}
+
+	doc := make(bson.D, 0, len(record))
+	seen := make(map[string]bool, len(record))
+	appendField := func(key string) {
+		if seen[key] {
+			return
+		}
+		if value, exists := record[key]; exists {
+			doc = append(doc, bson.E{Key: key, Value: value})
+			seen[key] = true
+		}
+	}
+
+	for _, key := range []string{"_id", "ts", "n", "c", "gen", "ft"} {
+		appendField(key)
+	}
+	for _, key := range fieldOrder {
+		appendField(key)
+	}
+
+	var rest []string
+	for key := range record {
+		if !seen[key] {
+			rest = append(rest, key)
+		}
+	}
+	sort.Strings(rest)
+	for _, key := range rest {
+		appendField(key)
+	}
+	return doc
+}
+
 // InsertBatch inserts a batch of records, ignoring duplicates
-func InsertBatch(ctx context.Context, col *mongo.Collection, data []SensorRecord) (int64, error) {
+// The optional fieldOrder is used for the document field order when ORDERED_FIELDS is enabled
+func InsertBatch(ctx context.Context, col *mongo.Collection, data []SensorRecord, fieldOrder ...string) (int64, error) {
+	return insertRecordBatch(ctx, col, data, fieldOrder).count()
+}
+
+// insertRecordBatch inserts a batch of records and returns its result
+func insertRecordBatch(ctx context.Context, col *mongo.Collection, data []SensorRecord, fieldOrder []string) batchResult {
 	if len(data) < 1 {
-		return 0, nil
+		return batchResult{}
 	}
 
 	var docs []interface{}
 	for _, record := range data {
-		docs = append(docs, record)
+		docs = append(docs, orderedDocument(record, fieldOrder))
 	}
 
 	// Print records before insert if debug flag is enabled
 	if GlobalConfig != nil && GlobalConfig.Debug {
 		for i, record := range data {
-			GlobalLogger.Infof("[DEBUG] InsertBatch record [%d/%d]: %+v", i+1, len(data), record)
+			LoggerFrom(ctx).Infof("[DEBUG] InsertBatch record [%d/%d]: %+v", i+1, len(data), record)
 		}
 	}
 
+	return insertBatch(ctx, col, docs)
+}
+
+// batchResult is the outcome of one unordered insert batch
+// The counts are only informational (LOG_BATCH_RESULTS): see count for the result of InsertBatch
+type batchResult struct {
+	Inserted   int64
+	Duplicates int64
+	Errors     int64
+	// Err is the error returned by InsertMany
+	Err error
+}
+
+// count returns the inserted count and error of InsertBatch
+// A batch failing with a duplicate key error counts as 0 inserted records and no error
+func (r batchResult) count() (int64, error) {
+	if r.Err == nil {
+		return r.Inserted, nil
+	}
+	// Check if it's a duplicate key error
+	if strings.Contains(r.Err.Error(), "E11000 duplicate key error") {
+		return 0, nil
+	}
+	return 0, r.Err
+}
+
+// insertBatch inserts documents unordered and counts the inserted, duplicate and failed documents
+func insertBatch(ctx context.Context, col *mongo.Collection, docs []interface{}) batchResult {
 	result, err := col.InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
-	if err != nil {
-		// Check if it's a duplicate key error
+	if err == nil {
+		return batchResult{Inserted: int64(len(result.InsertedIDs))}
+	}
+
+	var bulkErr mongo.BulkWriteException
+	if !errors.As(err, &bulkErr) {
 		if strings.Contains(err.Error(), "E11000 duplicate key error") {
-			return 0, nil
+			return batchResult{Duplicates: int64(len(docs)), Err: err}
 		}
-		return 0, err
+		return batchResult{Errors: int64(len(docs)), Err: err}
+	}
+
+	res := batchResult{Inserted: int64(len(docs) - len(bulkErr.WriteErrors)), Err: err}
+	for _, writeErr := range bulkErr.WriteErrors {
+		if writeErr.Code == 11000 {
+			res.Duplicates++
+		} else {
+			res.Errors++
+		}
+	}
+	return res
+}
+
+// insertProgress counts the records inserted from a file, for PROGRESS_EVERY logs
+type insertProgress struct {
+	filename string
+	inserted int64
+}
+
+// insertProgressKey is the context key of the insert progress of the file being processed
+type insertProgressKey struct{}
+
+// withInsertProgress returns a context counting the records inserted from a file
+// The progress is only carried when PROGRESS_EVERY is set
+func withInsertProgress(ctx context.Context, filename string) context.Context {
+	if GlobalConfig == nil || GlobalConfig.ProgressEvery <= 0 {
+		return ctx
 	}
+	return context.WithValue(ctx, insertProgressKey{}, &insertProgress{filename: filename})
+}
 
-	return int64(len(result.InsertedIDs)), nil
+// reportInsertProgress adds inserted records to the progress carried by the context
+// and logs a line each time the count crosses a multiple of PROGRESS_EVERY
+func reportInsertProgress(ctx context.Context, inserted int64) {
+	progress, ok := ctx.Value(insertProgressKey{}).(*insertProgress)
+	if !ok || inserted <= 0 {
+		return
+	}
+	every := int64(GlobalConfig.ProgressEvery)
+	before := progress.inserted
+	progress.inserted += inserted
+	if progress.inserted/every > before/every {
+		LoggerFrom(ctx).Infof("file %s: progress: %d records inserted", progress.filename, progress.inserted)
+	}
 }
 
 // InsertIgnoreDuplicate inserts all records with duplicate handling
-func InsertIgnoreDuplicate(ctx context.Context, col *mongo.Collection, data []SensorRecord) (int64, error) {
+// The optional fieldOrder is used for the document field order when ORDERED_FIELDS is enabled
+// With LOG_BATCH_RESULTS, the inserted/duplicate/error counts of each batch are logged
+func InsertIgnoreDuplicate(ctx context.Context, col *mongo.Collection, data []SensorRecord, fieldOrder ...string) (int64, error) {
 	var inserted int64
+	batches := (len(data) + BATCH_SIZE - 1) / BATCH_SIZE
 
 	for i := 0; i < len(data); i += BATCH_SIZE {
 		end := i + BATCH_SIZE
@@ -119,40 +668,172 @@ func InsertIgnoreDuplicate(ctx context.Context, col *mongo.Collection, data []Se
 
 		// Log batch processing if debug flag is enabled
 		if GlobalConfig != nil && GlobalConfig.Debug {
-			GlobalLogger.Infof("[DEBUG] InsertIgnoreDuplicate processing batch: %d-%d (total: %d)", i, end, len(data))
+			LoggerFrom(ctx).Infof("[DEBUG] InsertIgnoreDuplicate processing batch: %d-%d (total: %d)", i, end, len(data))
 		}
 
-		count, err := InsertBatch(ctx, col, arr)
+		result := insertRecordBatch(ctx, col, arr, fieldOrder)
+		if GlobalConfig != nil && GlobalConfig.LogBatchResults {
+			LoggerFrom(ctx).Infof("%s: batch %d/%d size: %d, inserted: %d, duplicates: %d, errors: %d",
+				col.Name(), i/BATCH_SIZE+1, batches, len(arr), result.Inserted, result.Duplicates, result.Errors)
+		}
+		count, err := result.count()
 		if err != nil {
 			return inserted, err
 		}
 		inserted += count
+		reportInsertProgress(ctx, count)
 	}
 
 	return inserted, nil
 }
 
 // FindBoxByDeviceID finds a box document by device_id
+// The box collection is always read from the main database (DB_NAME)
 // Returns the box or an error if not found
 func FindBoxByDeviceID(ctx context.Context, deviceID string) (*Box, error) {
+	if err := requireMongo(); err != nil {
+		return nil, err
+	}
 	boxCol := MongoDatabase.Collection("box")
 	var box Box
 	err := boxCol.FindOne(ctx, bson.M{"device_id": deviceID}).Decode(&box)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
-			return nil, fmt.Errorf("unknown device_id %s", deviceID)
+			return nil, fmt.Errorf("%w %s", ErrUnknownDevice, deviceID)
 		}
 		return nil, fmt.Errorf("failed to find box for device_id %s: %w", deviceID, err)
 	}
 	return &box, nil
 }
 
+// enrichRecords copies the BOX_ENRICH_FIELDS of the box document into each record
+// Fields missing from the box are skipped; fields already set on a record (readings, _id) are kept
+func enrichRecords(box *Box, records []SensorRecord) {
+	if GlobalConfig == nil || len(GlobalConfig.BoxEnrichFields) == 0 || box == nil {
+		return
+	}
+	for _, field := range GlobalConfig.BoxEnrichFields {
+		value, exists := box.Metadata[field]
+		if !exists {
+			continue
+		}
+		for _, record := range records {
+			if _, set := record[field]; !set {
+				record[field] = value
+			}
+		}
+	}
+}
+
+// ErrUnknownDevice is returned by FindBoxByDeviceID for devices without a box document
+var ErrUnknownDevice = errors.New("unknown device_id")
+
+// CreateBox creates the box document of an unknown device from BOX_TEMPLATE
+// The document carries the template fields, device_id, auto_created: true and the creation time
+// (Unix seconds) in created. An upsert on device_id keeps concurrent instances from creating it twice
+func CreateBox(ctx context.Context, deviceID string) (*Box, error) {
+	if err := requireMongo(); err != nil {
+		return nil, err
+	}
+
+	doc := bson.M{}
+	for k, v := range GlobalConfig.BoxTemplate {
+		doc[k] = v
+	}
+	delete(doc, "_id")
+	delete(doc, "device_id")
+	doc["auto_created"] = true
+	doc["created"] = nowFunc().Unix()
+
+	var box Box
+	err := MongoDatabase.Collection("box").FindOneAndUpdate(ctx,
+		bson.M{"device_id": deviceID},
+		bson.M{"$setOnInsert": doc},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&box)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create box for device_id %s: %w", deviceID, err)
+	}
+	return &box, nil
+}
+
+// FindBoxByID finds a box by its _id (an ObjectID hex string, or a plain string _id)
+func FindBoxByID(ctx context.Context, boxID string) (*Box, error) {
+	if err := requireMongo(); err != nil {
+		return nil, err
+	}
+	filter := bson.M{"_id": boxID}
+	if oid, err := primitive.ObjectIDFromHex(boxID); err == nil {
+		filter = bson.M{"_id": bson.M{"$in": bson.A{oid, boxID}}}
+	}
+	var box Box
+	err := MongoDatabase.Collection("box").FindOne(ctx, filter).Decode(&box)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, fmt.Errorf("unknown box %s", boxID)
+		}
+		return nil, fmt.Errorf("failed to find box %s: %w", boxID, err)
+	}
+	return &box, nil
+}
+
+// UpdateLastSeen sets the last_seen field of a box document to the newest record timestamp
+// last_seen never moves backwards: backfills of older files leave it unchanged
+func UpdateLastSeen(ctx context.Context, box *Box, ts int64) error {
+	if err := requireMongo(); err != nil {
+		return err
+	}
+	_, err := MongoDatabase.Collection("box").UpdateByID(ctx, box.ID, bson.M{"$max": bson.M{"last_seen": ts}})
+	if err != nil {
+		return fmt.Errorf("failed to update last_seen of device %s: %w", box.DeviceID, err)
+	}
+	return nil
+}
+
+// newestRecordTimestamp returns the newest record timestamp (0 if none)
+// Handles the {box_id, ts} _id of shared collections, so it can be read after the insert
+func newestRecordTimestamp(records []SensorRecord) int64 {
+	var newest int64
+	for _, record := range records {
+		if ts, err := recordTimestamp(record); err == nil && ts > newest {
+			newest = ts
+		}
+	}
+	return newest
+}
+
+// numericIDFilter restricts a latest-record filter to numeric timestamps (LATEST_NUMERIC_ID)
+// Documents with a corrupt _id (string, object, ...) would otherwise sort first and skew the baseline
+// Returns a copy: the caller's filter is not modified
+func numericIDFilter(filter bson.M) bson.M {
+	if GlobalConfig == nil || !GlobalConfig.LatestNumericID {
+		return filter
+	}
+	typed := make(bson.M, len(filter)+1)
+	for k, v := range filter {
+		typed[k] = v
+	}
+	key := "_id"
+	if isSharedCollection() {
+		key = "_id.ts"
+	}
+	typed[key] = bson.M{"$type": "number"}
+	return typed
+}
+
 // GetLatestRecord retrieves the latest (most recent by _id) record from a collection
 // Returns the record or nil if no records exist
 func GetLatestRecord(ctx context.Context, col *mongo.Collection) (*SensorRecord, error) {
+	return GetLatestRecordFiltered(ctx, col, bson.M{})
+}
+
+// GetLatestRecordFiltered retrieves the latest (most recent by _id) record matching the filter
+// Returns the record or nil if no records exist
+func GetLatestRecordFiltered(ctx context.Context, col *mongo.Collection, filter bson.M) (*SensorRecord, error) {
+	filter = numericIDFilter(filter)
 	opts := options.FindOne().SetSort(bson.M{"_id": -1})
 	var maxTs SensorRecord
-	err := col.FindOne(ctx, bson.M{}, opts).Decode(&maxTs)
+	err := col.FindOne(ctx, filter, opts).Decode(&maxTs)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
 			return nil, nil
@@ -165,11 +846,16 @@ func GetLatestRecord(ctx context.Context, col *mongo.Collection) (*SensorRecord,
 // FilterNewRecords filters records to keep only those with _id greater than maxID
 // Used to avoid re-inserting old data
 func FilterNewRecords(records []SensorRecord, maxID int64) ([]SensorRecord, error) {
+	return filterNewRecords(context.Background(), records, maxID)
+}
+
+// filterNewRecords is FilterNewRecords logging with the logger of ctx
+func filterNewRecords(ctx context.Context, records []SensorRecord, maxID int64) ([]SensorRecord, error) {
 	var newRecords []SensorRecord
 	for _, r := range records {
 		rID, err := GetInt64FromInterface(r["_id"])
 		if err != nil {
-			GlobalLogger.Warnf("warning: invalid record _id type: %v", err)
+			LoggerFrom(ctx).Warnf("warning: invalid record _id type: %v", err)
 			continue
 		}
 		if rID > maxID {
@@ -180,26 +866,67 @@ func FilterNewRecords(records []SensorRecord, maxID int64) ([]SensorRecord, erro
 }
 
 // InsertSensorRecords inserts sensor records for a device, filtering by latest timestamp
+// The optional fieldOrder is used for the document field order when ORDERED_FIELDS is enabled
 // Returns the number of records inserted
-func InsertSensorRecords(ctx context.Context, filename string, deviceID string, box *Box, records []SensorRecord) (int64, error) {
-	colName := fmt.Sprintf("sensor_data_%s", box.ID)
-	col := MongoDatabase.Collection(colName)
+func InsertSensorRecords(ctx context.Context, filename string, deviceID string, box *Box, records []SensorRecord, fieldOrder ...string) (int64, error) {
+	logger := LoggerFrom(ctx)
+	if err := requireMongo(); err != nil {
+		return 0, fmt.Errorf("file %s: %w", filename, err)
+	}
+
+	boxID, err := FormatBoxID(box.ID)
+	if err != nil {
+		return 0, fmt.Errorf("file %s: device %s: %w", filename, deviceID, err)
+	}
+
+	// Records are parsed before the box lookup, in the bucket timezone (or TIMEZONE_OFFSET):
+	// re-base them on the box timezone, if any, before comparing with the stored records
+	if loc, err := box.Location(); err != nil {
+		logger.Warnf("file %s: device %s: %v, keeping parsed timestamps", filename, deviceID, err)
+	} else if loc != nil {
+		reinterpretRecords(records, timezoneFor(ctx), loc)
+	}
+
+	// With YEARLY_COLLECTIONS, records spanning a new year are split over two collections
+	var inserted int64
+	colNames, groups := recordsByCollection(ctx, boxID, records)
+	for _, colName := range colNames {
+		n, err := insertCollectionRecords(ctx, filename, deviceID, boxID, colName, groups[colName], fieldOrder)
+		inserted += n
+		if err != nil {
+			return inserted, err
+		}
+	}
+	return inserted, nil
+}
+
+// insertCollectionRecords inserts the records of a box newer than the latest one stored in a sensor data collection
+func insertCollectionRecords(ctx context.Context, filename string, deviceID string, boxID string, colName string, records []SensorRecord, fieldOrder []string) (int64, error) {
+	logger := LoggerFrom(ctx)
+	if err := validateCollectionName(colName); err != nil {
+		return 0, fmt.Errorf("file %s: device %s: %w", filename, deviceID, err)
+	}
+	db := databaseFor(FileTypeCSV)
+	if err := reserveCollection(ctx, db, colName); err != nil {
+		return 0, fmt.Errorf("file %s: %w", filename, err)
+	}
+	col := db.Collection(colName)
 
 	// Get the latest record
-	maxTs, err := GetLatestRecord(ctx, col)
+	maxTs, err := GetLatestRecordFiltered(ctx, col, sensorRecordFilter(boxID))
 	if err != nil {
 		return 0, fmt.Errorf("file %s: %w", filename, err)
 	}
 
 	var toInsert []SensorRecord
 	if maxTs != nil {
-		maxID, err := GetInt64FromInterface((*maxTs)["_id"])
+		maxID, err := recordTimestamp(*maxTs)
 		if err != nil {
-			GlobalLogger.Warnf("warning: invalid max_id type: %v", err)
+			logger.Warnf("warning: invalid max_id type: %v", err)
 			toInsert = records
 		} else {
 			// Filter records to insert only new ones
-			toInsert, err = FilterNewRecords(records, maxID)
+			toInsert, err = filterNewRecords(ctx, records, maxID)
 			if err != nil {
 				return 0, fmt.Errorf("file %s: %w", filename, err)
 			}
@@ -208,12 +935,265 @@ func InsertSensorRecords(ctx context.Context, filename string, deviceID string,
 		toInsert = records
 	}
 
+	for _, record := range toInsert {
+		applySharedCollectionKey(boxID, record)
+	}
+
+	// With micro-batching, records are inserted with those of other files on the next flush
+	// The file waits for the flush, so its result only counts written records
+	if batchingEnabled() {
+		ticket := globalBatcher.add(ctx, col, toInsert, fieldOrder)
+		logger.Infof("file %s: buffered %d records from device %s for %s", filename, len(toInsert), deviceID, colName)
+		inserted, err := globalBatcher.wait(ctx, ticket)
+		if err != nil {
+			return inserted, fmt.Errorf("file %s: failed to insert buffered records into %s: %w", filename, colName, err)
+		}
+		logger.Infof("file %s: inserted %d buffered records from device %s into %s", filename, inserted, deviceID, colName)
+		return inserted, nil
+	}
+
 	// Insert records
-	inserted, err := InsertIgnoreDuplicate(ctx, col, toInsert)
+	inserted, err := InsertIgnoreDuplicate(ctx, col, toInsert, fieldOrder...)
 	if err != nil {
 		return 0, fmt.Errorf("file %s: failed to insert records into %s: %w", filename, colName, err)
 	}
 
-	GlobalLogger.Infof("file %s: inserted %d records from device %s into %s", filename, inserted, deviceID, colName)
+	logger.Infof("file %s: inserted %d records from device %s into %s", filename, inserted, deviceID, colName)
 	return inserted, nil
 }
+
+// CountNewRecords counts the records that InsertSensorRecords would insert for a box (newer than the
+// latest stored record) and those it would filter out as already present, without inserting anything
+// Records with an invalid _id are counted as filtered
+func CountNewRecords(ctx context.Context, boxID string, records []SensorRecord) (newCount int64, dupCount int64, err error) {
+	if err := requireMongo(); err != nil {
+		return 0, 0, err
+	}
+
+	colNames, groups := recordsByCollection(ctx, boxID, records)
+	for _, colName := range colNames {
+		n, err := countNewCollectionRecords(ctx, boxID, colName, groups[colName])
+		if err != nil {
+			return 0, 0, err
+		}
+		newCount += n
+	}
+	return newCount, int64(len(records)) - newCount, nil
+}
+
+// countNewCollectionRecords counts the records of a box newer than the latest one stored in a sensor data collection
+func countNewCollectionRecords(ctx context.Context, boxID string, colName string, records []SensorRecord) (int64, error) {
+	if err := validateCollectionName(colName); err != nil {
+		return 0, fmt.Errorf("box %s: %w", boxID, err)
+	}
+	col := databaseFor(FileTypeCSV).Collection(colName)
+
+	maxTs, err := GetLatestRecordFiltered(ctx, col, sensorRecordFilter(boxID))
+	if err != nil {
+		return 0, fmt.Errorf("box %s: %w", boxID, err)
+	}
+	if maxTs == nil {
+		return int64(len(records)), nil
+	}
+
+	maxID, err := recordTimestamp(*maxTs)
+	if err != nil {
+		return 0, fmt.Errorf("box %s: invalid max_id type: %w", boxID, err)
+	}
+	newRecords, err := filterNewRecords(ctx, records, maxID)
+	if err != nil {
+		return 0, fmt.Errorf("box %s: %w", boxID, err)
+	}
+	return int64(len(newRecords)), nil
+}
+
+// CorrectRecords upserts records into the sensor data collection of a box, keyed on _id
+// Intended for explicit correction workflows: unlike InsertSensorRecords it does not skip
+// records older than the latest stored one, and existing records are replaced
+// Returns the number of records updated or inserted
+func CorrectRecords(ctx context.Context, boxID string, records []SensorRecord) (int64, error) {
+	if err := requireMongo(); err != nil {
+		return 0, err
+	}
+	if len(records) < 1 {
+		return 0, nil
+	}
+
+	for _, record := range records {
+		if _, exists := record["_id"]; !exists {
+			return 0, fmt.Errorf("box %s: record without _id: %+v", boxID, record)
+		}
+	}
+
+	var corrected int64
+	colNames, groups := recordsByCollection(ctx, boxID, records)
+	for _, colName := range colNames {
+		n, err := correctCollectionRecords(ctx, boxID, colName, groups[colName])
+		corrected += n
+		if err != nil {
+			return corrected, err
+		}
+	}
+	return corrected, nil
+}
+
+// correctCollectionRecords upserts the records of a box into a sensor data collection, keyed on _id
+func correctCollectionRecords(ctx context.Context, boxID string, colName string, records []SensorRecord) (int64, error) {
+	if err := validateCollectionName(colName); err != nil {
+		return 0, fmt.Errorf("box %s: %w", boxID, err)
+	}
+	db := databaseFor(FileTypeCSV)
+	if err := reserveCollection(ctx, db, colName); err != nil {
+		return 0, err
+	}
+	col := db.Collection(colName)
+
+	var models []mongo.WriteModel
+	for _, record := range records {
+		applySharedCollectionKey(boxID, record)
+		models = append(models, mongo.NewReplaceOneModel().
+			SetFilter(bson.M{"_id": record["_id"]}).
+			SetReplacement(orderedDocument(record, nil)).
+			SetUpsert(true))
+	}
+
+	result, err := col.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	if err != nil {
+		return 0, fmt.Errorf("box %s: failed to correct records in %s: %w", boxID, colName, err)
+	}
+
+	corrected := result.MatchedCount + result.UpsertedCount
+	LoggerFrom(ctx).Infof("box %s: corrected %d records in %s (%d updated, %d inserted)", boxID, corrected, colName, result.MatchedCount, result.UpsertedCount)
+	return corrected, nil
+}
+
+// DeleteRecords deletes the records of a box with a timestamp in [from, to] (Unix seconds, inclusive)
+// Both bounds are required (non-zero, from <= to) so a mistake can't purge a whole collection
+// Returns the number of deleted records
+func DeleteRecords(ctx context.Context, boxID string, from int64, to int64) (int64, error) {
+	if err := requireMongo(); err != nil {
+		return 0, err
+	}
+	if from <= 0 || to <= 0 || from > to {
+		return 0, fmt.Errorf("box %s: invalid delete range [%d, %d], both bounds are required and from must not exceed to", boxID, from, to)
+	}
+
+	filter := sensorRecordFilter(boxID)
+	tsKey := "_id"
+	if isSharedCollection() {
+		tsKey = "_id.ts"
+	}
+	filter[tsKey] = bson.M{"$gte": from, "$lte": to}
+
+	// With YEARLY_COLLECTIONS, the range may span several collections
+	colNames := []string{sensorCollectionName(ctx, boxID)}
+	if GlobalConfig != nil && GlobalConfig.YearlyCollections {
+		colNames = nil
+		for year := collectionYear(from); year <= collectionYear(to); year++ {
+			colNames = append(colNames, fmt.Sprintf("%s_%d", sensorCollectionName(ctx, boxID), year))
+		}
+	}
+
+	var deleted int64
+	for _, colName := range colNames {
+		if err := validateCollectionName(colName); err != nil {
+			return deleted, fmt.Errorf("box %s: %w", boxID, err)
+		}
+		result, err := databaseFor(FileTypeCSV).Collection(colName).DeleteMany(ctx, filter)
+		if err != nil {
+			return deleted, fmt.Errorf("box %s: failed to delete records from %s: %w", boxID, colName, err)
+		}
+		deleted += result.DeletedCount
+		LoggerFrom(ctx).Infof("box %s: deleted %d records from %s in [%d, %d]", boxID, result.DeletedCount, colName, from, to)
+	}
+	return deleted, nil
+}
+
+// VerifyIndexes checks that every sensor_data_* collection has its _id index (_id_)
+// Every normal collection has one, unique by construction; it can be missing from capped collections
+// created with autoIndexId: false. Clustered collections are keyed by _id without an _id_ index and pass.
+// Missing indexes are reported; with REPAIR_INDEXES=true the _id index is created (the server rejects
+// the unique option on _id: the created index is unique anyway)
+// Checks the main database and every database configured with DB_NAME_<FILE TYPE>
+func VerifyIndexes(ctx context.Context) error {
+	if err := requireMongo(); err != nil {
+		return err
+	}
+	repair := parseBoolEnv("REPAIR_INDEXES", false)
+
+	databases := []*mongo.Database{MongoDatabase}
+	seen := map[string]bool{MongoDatabase.Name(): true}
+	for _, name := range MongoDatabaseNames {
+		if !seen[name] {
+			seen[name] = true
+			databases = append(databases, MongoClient.Database(name))
+		}
+	}
+
+	missing := 0
+	for _, db := range databases {
+		specs, err := db.ListCollectionSpecifications(ctx, bson.M{"name": bson.M{"$regex": "^sensor_data_"}})
+		if err != nil {
+			return fmt.Errorf("failed to list collections of %s: %w", db.Name(), err)
+		}
+
+		for _, spec := range specs {
+			if spec.Type == "view" {
+				continue
+			}
+			if _, err := spec.Options.LookupErr("clusteredIndex"); err == nil {
+				GlobalLogger.Debugf("collection %s.%s is clustered on _id", db.Name(), spec.Name)
+				continue
+			}
+			col := db.Collection(spec.Name)
+			ok, err := hasIDIndex(ctx, col)
+			if err != nil {
+				return fmt.Errorf("failed to list indexes of %s.%s: %w", db.Name(), spec.Name, err)
+			}
+			if ok {
+				continue
+			}
+
+			missing++
+			kind := "collection"
+			if capped, ok := spec.Options.Lookup("capped").BooleanOK(); ok && capped {
+				kind = "capped collection"
+			}
+			if !repair {
+				GlobalLogger.Warnf("%s %s.%s is missing the _id index", kind, db.Name(), spec.Name)
+				continue
+			}
+			index := mongo.IndexModel{Keys: bson.D{{Key: "_id", Value: 1}}}
+			if _, err := col.Indexes().CreateOne(ctx, index); err != nil {
+				return fmt.Errorf("failed to create _id index on %s.%s: %w", db.Name(), spec.Name, err)
+			}
+			GlobalLogger.Infof("%s %s.%s: created missing _id index", kind, db.Name(), spec.Name)
+		}
+	}
+
+	GlobalLogger.Infof("Index verification done: %d collection(s) missing the _id index (repair=%v)", missing, repair)
+	return nil
+}
+
+// hasIDIndex checks if a collection has its _id index (named _id_, on {_id: 1})
+func hasIDIndex(ctx context.Context, col *mongo.Collection) (bool, error) {
+	cursor, err := col.Indexes().List(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var index struct {
+			Name string `bson:"name"`
+			Key  bson.D `bson:"key"`
+		}
+		if err := cursor.Decode(&index); err != nil {
+			return false, err
+		}
+		if index.Name == "_id_" || (len(index.Key) == 1 && index.Key[0].Key == "_id") {
+			return true, nil
+		}
+	}
+	return false, cursor.Err()
+}
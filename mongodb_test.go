@@ -0,0 +1,1428 @@
+package loader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestRequireMongo(t *testing.T) {
+	ctx := context.Background()
+	if MongoDatabase != nil {
+		t.Fatal("MongoDatabase is initialized in unit tests")
+	}
+
+	if _, err := FindBoxByDeviceID(ctx, "CR300_19531"); !errors.Is(err, ErrMongoNotConnected) {
+		t.Errorf("FindBoxByDeviceID() error = %v, want ErrMongoNotConnected", err)
+	}
+	if _, err := InsertSensorRecords(ctx, "a.csv", "CR300_19531", &Box{}, []SensorRecord{{"_id": int64(1)}}); !errors.Is(err, ErrMongoNotConnected) {
+		t.Errorf("InsertSensorRecords() error = %v, want ErrMongoNotConnected", err)
+	}
+	if _, err := ProcessKVFileResult(ctx, AmChuaKVFormat(), "HoAmChua_TramTT_20250102_0304.txt", []byte("WA 1.5")); !errors.Is(err, ErrMongoNotConnected) {
+		t.Errorf("ProcessKVFileResult() error = %v, want ErrMongoNotConnected", err)
+	}
+	if err := unknownDevice(ctx, "a.csv", fmt.Errorf("station 1: %w", requireMongo())); !errors.Is(err, ErrMongoNotConnected) {
+		t.Errorf("unknownDevice() error = %v, want ErrMongoNotConnected", err)
+	}
+	if got := classifyError(requireMongo()); got != ErrorTypeMongo {
+		t.Errorf("classifyError(requireMongo()) = %s, want %s", got, ErrorTypeMongo)
+	}
+}
+
+func TestHashCollections(t *testing.T) {
+	ctx := context.Background()
+
+	withConfig(t, func(c *Config) { c.HashCollections = 0 })
+	if got := sensorCollectionName(ctx, "P7IBJJ87"); got != "sensor_data_P7IBJJ87" {
+		t.Errorf("without HASH_COLLECTIONS: got %s, want sensor_data_P7IBJJ87", got)
+	}
+	doc := map[string]interface{}{"_id": int64(1735787045)}
+	applySharedCollectionKey("P7IBJJ87", doc)
+	if doc["_id"] != int64(1735787045) || doc["box_id"] != nil {
+		t.Errorf("without HASH_COLLECTIONS: document changed to %v", doc)
+	}
+
+	withConfig(t, func(c *Config) { c.HashCollections = 8 })
+	name := sensorCollectionName(ctx, "P7IBJJ87")
+	if want := fmt.Sprintf("sensor_data_shared_%d", hashCollectionIndex("P7IBJJ87", 8)); name != want {
+		t.Errorf("got %s, want %s", name, want)
+	}
+	if name != sensorCollectionName(ctx, "P7IBJJ87") {
+		t.Errorf("collection name is not stable")
+	}
+	for _, boxID := range []string{"A", "LPDNWOUM", "YLW16RKW", "RIENVHK4"} {
+		if idx := hashCollectionIndex(boxID, 8); idx >= 8 {
+			t.Errorf("hashCollectionIndex(%s, 8) = %d, out of range", boxID, idx)
+		}
+	}
+
+	applySharedCollectionKey("P7IBJJ87", doc)
+	if doc["box_id"] != "P7IBJJ87" {
+		t.Errorf("box_id = %v, want P7IBJJ87", doc["box_id"])
+	}
+	if ts, err := recordTimestamp(SensorRecord(doc)); err != nil || ts != 1735787045 {
+		t.Errorf("recordTimestamp() = (%d, %v), want 1735787045", ts, err)
+	}
+	if filter := sensorRecordFilter("P7IBJJ87"); filter["box_id"] != "P7IBJJ87" {
+		t.Errorf("sensorRecordFilter() = %v, want the box_id filter", filter)
+	}
+}
+
+func TestOrderedDocument(t *testing.T) {
+	record := map[string]interface{}{"z": 1, "TE": 2.5, "_id": int64(10), "WA": 1.5, "n": 3.0, "ts": "date", "a": 0}
+
+	withConfig(t, func(c *Config) { c.OrderedFields = false })
+	if doc, ok := orderedDocument(record, []string{"WA", "TE"}).(map[string]interface{}); !ok || len(doc) != len(record) {
+		t.Errorf("without ORDERED_FIELDS: got %T, want the record itself", doc)
+	}
+
+	withConfig(t, func(c *Config) { c.OrderedFields = true })
+	doc, ok := orderedDocument(record, []string{"WA", "TE", "missing"}).(bson.D)
+	if !ok {
+		t.Fatalf("got %T, want bson.D", doc)
+	}
+	var keys []string
+	for _, e := range doc {
+		keys = append(keys, e.Key)
+	}
+	want := []string{"_id", "ts", "n", "WA", "TE", "a", "z"}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("field order = %v, want %v", keys, want)
+	}
+}
+
+func TestMongoKeepAlive(t *testing.T) {
+	// Nothing listens on port 1: pings fail without a MongoDB server
+	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI("mongodb://127.0.0.1:1").SetServerSelectionTimeout(50*time.Millisecond))
+	if err != nil {
+		t.Fatalf("mongo.Connect() error = %v", err)
+	}
+	defer client.Disconnect(context.Background())
+
+	logs := captureLogs(t)
+	if mongoKeepAlive(client, 100*time.Millisecond, true) {
+		t.Fatal("mongoKeepAlive() = true without a server")
+	}
+	if !strings.Contains(logs.String(), "keep-alive ping failed") {
+		t.Errorf("first failure not logged:\n%s", logs)
+	}
+	logs.Reset()
+	if mongoKeepAlive(client, 100*time.Millisecond, false) {
+		t.Fatal("mongoKeepAlive() = true without a server")
+	}
+	if logs.Len() != 0 {
+		t.Errorf("failure logged again during the same outage:\n%s", logs)
+	}
+
+	// The keep-alive goroutine pings the given client and is stopped by Shutdown (stopMongoKeepAlive)
+	previous := MongoClient
+	startMongoKeepAlive(client, 10*time.Millisecond)
+	time.Sleep(30 * time.Millisecond)
+	stopMongoKeepAlive()
+	if MongoClient != previous {
+		t.Errorf("keep-alive replaced the shared client")
+	}
+	if mongoKeepAliveStop != nil || mongoKeepAliveDone != nil {
+		t.Errorf("keep-alive not stopped")
+	}
+}
+
+func TestDatabaseFor(t *testing.T) {
+	t.Setenv("DB_NAME_CSV", "stations")
+	t.Setenv("DB_NAME_AMCHUA", "amchua")
+	t.Setenv("DB_NAME_BARIA", "")
+
+	// The client connects lazily: database handles need no server
+	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI("mongodb://127.0.0.1:1"))
+	if err != nil {
+		t.Fatalf("mongo.Connect() error = %v", err)
+	}
+	defer client.Disconnect(context.Background())
+
+	previousClient, previousDatabase, previousNames := MongoClient, MongoDatabase, MongoDatabaseNames
+	t.Cleanup(func() {
+		MongoClient, MongoDatabase, MongoDatabaseNames = previousClient, previousDatabase, previousNames
+	})
+	MongoClient, MongoDatabase, MongoDatabaseNames = client, client.Database("sensors"), loadDatabaseNames()
+
+	tests := []struct {
+		fileType string
+		want     string
+	}{
+		{"csv", "stations"},
+		{"AmChua", "amchua"},
+		{"Baria", "sensors"},
+		{"ndjson", "sensors"},
+	}
+	for _, tt := range tests {
+		if got := databaseFor(tt.fileType).Name(); got != tt.want {
+			t.Errorf("databaseFor(%q) = %s, want %s", tt.fileType, got, tt.want)
+		}
+	}
+}
+
+// withMockMongo points MongoClient and MongoDatabase to the mock deployment of mt for the duration of the test
+// Server replies are queued with mt.AddMockResponses, in the order of the commands sent
+func withMockMongo(mt *mtest.T) {
+	previousClient, previousDatabase, previousNames := MongoClient, MongoDatabase, MongoDatabaseNames
+	MongoClient, MongoDatabase, MongoDatabaseNames = mt.Client, mt.DB, nil
+	mt.Cleanup(func() {
+		MongoClient, MongoDatabase, MongoDatabaseNames = previousClient, previousDatabase, previousNames
+	})
+}
+
+// indexesResponse is the reply to listIndexes with the given index keys
+func indexesResponse(ns string, keys ...string) bson.D {
+	var indexes []bson.D
+	for _, key := range keys {
+		indexes = append(indexes, bson.D{{Key: "name", Value: key + "_1"}, {Key: "key", Value: bson.D{{Key: key, Value: 1}}}})
+	}
+	return mtest.CreateCursorResponse(0, ns, mtest.FirstBatch, indexes...)
+}
+
+// idIndexSpecError validates the indexes of a createIndexes command the way the server does for _id:
+// only the key, name and a few options are accepted, unique and sparse are rejected
+func idIndexSpecError(command bson.Raw) error {
+	indexes, _ := command.Lookup("indexes").Array().Values()
+	for _, index := range indexes {
+		spec := index.Document()
+		elements, _ := spec.Lookup("key").Document().Elements()
+		if len(elements) != 1 || elements[0].Key() != "_id" {
+			continue
+		}
+		for _, option := range []string{"unique", "sparse"} {
+			if _, err := spec.LookupErr(option); err == nil {
+				return fmt.Errorf("(InvalidIndexSpecificationOption) The field '%s' is not valid for an _id index specification", option)
+			}
+		}
+	}
+	return nil
+}
+
+func TestVerifyIndexes(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	collections := mtest.CreateCursorResponse(0, "test.$cmd.listCollections", mtest.FirstBatch,
+		bson.D{{Key: "name", Value: "sensor_data_A"}, {Key: "type", Value: "collection"}, {Key: "options", Value: bson.D{}}},
+		bson.D{{Key: "name", Value: "sensor_data_B"}, {Key: "type", Value: "collection"}, {Key: "options", Value: bson.D{{Key: "capped", Value: true}}}},
+		// Clustered collections have no _id_ index: their indexes are not listed
+		bson.D{{Key: "name", Value: "sensor_data_C"}, {Key: "type", Value: "collection"}, {Key: "options", Value: bson.D{
+			{Key: "clusteredIndex", Value: bson.D{{Key: "key", Value: bson.D{{Key: "_id", Value: 1}}}, {Key: "unique", Value: true}}},
+		}}},
+	)
+	idIndex := mtest.CreateCursorResponse(0, "test.sensor_data_A", mtest.FirstBatch, bson.D{{Key: "v", Value: 2}, {Key: "key", Value: bson.D{{Key: "_id", Value: 1}}}, {Key: "name", Value: "_id_"}})
+
+	mt.Run("report", func(mt *mtest.T) {
+		withMockMongo(mt)
+		mt.Setenv("REPAIR_INDEXES", "false")
+		logs := captureLogs(mt.T)
+		mt.AddMockResponses(collections, idIndex, indexesResponse("test.sensor_data_B", "ts"))
+
+		if err := VerifyIndexes(context.Background()); err != nil {
+			mt.Fatalf("VerifyIndexes() error = %v", err)
+		}
+		if !strings.Contains(logs.String(), "capped collection test.sensor_data_B is missing the _id index") {
+			mt.Errorf("missing index of sensor_data_B not reported:\n%s", logs)
+		}
+		for _, name := range []string{"sensor_data_A", "sensor_data_C"} {
+			if strings.Contains(logs.String(), name+" is missing") {
+				mt.Errorf("%s reported as missing its _id index:\n%s", name, logs)
+			}
+		}
+		if started := mt.GetAllStartedEvents(); len(started) != 3 {
+			mt.Errorf("got %d commands, want 3 (no index listed for the clustered collection, none created)", len(started))
+		}
+	})
+
+	mt.Run("repair", func(mt *mtest.T) {
+		withMockMongo(mt)
+		mt.Setenv("REPAIR_INDEXES", "true")
+		mt.AddMockResponses(collections, idIndex, indexesResponse("test.sensor_data_B"), mtest.CreateSuccessResponse())
+
+		if err := VerifyIndexes(context.Background()); err != nil {
+			mt.Fatalf("VerifyIndexes() error = %v", err)
+		}
+		started := mt.GetAllStartedEvents()
+		if len(started) != 4 || started[3].CommandName != "createIndexes" {
+			mt.Fatalf("got %d commands, want listCollections, 2 listIndexes and createIndexes", len(started))
+		}
+		command := started[3].Command
+		if collection := command.Lookup("createIndexes").StringValue(); collection != "sensor_data_B" {
+			mt.Errorf("index created on %s, want sensor_data_B", collection)
+		}
+		if err := idIndexSpecError(command); err != nil {
+			mt.Errorf("the server rejects the created index: %v", err)
+		}
+	})
+}
+
+func TestIDIndexSpecError(t *testing.T) {
+	// The index VerifyIndexes used to create, rejected by the server
+	command := bson.D{{Key: "createIndexes", Value: "sensor_data_B"}, {Key: "indexes", Value: bson.A{
+		bson.D{{Key: "key", Value: bson.D{{Key: "_id", Value: 1}}}, {Key: "name", Value: "_id_1"}, {Key: "unique", Value: true}},
+	}}}
+	raw, err := bson.Marshal(command)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := idIndexSpecError(raw); err == nil || !strings.Contains(err.Error(), "'unique' is not valid for an _id index") {
+		t.Errorf("idIndexSpecError() = %v, want the server rejection of unique", err)
+	}
+}
+
+func TestFormatBoxID(t *testing.T) {
+	oid, _ := primitive.ObjectIDFromHex("65a1b2c3d4e5f60718293a4b")
+	tests := []struct {
+		id      interface{}
+		want    string
+		wantErr bool
+	}{
+		{"RIENVHK4", "RIENVHK4", false},
+		{oid, "65a1b2c3d4e5f60718293a4b", false},
+		{42, "42", false},
+		{int32(42), "42", false},
+		{int64(1234567890123), "1234567890123", false},
+		{float64(1e7), "10000000", false},
+		{1.5, "", true},
+		{"", "", true},
+		{nil, "", true},
+		{[]byte("x"), "", true},
+	}
+	for _, tt := range tests {
+		got, err := FormatBoxID(tt.id)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("FormatBoxID(%#v) = %q, %v, want %q (error: %v)", tt.id, got, err, tt.want, tt.wantErr)
+		}
+		if err == nil {
+			if err := validateCollectionName("sensor_data_" + got); err != nil {
+				t.Errorf("FormatBoxID(%#v): %v", tt.id, err)
+			}
+		}
+	}
+}
+
+func TestValidateCollectionName(t *testing.T) {
+	tests := []struct {
+		name    string
+		wantErr bool
+	}{
+		{"sensor_data_RIENVHK4", false},
+		{"", true},
+		{"sensor_data_" + strings.Repeat("x", 120), true},
+		{"sensor_data_a$b", true},
+		{"sensor_data_a\x00", true},
+		{"system.sensor_data", true},
+	}
+	for _, tt := range tests {
+		if err := validateCollectionName(tt.name); (err != nil) != tt.wantErr {
+			t.Errorf("validateCollectionName(%q) error = %v, want error: %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestReserveCollectionMaxCollections(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("limit", func(mt *mtest.T) {
+		withMockMongo(mt)
+		withConfig(mt.T, func(c *Config) { c.MaxCollections = 2 })
+		collectionGuard.known, collectionGuard.created = make(map[string]bool), 0
+		mt.Cleanup(func() { collectionGuard.known, collectionGuard.created = make(map[string]bool), 0 })
+
+		listed := func(names ...string) bson.D {
+			var batch []bson.D
+			for _, name := range names {
+				batch = append(batch, bson.D{{Key: "name", Value: name}})
+			}
+			return mtest.CreateCursorResponse(0, "test.$cmd.listCollections", mtest.FirstBatch, batch...)
+		}
+		ctx := context.Background()
+
+		// An existing collection does not count against the limit
+		mt.AddMockResponses(listed("sensor_data_existing"), listed(), listed(), listed())
+		for _, name := range []string{"sensor_data_existing", "sensor_data_A", "sensor_data_B"} {
+			if err := reserveCollection(ctx, mt.DB, name); err != nil {
+				mt.Fatalf("reserveCollection(%s) error = %v", name, err)
+			}
+		}
+		err := reserveCollection(ctx, mt.DB, "sensor_data_C")
+		if err == nil || !strings.Contains(err.Error(), "MAX_COLLECTIONS (2) reached") {
+			mt.Errorf("third new collection: error = %v, want MAX_COLLECTIONS reached", err)
+		}
+
+		// Collections already used are not checked again and stay allowed
+		if err := reserveCollection(ctx, mt.DB, "sensor_data_A"); err != nil {
+			mt.Errorf("reserveCollection(sensor_data_A) again: error = %v", err)
+		}
+		if started := len(mt.GetAllStartedEvents()); started != 4 {
+			mt.Errorf("got %d listCollections commands, want 4", started)
+		}
+	})
+
+	withConfig(t, func(c *Config) { c.MaxCollections = 0 })
+	if err := reserveCollection(context.Background(), nil, "sensor_data_A"); err != nil {
+		t.Errorf("MAX_COLLECTIONS=0: reserveCollection() error = %v", err)
+	}
+}
+
+func TestCorrectRecords(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("upsert", func(mt *mtest.T) {
+		withMockMongo(mt)
+		withConfig(mt.T, func(c *Config) { c.MaxCollections, c.YearlyCollections, c.HashCollections = 0, false, 0 })
+		// The first record exists and is replaced, the second is inserted
+		mt.AddMockResponses(mtest.CreateSuccessResponse(
+			bson.E{Key: "n", Value: 2},
+			bson.E{Key: "nModified", Value: 1},
+			bson.E{Key: "upserted", Value: bson.A{bson.D{{Key: "index", Value: 1}, {Key: "_id", Value: int64(1000000060)}}}},
+		))
+
+		records := []SensorRecord{{"_id": int64(1000000000), "WA": 1.5}, {"_id": int64(1000000060), "WA": 1.6}}
+		corrected, err := CorrectRecords(context.Background(), "RIENVHK4", records)
+		if err != nil {
+			mt.Fatalf("CorrectRecords() error = %v", err)
+		}
+		if corrected != 2 {
+			mt.Errorf("CorrectRecords() = %d, want 2 (1 updated, 1 inserted)", corrected)
+		}
+
+		// A single upsert per record, keyed on _id, without looking up the latest stored record
+		started := mt.GetAllStartedEvents()
+		if len(started) != 1 || started[0].CommandName != "update" {
+			mt.Fatalf("got %d commands, want a single update", len(started))
+		}
+		if collection := started[0].Command.Lookup("update").StringValue(); collection != "sensor_data_RIENVHK4" {
+			mt.Errorf("collection = %s, want sensor_data_RIENVHK4", collection)
+		}
+		updates, _ := started[0].Command.Lookup("updates").Array().Values()
+		if len(updates) != 2 {
+			mt.Fatalf("got %d updates, want 2", len(updates))
+		}
+		for i, update := range updates {
+			doc := update.Document()
+			if !doc.Lookup("upsert").Boolean() || doc.Lookup("q", "_id").Int64() != records[i]["_id"] {
+				mt.Errorf("update %d = %v, want an upsert keyed on _id", i, doc)
+			}
+		}
+	})
+
+	mt.Run("missing _id", func(mt *mtest.T) {
+		withMockMongo(mt)
+		if _, err := CorrectRecords(context.Background(), "RIENVHK4", []SensorRecord{{"WA": 1.5}}); err == nil {
+			mt.Errorf("CorrectRecords() accepted a record without _id")
+		}
+		if started := len(mt.GetAllStartedEvents()); started != 0 {
+			mt.Errorf("got %d commands for an invalid record, want none", started)
+		}
+	})
+}
+
+func TestConnectMongoWithRetry(t *testing.T) {
+	previous := connectMongoFunc
+	t.Cleanup(func() { connectMongoFunc = previous })
+	client := &mongo.Client{}
+
+	var attempts int
+	connectMongoFunc = func(ctx context.Context, dbURL string) (*mongo.Client, error) {
+		attempts++
+		if deadline, ok := ctx.Deadline(); !ok || time.Until(deadline) > 5*time.Second {
+			t.Errorf("attempt %d: deadline not bounded by the startup timeout", attempts)
+		}
+		if attempts == 1 {
+			return nil, errors.New("server selection error")
+		}
+		return client, nil
+	}
+
+	// A failed attempt is retried after the backoff
+	got, err := connectMongoWithRetry("mongodb://db", 5*time.Second, 2)
+	if err != nil || got != client || attempts != 2 {
+		t.Errorf("connectMongoWithRetry() = %v, %v after %d attempts, want the client after 2", got, err, attempts)
+	}
+
+	// Without retries, the first failure is returned
+	attempts = 0
+	if _, err := connectMongoWithRetry("mongodb://db", 5*time.Second, 0); err == nil || attempts != 1 {
+		t.Errorf("MONGO_STARTUP_RETRIES=0: error = %v after %d attempts, want the first failure", err, attempts)
+	}
+}
+
+func TestMongoClientOptionsCompressors(t *testing.T) {
+	previous := mongoCompressors
+	t.Cleanup(func() { mongoCompressors = previous })
+
+	tests := []struct {
+		val  string
+		want []string
+	}{
+		{"", nil},
+		{"snappy,zstd", []string{"snappy", "zstd"}},
+		{" ZLIB , ", []string{"zlib"}},
+	}
+	for _, tt := range tests {
+		mongoCompressors = parseMongoCompressors(tt.val)
+		if got := mongoClientOptions("mongodb://db").Compressors; !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("MONGO_COMPRESSORS=%q: client compressors = %v, want %v", tt.val, got, tt.want)
+		}
+	}
+}
+
+// insertedDocuments returns the documents sent by the insert commands of mt
+func insertedDocuments(mt *mtest.T) []bson.Raw {
+	var docs []bson.Raw
+	for _, event := range mt.GetAllStartedEvents() {
+		if event.CommandName != "insert" {
+			continue
+		}
+		values, _ := event.Command.Lookup("documents").Array().Values()
+		for _, value := range values {
+			docs = append(docs, value.Document())
+		}
+	}
+	return docs
+}
+
+func TestBoxLocation(t *testing.T) {
+	tests := []struct {
+		timezone   string
+		wantOffset int
+		wantNil    bool
+		wantErr    bool
+	}{
+		{"", 0, true, false},
+		{"8", 8 * 3600, false, false},
+		{"-3", -3 * 3600, false, false},
+		{"Asia/Ho_Chi_Minh", 7 * 3600, false, false},
+		{"Mars/Olympus", 0, true, true},
+	}
+	for _, tt := range tests {
+		loc, err := (&Box{Timezone: tt.timezone}).Location()
+		if (err != nil) != tt.wantErr || (loc == nil) != tt.wantNil {
+			t.Errorf("Location(%q) = %v, %v", tt.timezone, loc, err)
+			continue
+		}
+		if loc != nil {
+			if _, offset := time.Date(2025, time.January, 2, 0, 0, 0, 0, loc).Zone(); offset != tt.wantOffset {
+				t.Errorf("Location(%q) offset = %d, want %d", tt.timezone, offset, tt.wantOffset)
+			}
+		}
+	}
+}
+
+func TestInsertSensorRecordsBoxTimezone(t *testing.T) {
+	// 2025-01-02 03:04:05 parsed in TIMEZONE_OFFSET (GMT+7)
+	const parsed = int64(1735761845)
+	tests := []struct {
+		timezone string
+		want     int64
+	}{
+		{"", parsed},
+		{"Asia/Ho_Chi_Minh", parsed},
+		{"8", parsed - 3600},
+		{"-3", parsed + 10*3600},
+		// Invalid timezones keep the parsed timestamps
+		{"Mars/Olympus", parsed},
+	}
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	for _, tt := range tests {
+		mt.Run("timezone "+tt.timezone, func(mt *mtest.T) {
+			withMockMongo(mt)
+			withConfig(mt.T, func(c *Config) { c.TimezoneLocation = time.FixedZone("GMT+7", 7*3600) })
+			mt.AddMockResponses(
+				mtest.CreateCursorResponse(0, "test.sensor_data_RIENVHK4", mtest.FirstBatch),
+				mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+			)
+
+			box := &Box{ID: "RIENVHK4", DeviceID: "CR300_19531", Timezone: tt.timezone}
+			records := []SensorRecord{{"_id": parsed, "WA": 1.5}}
+			if _, err := InsertSensorRecords(context.Background(), "a.csv", "CR300_19531", box, records); err != nil {
+				mt.Fatalf("InsertSensorRecords() error = %v", err)
+			}
+			docs := insertedDocuments(mt)
+			if len(docs) != 1 || docs[0].Lookup("_id").Int64() != tt.want {
+				mt.Errorf("inserted %v, want _id %d", docs, tt.want)
+			}
+		})
+	}
+}
+
+func TestCountNewRecords(t *testing.T) {
+	records := []SensorRecord{{"_id": int64(100)}, {"_id": int64(200)}, {"_id": int64(300)}, {"_id": int64(400)}}
+	tests := []struct {
+		name             string
+		latest           []bson.D
+		wantNew, wantDup int64
+	}{
+		{"empty collection", nil, 4, 0},
+		{"latest in the middle", []bson.D{{{Key: "_id", Value: int64(200)}}}, 2, 2},
+		{"latest after all records", []bson.D{{{Key: "_id", Value: int64(500)}}}, 0, 4},
+	}
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			withMockMongo(mt)
+			mt.AddMockResponses(mtest.CreateCursorResponse(0, "test.sensor_data_RIENVHK4", mtest.FirstBatch, tt.latest...))
+
+			newCount, dupCount, err := CountNewRecords(context.Background(), "RIENVHK4", records)
+			if err != nil || newCount != tt.wantNew || dupCount != tt.wantDup {
+				mt.Errorf("CountNewRecords() = %d, %d, %v, want %d, %d, nil", newCount, dupCount, err, tt.wantNew, tt.wantDup)
+			}
+			if countCommands(mt, "insert") != 0 {
+				mt.Error("CountNewRecords() inserted records")
+			}
+		})
+	}
+
+	mt.Run("not connected", func(mt *mtest.T) {
+		previous := MongoDatabase
+		MongoDatabase = nil
+		defer func() { MongoDatabase = previous }()
+		if _, _, err := CountNewRecords(context.Background(), "RIENVHK4", records); !errors.Is(err, ErrMongoNotConnected) {
+			mt.Errorf("CountNewRecords() error = %v, want ErrMongoNotConnected", err)
+		}
+	})
+}
+
+func TestDeleteRecords(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("range", func(mt *mtest.T) {
+		withMockMongo(mt)
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 3}))
+
+		deleted, err := DeleteRecords(context.Background(), "RIENVHK4", 100, 200)
+		if err != nil || deleted != 3 {
+			mt.Fatalf("DeleteRecords() = %d, %v, want 3, nil", deleted, err)
+		}
+		events := mt.GetAllStartedEvents()
+		if len(events) != 1 || events[0].CommandName != "delete" || events[0].Command.Lookup("delete").StringValue() != "sensor_data_RIENVHK4" {
+			mt.Fatalf("commands = %v, want one delete on sensor_data_RIENVHK4", events)
+		}
+		values, _ := events[0].Command.Lookup("deletes").Array().Values()
+		filter := values[0].Document().Lookup("q", "_id").Document()
+		if filter.Lookup("$gte").Int64() != 100 || filter.Lookup("$lte").Int64() != 200 {
+			mt.Errorf("delete filter = %v, want _id in [100, 200]", values[0].Document())
+		}
+	})
+
+	mt.Run("yearly collections", func(mt *mtest.T) {
+		withMockMongo(mt)
+		withConfig(mt.T, func(c *Config) {
+			c.YearlyCollections = true
+			c.TimezoneLocation = time.UTC
+		})
+		mt.AddMockResponses(
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 2}),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 5}),
+		)
+
+		// 2024-12-31 to 2025-01-01
+		deleted, err := DeleteRecords(context.Background(), "RIENVHK4", 1735603200, 1735700000)
+		if err != nil || deleted != 7 {
+			mt.Fatalf("DeleteRecords() = %d, %v, want 7, nil", deleted, err)
+		}
+		var collections []string
+		for _, event := range mt.GetAllStartedEvents() {
+			collections = append(collections, event.Command.Lookup("delete").StringValue())
+		}
+		if want := []string{"sensor_data_RIENVHK4_2024", "sensor_data_RIENVHK4_2025"}; !reflect.DeepEqual(collections, want) {
+			mt.Errorf("deleted from %v, want %v", collections, want)
+		}
+	})
+
+	mt.Run("bounds are required", func(mt *mtest.T) {
+		withMockMongo(mt)
+		for _, bounds := range [][2]int64{{0, 200}, {100, 0}, {200, 100}} {
+			if _, err := DeleteRecords(context.Background(), "RIENVHK4", bounds[0], bounds[1]); err == nil {
+				mt.Errorf("DeleteRecords(%d, %d) error = nil, want an invalid range", bounds[0], bounds[1])
+			}
+		}
+		if events := mt.GetAllStartedEvents(); len(events) != 0 {
+			mt.Errorf("commands = %v, want none", events)
+		}
+	})
+}
+
+func TestNumericIDFilter(t *testing.T) {
+	number := bson.M{"$type": "number"}
+	tests := []struct {
+		name    string
+		enabled bool
+		shards  int
+		filter  bson.M
+		want    bson.M
+	}{
+		{"disabled", false, 0, bson.M{}, bson.M{}},
+		{"enabled", true, 0, bson.M{}, bson.M{"_id": number}},
+		{"shared collection", true, 4, bson.M{"box_id": "RIENVHK4"}, bson.M{"box_id": "RIENVHK4", "_id.ts": number}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.LatestNumericID = tt.enabled
+				c.HashCollections = tt.shards
+			})
+			original := fmt.Sprint(tt.filter)
+			if got := numericIDFilter(tt.filter); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("numericIDFilter() = %v, want %v", got, tt.want)
+			}
+			if fmt.Sprint(tt.filter) != original {
+				t.Errorf("numericIDFilter() modified its argument: %v", tt.filter)
+			}
+		})
+	}
+}
+
+func TestGetLatestRecordNumericID(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("corrupt _id ignored", func(mt *mtest.T) {
+		withConfig(mt.T, func(c *Config) { c.LatestNumericID = true })
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "test."+mt.Coll.Name(), mtest.FirstBatch, bson.D{{Key: "_id", Value: int64(1735787040)}}))
+
+		latest, err := GetLatestRecord(context.Background(), mt.Coll)
+		if err != nil || latest == nil {
+			mt.Fatalf("GetLatestRecord() = %v, %v", latest, err)
+		}
+		if ts, err := recordTimestamp(*latest); err != nil || ts != 1735787040 {
+			mt.Errorf("latest _id = %d, %v, want 1735787040", ts, err)
+		}
+		find := mt.GetStartedEvent()
+		if find == nil || find.CommandName != "find" {
+			mt.Fatalf("command = %v, want find", find)
+		}
+		if typ := find.Command.Lookup("filter", "_id", "$type").StringValue(); typ != "number" {
+			mt.Errorf("find filter = %v, want _id of type number", find.Command.Lookup("filter"))
+		}
+		if sort := find.Command.Lookup("sort", "_id").AsInt64(); sort != -1 {
+			mt.Errorf("find sort = %v, want _id descending", find.Command.Lookup("sort"))
+		}
+	})
+}
+
+func TestProcessKVFileFanOutCollections(t *testing.T) {
+	format := &KVFormat{
+		Name:            "lake",
+		TimestampSource: KVTimestampSourceFilename,
+		Boxes:           []KVBox{{ID: "RIENVHK4", Metrics: []Metric{{Code: "WA", Name: "water"}, {Code: "TE", Name: "temp"}}}},
+	}
+	tests := []struct {
+		fanOut bool
+		want   []string
+	}{
+		{false, []string{"sensor_data_RIENVHK4"}},
+		{true, []string{"sensor_data_RIENVHK4_WA", "sensor_data_RIENVHK4_TE"}},
+	}
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	for _, tt := range tests {
+		mt.Run(fmt.Sprintf("fan out %v", tt.fanOut), func(mt *mtest.T) {
+			withMockMongo(mt)
+			for range tt.want {
+				mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}))
+			}
+			format.FanOutMetrics = tt.fanOut
+
+			result, err := ProcessKVFileResult(context.Background(), format, "lake/20250102030400.txt", []byte("water 1.5\ntemp 21.5\n"))
+			if err != nil || result.Inserted != int64(len(tt.want)) || result.MetricsWritten != 2 {
+				mt.Fatalf("ProcessKVFileResult() = %+v, %v, want %d documents with 2 metric values", result, err, len(tt.want))
+			}
+			var collections []string
+			for _, event := range mt.GetAllStartedEvents() {
+				if event.CommandName == "insert" {
+					collections = append(collections, event.Command.Lookup("insert").StringValue())
+				}
+			}
+			if !reflect.DeepEqual(collections, tt.want) {
+				mt.Errorf("inserted into %v, want %v", collections, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewestRecordTimestamp(t *testing.T) {
+	records := []SensorRecord{
+		{"_id": int64(200)},
+		{"_id": "corrupt"},
+		{"_id": bson.D{{Key: "box_id", Value: "RIENVHK4"}, {Key: "ts", Value: int64(300)}}},
+		{"_id": int64(100)},
+	}
+	if got := newestRecordTimestamp(records); got != 300 {
+		t.Errorf("newestRecordTimestamp() = %d, want 300", got)
+	}
+	if got := newestRecordTimestamp(nil); got != 0 {
+		t.Errorf("newestRecordTimestamp(nil) = %d, want 0", got)
+	}
+}
+
+func TestInsertBoxRecordsLastSeen(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	for _, enabled := range []bool{true, false} {
+		mt.Run(fmt.Sprintf("UPDATE_LAST_SEEN=%v", enabled), func(mt *mtest.T) {
+			withMockMongo(mt)
+			withConfig(mt.T, func(c *Config) { c.UpdateLastSeen = enabled })
+			mt.AddMockResponses(
+				mtest.CreateCursorResponse(0, "test.sensor_data_RIENVHK4", mtest.FirstBatch),
+				mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 2}),
+				mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}, bson.E{Key: "nModified", Value: 1}),
+			)
+
+			box := &Box{ID: "RIENVHK4", DeviceID: "CR300_19531"}
+			records := []SensorRecord{{"_id": int64(1735761845), "WA": 1.5}, {"_id": int64(1735761905), "WA": 1.6}}
+			if _, err := insertBoxRecords(context.Background(), "a.csv", "CR300_19531", box, records, []string{"WA"}); err != nil {
+				mt.Fatalf("insertBoxRecords() error = %v", err)
+			}
+
+			var update bson.Raw
+			for _, event := range mt.GetAllStartedEvents() {
+				if event.CommandName == "update" {
+					update = event.Command
+				}
+			}
+			if !enabled {
+				if update != nil {
+					mt.Errorf("box updated with UPDATE_LAST_SEEN disabled: %v", update)
+				}
+				return
+			}
+			if update == nil || update.Lookup("update").StringValue() != "box" {
+				mt.Fatalf("update = %v, want an update of the box collection", update)
+			}
+			values, _ := update.Lookup("updates").Array().Values()
+			statement := values[0].Document()
+			if statement.Lookup("q", "_id").StringValue() != "RIENVHK4" || statement.Lookup("u", "$max", "last_seen").Int64() != 1735761905 {
+				mt.Errorf("update statement = %v, want $max last_seen 1735761905 on box RIENVHK4", statement)
+			}
+		})
+	}
+}
+
+// boxResponse is the reply to a box lookup by device ID
+func boxResponse(boxID string, deviceID string) bson.D {
+	return mtest.CreateCursorResponse(0, "test.box", mtest.FirstBatch, bson.D{{Key: "_id", Value: boxID}, {Key: "device_id", Value: deviceID}})
+}
+
+func TestProcessReaderStoreFileType(t *testing.T) {
+	tests := []struct {
+		fileType  string
+		filename  string
+		content   []byte
+		responses []bson.D
+	}{
+		{
+			FileTypeCSV, "CR300_19531_Table1.csv", toa5CSV(`"TIMESTAMP","RECORD","water"`, `"2025-01-02 03:04:05",1,1.5`),
+			[]bson.D{
+				boxResponse("RIENVHK4", "CR300_19531"),
+				mtest.CreateCursorResponse(0, "test.sensor_data_RIENVHK4", mtest.FirstBatch),
+				mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+			},
+		},
+		{
+			FileTypeAmChua, "HoAmChua_TramTT/20251129190000.txt", []byte("rain_1 1.5\n"),
+			slices.Repeat([]bson.D{mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1})}, len(AmChuaBoxes)),
+		},
+		{
+			FileTypeBaria, "HoSongRay_KenhSongRay/MNK_SongRay_20251227200009.txt", []byte("MNK_SongRay\t12.5\n"),
+			[]bson.D{mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1})},
+		},
+	}
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	for _, tt := range tests {
+		for _, enabled := range []bool{true, false} {
+			mt.Run(fmt.Sprintf("%s STORE_FILE_TYPE=%v", tt.fileType, enabled), func(mt *mtest.T) {
+				withMockMongo(mt)
+				withConfig(mt.T, func(c *Config) { c.StoreFileType = enabled })
+				mt.AddMockResponses(tt.responses...)
+
+				if _, err := ProcessReader(context.Background(), tt.filename, bytes.NewReader(tt.content)); err != nil {
+					mt.Fatalf("ProcessReader() error = %v", err)
+				}
+				docs := insertedDocuments(mt)
+				if len(docs) == 0 {
+					mt.Fatal("no document inserted")
+				}
+				for _, doc := range docs {
+					ft, err := doc.LookupErr("ft")
+					if enabled && (err != nil || ft.StringValue() != tt.fileType) {
+						mt.Errorf("document %v: want ft %q", doc, tt.fileType)
+					}
+					if !enabled && err == nil {
+						mt.Errorf("document %v: want no ft", doc)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestProcessKVFileMinValidLines(t *testing.T) {
+	format := &KVFormat{
+		Name:            "lake",
+		Delimiter:       "\t",
+		TimestampSource: KVTimestampSourceFilename,
+		Boxes:           []KVBox{{ID: "RIENVHK4", Metrics: []Metric{{Code: "WA", Name: "water"}, {Code: "TE", Name: "temp"}}}},
+	}
+	// Mostly blank: one valid line, two skipped lines
+	content := []byte("\n\nwater\t1.5\n\ntemp\n\t\nbroken line\n\n")
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("below threshold", func(mt *mtest.T) {
+		withMockMongo(mt)
+		withConfig(mt.T, func(c *Config) { c.KVMinValidLines = 2 })
+		logs := captureLogs(mt.T)
+
+		_, err := ProcessKVFileResult(context.Background(), format, "lake/20250102030400.txt", content)
+		var parseErr *ParseError
+		if !errors.As(err, &parseErr) || !strings.Contains(err.Error(), "only 1 valid lake lines, below KV_MIN_VALID_LINES (2)") {
+			mt.Errorf("ProcessKVFileResult() error = %v, want a KV_MIN_VALID_LINES ParseError", err)
+		}
+		if !strings.Contains(logs.String(), "skipped 2 of 3 lake lines") {
+			mt.Errorf("skipped lines not summarized:\n%s", logs)
+		}
+		if events := mt.GetAllStartedEvents(); len(events) != 0 {
+			mt.Errorf("commands = %v, want nothing stored", events)
+		}
+	})
+
+	mt.Run("at threshold", func(mt *mtest.T) {
+		withMockMongo(mt)
+		withConfig(mt.T, func(c *Config) { c.KVMinValidLines = 1 })
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}))
+
+		result, err := ProcessKVFileResult(context.Background(), format, "lake/20250102030400.txt", content)
+		if err != nil || result.Inserted != 1 {
+			mt.Errorf("ProcessKVFileResult() = %+v, %v, want 1 document", result, err)
+		}
+	})
+}
+
+func TestProcessKVFileMinMetrics(t *testing.T) {
+	format := &KVFormat{
+		Name:            "lake",
+		Delimiter:       "\t",
+		TimestampSource: KVTimestampSourceFilename,
+		Boxes: []KVBox{
+			{ID: "RIENVHK4", Metrics: []Metric{{Code: "WA", Name: "water"}, {Code: "TE", Name: "temp"}}},
+			{ID: "BOXBBBBB", Metrics: []Metric{{Code: "WA", Name: "water"}}},
+		},
+	}
+	// Parses, but none of the values are box metrics
+	garbage := []byte("foo\t1\nbar\t2\n")
+
+	if got := populatedMetrics(format.Boxes, map[string]float64{"water": 1, "foo": 2}); got != 1 {
+		t.Errorf("populatedMetrics() = %d, want 1 (water counted once)", got)
+	}
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	for _, tt := range []struct {
+		name    string
+		content []byte
+	}{
+		{"garbage", garbage},
+		{"empty", nil},
+	} {
+		// Without KV_MIN_METRICS too: a file without any box metric always fails
+		mt.Run(tt.name, func(mt *mtest.T) {
+			withMockMongo(mt)
+			logs := captureLogs(mt.T)
+
+			_, err := ProcessKVFileResult(context.Background(), format, "lake/20250102030400.txt", tt.content)
+			var parseErr *ParseError
+			if !errors.As(err, &parseErr) || !strings.Contains(err.Error(), "no box metrics found") {
+				mt.Errorf("ProcessKVFileResult() error = %v, want a ParseError", err)
+			}
+			if !strings.Contains(logs.String(), "not storing") {
+				mt.Errorf("skipped file not logged:\n%s", logs)
+			}
+			if events := mt.GetAllStartedEvents(); len(events) != 0 {
+				mt.Errorf("commands = %v, want no zero documents stored", events)
+			}
+		})
+	}
+
+	mt.Run("below KV_MIN_METRICS", func(mt *mtest.T) {
+		withMockMongo(mt)
+		withConfig(mt.T, func(c *Config) { c.KVMinMetrics = 2 })
+		_, err := ProcessKVFileResult(context.Background(), format, "lake/20250102030400.txt", []byte("water\t1.5\n"))
+		var parseErr *ParseError
+		if !errors.As(err, &parseErr) || !strings.Contains(err.Error(), "only 1 box metrics found, below KV_MIN_METRICS (2)") {
+			mt.Errorf("ProcessKVFileResult() error = %v, want a KV_MIN_METRICS ParseError", err)
+		}
+		if events := mt.GetAllStartedEvents(); len(events) != 0 {
+			mt.Errorf("commands = %v, want nothing stored", events)
+		}
+	})
+
+	mt.Run("enough metrics", func(mt *mtest.T) {
+		withMockMongo(mt)
+		withConfig(mt.T, func(c *Config) { c.KVMinMetrics = 1 })
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}), mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}))
+		result, err := ProcessKVFileResult(context.Background(), format, "lake/20250102030400.txt", []byte("water\t1.5\n"))
+		if err != nil || result.Inserted != 2 {
+			mt.Errorf("ProcessKVFileResult() = %+v, %v, want one document per box", result, err)
+		}
+	})
+}
+
+func TestProcessKVFileDuplicatePolicy(t *testing.T) {
+	format := &KVFormat{
+		Name:            "lake",
+		Delimiter:       "\t",
+		TimestampSource: KVTimestampSourceFilename,
+		Boxes:           []KVBox{{ID: "RIENVHK4", Metrics: []Metric{{Code: "WA", Name: "water"}}}},
+	}
+	duplicate := mtest.CreateWriteErrorsResponse(mtest.WriteError{Index: 0, Code: 11000, Message: "E11000 duplicate key error"})
+	tests := []struct {
+		policy       string
+		wantInserted int64
+		wantSkipped  int64
+		wantErr      bool
+		wantCommands []string
+	}{
+		{KVDuplicateSkip, 0, 1, false, []string{"insert"}},
+		{KVDuplicateUpsert, 1, 0, false, []string{"insert", "update"}},
+		{KVDuplicateError, 0, 1, true, []string{"insert"}},
+	}
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	for _, tt := range tests {
+		mt.Run(tt.policy, func(mt *mtest.T) {
+			withMockMongo(mt)
+			withConfig(mt.T, func(c *Config) { c.KVDuplicatePolicy = tt.policy })
+			mt.AddMockResponses(duplicate, mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}, bson.E{Key: "nModified", Value: 1}))
+
+			result, err := ProcessKVFileResult(context.Background(), format, "lake/20250102030400.txt", []byte("water\t1.5\n"))
+			if (err != nil) != tt.wantErr || result.Inserted != tt.wantInserted || result.Skipped != tt.wantSkipped {
+				mt.Errorf("ProcessKVFileResult() = %+v, %v, want %d inserted, %d skipped, error %v", result, err, tt.wantInserted, tt.wantSkipped, tt.wantErr)
+			}
+			if tt.wantErr && !strings.Contains(err.Error(), "KV_DUPLICATE_POLICY=error") {
+				mt.Errorf("error = %v, want the duplicate policy", err)
+			}
+
+			var commands []string
+			for _, event := range mt.GetAllStartedEvents() {
+				commands = append(commands, event.CommandName)
+			}
+			if !slices.Equal(commands, tt.wantCommands) {
+				mt.Fatalf("commands = %v, want %v", commands, tt.wantCommands)
+			}
+			if tt.policy == KVDuplicateUpsert {
+				update := mt.GetAllStartedEvents()[1].Command.Lookup("updates").Array().Index(0).Value().Document()
+				if !update.Lookup("upsert").Boolean() || update.Lookup("u", "WA").Double() != 1.5 {
+					mt.Errorf("replacement = %v, want an upsert of the new document", update)
+				}
+			}
+		})
+	}
+}
+
+func TestProcessKVFileWithoutConfig(t *testing.T) {
+	format := &KVFormat{
+		Name:            "lake",
+		Delimiter:       "\t",
+		TimestampSource: KVTimestampSourceFilename,
+		Boxes:           []KVBox{{ID: "RIENVHK4", Metrics: []Metric{{Code: "WA", Name: "water"}}}},
+	}
+	content := []byte("water\t1.5\n")
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("before InitConfig", func(mt *mtest.T) {
+		withMockMongo(mt)
+		previous := GlobalConfig
+		GlobalConfig = nil
+		mt.Cleanup(func() { GlobalConfig = previous })
+		duplicate := mtest.CreateWriteErrorsResponse(mtest.WriteError{Index: 0, Code: 11000, Message: "E11000 duplicate key error"})
+		mt.AddMockResponses(duplicate)
+
+		// Defaults apply: the duplicate is skipped
+		result, err := ProcessKVFileResult(context.Background(), format, "lake/20250102030400.txt", content)
+		if err != nil || result.Skipped != 1 {
+			mt.Errorf("ProcessKVFileResult() = %+v, %v, want the duplicate skipped", result, err)
+		}
+	})
+}
+
+func TestRecordsByCollectionYearly(t *testing.T) {
+	gmt7 := time.FixedZone("GMT+7", 7*3600)
+	lastOf2024 := time.Date(2024, time.December, 31, 23, 30, 0, 0, gmt7).Unix()
+	firstOf2025 := time.Date(2025, time.January, 1, 0, 30, 0, 0, gmt7).Unix()
+	records := []SensorRecord{{"_id": lastOf2024}, {"_id": firstOf2025}, {"_id": lastOf2024 + 60}}
+
+	withConfig(t, func(c *Config) { c.TimezoneLocation = gmt7 })
+	names, groups := recordsByCollection(context.Background(), "RIENVHK4", records)
+	if len(names) != 1 || names[0] != "sensor_data_RIENVHK4" || len(groups[names[0]]) != 3 {
+		t.Errorf("single collection: recordsByCollection() = %v, %v", names, groups)
+	}
+
+	// The year is read in TIMEZONE_OFFSET: 2024-12-31 23:30 GMT+7 is 16:30 UTC
+	withConfig(t, func(c *Config) { c.YearlyCollections = true })
+	names, groups = recordsByCollection(context.Background(), "RIENVHK4", records)
+	if want := []string{"sensor_data_RIENVHK4_2024", "sensor_data_RIENVHK4_2025"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("yearly collections = %v, want %v", names, want)
+	}
+	if len(groups["sensor_data_RIENVHK4_2024"]) != 2 || len(groups["sensor_data_RIENVHK4_2025"]) != 1 {
+		t.Errorf("yearly groups = %v", groups)
+	}
+
+	// A record with an invalid _id goes to the collection of the current year of the clock
+	withNow(t, time.Date(2023, time.June, 1, 0, 0, 0, 0, gmt7))
+	names, _ = recordsByCollection(context.Background(), "RIENVHK4", []SensorRecord{{"_id": "bad"}})
+	if want := []string{"sensor_data_RIENVHK4_2023"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("invalid _id collection = %v, want %v", names, want)
+	}
+}
+
+func TestInsertSensorRecordsYearly(t *testing.T) {
+	gmt7 := time.FixedZone("GMT+7", 7*3600)
+	lastOf2024 := time.Date(2024, time.December, 31, 23, 30, 0, 0, gmt7).Unix()
+	firstOf2025 := time.Date(2025, time.January, 1, 0, 30, 0, 0, gmt7).Unix()
+	records := []SensorRecord{{"_id": lastOf2024, "WA": 1.0}, {"_id": firstOf2025, "WA": 2.0}, {"_id": firstOf2025 + 3600, "WA": 3.0}}
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("new year boundary", func(mt *mtest.T) {
+		withMockMongo(mt)
+		withConfig(mt.T, func(c *Config) {
+			c.YearlyCollections = true
+			c.TimezoneLocation = gmt7
+		})
+		mt.AddMockResponses(
+			// 2024: empty collection
+			mtest.CreateCursorResponse(0, "test.sensor_data_RIENVHK4_2024", mtest.FirstBatch),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+			// 2025: the first record of the year is already stored
+			mtest.CreateCursorResponse(0, "test.sensor_data_RIENVHK4_2025", mtest.FirstBatch, bson.D{{Key: "_id", Value: firstOf2025}}),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+		)
+
+		box := &Box{ID: "RIENVHK4", DeviceID: "CR300_19531"}
+		inserted, err := InsertSensorRecords(context.Background(), "a.csv", "CR300_19531", box, records)
+		if err != nil || inserted != 2 {
+			mt.Fatalf("InsertSensorRecords() = %d, %v, want 2, nil", inserted, err)
+		}
+		var commands []string
+		for _, event := range mt.GetAllStartedEvents() {
+			commands = append(commands, event.CommandName+" "+event.Command.Lookup(event.CommandName).StringValue())
+		}
+		want := []string{
+			"find sensor_data_RIENVHK4_2024", "insert sensor_data_RIENVHK4_2024",
+			"find sensor_data_RIENVHK4_2025", "insert sensor_data_RIENVHK4_2025",
+		}
+		if !reflect.DeepEqual(commands, want) {
+			mt.Errorf("commands = %v, want %v", commands, want)
+		}
+		docs := insertedDocuments(mt)
+		if len(docs) != 2 || docs[0].Lookup("_id").Int64() != lastOf2024 || docs[1].Lookup("_id").Int64() != firstOf2025+3600 {
+			mt.Errorf("inserted %v, want the 2024 record and the new 2025 record", docs)
+		}
+	})
+}
+
+func TestProcessReaderStationToBox(t *testing.T) {
+	content := toa5CSV(`"TIMESTAMP","RECORD","Station","water"`,
+		`"2025-01-02 03:04:05",1,"STA_A",1.5`,
+		`"2025-01-02 03:04:05",2,"STA_B",2.5`,
+		`"2025-01-02 03:05:05",3,"STA_A",1.6`,
+		`"2025-01-02 03:05:05",4,"STA_X",9.9`,
+	)
+	stationResponses := func(boxID string, inserted int) []bson.D {
+		return []bson.D{
+			mtest.CreateCursorResponse(0, "test.box", mtest.FirstBatch, bson.D{{Key: "_id", Value: boxID}}),
+			mtest.CreateCursorResponse(0, "test.sensor_data_"+boxID, mtest.FirstBatch),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: inserted}),
+		}
+	}
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("unmapped station skipped", func(mt *mtest.T) {
+		withMockMongo(mt)
+		withConfig(mt.T, func(c *Config) {
+			c.StationColumn = "Station"
+			c.StationToBox = map[string]string{"STA_A": "BOXAAAAA", "STA_B": "BOXBBBBB"}
+			c.UnknownDevicePolicy = UnknownDeviceSkip
+		})
+		mt.AddMockResponses(append(stationResponses("BOXAAAAA", 2), stationResponses("BOXBBBBB", 1)...)...)
+
+		result, err := ProcessReader(context.Background(), "consolidated.csv", bytes.NewReader(content))
+		if err != nil || result.DeviceID != "BOXAAAAA,BOXBBBBB" || result.Inserted != 3 || result.Skipped != 1 {
+			mt.Fatalf("ProcessReader() = %+v, %v, want 3 records into BOXAAAAA,BOXBBBBB and 1 skipped", result, err)
+		}
+		inserts := make(map[string][]float64)
+		for _, event := range mt.GetAllStartedEvents() {
+			if event.CommandName != "insert" {
+				continue
+			}
+			values, _ := event.Command.Lookup("documents").Array().Values()
+			for _, value := range values {
+				doc := value.Document()
+				if _, err := doc.LookupErr("Station"); err == nil {
+					mt.Errorf("station column stored: %v", doc)
+				}
+				collection := event.Command.Lookup("insert").StringValue()
+				inserts[collection] = append(inserts[collection], doc.Lookup("WA").Double())
+			}
+		}
+		want := map[string][]float64{"sensor_data_BOXAAAAA": {1.5, 1.6}, "sensor_data_BOXBBBBB": {2.5}}
+		if !reflect.DeepEqual(inserts, want) {
+			mt.Errorf("inserted %v, want %v", inserts, want)
+		}
+	})
+
+	mt.Run("unmapped station fails", func(mt *mtest.T) {
+		withMockMongo(mt)
+		withConfig(mt.T, func(c *Config) {
+			c.StationColumn = "Station"
+			c.StationToBox = map[string]string{"STA_A": "BOXAAAAA", "STA_B": "BOXBBBBB"}
+			c.UnknownDevicePolicy = UnknownDeviceFail
+		})
+		mt.AddMockResponses(append(stationResponses("BOXAAAAA", 2), stationResponses("BOXBBBBB", 1)...)...)
+
+		if _, err := ProcessReader(context.Background(), "consolidated.csv", bytes.NewReader(content)); err == nil || !strings.Contains(err.Error(), `station "STA_X" has no STATION_TO_BOX entry`) {
+			mt.Errorf("ProcessReader() error = %v, want the unmapped station", err)
+		}
+	})
+}
+
+func TestProcessReaderBoxEnrichFields(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("enrich", func(mt *mtest.T) {
+		withMockMongo(mt)
+		withConfig(mt.T, func(c *Config) { c.BoxEnrichFields = []string{"lat", "lon", "name", "elevation", "WA"} })
+		box := bson.D{
+			{Key: "_id", Value: "RIENVHK4"}, {Key: "device_id", Value: "CR300_19531"},
+			{Key: "lat", Value: 10.5}, {Key: "lon", Value: 106.25}, {Key: "name", Value: "Ho Am Chua"},
+			{Key: "owner", Value: "ops"}, {Key: "WA", Value: -1.0},
+		}
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "test.box", mtest.FirstBatch, box),
+			mtest.CreateCursorResponse(0, "test.sensor_data_RIENVHK4", mtest.FirstBatch),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 2}),
+		)
+
+		content := toa5CSV(`"TIMESTAMP","RECORD","water"`, `"2025-01-02 03:04:05",1,1.5`, `"2025-01-02 03:05:05",2,1.6`)
+		if _, err := ProcessReader(context.Background(), "CR300_19531_Table1.csv", bytes.NewReader(content)); err != nil {
+			mt.Fatalf("ProcessReader() error = %v", err)
+		}
+		docs := insertedDocuments(mt)
+		if len(docs) != 2 {
+			mt.Fatalf("inserted %d documents, want 2", len(docs))
+		}
+		for _, doc := range docs {
+			if doc.Lookup("lat").Double() != 10.5 || doc.Lookup("lon").Double() != 106.25 || doc.Lookup("name").StringValue() != "Ho Am Chua" {
+				mt.Errorf("document %v: want the box lat, lon and name", doc)
+			}
+			// Readings win over box fields, unlisted and missing fields are not copied
+			if doc.Lookup("WA").Double() < 0 {
+				mt.Errorf("document %v: reading overwritten by the box field", doc)
+			}
+			for _, field := range []string{"owner", "elevation", "device_id"} {
+				if _, err := doc.LookupErr(field); err == nil {
+					mt.Errorf("document %v: unexpected %s", doc, field)
+				}
+			}
+		}
+	})
+}
+
+func TestCreateBox(t *testing.T) {
+	withNow(t, time.Unix(1735786800, 0))
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("template", func(mt *mtest.T) {
+		withMockMongo(mt)
+		withConfig(mt.T, func(c *Config) {
+			// _id and device_id can't be overridden by the template
+			c.BoxTemplate = map[string]interface{}{"name": "unnamed", "_id": "fixed", "device_id": "other"}
+		})
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "value", Value: bson.D{
+			{Key: "_id", Value: "BOXAAAAA"},
+			{Key: "device_id", Value: "RIENVHK4"},
+			{Key: "name", Value: "unnamed"},
+			{Key: "auto_created", Value: true},
+		}}))
+
+		box, err := CreateBox(context.Background(), "RIENVHK4")
+		if err != nil {
+			mt.Fatalf("CreateBox() error = %v", err)
+		}
+		if box.DeviceID != "RIENVHK4" || box.Metadata["name"] != "unnamed" {
+			mt.Errorf("CreateBox() = %+v", box)
+		}
+
+		command := mt.GetStartedEvent().Command
+		if deviceID := command.Lookup("query", "device_id").StringValue(); deviceID != "RIENVHK4" {
+			mt.Errorf("box created for device_id %s", deviceID)
+		}
+		if !command.Lookup("upsert").Boolean() {
+			mt.Errorf("box creation is not an upsert")
+		}
+		doc := command.Lookup("update", "$setOnInsert").Document()
+		if name := doc.Lookup("name").StringValue(); name != "unnamed" {
+			mt.Errorf("name = %s, want the template value", name)
+		}
+		if !doc.Lookup("auto_created").Boolean() {
+			mt.Errorf("auto_created not set")
+		}
+		if created := doc.Lookup("created").Int64(); created != 1735786800 {
+			mt.Errorf("created = %d, want 1735786800", created)
+		}
+		for _, key := range []string{"_id", "device_id"} {
+			if _, err := doc.LookupErr(key); err == nil {
+				mt.Errorf("template field %s copied into the box document", key)
+			}
+		}
+	})
+}
+
+func TestInsertIgnoreDuplicateBatchResults(t *testing.T) {
+	records := make([]SensorRecord, BATCH_SIZE+76)
+	for i := range records {
+		records[i] = SensorRecord{"_id": int64(i), "WA": 1.0}
+	}
+	responses := func(mt *mtest.T) {
+		mt.AddMockResponses(
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: BATCH_SIZE}),
+			mtest.CreateWriteErrorsResponse(
+				mtest.WriteError{Index: 0, Code: 11000, Message: "E11000 duplicate key error"},
+				mtest.WriteError{Index: 5, Code: 121, Message: "Document failed validation"},
+			),
+		)
+	}
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("logged", func(mt *mtest.T) {
+		withMockMongo(mt)
+		withConfig(mt.T, func(c *Config) { c.LogBatchResults = true })
+		responses(mt)
+		logs := captureLogs(mt.T)
+
+		// A batch with a duplicate key error still counts as 0 inserted records and no error
+		inserted, err := InsertIgnoreDuplicate(context.Background(), mt.Coll, records)
+		if err != nil || inserted != int64(BATCH_SIZE) {
+			mt.Errorf("InsertIgnoreDuplicate() = %d, %v, want %d", inserted, err, BATCH_SIZE)
+		}
+		var lines []string
+		for _, line := range strings.Split(logs.String(), "\n") {
+			if strings.Contains(line, ": batch ") {
+				lines = append(lines, line)
+			}
+		}
+		want := []string{
+			fmt.Sprintf("batch 1/2 size: %d, inserted: %d, duplicates: 0, errors: 0", BATCH_SIZE, BATCH_SIZE),
+			"batch 2/2 size: 76, inserted: 74, duplicates: 1, errors: 1",
+		}
+		if len(lines) != len(want) {
+			mt.Fatalf("got %d batch log lines, want %d:\n%s", len(lines), len(want), logs)
+		}
+		for i := range want {
+			if !strings.Contains(lines[i], mt.Coll.Name()+": "+want[i]) {
+				mt.Errorf("batch log line %d = %q, want %q", i+1, lines[i], want[i])
+			}
+		}
+	})
+
+	mt.Run("disabled", func(mt *mtest.T) {
+		withMockMongo(mt)
+		withConfig(mt.T, func(c *Config) { c.LogBatchResults = false })
+		responses(mt)
+		logs := captureLogs(mt.T)
+		InsertIgnoreDuplicate(context.Background(), mt.Coll, records)
+		if strings.Contains(logs.String(), ": batch ") {
+			mt.Errorf("batch results logged with LOG_BATCH_RESULTS=false:\n%s", logs)
+		}
+	})
+}
+
+// progressLines returns the PROGRESS_EVERY lines of the logs
+func progressLines(logs *bytes.Buffer) []string {
+	var lines []string
+	for _, line := range strings.Split(logs.String(), "\n") {
+		if _, progress, found := strings.Cut(line, "file upload/a.csv: progress: "); found {
+			lines = append(lines, progress)
+		}
+	}
+	return lines
+}
+
+func TestReportInsertProgress(t *testing.T) {
+	withConfig(t, func(c *Config) { c.ProgressEvery = 100 })
+	logs := captureLogs(t)
+	ctx := withInsertProgress(context.Background(), "upload/a.csv")
+	for _, inserted := range []int64{60, 60, 0, 60, 200} {
+		reportInsertProgress(ctx, inserted)
+	}
+	want := []string{"120 records inserted", "380 records inserted"}
+	if got := progressLines(logs); !slices.Equal(got, want) {
+		t.Errorf("progress lines = %q, want %q", got, want)
+	}
+
+	// Disabled: the context carries no progress
+	withConfig(t, func(c *Config) { c.ProgressEvery = 0 })
+	logs.Reset()
+	ctx = withInsertProgress(context.Background(), "upload/a.csv")
+	reportInsertProgress(ctx, 500)
+	if got := progressLines(logs); len(got) != 0 {
+		t.Errorf("progress lines with PROGRESS_EVERY=0 = %q, want none", got)
+	}
+}
+
+func TestInsertIgnoreDuplicateProgress(t *testing.T) {
+	records := make([]SensorRecord, BATCH_SIZE+76)
+	for i := range records {
+		records[i] = SensorRecord{"_id": int64(i), "WA": 1.0}
+	}
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("batches", func(mt *mtest.T) {
+		withMockMongo(mt)
+		withConfig(mt.T, func(c *Config) { c.ProgressEvery = 1000 })
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: BATCH_SIZE}), mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 76}))
+		logs := captureLogs(mt.T)
+
+		ctx := withInsertProgress(context.Background(), "upload/a.csv")
+		if _, err := InsertIgnoreDuplicate(ctx, mt.Coll, records); err != nil {
+			mt.Fatalf("InsertIgnoreDuplicate() error = %v", err)
+		}
+		want := []string{fmt.Sprintf("%d records inserted", BATCH_SIZE)}
+		if got := progressLines(logs); !slices.Equal(got, want) {
+			mt.Errorf("progress lines = %q, want %q", got, want)
+		}
+	})
+}
+
+func TestProcessReaderDeviceIDAliases(t *testing.T) {
+	content := toa5CSV(`"TIMESTAMP","RECORD","water"`, `"2025-01-02 03:04:05",1,1.5`)
+	tests := []struct {
+		name       string
+		aliases    map[string]string
+		wantDevice string
+	}{
+		{"aliased", map[string]string{"CR300_19531": "CR300_00001"}, "CR300_00001"},
+		{"not aliased", map[string]string{"CR1000_7": "CR1000X_7"}, "CR300_19531"},
+	}
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			withMockMongo(mt)
+			withConfig(mt.T, func(c *Config) { c.DeviceIDAliases = tt.aliases })
+			mt.AddMockResponses(
+				boxResponse("RIENVHK4", tt.wantDevice),
+				mtest.CreateCursorResponse(0, "test.sensor_data_RIENVHK4", mtest.FirstBatch),
+				mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+			)
+
+			result, err := ProcessReader(context.Background(), "CR300_19531_Table1.csv", bytes.NewReader(content))
+			if err != nil || result.DeviceID != tt.wantDevice || result.Inserted != 1 {
+				mt.Fatalf("ProcessReader() = %+v, %v, want 1 record of %s", result, err, tt.wantDevice)
+			}
+			lookup := mt.GetAllStartedEvents()[0]
+			if got := lookup.Command.Lookup("filter", "device_id").StringValue(); lookup.CommandName != "find" || got != tt.wantDevice {
+				mt.Errorf("box looked up for device_id %s, want %s", got, tt.wantDevice)
+			}
+		})
+	}
+}
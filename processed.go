@@ -0,0 +1,77 @@
+package loader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ProcessedFilesCollection is the collection indexing the file generations already processed
+const ProcessedFilesCollection = "processed_files"
+
+// ProcessedFile is the index document of a processed file generation
+type ProcessedFile struct {
+	ID         string `bson:"_id"`
+	Bucket     string `bson:"bucket"`
+	File       string `bson:"file"`
+	Generation int64  `bson:"generation"`
+	FileType   string `bson:"file_type"`
+	Inserted   int64  `bson:"inserted"`
+	Processed  int64  `bson:"processed"`
+}
+
+// processedIndexEnabled checks if processed file generations are skipped (SKIP_PROCESSED_FILES)
+func processedIndexEnabled() bool {
+	return GlobalConfig != nil && GlobalConfig.SkipProcessedFiles && MongoDatabase != nil
+}
+
+// processedKey returns the processed index document ID of a file generation
+func processedKey(bucket string, filename string, generation int64) string {
+	return bucket + "/" + filename + "#" + strconv.FormatInt(generation, 10)
+}
+
+// IsProcessed checks if a file generation was already processed successfully
+// Unknown generations (0) are never considered processed; lookup errors are logged and the file is processed
+func IsProcessed(ctx context.Context, bucket string, filename string, generation int64) bool {
+	if !processedIndexEnabled() || generation == 0 {
+		return false
+	}
+
+	var record ProcessedFile
+	err := MongoDatabase.Collection(ProcessedFilesCollection).FindOne(ctx, bson.M{"_id": processedKey(bucket, filename, generation)}).Decode(&record)
+	if err != nil {
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			LoggerFrom(ctx).Warnf("file %s: failed to check processed files: %v", filename, err)
+		}
+		return false
+	}
+	return true
+}
+
+// markProcessed records a successfully processed file generation
+// A new generation of the same file gets its own document, so re-uploads are processed
+func markProcessed(ctx context.Context, bucket string, filename string, result *ProcessResult) error {
+	if !processedIndexEnabled() || result.Generation == 0 {
+		return nil
+	}
+
+	record := ProcessedFile{
+		ID:         processedKey(bucket, filename, result.Generation),
+		Bucket:     bucket,
+		File:       filename,
+		Generation: result.Generation,
+		FileType:   result.FileType,
+		Inserted:   result.Inserted,
+		Processed:  nowFunc().Unix(),
+	}
+	_, err := MongoDatabase.Collection(ProcessedFilesCollection).ReplaceOne(ctx, bson.M{"_id": record.ID}, record, options.Replace().SetUpsert(true))
+	if err != nil {
+		return fmt.Errorf("failed to record processed file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package loader
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestIsProcessed(t *testing.T) {
+	ctx := context.Background()
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("generations", func(mt *mtest.T) {
+		withMockMongo(mt)
+		withConfig(mt.T, func(c *Config) { c.SkipProcessedFiles = true })
+		ns := "test." + ProcessedFilesCollection
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, ns, mtest.FirstBatch, bson.D{{Key: "_id", Value: processedKey("uploads", "upload/a.csv", 1)}}),
+			mtest.CreateCursorResponse(0, ns, mtest.FirstBatch),
+		)
+		if !IsProcessed(ctx, "uploads", "upload/a.csv", 1) {
+			mt.Errorf("IsProcessed() = false for a processed generation")
+		}
+		// A new generation of the same file is processed again
+		if IsProcessed(ctx, "uploads", "upload/a.csv", 2) {
+			mt.Errorf("IsProcessed() = true for a new generation")
+		}
+		started := mt.GetAllStartedEvents()
+		if len(started) != 2 {
+			mt.Fatalf("got %d commands, want 2 lookups", len(started))
+		}
+		if id := started[1].Command.Lookup("filter", "_id").StringValue(); id != "uploads/upload/a.csv#2" {
+			mt.Errorf("looked up %s, want uploads/upload/a.csv#2", id)
+		}
+
+		// Unknown generations are never looked up
+		if IsProcessed(ctx, "uploads", "upload/a.csv", 0) || len(mt.GetAllStartedEvents()) != 2 {
+			mt.Errorf("generation 0 looked up or considered processed")
+		}
+	})
+
+	mt.Run("disabled", func(mt *mtest.T) {
+		withMockMongo(mt)
+		withConfig(mt.T, func(c *Config) { c.SkipProcessedFiles = false })
+		if IsProcessed(ctx, "uploads", "upload/a.csv", 1) || len(mt.GetAllStartedEvents()) != 0 {
+			mt.Errorf("processed files checked with SKIP_PROCESSED_FILES=false")
+		}
+	})
+}
+
+func TestMarkProcessed(t *testing.T) {
+	ctx := context.Background()
+	withNow(t, time.Unix(1735786800, 0))
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("upsert", func(mt *mtest.T) {
+		withMockMongo(mt)
+		withConfig(mt.T, func(c *Config) { c.SkipProcessedFiles = true })
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}))
+		result := &ProcessResult{Generation: 7, FileType: FileTypeCSV, Inserted: 12}
+		if err := markProcessed(ctx, "uploads", "upload/a.csv", result); err != nil {
+			mt.Fatalf("markProcessed() error = %v", err)
+		}
+
+		started := mt.GetStartedEvent()
+		if started == nil || started.CommandName != "update" {
+			mt.Fatalf("processed file not recorded")
+		}
+		update := started.Command.Lookup("updates").Array().Index(0).Value().Document()
+		if !update.Lookup("upsert").Boolean() {
+			mt.Errorf("processed file record is not an upsert")
+		}
+		record := update.Lookup("u")
+		if id := record.Document().Lookup("_id").StringValue(); id != "uploads/upload/a.csv#7" {
+			mt.Errorf("_id = %s, want uploads/upload/a.csv#7", id)
+		}
+		if inserted := record.Document().Lookup("inserted").Int64(); inserted != 12 {
+			mt.Errorf("inserted = %d, want 12", inserted)
+		}
+		if processed := record.Document().Lookup("processed").Int64(); processed != 1735786800 {
+			mt.Errorf("processed = %d, want 1735786800", processed)
+		}
+	})
+
+	mt.Run("unknown generation", func(mt *mtest.T) {
+		withMockMongo(mt)
+		withConfig(mt.T, func(c *Config) { c.SkipProcessedFiles = true })
+		if err := markProcessed(ctx, "uploads", "upload/a.csv", &ProcessResult{}); err != nil || len(mt.GetAllStartedEvents()) != 0 {
+			mt.Errorf("markProcessed() = %v, recorded a file without generation", err)
+		}
+	})
+}
+
+func TestHelloGCSSkipsProcessedGeneration(t *testing.T) {
+	now := time.Date(2025, time.January, 2, 12, 0, 0, 0, time.UTC)
+	withNow(t, now)
+	withFilePatterns(t, &FilePattern{AllowPatterns: mustCompilePatterns(t, `\.csv$`)})
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("skip", func(mt *mtest.T) {
+		withMockMongo(mt)
+		withConfig(mt.T, func(c *Config) {
+			c.SkipProcessedFiles = true
+			c.QuarantineThreshold = 0
+		})
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "test."+ProcessedFilesCollection, mtest.FirstBatch, bson.D{{Key: "_id", Value: "uploads/upload/a.csv#5"}}))
+
+		logs := captureLogs(mt.T)
+		event := newStorageEvent(mt.T, StorageObjectData{Name: "upload/a.csv", Bucket: "uploads", Generation: "5"}, now)
+		if err := helloGCS(context.Background(), event); err != nil {
+			mt.Fatalf("helloGCS() error = %v", err)
+		}
+		if !strings.Contains(logs.String(), "generation 5 already processed") {
+			mt.Errorf("processed generation not skipped:\n%s", logs)
+		}
+		if started := len(mt.GetAllStartedEvents()); started != 1 {
+			mt.Errorf("got %d commands, want only the processed files lookup", started)
+		}
+	})
+}
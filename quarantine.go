@@ -0,0 +1,104 @@
+package loader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// QuarantineCollection is the collection tracking processing failures per file
+const QuarantineCollection = "load_quarantine"
+
+// QuarantineRecord is the failure tracking document of a file
+type QuarantineRecord struct {
+	ID          string `bson:"_id"`
+	Failures    int    `bson:"failures"`
+	LastError   string `bson:"last_error"`
+	Updated     int64  `bson:"updated"`
+	Quarantined bool   `bson:"quarantined"`
+	// ErrorType - failure class of the last error: parse, storage, mongo or other
+	ErrorType string `bson:"error_type"`
+	// ErrorChain - messages of the last error and of the errors it wraps, outermost first
+	ErrorChain []string `bson:"error_chain"`
+	// FileType - detected type of the file ("csv", "amchua", ...) when the last error occurred
+	FileType string `bson:"file_type"`
+}
+
+// quarantineEnabled checks if failing files are quarantined (QUARANTINE_THRESHOLD > 0)
+func quarantineEnabled() bool {
+	return GlobalConfig != nil && GlobalConfig.QuarantineThreshold > 0 && MongoDatabase != nil
+}
+
+// quarantineKey returns the quarantine document ID of a file
+func quarantineKey(bucket string, filename string) string {
+	return bucket + "/" + filename
+}
+
+// IsQuarantined checks if a file has been quarantined after repeated failures
+// Lookup errors are logged and the file is treated as not quarantined
+func IsQuarantined(ctx context.Context, bucket string, filename string) bool {
+	if !quarantineEnabled() {
+		return false
+	}
+
+	var record QuarantineRecord
+	err := MongoDatabase.Collection(QuarantineCollection).FindOne(ctx, bson.M{"_id": quarantineKey(bucket, filename), "quarantined": true}).Decode(&record)
+	if err != nil {
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			LoggerFrom(ctx).Warnf("file %s: failed to check quarantine: %v", filename, err)
+		}
+		return false
+	}
+	return true
+}
+
+// recordFailure counts a processing failure of a file and quarantines it once QUARANTINE_THRESHOLD is reached
+// The last error is stored with its failure class and cause chain, so failures can be queried by category
+// Returns true if this failure quarantined the file
+func recordFailure(ctx context.Context, bucket string, filename string, fileType string, processErr error) (bool, error) {
+	if !quarantineEnabled() {
+		return false, nil
+	}
+
+	col := MongoDatabase.Collection(QuarantineCollection)
+	var record QuarantineRecord
+	err := col.FindOneAndUpdate(ctx,
+		bson.M{"_id": quarantineKey(bucket, filename)},
+		bson.M{
+			"$inc": bson.M{"failures": 1},
+			"$set": bson.M{
+				"last_error":  processErr.Error(),
+				"error_type":  classifyError(processErr),
+				"error_chain": errorChain(processErr),
+				"file_type":   fileType,
+				"updated":     nowFunc().Unix(),
+			},
+		},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&record)
+	if err != nil {
+		return false, fmt.Errorf("failed to record failure: %w", err)
+	}
+
+	if record.Quarantined || record.Failures < GlobalConfig.QuarantineThreshold {
+		return false, nil
+	}
+	if _, err := col.UpdateByID(ctx, record.ID, bson.M{"$set": bson.M{"quarantined": true}}); err != nil {
+		return false, fmt.Errorf("failed to quarantine: %w", err)
+	}
+	return true, nil
+}
+
+// clearFailures removes the failure tracking of a file after it was processed successfully
+func clearFailures(ctx context.Context, bucket string, filename string) {
+	if !quarantineEnabled() {
+		return
+	}
+	if _, err := MongoDatabase.Collection(QuarantineCollection).DeleteOne(ctx, bson.M{"_id": quarantineKey(bucket, filename)}); err != nil {
+		LoggerFrom(ctx).Warnf("file %s: failed to clear failure count: %v", filename, err)
+	}
+}
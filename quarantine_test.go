@@ -0,0 +1,114 @@
+package loader
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// quarantineResponse is the reply to the failure count update, returning the updated document
+func quarantineResponse(failures int, quarantined bool) bson.D {
+	return mtest.CreateSuccessResponse(bson.E{Key: "value", Value: bson.D{
+		{Key: "_id", Value: "uploads/upload/a.csv"},
+		{Key: "failures", Value: failures},
+		{Key: "quarantined", Value: quarantined},
+	}})
+}
+
+func TestRecordFailureThreshold(t *testing.T) {
+	ctx := context.Background()
+	processErr := &ParseError{Err: errors.New("invalid meta line")}
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("below threshold", func(mt *mtest.T) {
+		withMockMongo(mt)
+		withConfig(mt.T, func(c *Config) { c.QuarantineThreshold = 3 })
+		mt.AddMockResponses(quarantineResponse(2, false))
+		quarantined, err := recordFailure(ctx, "uploads", "upload/a.csv", FileTypeCSV, processErr)
+		if err != nil || quarantined {
+			mt.Errorf("recordFailure() = %v, %v, want not quarantined", quarantined, err)
+		}
+
+		started := mt.GetAllStartedEvents()
+		if len(started) != 1 || started[0].CommandName != "findAndModify" {
+			mt.Fatalf("got %d commands, want a single failure count update", len(started))
+		}
+		command := started[0].Command
+		if id := command.Lookup("query", "_id").StringValue(); id != quarantineKey("uploads", "upload/a.csv") {
+			mt.Errorf("failure counted for %s", id)
+		}
+		if errorType := command.Lookup("update", "$set", "error_type").StringValue(); errorType != ErrorTypeParse {
+			mt.Errorf("error_type = %s, want %s", errorType, ErrorTypeParse)
+		}
+		if fileType := command.Lookup("update", "$set", "file_type").StringValue(); fileType != FileTypeCSV {
+			mt.Errorf("file_type = %s, want %s", fileType, FileTypeCSV)
+		}
+		chain, _ := command.Lookup("update", "$set", "error_chain").Array().Values()
+		if len(chain) != 1 || chain[0].StringValue() != "invalid meta line" {
+			mt.Errorf("error_chain = %v, want [invalid meta line]", chain)
+		}
+		if !command.Lookup("upsert").Boolean() {
+			mt.Errorf("failure count update is not an upsert")
+		}
+	})
+
+	mt.Run("threshold reached", func(mt *mtest.T) {
+		withMockMongo(mt)
+		withConfig(mt.T, func(c *Config) { c.QuarantineThreshold = 3 })
+		mt.AddMockResponses(quarantineResponse(3, false), mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}, bson.E{Key: "nModified", Value: 1}))
+		quarantined, err := recordFailure(ctx, "uploads", "upload/a.csv", FileTypeCSV, processErr)
+		if err != nil || !quarantined {
+			mt.Errorf("recordFailure() = %v, %v, want quarantined", quarantined, err)
+		}
+		if started := mt.GetAllStartedEvents(); len(started) != 2 || started[1].CommandName != "update" {
+			mt.Errorf("file not marked as quarantined")
+		}
+	})
+
+	mt.Run("already quarantined", func(mt *mtest.T) {
+		withMockMongo(mt)
+		withConfig(mt.T, func(c *Config) { c.QuarantineThreshold = 3 })
+		// The file is only quarantined (and logged) once
+		mt.AddMockResponses(quarantineResponse(4, true))
+		quarantined, err := recordFailure(ctx, "uploads", "upload/a.csv", FileTypeCSV, processErr)
+		if err != nil || quarantined {
+			mt.Errorf("recordFailure() = %v, %v, want no new quarantine", quarantined, err)
+		}
+	})
+
+	mt.Run("disabled", func(mt *mtest.T) {
+		withMockMongo(mt)
+		withConfig(mt.T, func(c *Config) { c.QuarantineThreshold = 0 })
+		if quarantined, err := recordFailure(ctx, "uploads", "upload/a.csv", FileTypeCSV, processErr); err != nil || quarantined {
+			mt.Errorf("recordFailure() = %v, %v with QUARANTINE_THRESHOLD=0", quarantined, err)
+		}
+		if IsQuarantined(ctx, "uploads", "upload/a.csv") {
+			mt.Errorf("IsQuarantined() = true with QUARANTINE_THRESHOLD=0")
+		}
+		if started := len(mt.GetAllStartedEvents()); started != 0 {
+			mt.Errorf("got %d commands with QUARANTINE_THRESHOLD=0, want none", started)
+		}
+	})
+}
+
+func TestIsQuarantined(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("lookup", func(mt *mtest.T) {
+		withMockMongo(mt)
+		withConfig(mt.T, func(c *Config) { c.QuarantineThreshold = 3 })
+		ns := "test." + QuarantineCollection
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, ns, mtest.FirstBatch, bson.D{{Key: "_id", Value: "uploads/upload/a.csv"}, {Key: "quarantined", Value: true}}),
+			mtest.CreateCursorResponse(0, ns, mtest.FirstBatch),
+		)
+		if !IsQuarantined(context.Background(), "uploads", "upload/a.csv") {
+			mt.Errorf("IsQuarantined() = false for a quarantined file")
+		}
+		if IsQuarantined(context.Background(), "uploads", "upload/b.csv") {
+			mt.Errorf("IsQuarantined() = true for an unknown file")
+		}
+	})
+}
@@ -0,0 +1,92 @@
+package loader
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"strconv"
+	"time"
+)
+
+// Per-file summary line formats (SUMMARY_LOG_FORMAT)
+const (
+	SummaryLogFormatCSV  = "csv"
+	SummaryLogFormatJSON = "json"
+)
+
+// Per-file summary statuses
+const (
+	SummaryStatusOK    = "ok"
+	SummaryStatusError = "error"
+)
+
+// summaryColumns are the fields of a summary line, in CSV column order
+var summaryColumns = []string{"timestamp", "filename", "device_id", "file_type", "inserted", "skipped", "duration_ms", "status"}
+
+// FileSummary is the outcome of processing one file, emitted as a single summary line
+type FileSummary struct {
+	Timestamp  string `json:"timestamp"`
+	Filename   string `json:"filename"`
+	DeviceID   string `json:"device_id"`
+	FileType   string `json:"file_type"`
+	Inserted   int64  `json:"inserted"`
+	Skipped    int64  `json:"skipped"`
+	DurationMS int64  `json:"duration_ms"`
+	Status     string `json:"status"`
+}
+
+// logSummary emits the summary line of a processed file in SUMMARY_LOG_FORMAT
+// The line is written without timestamp or level prefix so it can be parsed downstream
+func logSummary(ctx context.Context, filename string, result *ProcessResult, duration time.Duration, err error) {
+	if GlobalConfig == nil || GlobalConfig.SummaryLogFormat == "" {
+		return
+	}
+
+	summary := FileSummary{
+		Timestamp:  nowFunc().UTC().Format(time.RFC3339),
+		Filename:   filename,
+		DurationMS: duration.Milliseconds(),
+		Status:     SummaryStatusOK,
+	}
+	if result != nil {
+		summary.DeviceID = result.DeviceID
+		summary.FileType = result.FileType
+		summary.Inserted = result.Inserted
+		summary.Skipped = result.Skipped
+	}
+	if err != nil {
+		summary.Status = SummaryStatusError
+	}
+
+	logger := LoggerFrom(ctx)
+	line, formatErr := summary.format(GlobalConfig.SummaryLogFormat)
+	if formatErr != nil {
+		logger.Warnf("file %s: failed to format summary line: %v", filename, formatErr)
+		return
+	}
+	logger.Raw(line)
+}
+
+// format returns the summary as a single CSV (columns as in summaryColumns) or JSON line
+func (s FileSummary) format(format string) (string, error) {
+	if format == SummaryLogFormatJSON {
+		line, err := json.Marshal(s)
+		return string(line), err
+	}
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{
+		s.Timestamp,
+		s.Filename,
+		s.DeviceID,
+		s.FileType,
+		strconv.FormatInt(s.Inserted, 10),
+		strconv.FormatInt(s.Skipped, 10),
+		strconv.FormatInt(s.DurationMS, 10),
+		s.Status,
+	})
+	w.Flush()
+	return string(bytes.TrimRight(buf.Bytes(), "\n")), w.Error()
+}
@@ -0,0 +1,59 @@
+package loader
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogSummary(t *testing.T) {
+	withNow(t, time.Date(2025, time.January, 2, 3, 4, 5, 0, time.UTC))
+	result := &ProcessResult{DeviceID: "CR300_19531", FileType: FileTypeCSV, Inserted: 12, Skipped: 3}
+
+	t.Run("csv", func(t *testing.T) {
+		withConfig(t, func(c *Config) { c.SummaryLogFormat = SummaryLogFormatCSV })
+		logs := captureLogs(t)
+		logSummary(context.Background(), "upload/a,b.csv", result, 1500*time.Millisecond, nil)
+
+		fields, err := csv.NewReader(strings.NewReader(logs.String())).Read()
+		if err != nil {
+			t.Fatalf("summary line %q is not CSV: %v", logs, err)
+		}
+		want := []string{"2025-01-02T03:04:05Z", "upload/a,b.csv", "CR300_19531", "csv", "12", "3", "1500", "ok"}
+		if !reflect.DeepEqual(fields, want) {
+			t.Errorf("summary fields = %q, want %q (columns %v)", fields, want, summaryColumns)
+		}
+		if strings.Count(logs.String(), "\n") != 1 {
+			t.Errorf("summary is not a single line: %q", logs)
+		}
+	})
+
+	t.Run("json", func(t *testing.T) {
+		withConfig(t, func(c *Config) { c.SummaryLogFormat = SummaryLogFormatJSON })
+		logs := captureLogs(t)
+		logSummary(context.Background(), "upload/a.csv", nil, 20*time.Millisecond, errors.New("parse error"))
+
+		var summary FileSummary
+		if err := json.Unmarshal(logs.Bytes(), &summary); err != nil {
+			t.Fatalf("summary line %q is not JSON: %v", logs, err)
+		}
+		want := FileSummary{Timestamp: "2025-01-02T03:04:05Z", Filename: "upload/a.csv", DurationMS: 20, Status: SummaryStatusError}
+		if summary != want {
+			t.Errorf("summary = %+v, want %+v", summary, want)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		withConfig(t, func(c *Config) { c.SummaryLogFormat = "" })
+		logs := captureLogs(t)
+		logSummary(context.Background(), "upload/a.csv", result, time.Second, nil)
+		if logs.Len() != 0 {
+			t.Errorf("summary logged without SUMMARY_LOG_FORMAT: %q", logs)
+		}
+	})
+}
@@ -0,0 +1,541 @@
+package loader
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// TransformScript is a list of assignments computing derived fields of each record, e.g.
+//
+//	dew = T - (100 - RH) / 5; frost = T < 0 && RH > 90 ? 1 : 0
+//
+// Statements are separated by ";" or newlines and run in order, so later statements can use earlier results.
+// Expressions are numeric: numbers, field names, + - * / %, comparisons (< <= > >= == !=, true = 1),
+// && || !, cond ? a : b, parentheses and the functions abs, min, max, round, floor, ceil, sqrt and pow.
+// A statement referencing a missing or non-numeric field is skipped for that record
+type TransformScript struct {
+	Statements []TransformStatement
+}
+
+// TransformStatement assigns the value of an expression to a record field
+type TransformStatement struct {
+	Field string
+	expr  exprNode
+}
+
+// transformScript is the script applied to CSV and NDJSON records (nil = no transforms)
+var transformScript *TransformScript
+
+// InitTransformScript loads the record transform script
+// Environment variables:
+//
+//	TRANSFORM_SCRIPT - derived field assignments run on each record, or "@<path>" to read them from a file (default: none)
+func InitTransformScript() {
+	source := os.Getenv("TRANSFORM_SCRIPT")
+	if strings.TrimSpace(source) == "" {
+		return
+	}
+	if path, ok := strings.CutPrefix(source, "@"); ok {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			GlobalLogger.Fatalf("failed to read TRANSFORM_SCRIPT file %s: %v", path, err)
+		}
+		source = string(data)
+	}
+	script, err := ParseTransformScript(source)
+	if err != nil {
+		GlobalLogger.Fatalf("invalid TRANSFORM_SCRIPT: %v", err)
+	}
+	transformScript = script
+	GlobalLogger.Infof("Record transforms: %d statement(s) computing %v", len(script.Statements), script.Fields())
+}
+
+// ParseTransformScript parses a transform script
+func ParseTransformScript(source string) (*TransformScript, error) {
+	script := &TransformScript{}
+	lines := strings.FieldsFunc(source, func(r rune) bool { return r == ';' || r == '\n' })
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		field, exprSource, found := strings.Cut(line, "=")
+		field = strings.TrimSpace(field)
+		// "a == b" has no assignment: the first "=" must not start "=="
+		if !found || strings.HasPrefix(exprSource, "=") || !isIdentifier(field) {
+			return nil, fmt.Errorf("statement %q: expected <field> = <expression>", line)
+		}
+		if isSystemField(field) {
+			return nil, fmt.Errorf("statement %q: %s is a system field", line, field)
+		}
+		expr, err := parseExpr(exprSource)
+		if err != nil {
+			return nil, fmt.Errorf("statement %q: %w", line, err)
+		}
+		script.Statements = append(script.Statements, TransformStatement{Field: field, expr: expr})
+	}
+	return script, nil
+}
+
+// Fields returns the fields assigned by the script, in statement order (without repeats)
+func (s *TransformScript) Fields() []string {
+	var fields []string
+	seen := make(map[string]bool)
+	for _, statement := range s.Statements {
+		if !seen[statement.Field] {
+			seen[statement.Field] = true
+			fields = append(fields, statement.Field)
+		}
+	}
+	return fields
+}
+
+// Apply runs the script on a record and returns the number of statements skipped
+// (missing or non-numeric operands, or a non-finite result)
+func (s *TransformScript) Apply(record SensorRecord) int {
+	skipped := 0
+	for _, statement := range s.Statements {
+		v, err := statement.expr.eval(record)
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+			skipped++
+			continue
+		}
+		record[statement.Field] = storedValue(v)
+	}
+	return skipped
+}
+
+// applyTransforms runs TRANSFORM_SCRIPT on the records of a file and returns the field list
+// extended with the computed fields (for ORDERED_FIELDS)
+func applyTransforms(ctx context.Context, filename string, records []SensorRecord, fields []string) []string {
+	if transformScript == nil {
+		return fields
+	}
+	skipped := 0
+	for _, record := range records {
+		skipped += transformScript.Apply(record)
+	}
+	if skipped > 0 {
+		LoggerFrom(ctx).Debugf("file %s: %d transform statement(s) skipped (missing or non-numeric fields)", filename, skipped)
+	}
+	for _, field := range transformScript.Fields() {
+		if !slices.Contains(fields, field) {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// isSystemField checks if a field is written by the loader itself and can't be assigned
+func isSystemField(field string) bool {
+	switch field {
+	case "_id", "ts", "n", "c", "gen", "ft", "box_id", "_cols":
+		return true
+	}
+	return false
+}
+
+// isIdentifier checks if s is a field name usable in expressions: letters, digits and _, not starting with a digit
+func isIdentifier(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, r := range s {
+		if r == '_' || unicode.IsLetter(r) || (i > 0 && unicode.IsDigit(r)) {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// exprNode is a node of a parsed transform expression
+type exprNode interface {
+	eval(record SensorRecord) (float64, error)
+}
+
+type numberNode float64
+
+func (n numberNode) eval(SensorRecord) (float64, error) { return float64(n), nil }
+
+type fieldNode string
+
+func (n fieldNode) eval(record SensorRecord) (float64, error) {
+	switch v := record[string(n)].(type) {
+	case float64:
+		return v, nil
+	case int64:
+		return float64(v), nil
+	case int:
+		return float64(v), nil
+	case bool:
+		return boolValue(v), nil
+	case nil:
+		return 0, fmt.Errorf("field %s is missing", string(n))
+	}
+	return 0, fmt.Errorf("field %s is not numeric", string(n))
+}
+
+type unaryNode struct {
+	op      string
+	operand exprNode
+}
+
+func (n unaryNode) eval(record SensorRecord) (float64, error) {
+	v, err := n.operand.eval(record)
+	if err != nil {
+		return 0, err
+	}
+	if n.op == "!" {
+		return boolValue(v == 0), nil
+	}
+	return -v, nil
+}
+
+type binaryNode struct {
+	op          string
+	left, right exprNode
+}
+
+func (n binaryNode) eval(record SensorRecord) (float64, error) {
+	l, err := n.left.eval(record)
+	if err != nil {
+		return 0, err
+	}
+	// Short-circuit: the right operand may reference a field missing when it isn't needed
+	switch {
+	case n.op == "&&" && l == 0:
+		return 0, nil
+	case n.op == "||" && l != 0:
+		return 1, nil
+	}
+	r, err := n.right.eval(record)
+	if err != nil {
+		return 0, err
+	}
+
+	switch n.op {
+	case "+":
+		return l + r, nil
+	case "-":
+		return l - r, nil
+	case "*":
+		return l * r, nil
+	case "/":
+		return l / r, nil
+	case "%":
+		return math.Mod(l, r), nil
+	case "<":
+		return boolValue(l < r), nil
+	case "<=":
+		return boolValue(l <= r), nil
+	case ">":
+		return boolValue(l > r), nil
+	case ">=":
+		return boolValue(l >= r), nil
+	case "==":
+		return boolValue(l == r), nil
+	case "!=":
+		return boolValue(l != r), nil
+	}
+	return boolValue(r != 0), nil // && and || with the left operand not deciding
+}
+
+type conditionalNode struct {
+	cond, then, otherwise exprNode
+}
+
+func (n conditionalNode) eval(record SensorRecord) (float64, error) {
+	c, err := n.cond.eval(record)
+	if err != nil {
+		return 0, err
+	}
+	if c != 0 {
+		return n.then.eval(record)
+	}
+	return n.otherwise.eval(record)
+}
+
+type callNode struct {
+	name string
+	args []exprNode
+}
+
+// transformFunctions are the functions of transform expressions and their number of arguments (-1 = at least one)
+var transformFunctions = map[string]int{
+	"abs": 1, "floor": 1, "ceil": 1, "round": 1, "sqrt": 1, "pow": 2, "min": -1, "max": -1,
+}
+
+func (n callNode) eval(record SensorRecord) (float64, error) {
+	args := make([]float64, len(n.args))
+	for i, arg := range n.args {
+		v, err := arg.eval(record)
+		if err != nil {
+			return 0, err
+		}
+		args[i] = v
+	}
+
+	switch n.name {
+	case "abs":
+		return math.Abs(args[0]), nil
+	case "floor":
+		return math.Floor(args[0]), nil
+	case "ceil":
+		return math.Ceil(args[0]), nil
+	case "round":
+		return math.Round(args[0]), nil
+	case "sqrt":
+		return math.Sqrt(args[0]), nil
+	case "pow":
+		return math.Pow(args[0], args[1]), nil
+	case "min":
+		v := args[0]
+		for _, a := range args[1:] {
+			v = math.Min(v, a)
+		}
+		return v, nil
+	}
+	v := args[0] // max
+	for _, a := range args[1:] {
+		v = math.Max(v, a)
+	}
+	return v, nil
+}
+
+// boolValue returns 1 for true and 0 for false
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// binaryPrecedence is the precedence of the binary operators (higher binds tighter)
+var binaryPrecedence = map[string]int{
+	"||": 1,
+	"&&": 2,
+	"==": 3, "!=": 3,
+	"<": 4, "<=": 4, ">": 4, ">=": 4,
+	"+": 5, "-": 5,
+	"*": 6, "/": 6, "%": 6,
+}
+
+// exprParser is a precedence climbing parser of transform expressions
+type exprParser struct {
+	tokens []string
+	pos    int
+}
+
+// parseExpr parses a transform expression
+func parseExpr(source string) (exprNode, error) {
+	tokens, err := tokenizeExpr(source)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("empty expression")
+	}
+	p := &exprParser{tokens: tokens}
+	node, err := p.conditional()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+	return node, nil
+}
+
+// peek returns the next token, "" at the end
+func (p *exprParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+// expect consumes the next token, which must be tok
+func (p *exprParser) expect(tok string) error {
+	if p.peek() != tok {
+		if p.peek() == "" {
+			return fmt.Errorf("expected %q at the end of the expression", tok)
+		}
+		return fmt.Errorf("expected %q, got %q", tok, p.peek())
+	}
+	p.pos++
+	return nil
+}
+
+// conditional parses cond ? a : b (right-associative) or a binary expression
+func (p *exprParser) conditional() (exprNode, error) {
+	cond, err := p.binary(1)
+	if err != nil || p.peek() != "?" {
+		return cond, err
+	}
+	p.pos++
+	then, err := p.conditional()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	otherwise, err := p.conditional()
+	if err != nil {
+		return nil, err
+	}
+	return conditionalNode{cond: cond, then: then, otherwise: otherwise}, nil
+}
+
+// binary parses the binary operators of at least minPrecedence (left-associative)
+func (p *exprParser) binary(minPrecedence int) (exprNode, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		precedence, ok := binaryPrecedence[op]
+		if !ok || precedence < minPrecedence {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.binary(precedence + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = binaryNode{op: op, left: left, right: right}
+	}
+}
+
+// unary parses - and ! prefixes
+func (p *exprParser) unary() (exprNode, error) {
+	if op := p.peek(); op == "-" || op == "!" {
+		p.pos++
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return unaryNode{op: op, operand: operand}, nil
+	}
+	return p.primary()
+}
+
+// primary parses numbers, fields, function calls and parenthesized expressions
+func (p *exprParser) primary() (exprNode, error) {
+	tok := p.peek()
+	switch {
+	case tok == "":
+		return nil, fmt.Errorf("unexpected end of expression")
+	case tok == "(":
+		p.pos++
+		node, err := p.conditional()
+		if err != nil {
+			return nil, err
+		}
+		return node, p.expect(")")
+	case tok[0] >= '0' && tok[0] <= '9' || tok[0] == '.':
+		p.pos++
+		v, err := strconv.ParseFloat(tok, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", tok)
+		}
+		return numberNode(v), nil
+	case isIdentifier(tok):
+		p.pos++
+		if p.peek() != "(" {
+			return fieldNode(tok), nil
+		}
+		return p.call(tok)
+	}
+	return nil, fmt.Errorf("unexpected %q", tok)
+}
+
+// call parses the arguments of a function call
+func (p *exprParser) call(name string) (exprNode, error) {
+	arity, ok := transformFunctions[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %s", name)
+	}
+	p.pos++ // (
+
+	var args []exprNode
+	if p.peek() != ")" {
+		for {
+			arg, err := p.conditional()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+			if p.peek() != "," {
+				break
+			}
+			p.pos++
+		}
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	if (arity >= 0 && len(args) != arity) || len(args) == 0 {
+		return nil, fmt.Errorf("%s: wrong number of arguments (%d)", name, len(args))
+	}
+	return callNode{name: name, args: args}, nil
+}
+
+// tokenizeExpr splits an expression into numbers, identifiers, operators and punctuation
+func tokenizeExpr(source string) ([]string, error) {
+	var tokens []string
+	runes := []rune(source)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case unicode.IsDigit(r) || r == '.':
+			start := i
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.') {
+				i++
+			}
+			// Exponent: 1e5, 2.5E-3
+			if i < len(runes) && (runes[i] == 'e' || runes[i] == 'E') {
+				j := i + 1
+				if j < len(runes) && (runes[j] == '+' || runes[j] == '-') {
+					j++
+				}
+				if j < len(runes) && unicode.IsDigit(runes[j]) {
+					for i = j; i < len(runes) && unicode.IsDigit(runes[i]); i++ {
+					}
+				}
+			}
+			tokens = append(tokens, string(runes[start:i]))
+		case r == '_' || unicode.IsLetter(r):
+			start := i
+			for i < len(runes) && (runes[i] == '_' || unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i])) {
+				i++
+			}
+			tokens = append(tokens, string(runes[start:i]))
+		default:
+			if i+1 < len(runes) {
+				switch two := string(runes[i : i+2]); two {
+				case "<=", ">=", "==", "!=", "&&", "||":
+					tokens = append(tokens, two)
+					i += 2
+					continue
+				}
+			}
+			if !strings.ContainsRune("+-*/%<>!?:(),", r) {
+				return nil, fmt.Errorf("unexpected character %q", r)
+			}
+			tokens = append(tokens, string(r))
+			i++
+		}
+	}
+	return tokens, nil
+}
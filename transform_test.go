@@ -0,0 +1,195 @@
+package loader
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// withTransformScript sets TRANSFORM_SCRIPT for the duration of the test
+func withTransformScript(t *testing.T, source string) {
+	t.Helper()
+	script, err := ParseTransformScript(source)
+	if err != nil {
+		t.Fatalf("ParseTransformScript() error = %v", err)
+	}
+	previous := transformScript
+	transformScript = script
+	t.Cleanup(func() { transformScript = previous })
+}
+
+func TestTransformExpressions(t *testing.T) {
+	record := SensorRecord{"T": 20.0, "RH": 85.0, "n": int64(3), "ok": true, "s": "text"}
+	tests := []struct {
+		expr string
+		want float64
+	}{
+		{"1 + 2 * 3", 7},
+		{"(1 + 2) * 3", 9},
+		{"10 - 4 - 3", 3},
+		{"2.5e1 / 5", 5},
+		{"7 % 4", 3},
+		{"-T + 1", -19},
+		{"T - (100 - RH) / 5", 17},
+		{"T > 15 && RH >= 85", 1},
+		{"T < 15 || !ok", 0},
+		{"T == 20 ? n : 0", 3},
+		{"T < 0 ? 1 : RH > 90 ? 2 : 3", 3},
+		{"abs(-2) + floor(1.7) + ceil(1.2) + round(2.5)", 8},
+		{"sqrt(16) + pow(2, 3)", 12},
+		{"min(T, RH, 5) + max(1, n)", 8},
+		// The right operand is not evaluated when the left one decides
+		{"T > 0 || missing", 1},
+	}
+	for _, tt := range tests {
+		expr, err := parseExpr(tt.expr)
+		if err != nil {
+			t.Errorf("parseExpr(%q) error = %v", tt.expr, err)
+			continue
+		}
+		if got, err := expr.eval(record); err != nil || got != tt.want {
+			t.Errorf("%s = %v, %v, want %v", tt.expr, got, err, tt.want)
+		}
+	}
+
+	for _, expr := range []string{"missing + 1", "s * 2"} {
+		node, err := parseExpr(expr)
+		if err != nil {
+			t.Fatalf("parseExpr(%q) error = %v", expr, err)
+		}
+		if _, err := node.eval(record); err == nil {
+			t.Errorf("%s: eval() error = nil, want a missing or non-numeric field", expr)
+		}
+	}
+}
+
+func TestParseTransformScript(t *testing.T) {
+	script, err := ParseTransformScript("# derived fields\ndew = T - (100 - RH) / 5; frost = T < 0 && RH > 90 ? 1 : 0\ndew = round(dew)")
+	if err != nil {
+		t.Fatalf("ParseTransformScript() error = %v", err)
+	}
+	if len(script.Statements) != 3 || !reflect.DeepEqual(script.Fields(), []string{"dew", "frost"}) {
+		t.Errorf("ParseTransformScript() = %d statements computing %v", len(script.Statements), script.Fields())
+	}
+
+	invalid := map[string]string{
+		"T == 1":          "expected <field> = <expression>",
+		"1x = 2":          "expected <field> = <expression>",
+		"_id = 1":         "system field",
+		"x = ":            "empty expression",
+		"x = (1 + 2":      `expected ")"`,
+		"x = 1 2":         `unexpected "2"`,
+		"x = foo(1)":      "unknown function foo",
+		"x = pow(1)":      "wrong number of arguments",
+		"x = max()":       "wrong number of arguments",
+		"x = T ? 1":       `expected ":"`,
+		"x = T # note":    "unexpected character",
+		"x = 1.2.3 + 1":   "invalid number",
+		"x = T < 0 ? : 1": `unexpected ":"`,
+	}
+	for source, want := range invalid {
+		if _, err := ParseTransformScript(source); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("ParseTransformScript(%q) error = %v, want %q", source, err, want)
+		}
+	}
+}
+
+func TestTransformScriptApply(t *testing.T) {
+	script, err := ParseTransformScript("dew = T - (100 - RH) / 5; dew2 = dew * 2; ratio = T / RH; wind = WS * 3.6")
+	if err != nil {
+		t.Fatalf("ParseTransformScript() error = %v", err)
+	}
+
+	record := SensorRecord{"T": 20.0, "RH": 85.0}
+	if skipped := script.Apply(record); skipped != 1 {
+		t.Errorf("Apply() skipped %d statements, want 1 (WS missing)", skipped)
+	}
+	// Later statements use earlier results
+	if record["dew"] != 17.0 || record["dew2"] != 34.0 {
+		t.Errorf("record = %v, want dew 17 and dew2 34", record)
+	}
+	if _, exists := record["wind"]; exists {
+		t.Errorf("wind computed without WS: %v", record)
+	}
+
+	// Non-finite results are not stored
+	record = SensorRecord{"T": 20.0, "RH": 0.0}
+	script.Apply(record)
+	if v, exists := record["ratio"]; exists {
+		t.Errorf("ratio = %v, want no value for a division by zero", v)
+	}
+
+	// DETECT_INT applies to computed values
+	withConfig(t, func(c *Config) { c.DetectInt = true })
+	record = SensorRecord{"T": 20.0, "RH": 85.0}
+	script.Apply(record)
+	if record["dew"] != int64(17) || record["ratio"] != 20.0/85.0 {
+		t.Errorf("DETECT_INT: record = %v", record)
+	}
+}
+
+func TestInitTransformScript(t *testing.T) {
+	previous := transformScript
+	t.Cleanup(func() { transformScript = previous })
+
+	path := filepath.Join(t.TempDir(), "transforms.txt")
+	if err := os.WriteFile(path, []byte("dew = T - (100 - RH) / 5\nfrost = T < 0 ? 1 : 0\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TRANSFORM_SCRIPT", "@"+path)
+	transformScript = nil
+	InitTransformScript()
+	if transformScript == nil || !reflect.DeepEqual(transformScript.Fields(), []string{"dew", "frost"}) {
+		t.Errorf("TRANSFORM_SCRIPT=@file: script = %+v", transformScript)
+	}
+
+	t.Setenv("TRANSFORM_SCRIPT", " ")
+	transformScript = nil
+	InitTransformScript()
+	if transformScript != nil {
+		t.Errorf("empty TRANSFORM_SCRIPT: script = %+v, want none", transformScript)
+	}
+}
+
+func TestProcessReaderTransformScript(t *testing.T) {
+	withTransformScript(t, "dew = TE - (100 - RH) / 5")
+	content := toa5CSV(`"TIMESTAMP","RECORD","temp","RH"`, `"2025-01-02 03:04:05",1,20,85`, `"2025-01-02 03:05:05",2,21,"NAN"`)
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("computed field", func(mt *mtest.T) {
+		withMockMongo(mt)
+		withConfig(mt.T, func(c *Config) { c.OrderedFields = true })
+		mt.AddMockResponses(
+			boxResponse("RIENVHK4", "CR300_19531"),
+			mtest.CreateCursorResponse(0, "test.sensor_data_RIENVHK4", mtest.FirstBatch),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 2}),
+		)
+		if _, err := ProcessReader(context.Background(), "CR300_19531_Table1.csv", bytes.NewReader(content)); err != nil {
+			mt.Fatalf("ProcessReader() error = %v", err)
+		}
+
+		docs := insertedDocuments(mt)
+		if len(docs) != 2 {
+			mt.Fatalf("inserted %d documents, want 2", len(docs))
+		}
+		if dew, err := docs[0].LookupErr("dew"); err != nil || dew.Double() != 17 {
+			mt.Errorf("first document = %v, want dew 17", docs[0])
+		}
+		// The computed field comes after the file columns
+		elements, _ := docs[0].Elements()
+		if last := elements[len(elements)-1].Key(); last != "dew" {
+			mt.Errorf("last field = %s, want dew", last)
+		}
+		// RH is missing in the second record: no dew
+		if _, err := docs[1].LookupErr("dew"); err == nil {
+			mt.Errorf("second document = %v, want no dew", docs[1])
+		}
+	})
+}